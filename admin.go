@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QueueStats describes internal queue and workers of a plugin
+type QueueStats struct {
+	Queue    int `json:"queue"`
+	Capacity int `json:"capacity"`
+	Workers  int `json:"workers"`
+	InFlight int `json:"in_flight"` // messages taken from the queue which are still being sent, and responses not read yet
+}
+
+// queueStater is implemented by plugins which buffer messages before processing them
+type queueStater interface {
+	QueueStats() QueueStats
+}
+
+// stater returns queue stats of the plugin, overflow queue stats include the queue of wrapped plugin
+func stater(plugin interface{}) (queueStater, bool) {
+	if l, ok := plugin.(*Limiter); ok {
+		plugin = l.plugin
+	}
+	if q, ok := plugin.(*OverflowQueue); ok {
+		return q, true
+	}
+	s, ok := unwrap(plugin).(queueStater)
+	return s, ok
+}
+
+// AdminPlugin describes a running plugin in admin API responses
+type AdminPlugin struct {
+	ID          int         `json:"id"`
+	Type        string      `json:"type"`
+	Description string      `json:"description"`
+	Input       bool        `json:"input"`
+	Output      bool        `json:"output"`
+	Paused      bool        `json:"paused,omitempty"`
+	Limit       string      `json:"limit,omitempty"`
+	Stats       *QueueStats `json:"stats,omitempty"`
+}
+
+// Admin is an HTTP API to inspect and control running gor instance
+type Admin struct {
+	plugins  *InOutPlugins
+	emitter  *Emitter
+	exit     func()
+	listener net.Listener
+	server   *http.Server
+	draining sync.Mutex
+}
+
+// NewAdmin starts admin API on the given address.
+// exit is called after graceful drain requested with /drain.
+func NewAdmin(address string, plugins *InOutPlugins, emitter *Emitter, exit func()) *Admin {
+	a := &Admin{plugins: plugins, emitter: emitter, exit: exit}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/plugins", a.handlePlugins)
+	mux.HandleFunc("/plugins/", a.handlePlugin)
+	mux.HandleFunc("/stats", a.handleStats)
+	mux.HandleFunc("/drain", a.handleDrain)
+	mux.HandleFunc("/metrics", metricsHandler)
+	a.server = &http.Server{Handler: mux}
+
+	var err error
+	a.listener, err = net.Listen("tcp", address)
+	if err != nil {
+		log.Fatal("[ADMIN] failed to start admin API: ", err)
+	}
+	go a.server.Serve(a.listener)
+
+	Debug(0, "[ADMIN] admin API listening on", a.listener.Addr())
+	return a
+}
+
+func (a *Admin) String() string {
+	return "Admin API: " + a.listener.Addr().String()
+}
+
+// Close stops admin API
+func (a *Admin) Close() error {
+	return a.server.Close()
+}
+
+func (a *Admin) describe(id int, plugin interface{}) AdminPlugin {
+	p := AdminPlugin{
+		ID:          id,
+		Type:        fmt.Sprintf("%T", unwrap(plugin)),
+		Description: fmt.Sprint(plugin),
+	}
+	// Limiter implements both interfaces, so the wrapped plugin is checked
+	if _, ok := unwrap(plugin).(PluginReader); ok {
+		p.Input = true
+		p.Paused = a.emitter.Paused(plugin.(PluginReader))
+	}
+	_, p.Output = unwrap(plugin).(PluginWriter)
+	if l, ok := plugin.(*Limiter); ok {
+		p.Limit = l.limitOptions()
+	}
+	if s, ok := stater(plugin); ok {
+		stats := s.QueueStats()
+		p.Stats = &stats
+	}
+	return p
+}
+
+func (a *Admin) handlePlugins(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	all := a.plugins.snapshot()
+	list := make([]AdminPlugin, 0, len(all))
+	for id, plugin := range all {
+		list = append(list, a.describe(id, plugin))
+	}
+	writeJSON(w, list)
+}
+
+func (a *Admin) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	list := make([]AdminPlugin, 0)
+	for id, plugin := range a.plugins.snapshot() {
+		if _, ok := stater(plugin); ok {
+			list = append(list, a.describe(id, plugin))
+		}
+	}
+	writeJSON(w, list)
+}
+
+// handlePlugin handles /plugins/<id>, /plugins/<id>/pause, /plugins/<id>/resume and /plugins/<id>/limit
+func (a *Admin) handlePlugin(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/plugins/"), "/"), "/")
+	id, err := strconv.Atoi(parts[0])
+	all := a.plugins.snapshot()
+	if err != nil || id < 0 || id >= len(all) {
+		http.Error(w, "plugin not found", http.StatusNotFound)
+		return
+	}
+	plugin := all[id]
+
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+	if action == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, a.describe(id, plugin))
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch action {
+	case "pause", "resume":
+		in, ok := plugin.(PluginReader)
+		if _, isReader := unwrap(plugin).(PluginReader); !ok || !isReader {
+			http.Error(w, "plugin is not an input", http.StatusBadRequest)
+			return
+		}
+		if action == "pause" {
+			err = a.emitter.Pause(in)
+		} else {
+			err = a.emitter.Resume(in)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		Debug(0, "[ADMIN]", action, plugin)
+	case "limit":
+		l, ok := plugin.(*Limiter)
+		if !ok {
+			http.Error(w, "plugin is not started with a limit, e.g. \"address|10%\"", http.StatusBadRequest)
+			return
+		}
+		limit := r.FormValue("limit")
+		if n, _ := parseLimitOptions(limit); n <= 0 {
+			http.Error(w, "invalid limit: "+limit, http.StatusBadRequest)
+			return
+		}
+		l.Reload(limit)
+		Debug(0, "[ADMIN] limit changed:", l)
+	default:
+		http.Error(w, "unknown action: "+action, http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, a.describe(id, plugin))
+}
+
+// handleDrain pauses all inputs, waits until output queues and requests in flight are empty and exits
+func (a *Admin) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	timeout := 30 * time.Second
+	if v := r.FormValue("timeout"); v != "" {
+		var err error
+		if timeout, err = time.ParseDuration(v); err != nil {
+			http.Error(w, "invalid timeout: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+
+	a.draining.Lock()
+	defer a.draining.Unlock()
+
+	Debug(0, "[ADMIN] draining, timeout", timeout)
+	for _, in := range a.plugins.Inputs {
+		// outputs are read for their responses, which should be delivered while draining
+		if _, ok := unwrap(in).(PluginWriter); !ok {
+			a.emitter.Pause(in)
+		}
+	}
+
+	drained := a.drain(timeout)
+	writeJSON(w, map[string]interface{}{"drained": drained, "queued": a.queued()})
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	Debug(0, "[ADMIN] drained:", drained, "exiting")
+	go a.exit()
+}
+
+func (a *Admin) drain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if a.queued() == 0 {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return a.queued() == 0
+}
+
+// queued returns number of messages waiting in output queues, being sent, or waiting for their responses to be read
+func (a *Admin) queued() (n int) {
+	for _, plugin := range a.plugins.snapshot() {
+		if s, ok := stater(plugin); ok {
+			stats := s.QueueStats()
+			n += stats.Queue + stats.InFlight
+		}
+	}
+	return
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		Debug(1, "[ADMIN] failed to write response:", err)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAdmin(t *testing.T) {
+	wg := new(sync.WaitGroup)
+
+	input := NewTestInput()
+	output := NewLimiter(NewTestOutput(func(*Message) {
+		wg.Done()
+	}), "100")
+
+	plugins := &InOutPlugins{
+		Inputs:  []PluginReader{input},
+		Outputs: []PluginWriter{output},
+	}
+	plugins.All = append(plugins.All, input, output)
+
+	emitter := NewEmitter()
+	emitter.Start(plugins, "")
+
+	exited := make(chan struct{})
+	admin := NewAdmin("127.0.0.1:0", plugins, emitter, func() { close(exited) })
+	defer admin.Close()
+	addr := "http://" + admin.listener.Addr().String()
+
+	request := func(method, path string) (res []AdminPlugin) {
+		req, _ := http.NewRequest(method, addr+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s %s: %s", method, path, resp.Status)
+		}
+		if path == "/plugins" {
+			json.NewDecoder(resp.Body).Decode(&res)
+		} else {
+			var p AdminPlugin
+			json.NewDecoder(resp.Body).Decode(&p)
+			res = append(res, p)
+		}
+		return
+	}
+
+	list := request("GET", "/plugins")
+	if len(list) != 2 || !list[0].Input || list[0].Output || !list[1].Output || list[1].Input || list[1].Limit != "100" {
+		t.Errorf("Wrong plugins: %+v", list)
+	}
+
+	if p := request("POST", "/plugins/0/pause")[0]; !p.Paused {
+		t.Error("Input should be paused")
+	}
+
+	// input is paused, message is read only after resume
+	wg.Add(1)
+	input.EmitGET()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		// single message might be read before pause takes effect
+		wg.Add(1)
+		input.EmitGET()
+		done = make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	select {
+	case <-done:
+		t.Error("Paused input should not be read")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	request("POST", "/plugins/0/resume")
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Resumed input should be read")
+	}
+
+	if p := request("POST", "/plugins/1/limit?limit=10%25")[0]; p.Limit != "10%" {
+		t.Errorf("Limit should be changed: %+v", p)
+	}
+
+	req, _ := http.NewRequest("POST", addr+"/plugins/1/pause", nil)
+	if resp, _ := http.DefaultClient.Do(req); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Output can't be paused: %s", resp.Status)
+	}
+
+	req, _ = http.NewRequest("POST", addr+"/drain?timeout=1s", nil)
+	if resp, _ := http.DefaultClient.Do(req); resp.StatusCode != http.StatusOK {
+		t.Errorf("Drain failed: %s", resp.Status)
+	}
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Error("Should exit after drain")
+	}
+
+	// plugins are listed while the emitter closes them
+	listed := make(chan struct{})
+	go func() {
+		defer close(listed)
+		for i := 0; i < 10; i++ {
+			if resp, err := http.Get(addr + "/plugins"); err == nil {
+				resp.Body.Close()
+			}
+		}
+	}()
+	emitter.Close()
+	<-listed
+}
+
+func TestAdminDrainResponses(t *testing.T) {
+	received := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(received)
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	responses := make(chan *Message, 10)
+	input := NewTestInput()
+	httpOutput := NewHTTPOutput(server.URL, &HTTPOutputConfig{TrackResponses: true})
+	output := NewTestOutput(func(msg *Message) {
+		if isRequestPayload(msg.Meta) {
+			return
+		}
+		responses <- msg
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []PluginReader{input, httpOutput},
+		Outputs: []PluginWriter{httpOutput, output},
+	}
+	plugins.All = append(plugins.All, input, httpOutput, output)
+
+	emitter := NewEmitter()
+	emitter.Start(plugins, "")
+	defer emitter.Close()
+
+	admin := NewAdmin("127.0.0.1:0", plugins, emitter, func() {})
+	defer admin.Close()
+
+	input.EmitGET()
+	<-received
+
+	// request is being sent, drain should wait for it and its response
+	if s := httpOutput.(queueStater).QueueStats(); s.InFlight == 0 {
+		t.Errorf("Request should be in flight: %+v", s)
+	}
+	resp, err := http.Post("http://"+admin.listener.Addr().String()+"/drain?timeout=2s", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var res struct{ Drained bool }
+	json.NewDecoder(resp.Body).Decode(&res)
+	if !res.Drained {
+		t.Error("Should be drained")
+	}
+	if emitter.Paused(httpOutput) {
+		t.Error("Responses of outputs should be read while draining")
+	}
+	select {
+	case <-responses:
+	case <-time.After(time.Second):
+		t.Error("Response should be delivered while draining")
+	}
+}
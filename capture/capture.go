@@ -48,6 +48,7 @@ type PcapOptions struct {
 	Promiscuous   bool          `json:"input-raw-promisc"`
 	Monitor       bool          `json:"input-raw-monitor"`
 	Snaplen       bool          `json:"input-raw-override-snaplen"`
+	Defragment    bool          `json:"input-raw-defragment"`
 }
 
 // Listener handle traffic capture, this is its representation.
@@ -61,14 +62,19 @@ type Listener struct {
 	Reading    chan bool // this channel is closed when the listener has started reading packets
 	PcapOptions
 	Engine          EngineType
-	ports           []uint16 // src or/and dst ports
+	ports           tcp.Ports       // src or/and dst ports
+	hosts           []tcp.HostPorts // ports of every host, when hosts have different ports
 	trackResponse   bool
 	expiry          time.Duration
 	allowIncomplete bool
 	messages        chan *tcp.Message
 	protocol        tcp.TCPProtocol
+	tlsKeyLog       *tcp.KeyLog
+	tunnels         *tcp.Tunnels
+	memoryLimits    *tcp.MemoryLimits // shared by parsers of all handles
 
-	host string // pcap file name or interface (name, hardware addr, index or ip address)
+	host  string // pcap file name or interface (name, hardware addr, index or ip address)
+	netns string // path of network namespace of the target, like /proc/<pid>/ns/net
 
 	closeDone chan struct{}
 	quit      chan struct{}
@@ -126,7 +132,7 @@ func (eng *EngineType) String() (e string) {
 // NewListener creates and initialize a new Listener. if transport or/and engine are invalid/unsupported
 // is "tcp" and "pcap", are assumed. l.Engine and l.Transport can help to get the values used.
 // if there is an error it will be associated with getting network interfaces
-func NewListener(host string, ports []uint16, transport string, engine EngineType, protocol tcp.TCPProtocol, trackResponse bool, expiry time.Duration, allowIncomplete bool) (l *Listener, err error) {
+func NewListener(host string, ports tcp.Ports, transport string, engine EngineType, protocol tcp.TCPProtocol, trackResponse bool, expiry time.Duration, allowIncomplete bool) (l *Listener, err error) {
 	l = &Listener{}
 
 	l.host = host
@@ -134,6 +140,20 @@ func NewListener(host string, ports []uint16, transport string, engine EngineTyp
 		l.host = "127.0.0.1"
 	}
 	l.ports = ports
+	if IsNamespaceTarget(host) {
+		if l.netns, err = namespacePath(host); err != nil {
+			return nil, err
+		}
+		// all interfaces of the namespace are captured
+		l.host = ""
+		switch engine {
+		case EngineRawSocket, EngineAFPacket:
+		case EnginePcapFile:
+			return nil, fmt.Errorf("can't read %s from a file", host)
+		default:
+			engine = EngineAFPacket
+		}
+	}
 
 	l.Transport = "tcp"
 	if transport != "" {
@@ -164,6 +184,11 @@ func NewListener(host string, ports []uint16, transport string, engine EngineTyp
 		l.Activate = l.activatePcapFile
 		return
 	}
+	if l.netns != "" {
+		// sockets are created inside the namespace, and keep capturing it
+		activate := l.Activate
+		l.Activate = func() error { return withNetns(l.netns, activate) }
+	}
 
 	err = l.setInterfaces()
 	if err != nil {
@@ -178,6 +203,29 @@ func (l *Listener) SetPcapOptions(opts PcapOptions) {
 	l.PcapOptions = opts
 }
 
+// SetTLSKeyLog enables decryption of TLS connections with secrets from the key log
+func (l *Listener) SetTLSKeyLog(keyLog *tcp.KeyLog) {
+	l.tlsKeyLog = keyLog
+}
+
+// SetTunnels enables decapsulation of tunneled packets, ports and host of the listener are matched
+// against inner headers
+func (l *Listener) SetTunnels(tunnels tcp.Tunnels) {
+	l.tunnels = &tunnels
+}
+
+// SetHosts captures multiple hosts with ports of their own, instead of host and ports of the listener.
+// Host of the listener should be empty, so that all interfaces are captured.
+func (l *Listener) SetHosts(hosts []tcp.HostPorts) {
+	l.hosts = hosts
+}
+
+// SetMemoryLimits limits memory of partial messages of all handles, of every connection, and size of every message.
+// Handles share the budget, so a busy interface can use memory of idle ones.
+func (l *Listener) SetMemoryLimits(maxMemory, maxConnMemory, maxMessageSize int) {
+	l.memoryLimits = tcp.NewMemoryLimits(maxMemory, maxConnMemory, maxMessageSize)
+}
+
 // Listen listens for packets from the handles, and call handler on every packet received
 // until the context done signal is sent or there is unrecoverable error on all handles.
 // this function must be called after activating pcap handles
@@ -216,29 +264,97 @@ func (l *Listener) Filter(ifi pcap.Interface) (filter string) {
 		hosts = interfaceAddresses(ifi)
 	}
 
-	filter = portsFilter(l.Transport, "dst", l.ports)
-
-	if len(hosts) != 0 && !l.Promiscuous {
-		filter = fmt.Sprintf("((%s) and (%s))", filter, hostsFilter("dst", hosts))
+	if len(l.hosts) != 0 {
+		// ports of the hosts differ, so the hosts are matched even in promiscuous mode
+		filter = hostPortsFilter(l.Transport, "dst", l.hosts)
+		if l.trackResponse {
+			filter = fmt.Sprintf("%s or %s", filter, hostPortsFilter(l.Transport, "src", l.hosts))
+		}
 	} else {
-		filter = fmt.Sprintf("(%s)", filter)
-	}
-
-	if l.trackResponse {
-		responseFilter := portsFilter(l.Transport, "src", l.ports)
+		filter = portsFilter(l.Transport, "dst", l.ports)
 
 		if len(hosts) != 0 && !l.Promiscuous {
-			responseFilter = fmt.Sprintf("((%s) and (%s))", responseFilter, hostsFilter("src", hosts))
+			filter = fmt.Sprintf("((%s) and (%s))", filter, hostsFilter("dst", hosts))
 		} else {
-			responseFilter = fmt.Sprintf("(%s)", responseFilter)
+			filter = fmt.Sprintf("(%s)", filter)
+		}
+
+		if l.trackResponse {
+			responseFilter := portsFilter(l.Transport, "src", l.ports)
+
+			if len(hosts) != 0 && !l.Promiscuous {
+				responseFilter = fmt.Sprintf("((%s) and (%s))", responseFilter, hostsFilter("src", hosts))
+			} else {
+				responseFilter = fmt.Sprintf("(%s)", responseFilter)
+			}
+
+			filter = fmt.Sprintf("%s or %s", filter, responseFilter)
 		}
+	}
+
+	if l.tunnels != nil {
+		filter = fmt.Sprintf("%s or %s", filter, tunnelsFilter(*l.tunnels))
+	}
 
-		filter = fmt.Sprintf("%s or %s", filter, responseFilter)
+	if l.Defragment {
+		// fragments are reassembled and matched by readFragment before parsing
+		filter = fmt.Sprintf("%s or %s", filter, fragmentsFilter)
 	}
 
 	return
 }
 
+// readFragment passes packet to the defragmenter, reassembled packets are matched against ports and hosts of
+// the listener, as fragments are captured whatever their datagram is. ips are addresses of the interface
+func (l *Listener) readFragment(defrag *defragmenter, packet *tcp.PcapPacket, ips []net.IP) *tcp.PcapPacket {
+	p := defrag.defragment(packet)
+	if p == nil || p == packet {
+		return p
+	}
+	if !l.matchPacket(p, ips) {
+		stats.Add("defrag_unmatched", 1)
+		return nil
+	}
+	return p
+}
+
+// matchPacket applies the automatic filter to a packet
+func (l *Listener) matchPacket(packet *tcp.PcapPacket, ips []net.IP) bool {
+	pckt, err := tcp.ParsePacket(packet.Data, packet.LType, packet.LTypeLen, packet.Ci, true)
+	if err != nil {
+		// inner headers of tunneled packets are matched by the parser
+		return l.tunnels != nil
+	}
+	if !listenAll(l.host) {
+		if ip := net.ParseIP(l.host); ip != nil {
+			ips = []net.IP{ip}
+		}
+	}
+	match := func(ip net.IP, port uint16) bool {
+		if len(l.hosts) != 0 {
+			for _, h := range l.hosts {
+				if h.IP.Equal(ip) && h.Ports.Match(port) {
+					return true
+				}
+			}
+			return false
+		}
+		if !l.ports.Match(port) {
+			return false
+		}
+		if len(ips) == 0 || l.Promiscuous {
+			return true
+		}
+		for _, host := range ips {
+			if host.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return match(pckt.DstIP, pckt.DstPort) || l.trackResponse && match(pckt.SrcIP, pckt.SrcPort)
+}
+
 // PcapHandle returns new pcap Handle from dev on success.
 // this function should be called after setting all necessary options for this listener
 func (l *Listener) PcapHandle(ifi pcap.Interface) (handle *pcap.Handle, err error) {
@@ -383,13 +499,45 @@ func (l *Listener) read() {
 				}
 			}
 
-			messageParser := tcp.NewMessageParser(l.messages, l.ports, hndl.ips, l.expiry, l.allowIncomplete)
-
-			if l.protocol == tcp.ProtocolHTTP {
-				messageParser.Start = http1StartHint
-				messageParser.End = http1EndHint
+			var options []tcp.ParserOption
+			var start tcp.HintStart
+			var end tcp.HintEnd
+			switch l.protocol {
+			case tcp.ProtocolHTTP:
+				start, end = http1StartHint, http1EndHint
+				options = append(options, tcp.WithWebSocket())
+			case tcp.ProtocolHTTP2:
+				// HTTP/2 streams are converted to HTTP/1.1 messages
+				start, end = http1StartHint, http1EndHint
+				options = append(options, tcp.WithHTTP2())
+			case tcp.ProtocolPostgres:
+				options = append(options, tcp.WithPostgres())
+			case tcp.ProtocolMySQL:
+				options = append(options, tcp.WithMySQL())
+			case tcp.ProtocolRedis:
+				options = append(options, tcp.WithRedis())
+			}
+			if l.tlsKeyLog != nil {
+				options = append(options, tcp.WithTLSKeyLog(l.tlsKeyLog))
+			}
+			if l.tunnels != nil {
+				options = append(options, tcp.WithTunnels(*l.tunnels, l.tunnelHosts(), l.trackResponse))
+			}
+			if l.memoryLimits != nil {
+				options = append(options, tcp.WithMemoryLimits(l.memoryLimits))
 			}
+			if l.hosts != nil {
+				options = append(options, tcp.WithHosts(l.hosts))
+			}
+
+			messageParser := tcp.NewMessageParser(l.messages, l.ports, hndl.ips, l.expiry, l.allowIncomplete, options...)
+			messageParser.Start = start
+			messageParser.End = end
 
+			var defrag *defragmenter
+			if l.Defragment {
+				defrag = newDefragmenter()
+			}
 			timer := time.NewTicker(1 * time.Second)
 
 			for {
@@ -412,12 +560,31 @@ func (l *Listener) read() {
 							ci.Timestamp = time.Now()
 						}
 
-						messageParser.PacketHandler(&tcp.PcapPacket{
+						packet := &tcp.PcapPacket{
 							Data:     data,
 							LType:    linkType,
 							LTypeLen: linkSize,
 							Ci:       &ci,
-						})
+						}
+						// link type of packets read from pcapng files depends on their interface
+						for _, data := range ci.AncillaryData {
+							if origin, ok := data.(packetOrigin); ok {
+								packet.LType = int(origin.LinkType)
+								if packet.LTypeLen, ok = pcapLinkTypeLength(packet.LType); !ok {
+									stats.Add("unknown_link_type", 1)
+									packet = nil
+									break
+								}
+								packet.Interface = origin.Interface
+								packet.Comments = origin.Comments
+							}
+						}
+						if packet != nil && defrag != nil {
+							packet = l.readFragment(defrag, packet, hndl.ips)
+						}
+						if packet != nil {
+							messageParser.PacketHandler(packet)
+						}
 						continue
 					}
 					if enext, ok := err.(pcap.NextError); ok && enext == pcap.NextErrorTimeoutExpired {
@@ -507,10 +674,11 @@ func (l *Listener) activateRawSocket() error {
 	return nil
 }
 
+// activatePcapFile opens pcap or pcapng files, host can also be a directory of capture files or a glob,
+// packets of several files are read in timestamp order
 func (l *Listener) activatePcapFile() (err error) {
-	var handle *pcap.Handle
-	var e error
-	if handle, e = pcap.OpenOffline(l.host); e != nil {
+	paths, e := pcapFilePaths(l.host)
+	if e != nil {
 		return fmt.Errorf("open pcap file error: %q", e)
 	}
 
@@ -519,9 +687,9 @@ func (l *Listener) activatePcapFile() (err error) {
 	l.BPFFilter = l.Filter(pcap.Interface{})
 	l.host = tmp
 
-	if e = handle.SetBPFFilter(l.BPFFilter); e != nil {
-		handle.Close()
-		return fmt.Errorf("BPF filter error: %q, filter: %s", e, l.BPFFilter)
+	handle, e := openPcapFiles(paths, l.BPFFilter)
+	if e != nil {
+		return fmt.Errorf("open pcap file error: %q", e)
 	}
 
 	fmt.Println("BPF Filter:", l.BPFFilter)
@@ -567,6 +735,9 @@ func (l *Listener) activateAFPacket() error {
 }
 
 func (l *Listener) setInterfaces() (err error) {
+	if l.netns != "" {
+		return withNetns(l.netns, l.setNamespaceInterfaces)
+	}
 	var pifis []pcap.Interface
 	pifis, err = pcap.FindAllDevs()
 	ifis, _ := net.Interfaces()
@@ -617,6 +788,35 @@ func (l *Listener) setInterfaces() (err error) {
 	return
 }
 
+// setNamespaceInterfaces lists interfaces of the current network namespace, libpcap may not see them,
+// so they are enumerated with netlink
+func (l *Listener) setNamespaceInterfaces() error {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+	for _, ni := range ifis {
+		if ni.Flags&net.FlagUp == 0 {
+			continue
+		}
+		if ni.Flags&net.FlagLoopback != 0 {
+			l.loopIndex = ni.Index
+		}
+		pi := pcap.Interface{Name: ni.Name}
+		addrs, _ := ni.Addrs()
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				pi.Addresses = append(pi.Addresses, pcap.InterfaceAddress{IP: ipnet.IP, Netmask: ipnet.Mask})
+			}
+		}
+		l.Interfaces = append(l.Interfaces, pi)
+	}
+	if len(l.Interfaces) == 0 {
+		return fmt.Errorf("no interfaces are up in network namespace %s", l.netns)
+	}
+	return nil
+}
+
 func isDevice(addr string, ifi pcap.Interface) bool {
 	// Windows npcap loopback have no IPs
 	if addr == "127.0.0.1" && ifi.Name == `\Device\NPF_Loopback` {
@@ -660,14 +860,64 @@ func listenAll(addr string) bool {
 	return false
 }
 
-func portsFilter(transport string, direction string, ports []uint16) string {
-	if len(ports) == 0 || ports[0] == 0 {
+func portsFilter(transport string, direction string, ports tcp.Ports) string {
+	if ports.All() {
 		return fmt.Sprintf("%s %s portrange 0-%d", transport, direction, 1<<16-1)
 	}
 
+	var filters, excluded []string
+	for _, r := range ports {
+		filter := fmt.Sprintf("%s %s port %d", transport, direction, r.Min)
+		if r.Min != r.Max {
+			filter = fmt.Sprintf("%s %s portrange %d-%d", transport, direction, r.Min, r.Max)
+		}
+		if r.Exclude {
+			excluded = append(excluded, filter)
+		} else {
+			filters = append(filters, filter)
+		}
+	}
+	if len(filters) == 0 {
+		filters = []string{fmt.Sprintf("%s %s portrange 0-%d", transport, direction, 1<<16-1)}
+	}
+	if len(excluded) == 0 {
+		return strings.Join(filters, " or ")
+	}
+	return fmt.Sprintf("(%s) and not (%s)", strings.Join(filters, " or "), strings.Join(excluded, " or "))
+}
+
+// tunnelsFilter matches packets of tunnels, their inner headers are filtered by the parser
+func tunnelsFilter(tunnels tcp.Tunnels) string {
+	filters := []string{"ip proto gre", "ip6 proto gre"}
+	for _, port := range []uint16{tunnels.VXLANPort, tunnels.GenevePort} {
+		if port != 0 {
+			filters = append(filters, fmt.Sprintf("udp dst port %d", port))
+		}
+	}
+	return fmt.Sprintf("(%s)", strings.Join(filters, " or "))
+}
+
+// tunnelHosts returns host of the listener if it is an address of tunneled packets, rather than of an interface
+func (l *Listener) tunnelHosts() []net.IP {
+	if l.Promiscuous || listenAll(l.host) {
+		return nil
+	}
+	for _, ifi := range l.Interfaces {
+		if isDevice(l.host, ifi) {
+			return nil
+		}
+	}
+	if ip := net.ParseIP(l.host); ip != nil {
+		return []net.IP{ip}
+	}
+	return nil
+}
+
+// hostPortsFilter matches every host with its own ports
+func hostPortsFilter(transport string, direction string, hosts []tcp.HostPorts) string {
 	var filters []string
-	for _, port := range ports {
-		filters = append(filters, fmt.Sprintf("%s %s port %d", transport, direction, port))
+	for _, h := range hosts {
+		filters = append(filters, fmt.Sprintf("((%s) and %s host %s)", portsFilter(transport, direction, h.Ports), direction, h.IP))
 	}
 	return strings.Join(filters, " or ")
 }
@@ -1,7 +1,10 @@
 package capture
 
 import (
+	"net"
 	"testing"
+
+	"github.com/buger/goreplay/tcp"
 )
 
 func TestSetInterfaces(t *testing.T) {
@@ -20,3 +23,35 @@ func TestSetInterfaces(t *testing.T) {
 		t.Errorf("loopback nic index was not found")
 	}
 }
+
+func TestPortsFilter(t *testing.T) {
+	cases := []struct {
+		ports  string
+		filter string
+	}{
+		{"*", "tcp dst portrange 0-65535"},
+		{"80,8000-8100", "tcp dst port 80 or tcp dst portrange 8000-8100"},
+		{"8000-8100,!8080", "(tcp dst portrange 8000-8100) and not (tcp dst port 8080)"},
+		{"!9090", "(tcp dst portrange 0-65535) and not (tcp dst port 9090)"},
+	}
+	for _, c := range cases {
+		ports, err := tcp.ParsePorts(c.ports)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filter := portsFilter("tcp", "dst", ports); filter != c.filter {
+			t.Errorf("%s: expected %q, got %q", c.ports, c.filter, filter)
+		}
+	}
+}
+
+func TestHostPortsFilter(t *testing.T) {
+	web, _ := tcp.ParsePorts("80,!81")
+	db, _ := tcp.ParsePorts("5432")
+	hosts := []tcp.HostPorts{{IP: net.ParseIP("10.0.0.1"), Ports: web}, {IP: net.ParseIP("10.0.0.2"), Ports: db}}
+
+	expected := "(((tcp src port 80) and not (tcp src port 81)) and src host 10.0.0.1) or ((tcp src port 5432) and src host 10.0.0.2)"
+	if filter := hostPortsFilter("tcp", "src", hosts); filter != expected {
+		t.Errorf("expected %q, got %q", expected, filter)
+	}
+}
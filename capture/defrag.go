@@ -0,0 +1,266 @@
+package capture
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+	"github.com/google/gopacket"
+)
+
+// limits of fragments waiting for reassembly
+const (
+	defragTimeout      = 30 * time.Second // same as default of linux
+	defragMaxMemory    = 16 << 20         // bytes of fragments of all datagrams
+	defragMaxFragments = 256              // fragments of one datagram
+	defragMaxLength    = 65535            // length of reassembled payload
+)
+
+// fragmentsFilter matches IPv4 fragments and IPv6 packets with fragment header, most of them
+// don't have TCP header and are not matched by ports
+const fragmentsFilter = "(ip[6:2] & 0x3fff != 0) or (ip6[6] = 44)"
+
+// defragmenter reassembles fragmented IPv4 and IPv6 datagrams, so the parser gets whole TCP segments.
+// Datagrams which are not completed within defragTimeout are dropped, as well as fragments which
+// don't fit within defragMaxMemory. It is used by a single goroutine.
+type defragmenter struct {
+	datagrams map[fragmentKey]*datagram
+	memory    int
+	lastSweep time.Time
+}
+
+type fragmentKey struct {
+	src, dst [16]byte
+	id       uint32
+	proto    byte
+	version  byte
+}
+
+type fragment struct {
+	offset int
+	data   []byte
+}
+
+// datagram holds fragments of a datagram until all of them are captured
+type datagram struct {
+	first     *tcp.PcapPacket // the first fragment
+	header    []byte          // link layer and unfragmentable part of IP header of the first fragment
+	next      byte            // IPv6 next header of fragment header of the first fragment
+	nextIndex int             // index of IPv6 next header field which points to fragment header
+	fragments []fragment
+	last      bool // the last fragment was captured
+	length    int  // length of payload, known when the last fragment is captured
+	size      int
+	start     time.Time
+}
+
+// fragmentInfo describes a fragment
+type fragmentInfo struct {
+	key       fragmentKey
+	offset    int
+	more      bool
+	header    int // length of unfragmentable part of IP header
+	next      byte
+	nextIndex int
+	payload   []byte
+}
+
+func newDefragmenter() *defragmenter {
+	return &defragmenter{datagrams: make(map[fragmentKey]*datagram)}
+}
+
+// defragment returns the packet if it is not a fragment, a reassembled packet if this fragment
+// completes its datagram, or nil
+func (d *defragmenter) defragment(p *tcp.PcapPacket) *tcp.PcapPacket {
+	if len(p.Data) <= p.LTypeLen {
+		return p
+	}
+	info, fragmented, valid := parseFragment(p.Data[p.LTypeLen:])
+	if !fragmented {
+		return p
+	}
+	ts := p.Ci.Timestamp
+	d.sweep(ts)
+	if !valid || p.Ci.CaptureLength < p.Ci.Length {
+		stats.Add("defrag_invalid", 1)
+		return nil
+	}
+	if d.memory+len(info.payload) > defragMaxMemory {
+		stats.Add("defrag_dropped", 1)
+		return nil
+	}
+
+	dg := d.datagrams[info.key]
+	if dg == nil {
+		dg = &datagram{start: ts}
+		d.datagrams[info.key] = dg
+	}
+	if len(dg.fragments) == defragMaxFragments {
+		stats.Add("defrag_dropped", int64(len(dg.fragments)+1))
+		d.remove(info.key, dg)
+		return nil
+	}
+	dg.fragments = append(dg.fragments, fragment{info.offset, append([]byte(nil), info.payload...)})
+	dg.size += len(info.payload)
+	d.memory += len(info.payload)
+	if info.offset == 0 {
+		dg.first = p
+		dg.header = append([]byte(nil), p.Data[:p.LTypeLen+info.header]...)
+		dg.next, dg.nextIndex = info.next, p.LTypeLen+info.nextIndex
+	}
+	if !info.more {
+		dg.last = true
+		dg.length = info.offset + len(info.payload)
+	}
+	if dg.first == nil || !dg.last {
+		return nil
+	}
+
+	// all bytes of the payload should be covered by fragments
+	sort.Slice(dg.fragments, func(i, j int) bool { return dg.fragments[i].offset < dg.fragments[j].offset })
+	end := 0
+	for _, f := range dg.fragments {
+		if f.offset > end {
+			return nil
+		}
+		if f.offset+len(f.data) > end {
+			end = f.offset + len(f.data)
+		}
+	}
+	if end != dg.length {
+		if end > dg.length {
+			stats.Add("defrag_invalid", int64(len(dg.fragments)))
+			d.remove(info.key, dg)
+		}
+		return nil
+	}
+	d.remove(info.key, dg)
+	stats.Add("defrag_reassembled", 1)
+	return dg.reassemble(ts)
+}
+
+// reassemble builds the datagram from the header of the first fragment and payloads of fragments
+func (dg *datagram) reassemble(ts time.Time) *tcp.PcapPacket {
+	data := make([]byte, len(dg.header)+dg.length)
+	copy(data, dg.header)
+	for _, f := range dg.fragments {
+		copy(data[len(dg.header)+f.offset:], f.data)
+	}
+	ip := data[dg.first.LTypeLen:]
+	if ip[0]>>4 == 4 {
+		ihl := int(ip[0]&0x0F) * 4
+		binary.BigEndian.PutUint16(ip[2:], uint16(ihl+dg.length))
+		// keep don't fragment flag
+		binary.BigEndian.PutUint16(ip[6:], binary.BigEndian.Uint16(ip[6:])&0x4000)
+		ip[10], ip[11] = 0, 0
+		binary.BigEndian.PutUint16(ip[10:], ipChecksum(ip[:ihl]))
+	} else {
+		// fragment header is removed
+		data[dg.nextIndex] = dg.next
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(ip)-40))
+	}
+	ci := gopacket.CaptureInfo{
+		Timestamp:     ts,
+		CaptureLength: len(data),
+		Length:        len(data),
+	}
+	return &tcp.PcapPacket{
+		Data:      data,
+		LType:     dg.first.LType,
+		LTypeLen:  dg.first.LTypeLen,
+		Ci:        &ci,
+		Interface: dg.first.Interface,
+		Comments:  dg.first.Comments,
+	}
+}
+
+func (d *defragmenter) remove(key fragmentKey, dg *datagram) {
+	d.memory -= dg.size
+	delete(d.datagrams, key)
+}
+
+// sweep drops datagrams which were not completed in time, timestamps of packets are used
+// so files are reassembled the same way as live traffic
+func (d *defragmenter) sweep(now time.Time) {
+	if now.Sub(d.lastSweep) < time.Second {
+		return
+	}
+	d.lastSweep = now
+	for key, dg := range d.datagrams {
+		if now.Sub(dg.start) > defragTimeout {
+			stats.Add("defrag_timeouts", int64(len(dg.fragments)))
+			d.remove(key, dg)
+		}
+	}
+}
+
+// parseFragment parses IP header, fragmented is false for packets which are not fragments, and valid is false
+// for fragments which can't be reassembled
+func parseFragment(ip []byte) (info fragmentInfo, fragmented, valid bool) {
+	switch {
+	case len(ip) >= 20 && ip[0]>>4 == 4:
+		flags := binary.BigEndian.Uint16(ip[6:])
+		if flags&0x3FFF == 0 {
+			return
+		}
+		fragmented = true
+		ihl, length := int(ip[0]&0x0F)*4, int(binary.BigEndian.Uint16(ip[2:]))
+		if ihl < 20 || length < ihl || length > len(ip) {
+			return
+		}
+		info.key.version = 4
+		copy(info.key.src[:], ip[12:16])
+		copy(info.key.dst[:], ip[16:20])
+		info.key.id = uint32(binary.BigEndian.Uint16(ip[4:]))
+		info.key.proto = ip[9]
+		info.offset = int(flags&0x1FFF) * 8
+		info.more = flags&0x2000 != 0
+		info.header = ihl
+		info.payload = ip[ihl:length]
+	case len(ip) >= 40 && ip[0]>>4 == 6:
+		next, index, pos := ip[6], 6, 40
+		// hop-by-hop options, routing and destination options headers may precede fragment header
+		for next == 0 || next == 43 || next == 60 {
+			if pos+8 > len(ip) {
+				return
+			}
+			next, index, pos = ip[pos], pos, pos+(int(ip[pos+1])+1)*8
+		}
+		if next != 44 {
+			return
+		}
+		fragmented = true
+		length := 40 + int(binary.BigEndian.Uint16(ip[4:]))
+		if pos+8 > length || length > len(ip) {
+			return
+		}
+		flags := binary.BigEndian.Uint16(ip[pos+2:])
+		info.key.version = 6
+		copy(info.key.src[:], ip[8:24])
+		copy(info.key.dst[:], ip[24:40])
+		info.key.id = binary.BigEndian.Uint32(ip[pos+4:])
+		info.offset = int(flags &^ 7)
+		info.more = flags&1 != 0
+		info.header = pos
+		info.next = ip[pos]
+		info.nextIndex = index
+		info.payload = ip[pos+8 : length]
+	default:
+		return
+	}
+	// all fragments except the last one are multiples of 8 bytes
+	valid = (!info.more || len(info.payload)%8 == 0) && info.offset+len(info.payload) <= defragMaxLength
+	return
+}
+
+func ipChecksum(hdr []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(hdr); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(hdr[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
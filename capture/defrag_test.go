@@ -0,0 +1,223 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"expvar"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+func tcpSegment(payload []byte) []byte {
+	seg := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(seg[0:], 50000)
+	binary.BigEndian.PutUint16(seg[2:], 80)
+	seg[12] = 5 << 4
+	return append(seg, payload...)
+}
+
+// ipv4Fragments splits TCP segment into fragments of Ethernet frames
+func ipv4Fragments(segment []byte, size int) (frames [][]byte) {
+	for offset := 0; offset < len(segment); offset += size {
+		end := offset + size
+		if end > len(segment) {
+			end = len(segment)
+		}
+		frame := make([]byte, 14+20, 14+20+end-offset)
+		binary.BigEndian.PutUint16(frame[12:], 0x0800)
+		ip := frame[14:]
+		ip[0] = 4<<4 | 5
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+end-offset))
+		binary.BigEndian.PutUint16(ip[4:], 7)
+		flags := uint16(offset / 8)
+		if end < len(segment) {
+			flags |= 0x2000
+		}
+		binary.BigEndian.PutUint16(ip[6:], flags)
+		ip[8], ip[9] = 64, 6
+		copy(ip[12:], []byte{10, 0, 0, 1})
+		copy(ip[16:], []byte{10, 0, 0, 2})
+		frames = append(frames, append(frame, segment[offset:end]...))
+	}
+	return
+}
+
+// ipv6Fragments splits TCP segment into fragments of raw IPv6 packets with hop-by-hop options header
+func ipv6Fragments(segment []byte, size int) (packets [][]byte) {
+	for offset := 0; offset < len(segment); offset += size {
+		end := offset + size
+		if end > len(segment) {
+			end = len(segment)
+		}
+		p := make([]byte, 40+8+8, 40+8+8+end-offset)
+		p[0] = 6 << 4
+		binary.BigEndian.PutUint16(p[4:], uint16(16+end-offset))
+		p[6] = 0 // hop-by-hop options
+		p[15], p[31] = 1, 2
+		p[40] = 44
+		p[48] = 6
+		flags := uint16(offset)
+		if end < len(segment) {
+			flags |= 1
+		}
+		binary.BigEndian.PutUint16(p[50:], flags)
+		binary.BigEndian.PutUint32(p[52:], 9)
+		packets = append(packets, append(p, segment[offset:end]...))
+	}
+	return
+}
+
+func pcapPacket(data []byte, linkType layers.LinkType, linkSize int, ts time.Time) *tcp.PcapPacket {
+	return &tcp.PcapPacket{
+		Data:     data,
+		LType:    int(linkType),
+		LTypeLen: linkSize,
+		Ci:       &gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(data), Length: len(data)},
+	}
+}
+
+func TestDefragment(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 50)
+	segment := tcpSegment(payload)
+	now := time.Now()
+
+	cases := []struct {
+		name      string
+		fragments [][]byte
+		linkType  layers.LinkType
+		linkSize  int
+	}{
+		{"IPv4", ipv4Fragments(segment, 200), layers.LinkTypeEthernet, 14},
+		{"IPv6", ipv6Fragments(segment, 200), layers.LinkTypeRaw, 0},
+	}
+	for _, c := range cases {
+		d := newDefragmenter()
+		// out of order, with a duplicate
+		order := []int{2, 0, 0, 1}
+		var reassembled *tcp.PcapPacket
+		for i, n := range order {
+			p := d.defragment(pcapPacket(c.fragments[n], c.linkType, c.linkSize, now))
+			if i < len(order)-1 && p != nil {
+				t.Errorf("%s: datagram is not complete", c.name)
+			}
+			reassembled = p
+		}
+		if reassembled == nil {
+			t.Errorf("%s: datagram should be reassembled", c.name)
+			continue
+		}
+		pckt, err := tcp.ParsePacket(reassembled.Data, reassembled.LType, reassembled.LTypeLen, reassembled.Ci, false)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if pckt.SrcPort != 50000 || pckt.DstPort != 80 || !bytes.Equal(pckt.Payload, payload) {
+			t.Errorf("%s: wrong packet %s -> %s %q", c.name, pckt.Src(), pckt.Dst(), pckt.Payload)
+		}
+		if len(d.datagrams) != 0 || d.memory != 0 {
+			t.Errorf("%s: fragments should be released", c.name)
+		}
+		if _, err = tcp.ParsePacket(c.fragments[1], int(c.linkType), c.linkSize, reassembled.Ci, true); err == nil {
+			t.Errorf("%s: fragments should not be parsed", c.name)
+		}
+	}
+
+	// not fragmented packets are passed as they are
+	d := newDefragmenter()
+	whole := ipv4Fragments(segment, len(segment))[0]
+	if p := pcapPacket(whole, layers.LinkTypeEthernet, 14, now); d.defragment(p) != p {
+		t.Error("packet is not a fragment")
+	}
+}
+
+func stat(name string) int64 {
+	if v, ok := stats.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestDefragmentLimits(t *testing.T) {
+	fragments := ipv4Fragments(tcpSegment(make([]byte, 400)), 200)
+	now := time.Now()
+
+	d := newDefragmenter()
+	timeouts := stat("defrag_timeouts")
+	d.defragment(pcapPacket(fragments[0], layers.LinkTypeEthernet, 14, now))
+	d.defragment(pcapPacket(fragments[1], layers.LinkTypeEthernet, 14, now.Add(defragTimeout+time.Second)))
+	if p := d.defragment(pcapPacket(fragments[2], layers.LinkTypeEthernet, 14, now.Add(defragTimeout+time.Second))); p != nil {
+		t.Error("first fragment should be dropped after timeout")
+	}
+	if stat("defrag_timeouts") != timeouts+1 {
+		t.Error("timeout should be counted")
+	}
+
+	invalid := stat("defrag_invalid")
+	truncated := pcapPacket(fragments[0], layers.LinkTypeEthernet, 14, now)
+	truncated.Ci.Length += 100
+	if d.defragment(truncated) != nil || stat("defrag_invalid") != invalid+1 {
+		t.Error("truncated fragment should be dropped")
+	}
+
+	d = newDefragmenter()
+	d.memory = defragMaxMemory - 100
+	dropped := stat("defrag_dropped")
+	if d.defragment(pcapPacket(fragments[0], layers.LinkTypeEthernet, 14, now)) != nil || stat("defrag_dropped") != dropped+1 {
+		t.Error("fragment exceeding memory limit should be dropped")
+	}
+}
+
+func TestReadFragment(t *testing.T) {
+	segment := tcpSegment(make([]byte, 400))
+	now := time.Now()
+	reassemble := func(l *Listener) *tcp.PcapPacket {
+		d := newDefragmenter()
+		var p *tcp.PcapPacket
+		for _, f := range ipv4Fragments(segment, 200) {
+			p = l.readFragment(d, pcapPacket(f, layers.LinkTypeEthernet, 14, now), nil)
+		}
+		return p
+	}
+	ports := func(s string) tcp.Ports {
+		p, _ := tcp.ParsePorts(s)
+		return p
+	}
+
+	cases := []struct {
+		name     string
+		listener *Listener
+		match    bool
+	}{
+		{"port", &Listener{host: "10.0.0.2", ports: ports("80")}, true},
+		{"other port", &Listener{host: "10.0.0.2", ports: ports("8080")}, false},
+		{"other host", &Listener{host: "10.0.0.3", ports: ports("80")}, false},
+		{"promiscuous", &Listener{host: "10.0.0.3", ports: ports("80"), PcapOptions: PcapOptions{Promiscuous: true}}, true},
+		{"response", &Listener{host: "10.0.0.1", ports: ports("50000"), trackResponse: true}, true},
+		{"hosts", &Listener{ports: ports("80"), hosts: []tcp.HostPorts{{IP: net.ParseIP("10.0.0.2"), Ports: ports("81")}}}, false},
+	}
+	for _, c := range cases {
+		unmatched := stat("defrag_unmatched")
+		if p := reassemble(c.listener); (p != nil) != c.match {
+			t.Errorf("%s: reassembled packet should be matched: %t", c.name, c.match)
+		}
+		if !c.match && stat("defrag_unmatched") != unmatched+1 {
+			t.Errorf("%s: unmatched packet should be counted", c.name)
+		}
+	}
+
+	l := &Listener{host: "10.0.0.2", ports: ports("80")}
+	if strings.Contains(l.Filter(pcap.Interface{}), fragmentsFilter) {
+		t.Error("fragments should be captured only when defragmentation is enabled")
+	}
+	l.Defragment = true
+	if !strings.Contains(l.Filter(pcap.Interface{}), fragmentsFilter) {
+		t.Error("fragments should be captured")
+	}
+}
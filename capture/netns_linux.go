@@ -0,0 +1,42 @@
+package capture
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// withNetns calls fn on a thread switched to the network namespace, sockets created by fn
+// stay in that namespace. An empty path runs fn in the current namespace.
+func withNetns(path string, fn func() error) error {
+	if path == "" {
+		return fn()
+	}
+	ns, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("network namespace %s: %v", path, err)
+	}
+	defer ns.Close()
+
+	runtime.LockOSThread()
+	self, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("current network namespace: %v", err)
+	}
+	defer self.Close()
+
+	if err = unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("switch to network namespace %s: %v", path, err)
+	}
+	err = fn()
+	if e := unix.Setns(int(self.Fd()), unix.CLONE_NEWNET); e != nil {
+		// the thread is left locked, so no other goroutine runs in the wrong namespace
+		return fmt.Errorf("restore network namespace: %v", e)
+	}
+	runtime.UnlockOSThread()
+	return err
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package capture
+
+import "fmt"
+
+func withNetns(path string, fn func() error) error {
+	if path == "" {
+		return fn()
+	}
+	return fmt.Errorf("network namespaces are supported only on linux")
+}
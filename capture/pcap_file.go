@@ -0,0 +1,471 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// pcapMaxBlock limits size of blocks and packet records read from pcap files
+const pcapMaxBlock = 64 << 20
+
+// pcapFileExtensions are extensions of capture files read from directories
+var pcapFileExtensions = []string{".pcap", ".pcapng", ".cap"}
+
+// packetOrigin is added to ancillary data of packets read from capture files, since link type and interface
+// may be different for every packet of a pcapng file
+type packetOrigin struct {
+	LinkType  layers.LinkType
+	Interface string
+	Comments  []string
+}
+
+// pcapFilePaths returns capture files to read: the file itself, capture files of a directory, or files matching a glob
+func pcapFilePaths(path string) ([]string, error) {
+	if info, err := os.Stat(path); err == nil {
+		if !info.IsDir() {
+			return []string{path}, nil
+		}
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		var paths []string
+		for _, entry := range entries {
+			if !entry.Mode().IsRegular() {
+				continue
+			}
+			ext := strings.ToLower(filepath.Ext(entry.Name()))
+			for _, e := range pcapFileExtensions {
+				if ext == e {
+					paths = append(paths, filepath.Join(path, entry.Name()))
+					break
+				}
+			}
+		}
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("no capture files in directory %s", path)
+		}
+		return paths, nil
+	}
+	paths, err := filepath.Glob(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no capture files match %s", path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// pcapFileSet reads packets of several capture files in timestamp order
+type pcapFileSet struct {
+	files   []*pcapFile
+	filter  string
+	filters map[layers.LinkType]*pcap.BPF
+}
+
+// openPcapFiles opens the files and reads their first packets, filter is a BPF expression
+// applied to packets of every link type, it is ignored if empty
+func openPcapFiles(paths []string, filter string) (*pcapFileSet, error) {
+	set := &pcapFileSet{filter: filter, filters: make(map[layers.LinkType]*pcap.BPF)}
+	for _, path := range paths {
+		f, err := openPcapFile(path)
+		if err != nil {
+			set.Close()
+			return nil, err
+		}
+		set.files = append(set.files, f)
+		if err = set.next(f); err != nil && err != io.EOF {
+			set.Close()
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// next reads the next packet of the file which matches the filter
+func (set *pcapFileSet) next(f *pcapFile) error {
+	for {
+		if err := f.next(); err != nil {
+			return err
+		}
+		if set.filter == "" {
+			return nil
+		}
+		bpf, ok := set.filters[f.packet.origin.LinkType]
+		if !ok {
+			var err error
+			if bpf, err = pcap.NewBPF(f.packet.origin.LinkType, 262144, set.filter); err != nil {
+				return fmt.Errorf("BPF filter error: %q, filter: %s, link type: %s", err, set.filter, f.packet.origin.LinkType)
+			}
+			set.filters[f.packet.origin.LinkType] = bpf
+		}
+		if bpf.Matches(f.packet.ci, f.packet.data) {
+			return nil
+		}
+	}
+}
+
+// ReadPacketData returns the earliest of next packets of the files
+func (set *pcapFileSet) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	var first *pcapFile
+	for _, f := range set.files {
+		if f.packet.data == nil {
+			continue
+		}
+		if first == nil || f.packet.ci.Timestamp.Before(first.packet.ci.Timestamp) {
+			first = f
+		}
+	}
+	if first == nil {
+		return nil, ci, io.EOF
+	}
+	data, ci = first.packet.data, first.packet.ci
+	ci.AncillaryData = append(ci.AncillaryData, first.packet.origin)
+	if err = set.next(first); err == io.EOF {
+		err = nil
+	}
+	return
+}
+
+// Close closes all files
+func (set *pcapFileSet) Close() error {
+	for _, f := range set.files {
+		f.file.Close()
+	}
+	set.files = nil
+	return nil
+}
+
+// pcapInterface is an interface of a pcapng section, or the only interface of a pcap file
+type pcapInterface struct {
+	name     string
+	linkType layers.LinkType
+	snaplen  uint32
+	binary   bool  // resolution of timestamps is a power of 2
+	exponent uint8 // timestamps are in units of 10^-exponent or 2^-exponent seconds
+	offset   int64 // seconds added to timestamps
+}
+
+// timestamp converts timestamp in units of the interface
+func (ifi *pcapInterface) timestamp(ts uint64) time.Time {
+	var units uint64
+	switch {
+	case ifi.binary:
+		units = 1 << ifi.exponent
+	case ifi.exponent > 9:
+		units = 1
+		for i := uint8(0); i < ifi.exponent-9; i++ {
+			units *= 10
+		}
+		ts /= units // ignore precision beyond nanoseconds
+		units = 1e9
+	default:
+		units = 1
+		for i := uint8(0); i < ifi.exponent; i++ {
+			units *= 10
+		}
+	}
+	sec, frac := ts/units, ts%units
+	hi, lo := bits.Mul64(frac, 1e9)
+	nsec, _ := bits.Div64(hi, lo, units)
+	return time.Unix(int64(sec)+ifi.offset, int64(nsec))
+}
+
+type pcapFilePacket struct {
+	data   []byte
+	ci     gopacket.CaptureInfo
+	origin packetOrigin
+}
+
+// pcapFile reads packets of a pcap or pcapng file
+type pcapFile struct {
+	path       string
+	file       *os.File
+	r          *bufio.Reader
+	order      binary.ByteOrder
+	ng         bool
+	interfaces []*pcapInterface
+	last       time.Time      // timestamp of the last packet, given to simple packet blocks
+	packet     pcapFilePacket // the next packet, data is nil when the file ended
+}
+
+// pcapng block types and options
+const (
+	pcapngSectionHeader     = 0x0A0D0D0A
+	pcapngInterface         = 0x00000001
+	pcapngSimplePacket      = 0x00000003
+	pcapngEnhancedPacket    = 0x00000006
+	pcapngByteOrderMagic    = 0x1A2B3C4D
+	pcapngOptionEnd         = 0
+	pcapngOptionComment     = 1
+	pcapngOptionIfName      = 2
+	pcapngOptionIfTsresol   = 9
+	pcapngOptionIfTsoffset  = 14
+	pcapMagicMicroseconds   = 0xA1B2C3D4
+	pcapMagicNanoseconds    = 0xA1B23C4D
+	pcapDefaultTsresol      = 6
+	pcapLinkTypeMask        = 0x0FFFFFFF
+	pcapHeaderLength        = 24
+	pcapRecordHeaderLength  = 16
+	pcapngMinBlockLength    = 12
+	pcapngSectionBodyLength = 16
+)
+
+func openPcapFile(path string) (*pcapFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &pcapFile{path: path, file: file, r: bufio.NewReaderSize(file, 1<<16)}
+	magic, err := f.r.Peek(4)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	switch {
+	case binary.BigEndian.Uint32(magic) == pcapngSectionHeader:
+		f.ng = true
+	case binary.LittleEndian.Uint32(magic) == pcapMagicMicroseconds || binary.LittleEndian.Uint32(magic) == pcapMagicNanoseconds:
+		f.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(magic) == pcapMagicMicroseconds || binary.BigEndian.Uint32(magic) == pcapMagicNanoseconds:
+		f.order = binary.BigEndian
+	default:
+		file.Close()
+		return nil, fmt.Errorf("%s: unknown capture file format", path)
+	}
+	if !f.ng {
+		if err = f.readHeader(); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return f, nil
+}
+
+// readHeader reads header of pcap file, which describes its only interface
+func (f *pcapFile) readHeader() error {
+	var hdr [pcapHeaderLength]byte
+	if _, err := io.ReadFull(f.r, hdr[:]); err != nil {
+		return err
+	}
+	ifi := &pcapInterface{
+		snaplen:  f.order.Uint32(hdr[16:]),
+		linkType: layers.LinkType(f.order.Uint32(hdr[20:]) & pcapLinkTypeMask),
+		exponent: pcapDefaultTsresol,
+	}
+	if f.order.Uint32(hdr[0:]) == pcapMagicNanoseconds {
+		ifi.exponent = 9
+	}
+	f.interfaces = []*pcapInterface{ifi}
+	return nil
+}
+
+// next reads the next packet to f.packet
+func (f *pcapFile) next() (err error) {
+	f.packet = pcapFilePacket{}
+	if f.ng {
+		err = f.nextBlock()
+	} else {
+		err = f.nextRecord()
+	}
+	if err == io.EOF || err == nil {
+		return
+	}
+	if err == io.ErrUnexpectedEOF {
+		err = errors.New("unexpected end of file")
+	}
+	return fmt.Errorf("%s: %v", f.path, err)
+}
+
+func (f *pcapFile) nextRecord() error {
+	var hdr [pcapRecordHeaderLength]byte
+	if _, err := io.ReadFull(f.r, hdr[:]); err != nil {
+		return err
+	}
+	ifi := f.interfaces[0]
+	captured := f.order.Uint32(hdr[8:])
+	if captured > pcapMaxBlock {
+		return fmt.Errorf("packet record too large: %d bytes", captured)
+	}
+	data := make([]byte, captured)
+	if _, err := io.ReadFull(f.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	sec, frac := uint64(f.order.Uint32(hdr[0:])), uint64(f.order.Uint32(hdr[4:]))
+	if ifi.exponent != 9 {
+		frac *= 1000 // microseconds
+	}
+	f.setPacket(ifi, data, int(f.order.Uint32(hdr[12:])), time.Unix(int64(sec), int64(frac)), nil)
+	return nil
+}
+
+func (f *pcapFile) setPacket(ifi *pcapInterface, data []byte, length int, ts time.Time, comments []string) {
+	if length < len(data) {
+		length = len(data)
+	}
+	f.last = ts
+	f.packet = pcapFilePacket{
+		data: data,
+		ci: gopacket.CaptureInfo{
+			Timestamp:     ts,
+			CaptureLength: len(data),
+			Length:        length,
+		},
+		origin: packetOrigin{LinkType: ifi.linkType, Interface: ifi.name, Comments: comments},
+	}
+}
+
+// nextBlock reads blocks of pcapng file until a packet is found
+func (f *pcapFile) nextBlock() error {
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(f.r, hdr[:]); err != nil {
+			return err
+		}
+		if binary.BigEndian.Uint32(hdr[0:]) == pcapngSectionHeader {
+			// byte order of the section is given by its header
+			bom, err := f.r.Peek(4)
+			if err != nil {
+				return io.ErrUnexpectedEOF
+			}
+			switch uint32(pcapngByteOrderMagic) {
+			case binary.LittleEndian.Uint32(bom):
+				f.order = binary.LittleEndian
+			case binary.BigEndian.Uint32(bom):
+				f.order = binary.BigEndian
+			default:
+				return errors.New("invalid byte order of section")
+			}
+		}
+		if f.order == nil {
+			return errors.New("missing section header")
+		}
+		typ, length := f.order.Uint32(hdr[0:]), f.order.Uint32(hdr[4:])
+		if length < pcapngMinBlockLength || length%4 != 0 || length > pcapMaxBlock {
+			return fmt.Errorf("invalid block length: %d", length)
+		}
+		block := make([]byte, length-8)
+		if _, err := io.ReadFull(f.r, block); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if f.order.Uint32(block[len(block)-4:]) != length {
+			return errors.New("block lengths don't match")
+		}
+		body := block[:len(block)-4]
+
+		switch typ {
+		case pcapngSectionHeader:
+			if len(body) < pcapngSectionBodyLength {
+				return errors.New("section header too short")
+			}
+			// interfaces are numbered per section
+			f.interfaces = nil
+		case pcapngInterface:
+			if len(body) < 8 {
+				return errors.New("interface description too short")
+			}
+			ifi := &pcapInterface{
+				linkType: layers.LinkType(f.order.Uint16(body[0:])),
+				snaplen:  f.order.Uint32(body[4:]),
+				exponent: pcapDefaultTsresol,
+			}
+			f.options(body[8:], func(code uint16, value []byte) {
+				switch {
+				case code == pcapngOptionIfName:
+					ifi.name = string(value)
+				case code == pcapngOptionIfTsresol && len(value) >= 1:
+					ifi.binary = value[0]&0x80 != 0
+					ifi.exponent = value[0] & 0x7F
+				case code == pcapngOptionIfTsoffset && len(value) >= 8:
+					ifi.offset = int64(f.order.Uint64(value))
+				}
+			})
+			if (ifi.binary && ifi.exponent > 63) || (!ifi.binary && ifi.exponent > 19) {
+				return fmt.Errorf("unsupported timestamp resolution of interface %d", len(f.interfaces))
+			}
+			f.interfaces = append(f.interfaces, ifi)
+		case pcapngEnhancedPacket:
+			if len(body) < 20 {
+				return errors.New("enhanced packet block too short")
+			}
+			id := f.order.Uint32(body[0:])
+			if int(id) >= len(f.interfaces) {
+				return fmt.Errorf("packet of unknown interface %d", id)
+			}
+			ifi := f.interfaces[id]
+			ts := uint64(f.order.Uint32(body[4:]))<<32 | uint64(f.order.Uint32(body[8:]))
+			captured := f.order.Uint32(body[12:])
+			padded := (uint64(captured) + 3) &^ 3
+			if padded > uint64(len(body)-20) {
+				return errors.New("packet data exceeds block")
+			}
+			var comments []string
+			f.options(body[20+padded:], func(code uint16, value []byte) {
+				if code == pcapngOptionComment {
+					comments = append(comments, string(value))
+				}
+			})
+			data := body[20 : 20+captured : 20+captured]
+			f.setPacket(ifi, data, int(f.order.Uint32(body[16:])), ifi.timestamp(ts), comments)
+			return nil
+		case pcapngSimplePacket:
+			if len(f.interfaces) == 0 {
+				return errors.New("packet of unknown interface 0")
+			}
+			if len(body) < 4 {
+				return errors.New("simple packet block too short")
+			}
+			ifi := f.interfaces[0]
+			length := f.order.Uint32(body[0:])
+			captured := uint32(len(body) - 4)
+			if length < captured {
+				captured = length
+			}
+			if ifi.snaplen != 0 && ifi.snaplen < captured {
+				captured = ifi.snaplen
+			}
+			// simple packets have no timestamps, they are given the timestamp of the previous packet
+			f.setPacket(ifi, body[4:4+captured:4+captured], int(length), f.last, nil)
+			return nil
+		}
+		// other blocks are skipped
+	}
+}
+
+// options calls fn for every option of a block, malformed options are ignored
+func (f *pcapFile) options(data []byte, fn func(code uint16, value []byte)) {
+	for len(data) >= 4 {
+		code, length := f.order.Uint16(data[0:]), int(f.order.Uint16(data[2:]))
+		if code == pcapngOptionEnd || 4+length > len(data) {
+			return
+		}
+		fn(code, data[4:4+length])
+		n := 4 + (length+3)&^3
+		if n > len(data) {
+			return
+		}
+		data = data[n:]
+	}
+}
@@ -0,0 +1,154 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcapngBlock builds block of pcapng file
+func pcapngBlock(order binary.ByteOrder, typ uint32, body []byte, options ...[]byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	for _, o := range options {
+		body = append(body, o...)
+	}
+	if len(options) > 0 {
+		body = append(body, 0, 0, 0, 0)
+	}
+	block := make([]byte, 12+len(body))
+	order.PutUint32(block[0:], typ)
+	order.PutUint32(block[4:], uint32(len(block)))
+	copy(block[8:], body)
+	order.PutUint32(block[len(block)-4:], uint32(len(block)))
+	return block
+}
+
+func pcapngOption(order binary.ByteOrder, code uint16, value []byte) []byte {
+	o := make([]byte, 4+(len(value)+3)&^3)
+	order.PutUint16(o[0:], code)
+	order.PutUint16(o[2:], uint16(len(value)))
+	copy(o[4:], value)
+	return o
+}
+
+func pcapngSection(order binary.ByteOrder) []byte {
+	body := make([]byte, 16)
+	order.PutUint32(body[0:], pcapngByteOrderMagic)
+	order.PutUint16(body[4:], 1)
+	binary.BigEndian.PutUint64(body[8:], ^uint64(0))
+	return pcapngBlock(order, pcapngSectionHeader, body)
+}
+
+func pcapngIDB(order binary.ByteOrder, linkType layers.LinkType, options ...[]byte) []byte {
+	body := make([]byte, 8)
+	order.PutUint16(body[0:], uint16(linkType))
+	return pcapngBlock(order, pcapngInterface, body, options...)
+}
+
+func pcapngEPB(order binary.ByteOrder, id uint32, ts uint64, data []byte, options ...[]byte) []byte {
+	body := make([]byte, 20, 20+len(data))
+	order.PutUint32(body[0:], id)
+	order.PutUint32(body[4:], uint32(ts>>32))
+	order.PutUint32(body[8:], uint32(ts))
+	order.PutUint32(body[12:], uint32(len(data)))
+	order.PutUint32(body[16:], uint32(len(data)))
+	return pcapngBlock(order, pcapngEnhancedPacket, append(body, data...), options...)
+}
+
+func TestPcapFiles(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pcap")
+	defer os.RemoveAll(dir)
+
+	le, be := binary.LittleEndian, binary.BigEndian
+	var ng []byte
+	ng = append(ng, pcapngSection(le)...)
+	ng = append(ng, pcapngIDB(le, layers.LinkTypeEthernet, pcapngOption(le, pcapngOptionIfName, []byte("eth0")))...)
+	ng = append(ng, pcapngIDB(le, layers.LinkTypeRaw, pcapngOption(le, pcapngOptionIfName, []byte("tun0")), pcapngOption(le, pcapngOptionIfTsresol, []byte{9}))...)
+	ng = append(ng, pcapngEPB(le, 0, 1000000, []byte("first"), pcapngOption(le, pcapngOptionComment, []byte("a b")), pcapngOption(le, pcapngOptionComment, []byte("c")))...)
+	ng = append(ng, pcapngEPB(le, 1, 3000000500, []byte("third"))...)
+	// interfaces of the next section are numbered from 0
+	ng = append(ng, pcapngSection(be)...)
+	ng = append(ng, pcapngIDB(be, layers.LinkTypeLinuxSLL, pcapngOption(be, pcapngOptionIfName, []byte("any")), pcapngOption(be, pcapngOptionIfTsresol, []byte{0x80 | 10}))...)
+	ng = append(ng, pcapngEPB(be, 0, 5<<10+512, []byte("fifth"))...)
+	ioutil.WriteFile(filepath.Join(dir, "a.pcapng"), ng, 0644)
+
+	var buf bytes.Buffer
+	w := pcapgo.NewWriterNanos(&buf)
+	w.WriteFileHeader(65535, layers.LinkTypeEthernet)
+	w.WritePacket(gopacket.CaptureInfo{Timestamp: time.Unix(2, 0), CaptureLength: 6, Length: 6}, []byte("second"))
+	w.WritePacket(gopacket.CaptureInfo{Timestamp: time.Unix(4, 0), CaptureLength: 6, Length: 6}, []byte("fourth"))
+	ioutil.WriteFile(filepath.Join(dir, "b.pcap"), buf.Bytes(), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a capture"), 0644)
+
+	expected := []struct {
+		data   string
+		ts     time.Time
+		origin packetOrigin
+	}{
+		{"first", time.Unix(1, 0), packetOrigin{layers.LinkTypeEthernet, "eth0", []string{"a b", "c"}}},
+		{"second", time.Unix(2, 0), packetOrigin{layers.LinkTypeEthernet, "", nil}},
+		{"third", time.Unix(3, 500), packetOrigin{layers.LinkTypeRaw, "tun0", nil}},
+		{"fourth", time.Unix(4, 0), packetOrigin{layers.LinkTypeEthernet, "", nil}},
+		{"fifth", time.Unix(5, 500000000), packetOrigin{layers.LinkTypeLinuxSLL, "any", nil}},
+	}
+
+	for _, path := range []string{dir, filepath.Join(dir, "*.pcap*")} {
+		paths, err := pcapFilePaths(path)
+		if err != nil || len(paths) != 2 {
+			t.Fatalf("Wrong files of %s: %v %v", path, paths, err)
+		}
+		set, err := openPcapFiles(paths, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range expected {
+			data, ci, err := set.ReadPacketData()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != e.data || !ci.Timestamp.Equal(e.ts) || len(ci.AncillaryData) != 1 || !reflect.DeepEqual(ci.AncillaryData[0], e.origin) {
+				t.Errorf("Expected %s at %v from %v, got %q at %v from %v", e.data, e.ts, e.origin, data, ci.Timestamp, ci.AncillaryData)
+			}
+		}
+		if _, _, err = set.ReadPacketData(); err != io.EOF {
+			t.Errorf("Expected EOF, got %v", err)
+		}
+		set.Close()
+	}
+}
+
+func TestPcapFileErrors(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pcap")
+	defer os.RemoveAll(dir)
+
+	le := binary.LittleEndian
+	truncated := append(pcapngSection(le), pcapngIDB(le, layers.LinkTypeEthernet)...)
+	truncated = append(truncated, pcapngEPB(le, 0, 0, []byte("data"))[:20]...)
+	files := map[string][]byte{
+		"unknown.pcap":   []byte("not a capture file"),
+		"interface.pcap": append(pcapngSection(le), pcapngEPB(le, 0, 0, []byte("data"))...),
+		"truncated.pcap": truncated,
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, data, 0644)
+		if _, err := openPcapFiles([]string{path}, ""); err == nil {
+			t.Errorf("Expected error reading %s", name)
+		}
+	}
+	if _, err := pcapFilePaths(filepath.Join(dir, "*.pcapng")); err == nil {
+		t.Errorf("Expected error if no files match")
+	}
+}
@@ -0,0 +1,267 @@
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Prefixes of capture targets which are network namespaces, rather than hosts or interfaces
+const (
+	TargetNetns     = "netns:"     // path of network namespace, like /proc/<pid>/ns/net or /var/run/netns/<name>
+	TargetPID       = "pid:"       // namespace of the process
+	TargetCgroup    = "cgroup:"    // namespace of a process of the cgroup, path is relative to /sys/fs/cgroup
+	TargetContainer = "container:" // namespace of the container, its process is found with CRI runtime
+)
+
+// criEndpoints are default sockets of CRI runtimes, CONTAINER_RUNTIME_ENDPOINT takes precedence like with crictl
+var criEndpoints = []string{
+	"/run/containerd/containerd.sock",
+	"/run/crio/crio.sock",
+	"/var/run/cri-dockerd.sock",
+}
+
+// cgroupRoot is where cgroup filesystem is mounted
+var cgroupRoot = "/sys/fs/cgroup"
+
+// IsNamespaceTarget checks if the host is a network namespace target
+func IsNamespaceTarget(host string) bool {
+	for _, prefix := range []string{TargetNetns, TargetPID, TargetCgroup, TargetContainer} {
+		if strings.HasPrefix(host, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// namespacePath returns path of the network namespace of the target
+func namespacePath(target string) (string, error) {
+	switch {
+	case strings.HasPrefix(target, TargetNetns):
+		return strings.TrimPrefix(target, TargetNetns), nil
+	case strings.HasPrefix(target, TargetPID):
+		pid, err := strconv.Atoi(strings.TrimPrefix(target, TargetPID))
+		if err != nil || pid <= 0 {
+			return "", fmt.Errorf("invalid pid of target %s", target)
+		}
+		return pidNamespace(pid), nil
+	case strings.HasPrefix(target, TargetCgroup):
+		pid, err := cgroupPID(strings.TrimPrefix(target, TargetCgroup))
+		if err != nil {
+			return "", err
+		}
+		return pidNamespace(pid), nil
+	case strings.HasPrefix(target, TargetContainer):
+		pid, err := containerPID(strings.TrimPrefix(target, TargetContainer))
+		if err != nil {
+			return "", err
+		}
+		return pidNamespace(pid), nil
+	}
+	return "", fmt.Errorf("unknown target %s", target)
+}
+
+func pidNamespace(pid int) string {
+	return fmt.Sprintf("/proc/%d/ns/net", pid)
+}
+
+// cgroupPID returns the first process of the cgroup
+func cgroupPID(cgroup string) (int, error) {
+	f, err := os.Open(filepath.Join(cgroupRoot, filepath.Clean("/"+cgroup), "cgroup.procs"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if pid, err := strconv.Atoi(strings.TrimSpace(s.Text())); err == nil && pid > 0 {
+			return pid, nil
+		}
+	}
+	return 0, fmt.Errorf("no processes in cgroup %s", cgroup)
+}
+
+// containerPID asks CRI runtime for the process of the container
+func containerPID(id string) (int, error) {
+	if id == "" {
+		return 0, errors.New("empty container id")
+	}
+	endpoints := criEndpoints
+	if endpoint := os.Getenv("CONTAINER_RUNTIME_ENDPOINT"); endpoint != "" {
+		endpoints = []string{strings.TrimPrefix(endpoint, "unix://")}
+	}
+	var errs []string
+	for _, endpoint := range endpoints {
+		if _, err := os.Stat(endpoint); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		pid, err := criContainerPID(endpoint, id)
+		if err == nil {
+			return pid, nil
+		}
+		errs = append(errs, endpoint+": "+err.Error())
+	}
+	return 0, fmt.Errorf("can't find container %s: %s", id, strings.Join(errs, "; "))
+}
+
+// criError is an error status of gRPC call
+type criError struct {
+	code    string
+	message string
+}
+
+func (e criError) Error() string {
+	return fmt.Sprintf("CRI error %s: %s", e.code, e.message)
+}
+
+// criUnimplemented is gRPC status of unknown methods
+const criUnimplemented = "12"
+
+// criContainerPID calls ContainerStatus of CRI runtime listening on unix socket, verbose status
+// of containerd and CRI-O has pid of the container in "info"
+func criContainerPID(endpoint, id string) (int, error) {
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return net.Dial("unix", endpoint)
+			},
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	// ContainerStatusRequest{container_id: id, verbose: true}
+	var req []byte
+	req = protowire.AppendTag(req, 1, protowire.BytesType)
+	req = protowire.AppendString(req, id)
+	req = protowire.AppendTag(req, 2, protowire.VarintType)
+	req = protowire.AppendVarint(req, 1)
+
+	var resp []byte
+	var err error
+	for _, service := range []string{"runtime.v1.RuntimeService", "runtime.v1alpha2.RuntimeService"} {
+		resp, err = criCall(client, "/"+service+"/ContainerStatus", req)
+		if e, ok := err.(criError); !ok || e.code != criUnimplemented {
+			break
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := criStatusInfo(resp)
+	if err != nil {
+		return 0, err
+	}
+	var verbose struct {
+		PID int `json:"pid"`
+	}
+	if err = json.Unmarshal([]byte(info["info"]), &verbose); err != nil || verbose.PID <= 0 {
+		return 0, fmt.Errorf("container %s is not running", id)
+	}
+	return verbose.PID, nil
+}
+
+func criCall(client *http.Client, method string, msg []byte) ([]byte, error) {
+	body := proto.AppendGRPCFrame(nil, proto.GRPCFrame{Data: msg})
+	req, err := http.NewRequestWithContext(context.Background(), "POST", "http://localhost"+method, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	// status is sent in headers of responses without messages
+	status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CRI response status %d", resp.StatusCode)
+	}
+	if status != "0" {
+		return nil, criError{status, message}
+	}
+	frames, err := proto.GRPCFrames(data)
+	if err != nil || len(frames) != 1 {
+		return nil, errors.New("invalid CRI response")
+	}
+	return frames[0].Data, nil
+}
+
+// criStatusInfo returns info map of ContainerStatusResponse
+func criStatusInfo(msg []byte) (map[string]string, error) {
+	info := make(map[string]string)
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		if num != 2 || typ != protowire.BytesType {
+			if n = protowire.ConsumeFieldValue(num, typ, msg); n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			msg = msg[n:]
+			continue
+		}
+		entry, n := protowire.ConsumeBytes(msg)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		var key, value string
+		for len(entry) > 0 {
+			num, typ, n := protowire.ConsumeTag(entry)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			entry = entry[n:]
+			if typ == protowire.BytesType && (num == 1 || num == 2) {
+				v, n := protowire.ConsumeString(entry)
+				if n < 0 {
+					return nil, protowire.ParseError(n)
+				}
+				if num == 1 {
+					key = v
+				} else {
+					value = v
+				}
+				entry = entry[n:]
+				continue
+			}
+			if n = protowire.ConsumeFieldValue(num, typ, entry); n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			entry = entry[n:]
+		}
+		info[key] = value
+	}
+	return info, nil
+}
@@ -0,0 +1,164 @@
+package capture
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buger/goreplay/proto"
+	"github.com/buger/goreplay/tcp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// fakeCRI serves ContainerStatus of v1alpha2 runtime service only, like older containerd
+func fakeCRI(t *testing.T, containers map[string]string) (endpoint string, closeFn func()) {
+	dir, err := ioutil.TempDir("", "cri")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint = filepath.Join(dir, "cri.sock")
+	ln, err := net.Listen("unix", endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		if r.URL.Path != "/runtime.v1alpha2.RuntimeService/ContainerStatus" {
+			w.Header().Set("Grpc-Status", criUnimplemented)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		frames, _ := proto.GRPCFrames(body)
+		var id string
+		var verbose bool
+		msg := frames[0].Data
+		for len(msg) > 0 {
+			num, _, n := protowire.ConsumeTag(msg)
+			msg = msg[n:]
+			if num == 1 {
+				id, n = protowire.ConsumeString(msg)
+			} else {
+				var v uint64
+				v, n = protowire.ConsumeVarint(msg)
+				verbose = v == 1
+			}
+			msg = msg[n:]
+		}
+		w.Header().Set("Trailer", "Grpc-Status")
+		info, ok := containers[id]
+		if !ok || !verbose {
+			w.Header().Set("Grpc-Status", "5")
+			return
+		}
+
+		// status, then info map
+		var resp []byte
+		resp = protowire.AppendTag(resp, 1, protowire.BytesType)
+		resp = protowire.AppendString(resp, "")
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, "info")
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, info)
+		resp = protowire.AppendTag(resp, 2, protowire.BytesType)
+		resp = protowire.AppendBytes(resp, entry)
+		w.Write(proto.AppendGRPCFrame(nil, proto.GRPCFrame{Data: resp}))
+		w.Header().Set("Grpc-Status", "0")
+	})
+	go http.Serve(ln, h2c.NewHandler(handler, &http2.Server{}))
+
+	return endpoint, func() {
+		ln.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestContainerTarget(t *testing.T) {
+	endpoint, closeFn := fakeCRI(t, map[string]string{
+		"web":     `{"pid": 4242, "sandboxID": "abc"}`,
+		"stopped": `{"pid": 0}`,
+	})
+	defer closeFn()
+	os.Setenv("CONTAINER_RUNTIME_ENDPOINT", "unix://"+endpoint)
+	defer os.Unsetenv("CONTAINER_RUNTIME_ENDPOINT")
+
+	path, err := namespacePath(TargetContainer + "web")
+	if err != nil || path != "/proc/4242/ns/net" {
+		t.Errorf("expected namespace of container process, got %q %v", path, err)
+	}
+	for _, id := range []string{"stopped", "unknown", ""} {
+		if _, err = namespacePath(TargetContainer + id); err == nil {
+			t.Errorf("container %q should not be found", id)
+		}
+	}
+}
+
+func TestNamespaceTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(root string) { cgroupRoot = root }(cgroupRoot)
+	cgroupRoot = dir
+	os.MkdirAll(filepath.Join(dir, "kubepods/pod1"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "kubepods/pod1/cgroup.procs"), []byte("17\n18\n"), 0644)
+	os.MkdirAll(filepath.Join(dir, "empty"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "empty/cgroup.procs"), nil, 0644)
+
+	cases := []struct {
+		target string
+		path   string
+	}{
+		{"netns:/var/run/netns/test", "/var/run/netns/test"},
+		{"pid:1234", "/proc/1234/ns/net"},
+		{"pid:-1", ""},
+		{"pid:abc", ""},
+		{"cgroup:/kubepods/pod1", "/proc/17/ns/net"},
+		{"cgroup:empty", ""},
+		{"cgroup:missing", ""},
+	}
+	for _, c := range cases {
+		if !IsNamespaceTarget(c.target) {
+			t.Errorf("%s should be a namespace target", c.target)
+		}
+		path, err := namespacePath(c.target)
+		if path != c.path || (err == nil) != (c.path != "") {
+			t.Errorf("%s: expected %q, got %q %v", c.target, c.path, path, err)
+		}
+	}
+	if IsNamespaceTarget("127.0.0.1") || IsNamespaceTarget("eth0") {
+		t.Error("hosts and interfaces are not namespace targets")
+	}
+}
+
+func TestNamespaceInterfaces(t *testing.T) {
+	l, err := NewListener("netns:/proc/self/ns/net", tcp.Ports{{Min: 80, Max: 80}}, "", EnginePcap, 0, false, 0, false)
+	if err != nil {
+		if strings.Contains(err.Error(), "operation not permitted") {
+			t.Skip(err)
+		}
+		t.Fatal(err)
+	}
+	if l.Engine != EngineAFPacket || l.host != "" {
+		t.Errorf("expected af_packet engine capturing all interfaces, got %s %q", l.Engine.String(), l.host)
+	}
+	var loopback bool
+	for _, ifi := range l.Interfaces {
+		loopback = loopback || ifi.Name == "lo" && len(ifi.Addresses) > 0
+	}
+	if !loopback || l.loopIndex == 0 {
+		t.Errorf("expected loopback interface of the namespace, got %v", l.Interfaces)
+	}
+
+	if _, err = NewListener("pid:1", nil, "", EnginePcapFile, 0, false, 0, false); err == nil {
+		t.Error("namespace targets can't be read from files")
+	}
+}
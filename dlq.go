@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// dlq is the dead-letter output, which receives messages outputs failed to deliver,
+// configured with --output-dlq or dlq of --config file
+var dlq struct {
+	sync.RWMutex
+	output PluginWriter
+}
+
+func setDLQ(output PluginWriter) {
+	dlq.Lock()
+	dlq.output = output
+	dlq.Unlock()
+}
+
+// deadLetter writes the message which the output failed to deliver to the dead-letter output.
+// Name of the output and the reason are added to the header of the message, as dlq-output and dlq-reason fields,
+// so the file written by the dead-letter output can be replayed with --input-file.
+// It reports whether the message was written to the dead-letter output.
+func deadLetter(output string, msg *Message, reason interface{}) bool {
+	// counted when the message is written, so the dead-letter output can be closed after it
+	defer outputDropped.With(output).Inc()
+
+	dlq.RLock()
+	w := dlq.output
+	dlq.RUnlock()
+	if w == nil || output == fmt.Sprint(unwrap(w)) {
+		return false
+	}
+
+	meta := appendPayloadMeta(msg.Meta, "dlq-output", output)
+	meta = appendPayloadMeta(meta, "dlq-reason", fmt.Sprint(reason))
+	if _, err := w.PluginWrite(&Message{Meta: meta, Data: msg.Data}); err != nil {
+		Debug(1, fmt.Sprintf("[DLQ] failed to write message of %s: %q", output, err))
+		return false
+	}
+	return true
+}
+
+// NewDLQOutput creates the output of --output-dlq, given as type:address. Types are file, tcp and kafka,
+// address of kafka is a list of brokers, with optional /topic, --output-kafka-topic is used without it.
+func NewDLQOutput(option string) PluginWriter {
+	i := strings.IndexByte(option, ':')
+	if i == -1 {
+		log.Fatalf("[DLQ] expected type:address, got %q", option)
+	}
+	kind, address := option[:i], option[i+1:]
+
+	switch kind {
+	case "file":
+		if strings.HasPrefix(address, "s3://") {
+			return NewS3Output(address, &Settings.OutputFileConfig)
+		}
+		// single file, so it can be replayed by the name it was given
+		config := Settings.OutputFileConfig
+		config.Append = true
+		return NewFileOutput(address, &config)
+	case "tcp":
+		return NewTCPOutput(address, &Settings.OutputTCPConfig)
+	case "kafka":
+		config := Settings.OutputKafkaConfig
+		config.Host = address
+		// messages are kept in the format of --output-file
+		config.UseJSON = false
+		if j := strings.LastIndexByte(address, '/'); j != -1 {
+			config.Host, config.Topic = address[:j], address[j+1:]
+		}
+		if config.Host == "" || config.Topic == "" {
+			log.Fatalf("[DLQ] kafka brokers and topic are required, got %q", address)
+		}
+		return NewKafkaOutput("", &config, &Settings.KafkaTLSConfig)
+	}
+	log.Fatalf("[DLQ] unknown output type %q, expected file, tcp or kafka", kind)
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type errorOutput struct{}
+
+func (errorOutput) PluginWrite(msg *Message) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func (errorOutput) String() string {
+	return "Error output"
+}
+
+func TestDeadLetterOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dlq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dlqOutput := NewDLQOutput("file:" + filepath.Join(dir, "lost.gor"))
+	setDLQ(dlqOutput)
+	defer setDLQ(nil)
+
+	// message failed by output is kept by dead-letter output, and the input is copied further
+	input := NewTestInput()
+	delivered := make(chan struct{}, 10)
+	copied := make(chan error)
+	go func() {
+		copied <- CopyMulty(input, errorOutput{}, NewTestOutput(func(*Message) { delivered <- struct{}{} }))
+	}()
+	input.EmitBytes([]byte("GET /written HTTP/1.1\r\n\r\n"))
+	input.EmitGET()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-delivered:
+		case <-time.After(time.Second):
+			t.Fatal("input should be copied after the failed write")
+		}
+	}
+	input.Close()
+	if err = <-copied; err != nil {
+		t.Errorf("failed write should not stop copying: %q", err)
+	}
+
+	// request which failed to replay
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	output := NewHTTPOutput("http://"+ln.Addr().String(), &HTTPOutputConfig{})
+	defer output.(*HTTPOutput).Close()
+	output.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1), Data: []byte("GET /replayed HTTP/1.1\r\n\r\n")})
+
+	for i := 0; i < 100 && outputDropped.With(output.(*HTTPOutput).String()).Value() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	dlqOutput.(*FileOutput).Close()
+
+	// lost traffic can be replayed from the file, by the name given to --output-dlq
+	lost := NewFileInput(filepath.Join(dir, "lost.gor"), false, 100, 0, false)
+	defer lost.Close()
+	reasons := make(map[string]string)
+	for i := 0; i < 3; i++ {
+		msg, err := lost.PluginRead()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields := make(map[string]string)
+		for _, field := range payloadMeta(msg.Meta)[4:] {
+			kv := strings.SplitN(string(field), "=", 2)
+			fields[kv[0]], _ = url.QueryUnescape(kv[1])
+		}
+		reasons[fields["dlq-output"]+" "+string(msg.Data)] = fields["dlq-reason"]
+	}
+
+	if reason := reasons["Error output GET /written HTTP/1.1\r\n\r\n"]; reason != "disk full" {
+		t.Errorf("expected error of output as reason, got %q in %v", reason, reasons)
+	}
+	replayed := output.(*HTTPOutput).String() + " GET /replayed HTTP/1.1\r\n\r\n"
+	if reason := reasons[replayed]; !strings.Contains(reason, "connection refused") {
+		t.Errorf("expected error of replay as reason, got %q in %v", reason, reasons)
+	}
+}
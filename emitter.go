@@ -1,10 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"hash/fnv"
 	"io"
-	"log"
 	"sync"
 	"time"
 
@@ -15,8 +15,55 @@ import (
 type Emitter struct {
 	sync.WaitGroup
 	plugins *InOutPlugins
+
+	mu    sync.Mutex
+	gates map[PluginReader]*inputGate
+}
+
+// inputGate blocks reading from an input while it is paused
+type inputGate struct {
+	mu      sync.Mutex
+	resumed chan struct{} // nil if not paused
+}
+
+func (g *inputGate) pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed == nil {
+		g.resumed = make(chan struct{})
+	}
+}
+
+func (g *inputGate) resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed != nil {
+		close(g.resumed)
+		g.resumed = nil
+	}
+}
+
+func (g *inputGate) paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.resumed != nil
 }
 
+func (g *inputGate) wait() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	resumed := g.resumed
+	g.mu.Unlock()
+	if resumed != nil {
+		<-resumed
+	}
+}
+
+// ErrNotReadByEmitter returned when pausing an input which is consumed by another plugin, e.g. middleware
+var ErrNotReadByEmitter = errors.New("input is not read by emitter")
+
 // NewEmitter creates and initializes new Emitter object.
 func NewEmitter() *Emitter {
 	return &Emitter{}
@@ -37,50 +84,138 @@ func (e *Emitter) Start(plugins *InOutPlugins, middlewareCmd string) {
 		}
 
 		e.plugins.Inputs = append(e.plugins.Inputs, middleware)
+		e.plugins.mu.Lock()
 		e.plugins.All = append(e.plugins.All, middleware)
+		e.plugins.mu.Unlock()
 		e.Add(1)
-		go func() {
+		go func(gate *inputGate) {
 			defer e.Done()
-			if err := CopyMulty(middleware, plugins.Outputs...); err != nil {
+			if err := copyRoutes(middleware, gate, newRouteWriter(&Route{
+				Outputs:   plugins.Outputs,
+				Modifiers: []*HTTPModifierConfig{&Settings.ModifierConfig},
+			})); err != nil {
 				Debug(2, fmt.Sprintf("[EMITTER] error during copy: %q", err))
 			}
-		}()
+		}(e.gate(middleware))
 	} else {
-		for _, in := range plugins.Inputs {
+		for in, writers := range routeWriters(plugins) {
 			e.Add(1)
-			go func(in PluginReader) {
+			go func(in PluginReader, gate *inputGate, writers []*routeWriter) {
 				defer e.Done()
-				if err := CopyMulty(in, plugins.Outputs...); err != nil {
+				if err := copyRoutes(in, gate, writers...); err != nil {
 					Debug(2, fmt.Sprintf("[EMITTER] error during copy: %q", err))
 				}
-			}(in)
+			}(in, e.gate(in), writers)
+		}
+	}
+}
+
+func (e *Emitter) gate(in PluginReader) *inputGate {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.gates == nil {
+		e.gates = make(map[PluginReader]*inputGate)
+	}
+	g := new(inputGate)
+	e.gates[in] = g
+	return g
+}
+
+func (e *Emitter) findGate(in PluginReader) (*inputGate, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	g, ok := e.gates[in]
+	if !ok {
+		return nil, ErrNotReadByEmitter
+	}
+	return g, nil
+}
+
+// Pause stops reading from the input until Resume is called.
+// Message which is already being read is still delivered to outputs.
+func (e *Emitter) Pause(in PluginReader) error {
+	g, err := e.findGate(in)
+	if err != nil {
+		return err
+	}
+	g.pause()
+	return nil
+}
+
+// Resume continues reading from the paused input
+func (e *Emitter) Resume(in PluginReader) error {
+	g, err := e.findGate(in)
+	if err != nil {
+		return err
+	}
+	g.resume()
+	return nil
+}
+
+// Paused reports whether reading from the input is paused
+func (e *Emitter) Paused(in PluginReader) bool {
+	g, err := e.findGate(in)
+	return err == nil && g.paused()
+}
+
+// routeWriters groups routes by their inputs, so every input is read by a single goroutine
+// even if it feeds multiple routes. Without configured routes all inputs go to all outputs.
+func routeWriters(plugins *InOutPlugins) map[PluginReader][]*routeWriter {
+	routes := plugins.Routes
+	if len(routes) == 0 {
+		routes = []*Route{{
+			Inputs:    plugins.Inputs,
+			Outputs:   plugins.Outputs,
+			Modifiers: []*HTTPModifierConfig{&Settings.ModifierConfig},
+		}}
+	}
+
+	writers := make(map[PluginReader][]*routeWriter)
+	for _, route := range routes {
+		for _, in := range route.Inputs {
+			writers[in] = append(writers[in], newRouteWriter(route))
 		}
 	}
+	return writers
 }
 
 // Close closes all the goroutine and waits for it to finish.
 func (e *Emitter) Close() {
-	for _, p := range e.plugins.All {
+	// paused inputs should be able to notice that they are stopped
+	e.mu.Lock()
+	for _, g := range e.gates {
+		g.resume()
+	}
+	e.mu.Unlock()
+
+	all := e.plugins.snapshot()
+	for _, p := range all {
 		if cp, ok := p.(io.Closer); ok {
 			cp.Close()
 		}
 	}
-	if len(e.plugins.All) > 0 {
+	if len(all) > 0 {
 		// wait for everything to stop
 		e.Wait()
 	}
+	e.plugins.mu.Lock()
 	e.plugins.All = nil // avoid Close to make changes again
+	e.plugins.mu.Unlock()
 }
 
 // CopyMulty copies from 1 reader to multiple writers
 func CopyMulty(src PluginReader, writers ...PluginWriter) error {
-	wIndex := 0
-	modifier := NewHTTPModifier(&Settings.ModifierConfig)
-	filteredRequests := make(map[string]int64)
-	filteredRequestsLastCleanTime := time.Now().UnixNano()
-	filteredCount := 0
+	return copyRoutes(src, nil, newRouteWriter(&Route{
+		Outputs:   writers,
+		Modifiers: []*HTTPModifierConfig{&Settings.ModifierConfig},
+	}))
+}
 
+// copyRoutes copies from 1 reader to the outputs of multiple routes
+func copyRoutes(src PluginReader, gate *inputGate, routes ...*routeWriter) error {
+	read := inputMessages.With(fmt.Sprint(unwrap(src)))
 	for {
+		gate.wait()
 		msg, err := src.PluginRead()
 		if err != nil {
 			if err == ErrorStopped || err == io.EOF {
@@ -92,86 +227,166 @@ func CopyMulty(src PluginReader, writers ...PluginWriter) error {
 			if len(msg.Data) > int(Settings.CopyBufferSize) {
 				msg.Data = msg.Data[:Settings.CopyBufferSize]
 			}
+			read.Inc()
 			meta := payloadMeta(msg.Meta)
 			if len(meta) < 3 {
 				Debug(2, fmt.Sprintf("[EMITTER] Found malformed record %q from %q", msg.Meta, src))
 				continue
 			}
-			requestID := byteutils.SliceToString(meta[1])
 			// start a subroutine only when necessary
 			if Settings.Verbose >= 3 {
 				Debug(3, "[EMITTER] input: ", byteutils.SliceToString(msg.Meta[:len(msg.Meta)-1]), " from: ", src)
 			}
-			if modifier != nil {
-				Debug(3, "[EMITTER] modifier:", requestID, "from:", src)
-				if isRequestPayload(msg.Meta) {
-					msg.Data = modifier.Rewrite(msg.Data)
-					// If modifier tells to skip request
-					if len(msg.Data) == 0 {
-						filteredRequests[requestID] = time.Now().UnixNano()
-						filteredCount++
-						continue
-					}
-					Debug(3, "[EMITTER] Rewritten input:", requestID, "from:", src)
 
-				} else {
-					if _, ok := filteredRequests[requestID]; ok {
-						delete(filteredRequests, requestID)
-						filteredCount--
-						continue
+			for i, route := range routes {
+				routeMsg := msg
+				// modifiers rewrite data in place, so every route needs its own copy
+				if i < len(routes)-1 {
+					routeMsg = &Message{
+						Meta: append([]byte(nil), msg.Meta...),
+						Data: append([]byte(nil), msg.Data...),
 					}
 				}
+				if err := route.write(src, routeMsg, meta); err != nil {
+					return err
+				}
 			}
+		}
+
+		for _, route := range routes {
+			route.clean()
+		}
+	}
+}
+
+// routeWriter applies route modifiers and writes messages to route outputs.
+// It holds state of a single input, and must not be shared between goroutines.
+type routeWriter struct {
+	route   *Route
+	writers []PluginWriter
+	wIndex  int
 
-			if Settings.PrettifyHTTP {
-				msg.Data = prettifyHTTP(msg.Data)
+	labels  []string
+	written []*Counter
+	errors  []*Counter
+
+	filteredRequests              map[string]int64
+	filteredRequestsLastCleanTime int64
+	filteredCount                 int
+}
+
+func newRouteWriter(route *Route) *routeWriter {
+	r := new(routeWriter)
+	r.route = route
+	r.writers = route.Outputs
+	for _, w := range r.writers {
+		label := fmt.Sprint(unwrap(w))
+		r.labels = append(r.labels, label)
+		r.written = append(r.written, outputMessages.With(label))
+		r.errors = append(r.errors, outputErrors.With(label))
+	}
+	if route.modifierChain() == nil {
+		route.SetModifiers(route.Modifiers)
+	}
+	r.filteredRequests = make(map[string]int64)
+	r.filteredRequestsLastCleanTime = time.Now().UnixNano()
+	return r
+}
+
+func (r *routeWriter) write(src PluginReader, msg *Message, meta [][]byte) error {
+	if len(r.writers) == 0 {
+		return nil
+	}
+
+	requestID := byteutils.SliceToString(meta[1])
+
+	// chain can be replaced on reload, so it is loaded once per message
+	if chain := r.route.modifierChain(); len(chain.modifiers) > 0 {
+		Debug(3, "[EMITTER] modifier:", requestID, "from:", src)
+		if isRequestPayload(msg.Meta) {
+			for _, modifier := range chain.modifiers {
+				msg.Data = modifier.Rewrite(msg.Data)
+				// If modifier tells to skip request
 				if len(msg.Data) == 0 {
-					continue
+					r.filteredRequests[requestID] = time.Now().UnixNano()
+					r.filteredCount++
+					return nil
 				}
 			}
+			Debug(3, "[EMITTER] Rewritten input:", requestID, "from:", src)
 
-			if Settings.SplitOutput {
-				if Settings.RecognizeTCPSessions {
-					if !PRO {
-						log.Fatal("Detailed TCP sessions work only with PRO license")
-					}
-					hasher := fnv.New32a()
-					hasher.Write(meta[1])
+		} else {
+			if _, ok := r.filteredRequests[requestID]; ok {
+				delete(r.filteredRequests, requestID)
+				r.filteredCount--
+				return nil
+			}
+		}
+	}
 
-					wIndex = int(hasher.Sum32()) % len(writers)
-					if _, err := writers[wIndex].PluginWrite(msg); err != nil {
-						return err
-					}
-				} else {
-					// Simple round robin
-					if _, err := writers[wIndex].PluginWrite(msg); err != nil {
-						return err
-					}
+	if Settings.PrettifyHTTP {
+		msg.Data = prettifyHTTP(msg.Data)
+		if len(msg.Data) == 0 {
+			return nil
+		}
+	}
 
-					wIndex = (wIndex + 1) % len(writers)
-				}
-			} else {
-				for _, dst := range writers {
-					if _, err := dst.PluginWrite(msg); err != nil && err != io.ErrClosedPipe {
-						return err
-					}
-				}
+	if Settings.SplitOutput {
+		if Settings.RecognizeTCPSessions {
+			// all messages of a captured session go to the same output
+			hasher := fnv.New32a()
+			hasher.Write([]byte(sessionID(meta[1])))
+
+			r.wIndex = int(hasher.Sum32()) % len(r.writers)
+			if err := r.writeTo(r.wIndex, msg); err != nil {
+				return err
+			}
+		} else {
+			// Simple round robin
+			if err := r.writeTo(r.wIndex, msg); err != nil {
+				return err
 			}
+
+			r.wIndex = (r.wIndex + 1) % len(r.writers)
 		}
+	} else {
+		for i := range r.writers {
+			if err := r.writeTo(i, msg); err != nil && err != io.ErrClosedPipe {
+				return err
+			}
+		}
+	}
 
-		// Run GC on each 1000 request
-		if filteredCount > 0 && filteredCount%1000 == 0 {
-			// Clean up filtered requests for which we didn't get a response to filter
-			now := time.Now().UnixNano()
-			if now-filteredRequestsLastCleanTime > int64(60*time.Second) {
-				for k, v := range filteredRequests {
-					if now-v > int64(60*time.Second) {
-						delete(filteredRequests, k)
-						filteredCount--
-					}
+	return nil
+}
+
+func (r *routeWriter) writeTo(i int, msg *Message) error {
+	_, err := r.writers[i].PluginWrite(msg)
+	if err == nil {
+		r.written[i].Inc()
+	} else if err != io.ErrClosedPipe {
+		r.errors[i].Inc()
+		// the message is kept by the dead-letter output, so copying goes on
+		if deadLetter(r.labels[i], msg, err) {
+			return nil
+		}
+	}
+	return err
+}
+
+// clean runs GC on each 1000 filtered request
+func (r *routeWriter) clean() {
+	if r.filteredCount > 0 && r.filteredCount%1000 == 0 {
+		// Clean up filtered requests for which we didn't get a response to filter
+		now := time.Now().UnixNano()
+		if now-r.filteredRequestsLastCleanTime > int64(60*time.Second) {
+			for k, v := range r.filteredRequests {
+				if now-v > int64(60*time.Second) {
+					delete(r.filteredRequests, k)
+					r.filteredCount--
 				}
-				filteredRequestsLastCleanTime = time.Now().UnixNano()
 			}
+			r.filteredRequestsLastCleanTime = time.Now().UnixNano()
 		}
 	}
 }
@@ -14,6 +14,7 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -45,6 +46,8 @@ func init() {
 		fmt.Fprintf(w, "\n}\n")
 	})
 
+	http.HandleFunc("/metrics", metricsHandler)
+
 	http.HandleFunc("/debug/pprof/", httppptof.Index)
 	http.HandleFunc("/debug/pprof/cmdline", httppptof.Cmdline)
 	http.HandleFunc("/debug/pprof/profile", httppptof.Profile)
@@ -108,14 +111,30 @@ func main() {
 	}
 
 	closeCh := make(chan int)
+	var closeOnce sync.Once
+	stop := func() {
+		closeOnce.Do(func() { close(closeCh) })
+	}
+
 	emitter := NewEmitter()
-	go emitter.Start(plugins, Settings.Middleware)
+	// routes and input gates should exist before the admin API uses them
+	emitter.Start(plugins, Settings.Middleware)
+
+	if Settings.Admin != "" {
+		NewAdmin(Settings.Admin, plugins, emitter, stop)
+	}
+
+	// without --config reload fails and SIGHUP is only logged
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go plugins.WatchPipeline(hup, Settings.ConfigWatch)
+
 	if Settings.ExitAfter > 0 {
 		log.Printf("Running gor for a duration of %s\n", Settings.ExitAfter)
 
 		time.AfterFunc(Settings.ExitAfter, func() {
 			log.Printf("gor run timeout %s\n", Settings.ExitAfter)
-			close(closeCh)
+			stop()
 		})
 	}
 	c := make(chan os.Signal, 1)
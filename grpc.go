@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/buger/goreplay/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+	protobuf "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// grpcJSONHeader marks payloads with gRPC messages rendered as JSON, its value is the full method name
+var grpcJSONHeader = []byte("X-Gor-Grpc-Json")
+
+// number of requests remembered to find message types of their responses
+const grpcCodecMaxCalls = 10000
+
+// grpcCodec is used by --output-stdout and middleware when --grpc-descriptor-set is set
+var grpcCodec *GRPCCodec
+
+// GRPCCodec renders protobuf messages of gRPC calls as JSON, using message types from descriptor set,
+// and encodes rendered messages back to protobuf.
+//
+// Body of rendered payload is a JSON array with a message per element, and grpcJSONHeader is added to it.
+type GRPCCodec struct {
+	files *protoregistry.Files
+
+	mu      sync.Mutex
+	methods map[string]protoreflect.MethodDescriptor // methods of calls by request id
+	calls   []string                                 // request ids in order they were seen
+}
+
+// NewGRPCCodec loads descriptor set file, produced by `protoc --include_imports --descriptor_set_out`
+func NewGRPCCodec(path string) (*GRPCCodec, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err = protobuf.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("can't parse descriptor set %q: %v", path, err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor set %q: %v", path, err)
+	}
+	return &GRPCCodec{files: files, methods: make(map[string]protoreflect.MethodDescriptor)}, nil
+}
+
+// method finds method by path of gRPC request: /package.Service/Method
+func (c *GRPCCodec) method(path string) protoreflect.MethodDescriptor {
+	i := strings.LastIndexByte(path, '/')
+	if i < 1 {
+		return nil
+	}
+	d, err := c.files.FindDescriptorByName(protoreflect.FullName(strings.TrimPrefix(path[:i], "/")))
+	if err != nil {
+		return nil
+	}
+	if service, ok := d.(protoreflect.ServiceDescriptor); ok {
+		return service.Methods().ByName(protoreflect.Name(path[i+1:]))
+	}
+	return nil
+}
+
+// callMethod returns method of the call which payload belongs to, requests are remembered for their responses
+func (c *GRPCCodec) callMethod(meta, payload []byte) protoreflect.MethodDescriptor {
+	id := string(payloadID(meta))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !isRequestPayload(meta) {
+		return c.methods[id]
+	}
+	m := c.method(string(proto.Path(payload)))
+	if m == nil {
+		return nil
+	}
+	if _, ok := c.methods[id]; !ok {
+		if len(c.calls) >= grpcCodecMaxCalls {
+			delete(c.methods, c.calls[0])
+			c.calls = c.calls[1:]
+		}
+		c.calls = append(c.calls, id)
+	}
+	c.methods[id] = m
+	return m
+}
+
+func messageType(m protoreflect.MethodDescriptor, meta []byte) protoreflect.MessageDescriptor {
+	if isRequestPayload(meta) {
+		return m.Input()
+	}
+	return m.Output()
+}
+
+// Render replaces protobuf messages in body of gRPC payload with JSON.
+// Payloads of other protocols, unknown methods and messages which can't be decoded are returned unchanged.
+func (c *GRPCCodec) Render(meta, payload []byte) []byte {
+	if !proto.IsGRPC(payload) {
+		return payload
+	}
+	m := c.callMethod(meta, payload)
+	if m == nil {
+		return payload
+	}
+	headers, body, trailers, err := proto.SplitMessage(payload)
+	if err != nil {
+		return payload
+	}
+	frames, err := proto.GRPCFrames(body)
+	if err != nil {
+		return payload
+	}
+
+	compression := string(proto.Header(headers, []byte("Grpc-Encoding")))
+	messages := make([]json.RawMessage, 0, len(frames))
+	for _, f := range frames {
+		data := f.Data
+		if f.Compressed {
+			if compression != "gzip" {
+				return payload
+			}
+			r, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return payload
+			}
+			if data, err = ioutil.ReadAll(r); err != nil {
+				return payload
+			}
+		}
+		msg := dynamicpb.NewMessage(messageType(m, meta))
+		if err = protobuf.Unmarshal(data, msg); err != nil {
+			Debug(1, "[GRPC] failed to decode message of", m.FullName(), err)
+			return payload
+		}
+		js, err := protojson.Marshal(msg)
+		if err != nil {
+			return payload
+		}
+		messages = append(messages, js)
+	}
+	rendered, _ := json.Marshal(messages)
+
+	// header helpers modify payload in place, and it is shared with other outputs
+	headers = append([]byte(nil), headers...)
+	headers = proto.DeleteHeader(headers, []byte("Grpc-Encoding"))
+	headers = proto.SetHeader(headers, grpcJSONHeader, []byte("/"+string(m.Parent().FullName())+"/"+string(m.Name())))
+	return grpcBody(headers, rendered, trailers)
+}
+
+// Encode converts messages rendered by Render back to protobuf. Payloads without rendered messages are returned unchanged.
+func (c *GRPCCodec) Encode(meta, payload []byte) []byte {
+	path := proto.Header(payload, grpcJSONHeader)
+	if len(path) == 0 {
+		return payload
+	}
+	m := c.method(string(path))
+	if m == nil {
+		Debug(1, "[GRPC] unknown method", string(path))
+		return payload
+	}
+	headers, body, trailers, err := proto.SplitMessage(payload)
+	if err != nil {
+		return payload
+	}
+
+	var messages []json.RawMessage
+	if err = json.Unmarshal(body, &messages); err != nil {
+		Debug(1, "[GRPC] messages should be encoded as JSON array:", err)
+		return payload
+	}
+	var encoded []byte
+	for _, js := range messages {
+		msg := dynamicpb.NewMessage(messageType(m, meta))
+		if err = protojson.Unmarshal(js, msg); err != nil {
+			Debug(1, "[GRPC] failed to encode message of", m.FullName(), err)
+			return payload
+		}
+		// fields of dynamic messages are written in random order unless marshaling is deterministic
+		data, err := protobuf.MarshalOptions{Deterministic: true}.Marshal(msg)
+		if err != nil {
+			return payload
+		}
+		encoded = proto.AppendGRPCFrame(encoded, proto.GRPCFrame{Data: data})
+	}
+
+	headers = proto.DeleteHeader(append([]byte(nil), headers...), grpcJSONHeader)
+	return grpcBody(headers, encoded, trailers)
+}
+
+// grpcBody builds payload with new body, chunked if the original payload had trailers
+func grpcBody(headers, body, trailers []byte) []byte {
+	if bytes.Equal(proto.Header(headers, []byte("Transfer-Encoding")), []byte("chunked")) {
+		payload := headers[:len(headers):len(headers)]
+		if len(body) > 0 {
+			payload = append(payload, strconv.FormatInt(int64(len(body)), 16)+"\r\n"...)
+			payload = append(append(payload, body...), proto.CRLF...)
+		}
+		payload = append(payload, "0\r\n"...)
+		if len(trailers) == 0 {
+			trailers = proto.CRLF
+		}
+		return append(payload, trailers...)
+	}
+	headers = proto.SetHeader(headers, []byte("Content-Length"), []byte(strconv.Itoa(len(body))))
+	return append(headers[:len(headers):len(headers)], body...)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/buger/goreplay/proto"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	protobuf "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// grpcTestDescriptorSet writes descriptor set of test.Echo service:
+//
+//	message EchoRequest { string text = 1; int32 count = 2; }
+//	message EchoReply { repeated string texts = 1; }
+//	service Echo { rpc Say(EchoRequest) returns (EchoReply); }
+func grpcTestDescriptorSet(t *testing.T) string {
+	field := func(name string, number int32, label descriptorpb.FieldDescriptorProto_Label, typ descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{Name: &name, Number: &number, Label: &label, Type: &typ, JsonName: &name}
+	}
+	optional, repeated := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL, descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:    protobuf.String("echo.proto"),
+		Package: protobuf.String("test"),
+		Syntax:  protobuf.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: protobuf.String("EchoRequest"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("text", 1, optional, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				field("count", 2, optional, descriptorpb.FieldDescriptorProto_TYPE_INT32),
+			},
+		}, {
+			Name:  protobuf.String("EchoReply"),
+			Field: []*descriptorpb.FieldDescriptorProto{field("texts", 1, repeated, descriptorpb.FieldDescriptorProto_TYPE_STRING)},
+		}},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: protobuf.String("Echo"),
+			Method: []*descriptorpb.MethodDescriptorProto{{
+				Name:       protobuf.String("Say"),
+				InputType:  protobuf.String(".test.EchoRequest"),
+				OutputType: protobuf.String(".test.EchoReply"),
+			}},
+		}},
+	}}}
+	data, err := protobuf.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, _ := ioutil.TempDir("", "gor-grpc")
+	path := filepath.Join(dir, "echo.protoset")
+	if err = ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// wire format of EchoRequest{text: "hi", count: 2} and EchoReply{texts: ["hi", "hi"]}
+var (
+	grpcTestRequest = []byte{0x0a, 0x02, 'h', 'i', 0x10, 0x02}
+	grpcTestReply   = []byte{0x0a, 0x02, 'h', 'i', 0x0a, 0x02, 'h', 'i'}
+)
+
+func TestGRPCCodec(t *testing.T) {
+	path := grpcTestDescriptorSet(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	codec, err := NewGRPCCodec(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := uuid()
+	body := proto.AppendGRPCFrame(nil, proto.GRPCFrame{Data: grpcTestRequest})
+	req := append([]byte("POST /test.Echo/Say HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/grpc\r\nContent-Length: 11\r\n\r\n"), body...)
+	reqMeta := payloadHeader(RequestPayload, id, 1, -1)
+
+	rendered := codec.Render(reqMeta, req)
+	expected := "POST /test.Echo/Say HTTP/1.1\r\nX-Gor-Grpc-Json: /test.Echo/Say\r\nHost: example.com\r\nContent-Type: application/grpc\r\nContent-Length: 25\r\n\r\n" +
+		`[{"text":"hi","count":2}]`
+	if string(rendered) != expected {
+		t.Errorf("Wrong rendered request:\n%q\nexpected:\n%q", rendered, expected)
+	}
+	if encoded := codec.Encode(reqMeta, rendered); !bytes.Equal(encoded, req) {
+		t.Errorf("Wrong encoded request:\n%q\nexpected:\n%q", encoded, req)
+	}
+
+	// response is decoded using method of request with the same id, trailers are kept
+	body = proto.AppendGRPCFrame(nil, proto.GRPCFrame{Data: grpcTestReply})
+	resp := []byte("HTTP/1.1 200 OK\r\nContent-Type: application/grpc\r\nTransfer-Encoding: chunked\r\nTrailer: Grpc-Status\r\n\r\nd\r\n" +
+		string(body) + "\r\n0\r\nGrpc-Status: 0\r\n\r\n")
+	respMeta := payloadHeader(ResponsePayload, id, 2, 1)
+	rendered = codec.Render(respMeta, resp)
+	if !strings.HasSuffix(string(rendered), "\r\n\r\n17\r\n"+`[{"texts":["hi","hi"]}]`+"\r\n0\r\nGrpc-Status: 0\r\n\r\n") {
+		t.Errorf("Wrong rendered response: %q", rendered)
+	}
+	if encoded := codec.Encode(respMeta, rendered); !bytes.Equal(encoded, resp) {
+		t.Errorf("Wrong encoded response:\n%q\nexpected:\n%q", encoded, resp)
+	}
+
+	if r := codec.Render(payloadHeader(ResponsePayload, uuid(), 2, 1), resp); !bytes.Equal(r, resp) {
+		t.Error("Response of unknown call should not be changed")
+	}
+	plain := []byte("GET / HTTP/1.1\r\n\r\n")
+	if r := codec.Render(reqMeta, plain); !bytes.Equal(r, plain) {
+		t.Error("Non gRPC payload should not be changed")
+	}
+}
+
+func TestGRPCOutput(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	input := NewTestInput()
+
+	server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.ProtoMajor != 2 || req.URL.Path != "/test.Echo/Say" || req.Header.Get("X-Request-Id") != "42" ||
+			!bytes.Equal(body, proto.AppendGRPCFrame(nil, proto.GRPCFrame{Data: grpcTestRequest})) {
+			t.Errorf("Wrong request: %s %s %v %q", req.Proto, req.URL, req.Header, body)
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write(proto.AppendGRPCFrame(nil, proto.GRPCFrame{Data: grpcTestReply}))
+		w.Header().Set("Grpc-Status", "0")
+	}), new(http2.Server)))
+	defer server.Close()
+
+	grpcOutput := NewGRPCOutput(strings.TrimPrefix(server.URL, "http://"), &HTTPOutputConfig{TrackResponses: true})
+	output := NewTestOutput(func(msg *Message) {
+		if msg.Meta[0] == ReplayedResponsePayload {
+			if !proto.IsGRPC(msg.Data) || string(proto.GRPCStatus(msg.Data)) != "0" {
+				t.Errorf("Wrong replayed response: %q", msg.Data)
+			}
+		}
+		wg.Done()
+	})
+
+	plugins := &InOutPlugins{
+		Inputs:  []PluginReader{input, grpcOutput},
+		Outputs: []PluginWriter{grpcOutput, output},
+	}
+	plugins.All = append(plugins.All, input, output, grpcOutput)
+
+	emitter := NewEmitter()
+	go emitter.Start(plugins, Settings.Middleware)
+
+	// request and replayed response
+	wg.Add(2)
+	input.EmitBytes(append([]byte("POST /test.Echo/Say HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/grpc\r\nTe: trailers\r\nX-Request-Id: 42\r\nContent-Length: 11\r\n\r\n"),
+		proto.AppendGRPCFrame(nil, proto.GRPCFrame{Data: grpcTestRequest})...))
+	wg.Wait()
+	emitter.Close()
+}
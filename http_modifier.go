@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/base64"
+	"fmt"
 	"hash/fnv"
 	"strings"
 
@@ -11,6 +12,7 @@ import (
 
 type HTTPModifier struct {
 	config *HTTPModifierConfig
+	route  string // used to label drop metrics
 }
 
 func NewHTTPModifier(config *HTTPModifierConfig) *HTTPModifier {
@@ -51,6 +53,7 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 		}
 
 		if !matched {
+			m.dropped("http-allow-method")
 			return
 		}
 	}
@@ -80,6 +83,7 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 		}
 
 		if !matched {
+			m.dropped("http-allow-url")
 			return
 		}
 	}
@@ -89,6 +93,7 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 
 		for _, f := range m.config.URLNegativeRegexp {
 			if f.regexp.Match(path) {
+				m.dropped("http-disallow-url " + f.regexp.String())
 				return
 			}
 		}
@@ -98,11 +103,8 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 		for _, f := range m.config.HeaderFilters {
 			value := proto.Header(payload, f.name)
 
-			if len(value) == 0 {
-				return
-			}
-
-			if !f.regexp.Match(value) {
+			if len(value) == 0 || !f.regexp.Match(value) {
+				m.dropped(fmt.Sprintf("http-allow-header %s: %s", f.name, f.regexp))
 				return
 			}
 		}
@@ -113,6 +115,7 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 			value := proto.Header(payload, f.name)
 
 			if len(value) > 0 && f.regexp.Match(value) {
+				m.dropped(fmt.Sprintf("http-disallow-header %s: %s", f.name, f.regexp))
 				return
 			}
 		}
@@ -128,6 +131,7 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 				if strings.Compare(valueString, trimmedBasicAuthEncoded) != 0 {
 					decodedAuth, _ := base64.StdEncoding.DecodeString(trimmedBasicAuthEncoded)
 					if !f.regexp.Match(decodedAuth) {
+						m.dropped("http-basic-auth-filter " + f.regexp.String())
 						return
 					}
 				}
@@ -144,6 +148,7 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 				hasher.Write(value)
 
 				if (hasher.Sum32() % 100) >= f.percent {
+					m.dropped(fmt.Sprintf("http-header-limiter %s:%d%%", f.name, f.percent))
 					return
 				}
 			}
@@ -159,6 +164,7 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 				hasher.Write(value)
 
 				if (hasher.Sum32() % 100) >= f.percent {
+					m.dropped(fmt.Sprintf("http-param-limiter %s:%d%%", f.name, f.percent))
 					return
 				}
 			}
@@ -194,3 +200,8 @@ func (m *HTTPModifier) Rewrite(payload []byte) (response []byte) {
 
 	return payload
 }
+
+// dropped counts request filtered out by the rule
+func (m *HTTPModifier) dropped(rule string) {
+	modifierDrops.With(m.route, rule).Inc()
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// values of requests still waiting for one of their responses, per session
+const maxPendingValues = 100
+
+// substitution extracts a value from responses, values extracted from captured responses are replaced
+// with values extracted from replayed ones in later requests of the session
+type substitution struct {
+	rule     string
+	jsonPath []string       // json:<path>, like json:data.token or json:items.0.id
+	header   string         // header:<name>:<regexp>, the first group, or the whole match, is the value
+	re       *regexp.Regexp // of header
+}
+
+func parseSubstitution(rule string) (*substitution, error) {
+	sub := &substitution{rule: rule}
+	switch {
+	case strings.HasPrefix(rule, "json:") && len(rule) > len("json:"):
+		sub.jsonPath = strings.Split(rule[len("json:"):], ".")
+	case strings.HasPrefix(rule, "header:"):
+		parts := strings.SplitN(rule[len("header:"):], ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("expected header:<name>:<regexp>, got %q", rule)
+		}
+		re, err := regexp.Compile(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		sub.header, sub.re = textproto.CanonicalMIMEHeaderKey(parts[0]), re
+	default:
+		return nil, fmt.Errorf("expected json:<path> or header:<name>:<regexp>, got %q", rule)
+	}
+	return sub, nil
+}
+
+// extract returns the value of the response, it should be decoded with prettifyHTTP
+func (sub *substitution) extract(resp []byte) string {
+	if sub.re != nil {
+		for _, v := range proto.ParseHeaders(resp)[sub.header] {
+			if m := sub.re.FindStringSubmatch(v); m != nil {
+				return m[len(m)-1]
+			}
+		}
+		return ""
+	}
+
+	d := json.NewDecoder(bytes.NewReader(proto.Body(resp)))
+	d.UseNumber()
+	var v interface{}
+	if d.Decode(&v) != nil {
+		return ""
+	}
+	for _, key := range sub.jsonPath {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = node[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return ""
+			}
+			v = node[i]
+		default:
+			return ""
+		}
+	}
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	return ""
+}
+
+// sessionState is the state of a replayed session: cookies set by replayed responses, and values of
+// captured responses with their replacements
+type sessionState struct {
+	cookieJar     bool
+	substitutions []*substitution
+
+	cookies map[string]string
+	values  map[string]string // captured value -> replayed value
+	pending map[string]*pendingValues
+	order   []string // ids of pending values, the oldest first
+}
+
+// pendingValues are values of a request which got only one of its captured and replayed responses
+type pendingValues struct {
+	captured, replayed []string
+}
+
+func newSessionState(cookieJar bool, substitutions []*substitution) *sessionState {
+	return &sessionState{
+		cookieJar:     cookieJar,
+		substitutions: substitutions,
+		cookies:       make(map[string]string),
+		values:        make(map[string]string),
+		pending:       make(map[string]*pendingValues),
+	}
+}
+
+// rewrite replaces captured values and cookies of the request with replayed ones
+func (s *sessionState) rewrite(req []byte) []byte {
+	if len(s.values) == 0 && len(s.cookies) == 0 {
+		return req
+	}
+	// headers are modified in place, captured messages are shared by outputs
+	req = append([]byte(nil), req...)
+	if len(s.values) > 0 {
+		req = s.substitute(req)
+	}
+	if len(s.cookies) > 0 {
+		req = s.setCookies(req)
+	}
+	return req
+}
+
+func (s *sessionState) substitute(req []byte) []byte {
+	pos := proto.MIMEHeadersEndPos(req)
+	if pos == -1 {
+		pos = len(req)
+	}
+	head, body := req[:pos], req[pos:]
+	chunked := bytes.Equal(proto.Header(req, []byte("Transfer-Encoding")), []byte("chunked"))
+	bodyChanged := false
+	for captured, replayed := range s.values {
+		head = bytes.Replace(head, []byte(captured), []byte(replayed), -1)
+		// sizes of chunks can't be fixed
+		if !chunked && bytes.Contains(body, []byte(captured)) {
+			body = bytes.Replace(body, []byte(captured), []byte(replayed), -1)
+			bodyChanged = true
+		}
+	}
+	if bodyChanged && len(proto.Header(head, []byte("Content-Length"))) > 0 {
+		head = proto.SetHeader(head, []byte("Content-Length"), []byte(strconv.Itoa(len(body))))
+	}
+	return append(head, body...)
+}
+
+// setCookies replaces values of cookies set by replayed responses, and adds the missing ones
+func (s *sessionState) setCookies(req []byte) []byte {
+	var pairs []string
+	seen := make(map[string]bool)
+	for _, pair := range strings.Split(string(proto.Header(req, []byte("Cookie"))), ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name := strings.SplitN(pair, "=", 2)[0]
+		if value, ok := s.cookies[name]; ok {
+			pair = name + "=" + value
+		}
+		seen[name] = true
+		pairs = append(pairs, pair)
+	}
+	for name, value := range s.cookies {
+		if !seen[name] {
+			pairs = append(pairs, name+"="+value)
+		}
+	}
+	return proto.SetHeader(req, []byte("Cookie"), []byte(strings.Join(pairs, "; ")))
+}
+
+// replayed updates the state with the replayed response of the request
+func (s *sessionState) replayed(id string, resp []byte) {
+	if s.cookieJar {
+		header := http.Header(proto.ParseHeaders(resp))
+		for _, c := range (&http.Response{Header: header}).Cookies() {
+			if c.MaxAge < 0 {
+				delete(s.cookies, c.Name)
+			} else {
+				s.cookies[c.Name] = c.Value
+			}
+		}
+	}
+	if len(s.substitutions) > 0 {
+		s.pair(id, nil, s.extract(resp))
+	}
+}
+
+// captured updates the state with the captured response of the request
+func (s *sessionState) captured(id string, resp []byte) {
+	if len(s.substitutions) > 0 {
+		s.pair(id, s.extract(resp), nil)
+	}
+}
+
+func (s *sessionState) extract(resp []byte) []string {
+	// decoded copy, so captured messages shared by outputs are not modified
+	resp = prettifyHTTP(append([]byte(nil), resp...))
+	values := make([]string, len(s.substitutions))
+	for i, sub := range s.substitutions {
+		values[i] = sub.extract(resp)
+	}
+	return values
+}
+
+// pair stores values of the captured response as aliases of values of the replayed one,
+// when both responses of the request are known
+func (s *sessionState) pair(id string, captured, replayed []string) {
+	p := s.pending[id]
+	if p == nil {
+		if len(s.pending) >= maxPendingValues {
+			// the oldest response is the one most likely to never come
+			delete(s.pending, s.order[0])
+			s.order = s.order[1:]
+		}
+		s.pending[id] = &pendingValues{captured, replayed}
+		s.order = append(s.order, id)
+		return
+	}
+	if captured == nil {
+		captured = p.captured
+	} else {
+		replayed = p.replayed
+	}
+	delete(s.pending, id)
+	for i, pending := range s.order {
+		if pending == id {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	for i := range captured {
+		if captured[i] != "" && replayed[i] != "" && captured[i] != replayed[i] {
+			s.values[captured[i]] = replayed[i]
+		}
+	}
+}
+
+// httpSessionClient replays a captured session over a single keep-alive connection
+type httpSessionClient struct {
+	o      *HTTPOutput
+	client *HTTPClient
+	state  *sessionState // nil without cookie jar and substitutions
+}
+
+func (o *HTTPOutput) newSessionClient() sessionClient {
+	config := *o.config
+	c := &httpSessionClient{o: o}
+	if o.config.CookieJar || len(o.config.substitutions) > 0 {
+		c.state = newSessionState(o.config.CookieJar, o.config.substitutions)
+		// replayed responses are needed to update the state
+		config.TrackResponses = true
+	}
+	c.client = NewHTTPClient(&config)
+	switch t := c.client.Client.Transport.(type) {
+	case nil:
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxConnsPerHost = 1
+		c.client.Client.Transport = transport
+	case *http.Transport:
+		t.MaxConnsPerHost = 1
+	}
+	return c
+}
+
+func (c *httpSessionClient) send(msg *Message) {
+	if c.state == nil {
+		c.o.sendRequest(c.client, msg)
+		return
+	}
+	id := string(payloadID(msg.Meta))
+	if !isRequestPayload(msg.Meta) {
+		c.state.captured(id, msg.Data)
+		return
+	}
+	req := &Message{Meta: msg.Meta, Data: c.state.rewrite(msg.Data)}
+	if resp := c.o.sendRequest(c.client, req); resp != nil {
+		c.state.replayed(id, resp)
+	}
+}
+
+func (c *httpSessionClient) close() {
+	c.client.Client.CloseIdleConnections()
+}
@@ -207,7 +207,7 @@ type FileInput struct {
 	exit        chan bool
 	path        string
 	readers     []*fileInputReader
-	speedFactor float64
+	speedFactor atomic.Value // float64, replaced when limit of the input is reloaded
 	loop        bool
 	readDepth   int
 	dryRun      bool
@@ -222,7 +222,7 @@ func NewFileInput(path string, loop bool, readDepth int, maxWait time.Duration,
 	i.data = make(chan []byte, 1000)
 	i.exit = make(chan bool)
 	i.path = path
-	i.speedFactor = 1
+	i.speedFactor.Store(float64(1))
 	i.loop = loop
 	i.readDepth = readDepth
 	i.stats = expvar.NewMap("file-" + path)
@@ -364,8 +364,8 @@ func (i *FileInput) emit() {
 				firstWait = diff
 			}
 
-			if i.speedFactor != 1 {
-				diff = int64(float64(diff) / i.speedFactor)
+			if speedFactor := i.speedFactor.Load().(float64); speedFactor != 1 {
+				diff = int64(float64(diff) / speedFactor)
 			}
 
 			if i.maxWait > 0 && diff > int64(i.maxWait) {
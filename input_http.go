@@ -1,27 +1,65 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync"
 	"time"
 )
 
-// HTTPInput used for sending requests to Gor via http
+// HTTPInputConfig input http configuration
+type HTTPInputConfig struct {
+	ProxyURL string `json:"input-http-proxy"` // upstream of reverse proxy mode, requests are answered with fake 200 if empty
+}
+
+// HTTPInput used for sending requests to Gor via http. In reverse proxy mode requests are forwarded
+// to the upstream, and both requests and original responses are emitted.
 type HTTPInput struct {
-	data     chan []byte
-	address  string
-	listener net.Listener
-	stop     chan bool // Channel used only to indicate goroutine should shutdown
+	data      chan *Message
+	address   string
+	listener  net.Listener
+	proxy     *httputil.ReverseProxy
+	bodyLimit int       // recorded part of proxied response bodies
+	stop      chan bool // Channel used only to indicate goroutine should shutdown
 }
 
+// proxyCall links the response of proxied request to its request
+type proxyCall struct {
+	id    []byte
+	start time.Time
+}
+
+type proxyCallKey struct{}
+
 // NewHTTPInput constructor for HTTPInput. Accepts address with port which it will listen on.
-func NewHTTPInput(address string) (i *HTTPInput) {
+func NewHTTPInput(address string, config *HTTPInputConfig) (i *HTTPInput) {
 	i = new(HTTPInput)
-	i.data = make(chan []byte, 1000)
+	i.data = make(chan *Message, 1000)
 	i.stop = make(chan bool)
 
+	if config.ProxyURL != "" {
+		upstream, err := url.Parse(config.ProxyURL)
+		if err != nil || upstream.Host == "" {
+			log.Fatalf("input-http-proxy: invalid upstream %q", config.ProxyURL)
+		}
+		i.proxy = httputil.NewSingleHostReverseProxy(upstream)
+		i.bodyLimit = int(Settings.CopyBufferSize)
+		i.proxy.ModifyResponse = i.response
+		i.proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			Debug(1, fmt.Sprintf("[INPUT-HTTP] upstream error: %q", err))
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}
+
 	i.listen(address)
 
 	return
@@ -29,14 +67,11 @@ func NewHTTPInput(address string) (i *HTTPInput) {
 
 // PluginRead reads message from this plugin
 func (i *HTTPInput) PluginRead() (*Message, error) {
-	var msg Message
 	select {
 	case <-i.stop:
 		return nil, ErrorStopped
-	case buf := <-i.data:
-		msg.Data = buf
-		msg.Meta = payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1)
-		return &msg, nil
+	case msg := <-i.data:
+		return msg, nil
 	}
 }
 
@@ -52,7 +87,126 @@ func (i *HTTPInput) handler(w http.ResponseWriter, r *http.Request) {
 
 	buf, _ := httputil.DumpRequestOut(r, true)
 	http.Error(w, http.StatusText(200), 200)
-	i.data <- buf
+	i.data <- &Message{
+		Meta: payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1),
+		Data: buf,
+	}
+}
+
+// forward emits the request as it was received, and passes it to the upstream.
+// Body is recorded while it is sent to the upstream, so it is not buffered as a whole.
+func (i *HTTPInput) forward(w http.ResponseWriter, r *http.Request) {
+	call := &proxyCall{id: uuid(), start: time.Now()}
+	meta := payloadHeader(RequestPayload, call.id, call.start.UnixNano(), -1)
+	body := &recordedBody{ReadCloser: r.Body, limit: i.bodyLimit, record: func(body *bytes.Buffer, truncated bool) {
+		req := *r
+		req.Body = ioutil.NopCloser(body)
+		if truncated {
+			req.Header = r.Header.Clone()
+			req.Header.Set("Content-Length", strconv.Itoa(body.Len()))
+			req.ContentLength = int64(body.Len())
+			req.TransferEncoding = nil
+		}
+		buf, err := httputil.DumpRequest(&req, true)
+		if err != nil {
+			Debug(1, fmt.Sprintf("[INPUT-HTTP] failed to record request: %q", err))
+			return
+		}
+		i.emit(&Message{Meta: meta, Data: buf})
+	}}
+	r.Body = body
+	if r.ContentLength == 0 {
+		// empty body is not sent to the upstream, the request is recorded before its response
+		body.Close()
+	}
+	i.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyCallKey{}, call)))
+	// the upstream may fail before the body is sent
+	body.Close()
+}
+
+// response emits the original response of the upstream, latency is the time until its headers were received.
+// Body is recorded while it is passed to the client, so streamed responses are not delayed.
+func (i *HTTPInput) response(resp *http.Response) error {
+	call, ok := resp.Request.Context().Value(proxyCallKey{}).(*proxyCall)
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	meta := payloadHeader(ResponsePayload, call.id, now.UnixNano(), now.Sub(call.start).Nanoseconds())
+	// body of switching protocols response is the upgraded connection
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		buf, err := httputil.DumpResponse(resp, false)
+		if err != nil {
+			return err
+		}
+		i.emit(&Message{Meta: meta, Data: buf})
+		return nil
+	}
+	resp.Body = &recordedBody{ReadCloser: resp.Body, limit: i.bodyLimit, record: func(body *bytes.Buffer, truncated bool) {
+		recorded := *resp
+		recorded.Body = ioutil.NopCloser(body)
+		if truncated {
+			recorded.ContentLength = int64(body.Len())
+			recorded.TransferEncoding = nil
+		}
+		buf, err := httputil.DumpResponse(&recorded, true)
+		if err != nil {
+			Debug(1, fmt.Sprintf("[INPUT-HTTP] failed to record response: %q", err))
+			return
+		}
+		i.emit(&Message{Meta: meta, Data: buf})
+	}}
+	return nil
+}
+
+// emit passes the message to the emitter without blocking, proxied traffic is not slowed down by outputs
+func (i *HTTPInput) emit(msg *Message) {
+	select {
+	case i.data <- msg:
+	default:
+		inputDropped.With(i.String()).Inc()
+		Debug(2, "[INPUT-HTTP] message dropped, input queue is full")
+	}
+}
+
+// recordedBody copies up to limit bytes of a request or response body, while it is read by the proxy.
+// Message is recorded when the body is closed, longer bodies are recorded truncated.
+type recordedBody struct {
+	io.ReadCloser
+	limit     int
+	record    func(body *bytes.Buffer, truncated bool)
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	truncated bool
+	recorded  bool
+}
+
+func (b *recordedBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.recorded {
+		return
+	}
+	if room := b.limit - b.buf.Len(); room < n {
+		b.buf.Write(p[:room])
+		b.truncated = true
+	} else {
+		b.buf.Write(p[:n])
+	}
+	return
+}
+
+// Close can be called more than once, the message is recorded only the first time
+func (b *recordedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.recorded {
+		b.recorded = true
+		b.record(&b.buf, b.truncated)
+	}
+	return err
 }
 
 func (i *HTTPInput) listen(address string) {
@@ -61,6 +215,11 @@ func (i *HTTPInput) listen(address string) {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/", i.handler)
+	var handler http.Handler = mux
+	if i.proxy != nil {
+		// paths are forwarded as they are, without cleaning and redirects of the mux
+		handler = http.HandlerFunc(i.forward)
+	}
 
 	i.listener, err = net.Listen("tcp", address)
 	if err != nil {
@@ -69,7 +228,7 @@ func (i *HTTPInput) listen(address string) {
 	i.address = i.listener.Addr().String()
 
 	go func() {
-		err = http.Serve(i.listener, mux)
+		err = http.Serve(i.listener, handler)
 		if err != nil && err != http.ErrServerClosed {
 			log.Fatal("HTTP input serve failure ", err)
 		}
@@ -77,5 +236,8 @@ func (i *HTTPInput) listen(address string) {
 }
 
 func (i *HTTPInput) String() string {
+	if i.proxy != nil {
+		return "HTTP proxy input: " + i.address
+	}
 	return "HTTP input: " + i.address
 }
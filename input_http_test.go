@@ -2,7 +2,11 @@ package main
 
 import (
 	"bytes"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -12,7 +16,7 @@ import (
 func TestHTTPInput(t *testing.T) {
 	wg := new(sync.WaitGroup)
 
-	input := NewHTTPInput("127.0.0.1:0")
+	input := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{})
 	time.Sleep(time.Millisecond)
 	output := NewTestOutput(func(*Message) {
 		wg.Done()
@@ -44,7 +48,7 @@ func TestInputHTTPLargePayload(t *testing.T) {
 	var large [n]byte
 	large[n-1] = '0'
 
-	input := NewHTTPInput("127.0.0.1:0")
+	input := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{})
 	output := NewTestOutput(func(msg *Message) {
 		_len := len(msg.Data)
 		if _len >= n { // considering http body CRLF
@@ -78,3 +82,131 @@ func TestInputHTTPLargePayload(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestHTTPInputProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Path", r.URL.RequestURI())
+		w.WriteHeader(http.StatusCreated)
+		w.Write(append([]byte("echo "), body...))
+	}))
+	defer upstream.Close()
+
+	input := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{ProxyURL: upstream.URL})
+	defer input.Close()
+
+	resp, err := http.Post("http://"+input.address+"//a/../b?q=1", "text/plain", strings.NewReader("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || string(body) != "echo ping" || resp.Header.Get("X-Path") != "//a/../b?q=1" {
+		t.Errorf("expected response of upstream, got %d %q %q", resp.StatusCode, body, resp.Header.Get("X-Path"))
+	}
+
+	req, _ := input.PluginRead()
+	res, _ := input.PluginRead()
+	if !isRequestPayload(req.Meta) || !bytes.HasPrefix(req.Data, []byte("POST //a/../b?q=1 HTTP/1.1")) || !bytes.HasSuffix(req.Data, []byte("ping")) {
+		t.Errorf("expected original request, got %q %q", req.Meta, req.Data)
+	}
+	reqMeta, resMeta := payloadMeta(req.Meta), payloadMeta(res.Meta)
+	if res.Meta[0] != ResponsePayload || !bytes.Equal(reqMeta[1], resMeta[1]) || !bytes.HasPrefix(res.Data, []byte("HTTP/1.1 201 Created")) || !bytes.HasSuffix(res.Data, []byte("echo ping")) {
+		t.Errorf("expected original response of the request, got %q %q", res.Meta, res.Data)
+	}
+	if latency, _ := strconv.ParseInt(string(resMeta[3]), 10, 64); latency <= 0 {
+		t.Errorf("expected latency of the response, got %q", resMeta[3])
+	}
+}
+
+func TestHTTPInputProxyRequestLimit(t *testing.T) {
+	received := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- string(body)
+	}))
+	defer upstream.Close()
+
+	input := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{ProxyURL: upstream.URL})
+	defer input.Close()
+	input.bodyLimit = 4
+
+	resp, err := http.Post("http://"+input.address+"/upload", "text/plain", strings.NewReader("ping pong"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if body := <-received; body != "ping pong" {
+		t.Errorf("expected whole body to be sent to the upstream, got %q", body)
+	}
+
+	req, _ := input.PluginRead()
+	if !isRequestPayload(req.Meta) || !bytes.Contains(req.Data, []byte("Content-Length: 4\r\n")) || !bytes.HasSuffix(req.Data, []byte("\r\n\r\nping")) {
+		t.Errorf("expected request truncated to body limit, got %q", req.Data)
+	}
+}
+
+func TestHTTPInputProxyStreaming(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: 1\n\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("data: 2\n\n"))
+	}))
+	defer upstream.Close()
+
+	input := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{ProxyURL: upstream.URL})
+	defer input.Close()
+	input.bodyLimit = 12
+
+	resp, err := http.Get("http://" + input.address + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	event := make([]byte, 9)
+	if _, err := io.ReadFull(resp.Body, event); err != nil || string(event) != "data: 1\n\n" {
+		t.Fatalf("expected first event before the response is complete, got %q %v", event, err)
+	}
+	close(release)
+	ioutil.ReadAll(resp.Body)
+
+	input.PluginRead()
+	res, _ := input.PluginRead()
+	if !bytes.HasPrefix(res.Data, []byte("HTTP/1.1 200 OK")) || !bytes.HasSuffix(res.Data, []byte("\r\n\r\ndata: 1\n\ndat")) {
+		t.Errorf("expected response truncated to body limit, got %q", res.Data)
+	}
+}
+
+func TestHTTPInputProxyDrop(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("pong"))
+	}))
+	defer upstream.Close()
+
+	input := NewHTTPInput("127.0.0.1:0", &HTTPInputConfig{ProxyURL: upstream.URL})
+	defer input.Close()
+	// nobody reads the input
+	input.data = make(chan *Message)
+	dropped := inputDropped.With(input.String())
+	before := dropped.Value()
+
+	resp, err := http.Get("http://" + input.address + "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "pong" {
+		t.Errorf("expected response of upstream, got %q", body)
+	}
+	// response is recorded when the proxy closes its body, after the client got it
+	for i := 0; i < 100 && dropped.Value()-before < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := dropped.Value() - before; n != 2 {
+		t.Errorf("expected request and response to be dropped, got %d", n)
+	}
+}
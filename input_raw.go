@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -27,9 +26,16 @@ type RAWInputConfig struct {
 	RealIPHeader    string             `json:"input-raw-realip-header"`
 	Stats           bool               `json:"input-raw-stats"`
 	AllowIncomplete bool               `json:"input-raw-allow-incomplete"`
+	TLSKeyLog       string             `json:"input-raw-tls-keylog"`
+	Decapsulate     bool               `json:"input-raw-decapsulate"`
+	VXLANPort       int                `json:"input-raw-vxlan-port"`
+	GenevePort      int                `json:"input-raw-geneve-port"`
+	MaxMemory       size.Size          `json:"input-raw-max-memory"`
+	MaxConnMemory   size.Size          `json:"input-raw-max-connection-memory"`
 	quit            chan bool          // Channel used only to indicate goroutine should shutdown
 	host            string
-	ports           []uint16
+	ports           tcp.Ports
+	hosts           []tcp.HostPorts // hosts with ports of their own, host and ports are empty then
 }
 
 // RAWInput used for intercepting traffic for given address
@@ -41,6 +47,7 @@ type RAWInput struct {
 	messageParser  *tcp.MessageParser
 	cancelListener context.CancelFunc
 	closed         bool
+	label          string // of metrics, the same as String()
 }
 
 // NewRAWInput constructor for RAWInput. Accepts raw input config as arguments.
@@ -49,33 +56,94 @@ func NewRAWInput(address string, config RAWInputConfig) (i *RAWInput) {
 	i.RAWInputConfig = config
 	i.quit = make(chan bool)
 
-	host, _ports, err := net.SplitHostPort(address)
+	host, ports, hosts, err := parseRAWAddress(address)
 	if err != nil {
 		log.Fatalf("input-raw: error while parsing address: %s", err)
 	}
 
-	var ports []uint16
-	if _ports != "" {
-		portsStr := strings.Split(_ports, ",")
-
-		for _, portStr := range portsStr {
-			port, err := strconv.Atoi(strings.TrimSpace(portStr))
-			if err != nil {
-				log.Fatalf("parsing port error: %v", err)
-			}
-			ports = append(ports, uint16(port))
-
-		}
-	}
-
 	i.host = host
 	i.ports = ports
+	i.hosts = hosts
+	i.label = i.String()
 
 	i.listen(address)
 
 	return
 }
 
+// parseRAWAddress parses comma separated host:port items. Ports can be ranges like 8000-8100 or * for all ports,
+// items prefixed with ! are excluded, and items without host belong to the host of the previous item, or of the
+// first item with host: ":8000-8100,9000,!:8080". Hosts with ports of their own should be IP addresses, they are
+// returned as hosts: "10.0.0.1:80,!:81,10.0.0.2:8080"
+func parseRAWAddress(address string) (host string, ports tcp.Ports, hosts []tcp.HostPorts, err error) {
+	var names []string
+	hostPorts := make(map[string]tcp.Ports)
+	var current string
+	var first tcp.Ports // ports which go before the first host
+	for _, item := range strings.Split(address, ",") {
+		item = strings.TrimSpace(item)
+		exclude := strings.HasPrefix(item, "!")
+		item = strings.TrimPrefix(item, "!")
+
+		var itemHost, port string
+		switch {
+		case capture.IsNamespaceTarget(item):
+			// namespace targets like pid:1234:80 contain colons themselves
+			itemHost = item
+			if pos := strings.LastIndexByte(item, ':'); pos > strings.IndexByte(item, ':') {
+				itemHost, port = item[:pos], item[pos+1:]
+			}
+		case strings.Contains(item, ":"):
+			if itemHost, port, err = net.SplitHostPort(item); err != nil {
+				return
+			}
+		default:
+			port = item
+		}
+		if itemHost != "" {
+			if _, ok := hostPorts[itemHost]; !ok {
+				names = append(names, itemHost)
+				hostPorts[itemHost] = nil
+			}
+			current = itemHost
+		}
+		if port == "" {
+			continue
+		}
+		if exclude {
+			port = "!" + port
+		}
+		var r tcp.Ports
+		if r, err = tcp.ParsePorts(port); err != nil {
+			return
+		}
+		if current == "" {
+			first = append(first, r...)
+		} else {
+			hostPorts[current] = append(hostPorts[current], r...)
+		}
+	}
+
+	switch len(names) {
+	case 0:
+		return "", first, nil, nil
+	case 1:
+		return names[0], append(first, hostPorts[names[0]]...), nil, nil
+	}
+	hostPorts[names[0]] = append(first, hostPorts[names[0]]...)
+	for _, name := range names {
+		ip := net.ParseIP(name)
+		if name == "localhost" {
+			ip = net.IPv4(127, 0, 0, 1)
+		}
+		if ip == nil {
+			return "", nil, nil, fmt.Errorf("%s and %s should be captured by separate --input-raw, only IP addresses can be captured together", names[0], name)
+		}
+		hosts = append(hosts, tcp.HostPorts{IP: ip, Ports: hostPorts[name]})
+	}
+	return "", nil, hosts, nil
+}
+
 // PluginRead reads meassage from this plugin
 func (i *RAWInput) PluginRead() (*Message, error) {
 	var msgTCP *tcp.Message
@@ -85,16 +153,29 @@ func (i *RAWInput) PluginRead() (*Message, error) {
 		return nil, ErrorStopped
 	case msgTCP = <-i.listener.Messages():
 		msg.Data = msgTCP.Data()
+		msg.packets = msgTCP.CapturedPackets()
 	}
 
 	var msgType byte = ResponsePayload
-	if msgTCP.Direction == tcp.DirIncoming {
+	switch {
+	case msgTCP.WebSocket && msgTCP.Direction == tcp.DirIncoming:
+		msgType = WebSocketFramePayload
+	case msgTCP.WebSocket:
+		msgType = WebSocketResponseFramePayload
+	case msgTCP.Direction == tcp.DirIncoming:
 		msgType = RequestPayload
 		if i.RealIPHeader != "" {
 			msg.Data = proto.SetHeader(msg.Data, []byte(i.RealIPHeader), []byte(msgTCP.SrcAddr))
 		}
 	}
 	msg.Meta = payloadHeader(msgType, msgTCP.UUID(), msgTCP.Start.UnixNano(), msgTCP.End.UnixNano()-msgTCP.Start.UnixNano())
+	// packets read from pcapng files may have interface names and comments
+	if ifi := msgTCP.Interface(); ifi != "" {
+		msg.Meta = appendPayloadMeta(msg.Meta, "interface", ifi)
+	}
+	for _, comment := range msgTCP.Comments() {
+		msg.Meta = appendPayloadMeta(msg.Meta, "comment", comment)
+	}
 
 	// to be removed....
 	if msgTCP.Truncated {
@@ -108,6 +189,7 @@ func (i *RAWInput) PluginRead() (*Message, error) {
 		stat := msgTCP.Stats
 		go i.addStats(stat)
 	}
+	i.observe(&msgTCP.Stats)
 	msgTCP = nil
 	return &msg, nil
 }
@@ -119,6 +201,20 @@ func (i *RAWInput) listen(address string) {
 		log.Fatal(err)
 	}
 	i.listener.SetPcapOptions(i.PcapOptions)
+	if i.hosts != nil {
+		i.listener.SetHosts(i.hosts)
+	}
+	if i.TLSKeyLog != "" {
+		keyLog, err := tcp.NewKeyLog(i.TLSKeyLog)
+		if err != nil {
+			log.Fatal("failed to read TLS key log: ", err)
+		}
+		i.listener.SetTLSKeyLog(keyLog)
+	}
+	i.listener.SetMemoryLimits(int(i.MaxMemory), int(i.MaxConnMemory), int(i.CopyBufferSize))
+	if i.Decapsulate {
+		i.listener.SetTunnels(tcp.Tunnels{VXLANPort: uint16(i.VXLANPort), GenevePort: uint16(i.GenevePort)})
+	}
 	err = i.listener.Activate()
 	if err != nil {
 		log.Fatal(err)
@@ -136,7 +232,34 @@ func (i *RAWInput) listen(address string) {
 }
 
 func (i *RAWInput) String() string {
-	return fmt.Sprintf("Intercepting traffic from: %s:%s", i.host, strings.Join(strings.Fields(fmt.Sprint(i.ports)), ","))
+	if i.hosts != nil {
+		addresses := make([]string, len(i.hosts))
+		for n, h := range i.hosts {
+			addresses[n] = fmt.Sprintf("%s:[%s]", h.IP, h.Ports)
+		}
+		return "Intercepting traffic from: " + strings.Join(addresses, ", ")
+	}
+	return fmt.Sprintf("Intercepting traffic from: %s:[%s]", i.host, i.ports)
+}
+
+// observe updates tcp message metrics
+func (i *RAWInput) observe(stats *tcp.Stats) {
+	label := i.label
+	direction := "response"
+	if stats.Direction == tcp.DirIncoming {
+		direction = "request"
+	}
+	tcpMessages.With(label, direction).Inc()
+	tcpMessageBytes.With(label, direction).Add(uint64(stats.Length))
+	if stats.TimedOut {
+		tcpTimedOutMessages.With(label).Inc()
+	}
+	if stats.Truncated {
+		tcpTruncatedMessages.With(label).Inc()
+	}
+	if stats.LostData > 0 {
+		tcpLostBytes.With(label).Add(uint64(stats.LostData))
+	}
 }
 
 // GetStats returns the stats so far and reset the stats
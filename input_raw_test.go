@@ -356,3 +356,42 @@ func BenchmarkRAWInputWithReplay(b *testing.B) {
 	b.ReportMetric(float64(replayCounter), "replayed")
 	emitter.Close()
 }
+
+func TestParseInputAddress(t *testing.T) {
+	cases := []struct {
+		address string
+		host    string
+		ports   string
+	}{
+		{":80", "", "80"},
+		{"127.0.0.1:80,8080", "127.0.0.1", "80,8080"},
+		{":8000-8100,9000,!:8080", "", "8000-8100,9000,!8080"},
+		{"eth0:*,!9090", "eth0", "*,!9090"},
+		{"[::1]:80,[::1]:443", "::1", "80,443"},
+		{"pid:1234:80-90", "pid:1234", "80-90"},
+		{"netns:/var/run/netns/web:80,!:81", "netns:/var/run/netns/web", "80,!81"},
+	}
+	for _, c := range cases {
+		host, ports, hosts, err := parseRAWAddress(c.address)
+		if err != nil || host != c.host || ports.String() != c.ports || hosts != nil {
+			t.Errorf("%s: expected %s %s, got %s %s %v", c.address, c.host, c.ports, host, ports, err)
+		}
+	}
+	for _, address := range []string{"10.0.0.1:80,eth0:80", ":80-", "localhost"} {
+		if _, _, _, err := parseRAWAddress(address); err == nil {
+			t.Errorf("%s should be invalid", address)
+		}
+	}
+
+	// hosts with different ports, ports without host belong to the previous host
+	host, ports, hosts, err := parseRAWAddress(":8000,10.0.0.1:80,!:81,[::1]:443,10.0.0.1:90")
+	if err != nil || host != "" || ports != nil || len(hosts) != 2 {
+		t.Fatalf("expected 2 hosts, got %s %s %v %v", host, ports, hosts, err)
+	}
+	if hosts[0].IP.String() != "10.0.0.1" || hosts[0].Ports.String() != "8000,80,!81,90" {
+		t.Errorf("wrong ports of first host: %s %s", hosts[0].IP, hosts[0].Ports)
+	}
+	if hosts[1].IP.String() != "::1" || hosts[1].Ports.String() != "443" {
+		t.Errorf("wrong ports of second host: %s %s", hosts[1].IP, hosts[1].Ports)
+	}
+}
@@ -6,12 +6,15 @@ import (
 	"math/rand"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 // Limiter is a wrapper for input or output plugin which adds rate limiting
 type Limiter struct {
+	mu        sync.Mutex
 	plugin    interface{}
+	options   string
 	limit     int
 	isPercent bool
 
@@ -35,19 +38,46 @@ func parseLimitOptions(options string) (limit int, isPercent bool) {
 // `options` allow to sprcify relatve or absolute limiting
 func NewLimiter(plugin interface{}, options string) PluginReadWriter {
 	l := new(Limiter)
-	l.limit, l.isPercent = parseLimitOptions(options)
 	l.plugin = plugin
 	l.currentTime = time.Now().UnixNano()
+	l.setOptions(options)
+
+	return l
+}
+
+func (l *Limiter) setOptions(options string) {
+	l.options = options
+	l.limit, l.isPercent = parseLimitOptions(options)
 
 	// FileInput have its own rate limiting. Unlike other inputs we not just dropping requests, we can slow down or speed up request emittion.
-	if fi, ok := l.plugin.(*FileInput); ok && l.isPercent {
-		fi.speedFactor = float64(l.limit) / float64(100)
+	if fi, ok := l.plugin.(*FileInput); ok {
+		speedFactor := float64(1)
+		if l.isPercent {
+			speedFactor = float64(l.limit) / float64(100)
+		}
+		fi.speedFactor.Store(speedFactor)
 	}
+}
 
-	return l
+// Reload changes limit of the running plugin, accepts the same options as NewLimiter
+func (l *Limiter) Reload(options string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.setOptions(options)
+	l.currentRPS = 0
+}
+
+func (l *Limiter) limitOptions() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.options
 }
 
 func (l *Limiter) isLimited() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
 	// File input have its own limiting algorithm
 	if _, ok := l.plugin.(*FileInput); ok && l.isPercent {
 		return false
@@ -99,7 +129,20 @@ func (l *Limiter) PluginRead() (msg *Message, err error) {
 	return
 }
 
+// unwrap returns plugin wrapped by Limiter and OverflowQueue
+func unwrap(plugin interface{}) interface{} {
+	switch p := plugin.(type) {
+	case *Limiter:
+		return unwrap(p.plugin)
+	case *OverflowQueue:
+		return unwrap(p.plugin)
+	}
+	return plugin
+}
+
 func (l *Limiter) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	return fmt.Sprintf("Limiting %s to: %d (isPercent: %v)", l.plugin, l.limit, l.isPercent)
 }
 
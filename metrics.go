@@ -0,0 +1,291 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metrics exposed in Prometheus text format on /metrics
+var (
+	inputMessages  = NewCounterVec("gor_input_messages_total", "Messages read from input.", "input")
+	inputDropped   = NewCounterVec("gor_input_dropped_total", "Messages input dropped, because they were not read in time.", "input")
+	outputMessages = NewCounterVec("gor_output_messages_total", "Messages passed to output.", "output")
+	outputErrors   = NewCounterVec("gor_output_errors_total", "Errors returned by output, including failed replays.", "output")
+	outputDropped  = NewCounterVec("gor_output_dropped_total", "Messages output failed to deliver, written to dead-letter output if configured.", "output")
+	modifierDrops  = NewCounterVec("gor_modifier_dropped_total", "Requests dropped by modifier rule.", "route", "rule")
+	replayLatency  = NewHistogramVec("gor_replay_latency_seconds", "Latency of replayed requests.",
+		[]float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}, "output")
+
+	tcpMessages          = NewCounterVec("gor_tcp_messages_total", "TCP messages reassembled by raw input.", "input", "direction")
+	tcpMessageBytes      = NewCounterVec("gor_tcp_message_bytes_total", "Payload bytes of TCP messages reassembled by raw input.", "input", "direction")
+	tcpTimedOutMessages  = NewCounterVec("gor_tcp_timed_out_messages_total", "TCP messages emitted before they were complete.", "input")
+	tcpTruncatedMessages = NewCounterVec("gor_tcp_truncated_messages_total", "TCP messages truncated because of size limit.", "input")
+	tcpLostBytes         = NewCounterVec("gor_tcp_lost_bytes_total", "Bytes lost in TCP messages reassembled by raw input.", "input")
+)
+
+func init() {
+	// stats collected by tcp and capture packages
+	registerMetric(&expvarMetric{mapName: "tcp", prefix: "gor_tcp_stats_"})
+	registerMetric(&expvarMetric{mapName: "raw", prefix: "gor_raw_stats_"})
+}
+
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+var registry struct {
+	sync.Mutex
+	metrics []metric
+}
+
+func registerMetric(m metric) {
+	registry.Lock()
+	registry.metrics = append(registry.metrics, m)
+	registry.Unlock()
+}
+
+// metricsHandler writes all registered metrics in Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	registry.Lock()
+	defer registry.Unlock()
+	for _, m := range registry.metrics {
+		m.writeTo(w)
+	}
+}
+
+// metricVec holds series of a metric family by their label values
+type metricVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.RWMutex
+	series map[string]interface{}
+}
+
+func (v *metricVec) get(values []string, create func() interface{}) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	v.mu.RLock()
+	s, ok := v.series[key]
+	v.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if s, ok = v.series[key]; !ok {
+		s = create()
+		v.series[key] = s
+	}
+	return s
+}
+
+// sorted returns series ordered by label values, to keep output stable
+func (v *metricVec) sorted() (keys []string, series []interface{}) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		series = append(series, v.series[k])
+	}
+	return
+}
+
+func (v *metricVec) writeHeader(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelPairs formats labels as name="value" pairs
+func labelPairs(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := labelEscaper.Replace(values[i])
+		pairs[i] = name + `="` + value + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprint(f)
+}
+
+// Counter is a single monotonically increasing value
+type Counter struct {
+	values []string
+	value  uint64
+}
+
+// Inc increments counter by 1
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+// Add increments counter by n
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+// Value returns current value of the counter
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// CounterVec is a family of counters with the same name and different label values
+type CounterVec struct {
+	metricVec
+}
+
+// NewCounterVec creates and registers a counter family
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{metricVec{name: name, help: help, labels: labels, series: make(map[string]interface{})}}
+	registerMetric(c)
+	return c
+}
+
+// With returns counter for the given label values, creating it if needed
+func (c *CounterVec) With(values ...string) *Counter {
+	return c.get(values, func() interface{} {
+		return &Counter{values: append([]string(nil), values...)}
+	}).(*Counter)
+}
+
+func (c *CounterVec) writeTo(w io.Writer) {
+	_, series := c.sorted()
+	if len(series) == 0 {
+		return
+	}
+	c.writeHeader(w, "counter")
+	for _, s := range series {
+		counter := s.(*Counter)
+		fmt.Fprintf(w, "%s{%s} %d\n", c.name, labelPairs(c.labels, counter.values), counter.Value())
+	}
+}
+
+// Histogram counts observations in configurable buckets
+type Histogram struct {
+	values  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Observe adds a single observation to the histogram
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// HistogramVec is a family of histograms with the same name and buckets and different label values
+type HistogramVec struct {
+	metricVec
+	buckets []float64
+}
+
+// NewHistogramVec creates and registers a histogram family, buckets are upper bounds in increasing order
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{metricVec{name: name, help: help, labels: labels, series: make(map[string]interface{})}, buckets}
+	registerMetric(h)
+	return h
+}
+
+// With returns histogram for the given label values, creating it if needed
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return h.get(values, func() interface{} {
+		return &Histogram{
+			values:  append([]string(nil), values...),
+			buckets: h.buckets,
+			counts:  make([]uint64, len(h.buckets)),
+		}
+	}).(*Histogram)
+}
+
+func (h *HistogramVec) writeTo(w io.Writer) {
+	_, series := h.sorted()
+	if len(series) == 0 {
+		return
+	}
+	h.writeHeader(w, "histogram")
+	for _, s := range series {
+		hist := s.(*Histogram)
+		labels := labelPairs(h.labels, hist.values)
+		if labels != "" {
+			labels += ","
+		}
+
+		hist.mu.Lock()
+		for i, upper := range hist.buckets {
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", h.name, labels, formatFloat(upper), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", h.name, labels, hist.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", h.name, strings.TrimSuffix(labels, ","), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, strings.TrimSuffix(labels, ","), hist.count)
+		hist.mu.Unlock()
+	}
+}
+
+// expvarMetric exposes numeric values of an expvar map as untyped metrics
+type expvarMetric struct {
+	mapName string
+	prefix  string
+}
+
+func (e *expvarMetric) writeTo(w io.Writer) {
+	m, ok := expvar.Get(e.mapName).(*expvar.Map)
+	if !ok {
+		return
+	}
+	m.Do(func(kv expvar.KeyValue) {
+		var value string
+		switch v := kv.Value.(type) {
+		case *expvar.Int:
+			value = fmt.Sprint(v.Value())
+		case *expvar.Float:
+			value = formatFloat(v.Value())
+		default:
+			return
+		}
+		name := e.prefix + metricName(kv.Key)
+		fmt.Fprintf(w, "# TYPE %s untyped\n%s %s\n", name, name, value)
+	})
+}
+
+// metricName replaces characters not allowed in metric names
+func metricName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	counter := &CounterVec{metricVec{name: "test_total", help: "Test counter.", labels: []string{"name"}, series: make(map[string]interface{})}}
+	counter.With(`b "quoted"`).Add(2)
+	counter.With("a").Inc()
+
+	hist := &HistogramVec{metricVec{name: "test_seconds", help: "Test histogram.", labels: []string{"name"}, series: make(map[string]interface{})}, []float64{0.1, 1}}
+	hist.With("a").Observe(0.05)
+	hist.With("a").Observe(0.5)
+	hist.With("a").Observe(5)
+
+	var b strings.Builder
+	counter.writeTo(&b)
+	hist.writeTo(&b)
+
+	expected := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{name="a"} 1
+test_total{name="b \"quoted\""} 2
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{name="a",le="0.1"} 1
+test_seconds_bucket{name="a",le="1"} 2
+test_seconds_bucket{name="a",le="+Inf"} 3
+test_seconds_sum{name="a"} 5.55
+test_seconds_count{name="a"} 3
+`
+	if b.String() != expected {
+		t.Errorf("Wrong metrics output:\n%s", b.String())
+	}
+}
+
+func TestEmitterMetrics(t *testing.T) {
+	wg := new(sync.WaitGroup)
+
+	input := NewTestInput()
+	output := NewTestOutput(func(*Message) {
+		wg.Done()
+	})
+
+	modifier, _ := NewModifierConfig(map[string]stringList{"http-disallow-url": {"^/drop"}})
+	plugins := &InOutPlugins{
+		Inputs:  []PluginReader{input},
+		Outputs: []PluginWriter{output},
+		Routes: []*Route{
+			{Name: "metrics", Inputs: []PluginReader{input}, Outputs: []PluginWriter{output}, Modifiers: []*HTTPModifierConfig{modifier}},
+		},
+	}
+	plugins.All = append(plugins.All, input, output)
+
+	read := inputMessages.With(input.String()).Value()
+	written := outputMessages.With("Test Output").Value()
+
+	emitter := NewEmitter()
+	emitter.Start(plugins, "")
+
+	wg.Add(1)
+	input.EmitBytes([]byte("GET /drop HTTP/1.1\r\n\r\n"))
+	input.EmitGET()
+	wg.Wait()
+	emitter.Close()
+
+	if n := inputMessages.With(input.String()).Value() - read; n != 2 {
+		t.Errorf("Expected 2 read messages, got %d", n)
+	}
+	if n := outputMessages.With("Test Output").Value() - written; n != 1 {
+		t.Errorf("Expected 1 written message, got %d", n)
+	}
+	if n := modifierDrops.With("metrics", "http-disallow-url ^/drop").Value(); n != 1 {
+		t.Errorf("Expected 1 dropped message, got %d", n)
+	}
+
+	rec := httptest.NewRecorder()
+	metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), `gor_modifier_dropped_total{route="metrics",rule="http-disallow-url ^/drop"} 1`) {
+		t.Errorf("Dropped requests should be exposed:\n%s", rec.Body.String())
+	}
+}
@@ -85,6 +85,9 @@ func (m *Middleware) copy(to io.Writer, from PluginReader) {
 		if Settings.PrettifyHTTP {
 			buf = prettifyHTTP(msg.Data)
 		}
+		if grpcCodec != nil {
+			buf = grpcCodec.Render(msg.Meta, buf)
+		}
 		dstLen := (len(buf)+len(msg.Meta))*2 + 1
 		// if enough space was previously allocated use it instead
 		if dstLen > len(dst) {
@@ -122,6 +125,9 @@ func (m *Middleware) read(from io.Reader) {
 		}
 		var msg Message
 		msg.Meta, msg.Data = payloadMetaWithBody(buf)
+		if grpcCodec != nil {
+			msg.Data = grpcCodec.Encode(msg.Meta, msg.Data)
+		}
 		select {
 		case <-m.stop:
 			return
@@ -14,6 +14,7 @@ type BinaryOutputConfig struct {
 	BufferSize     size.Size     `json:"output-tcp-response-buffer"`
 	Debug          bool          `json:"output-binary-debug"`
 	TrackResponses bool          `json:"output-binary-track-response"`
+	Retry          *RetryConfig  // shared by outputs, nil disables retries
 }
 
 // BinaryOutput plugin manage pool of workers which send request to replayed server
@@ -24,10 +25,13 @@ type BinaryOutput struct {
 	// alignment. atomic.* functions crash on 32bit machines if operand is not
 	// aligned at 64bit. See https://github.com/golang/go/issues/599
 	activeWorkers int64
+	pending       int64 // requests written to the queue which are not sent yet
 	address       string
 	queue         chan *Message
 	responses     chan response
 	needWorker    chan int
+	sessions      *sessionWorkers // replay of captured TCP sessions
+	retrier       *retrier
 	quit          chan struct{}
 	config        *BinaryOutputConfig
 	queueStats    *GorStat
@@ -45,6 +49,12 @@ func NewBinaryOutput(address string, config *BinaryOutputConfig) PluginReadWrite
 	o.responses = make(chan response, 1000)
 	o.needWorker = make(chan int, 1)
 	o.quit = make(chan struct{})
+	o.retrier = newRetrier(o.String(), o.config.Retry)
+
+	if Settings.RecognizeTCPSessions {
+		o.sessions = newSessionWorkers(o.String(), cap(o.queue), o.config.Workers, o.newSessionClient)
+		return o
+	}
 
 	// Initial workers count
 	if o.config.Workers == 0 {
@@ -87,6 +97,7 @@ func (o *BinaryOutput) startWorker() {
 		select {
 		case msg := <-o.queue:
 			o.sendRequest(client, msg)
+			atomic.AddInt64(&o.pending, -1)
 			deathCount = 0
 		case <-time.After(time.Millisecond * 100):
 			// When dynamic scaling enabled workers die after 2s of inactivity
@@ -114,7 +125,12 @@ func (o *BinaryOutput) PluginWrite(msg *Message) (n int, err error) {
 	if !isRequestPayload(msg.Meta) {
 		return len(msg.Data), nil
 	}
+	if o.sessions != nil {
+		o.sessions.write(msg)
+		return len(msg.Data) + len(msg.Meta), nil
+	}
 
+	atomic.AddInt64(&o.pending, 1)
 	o.queue <- msg
 
 	if o.config.Workers == 0 {
@@ -150,12 +166,29 @@ func (o *BinaryOutput) sendRequest(client *TCPClient, msg *Message) {
 
 	uuid := payloadID(msg.Meta)
 
-	start := time.Now()
-	resp, err := client.Send(msg.Data)
-	stop := time.Now()
-
+	var resp []byte
+	var start, stop time.Time
+	send := func() (err error) {
+		start = time.Now()
+		resp, err = client.Send(msg.Data)
+		stop = time.Now()
+
+		if err != nil {
+			outputErrors.With(o.String()).Inc()
+			Debug(1, "Request error:", err)
+		} else {
+			replayLatency.With(o.String()).Observe(stop.Sub(start).Seconds())
+		}
+		return err
+	}
+	var err error
+	if o.retrier != nil {
+		err = o.retrier.do(send)
+	} else {
+		err = send()
+	}
 	if err != nil {
-		Debug(1, "Request error:", err)
+		deadLetter(o.String(), msg, err)
 	}
 
 	if o.config.TrackResponses {
@@ -163,6 +196,47 @@ func (o *BinaryOutput) sendRequest(client *TCPClient, msg *Message) {
 	}
 }
 
+// binarySessionClient replays a captured session over a single connection
+type binarySessionClient struct {
+	o      *BinaryOutput
+	client *TCPClient
+}
+
+func (o *BinaryOutput) newSessionClient() sessionClient {
+	client := NewTCPClient(o.address, &TCPClientConfig{
+		Debug:              o.config.Debug,
+		Timeout:            o.config.Timeout,
+		ResponseBufferSize: int(o.config.BufferSize),
+	})
+	return &binarySessionClient{o, client}
+}
+
+func (c *binarySessionClient) send(msg *Message) {
+	c.o.sendRequest(c.client, msg)
+}
+
+func (c *binarySessionClient) close() {
+	c.client.Disconnect()
+}
+
+// QueueStats returns number of queued requests, requests in flight and active workers
+func (o *BinaryOutput) QueueStats() QueueStats {
+	stats := QueueStats{
+		Queue:    len(o.queue),
+		Capacity: cap(o.queue),
+		Workers:  int(atomic.LoadInt64(&o.activeWorkers)),
+		InFlight: len(o.responses),
+	}
+	if pending := int(atomic.LoadInt64(&o.pending)) - stats.Queue; pending > 0 {
+		stats.InFlight += pending
+	}
+	if o.sessions != nil {
+		stats.Workers = o.sessions.len()
+		stats.InFlight += o.sessions.queued()
+	}
+	return stats
+}
+
 func (o *BinaryOutput) String() string {
 	return "Binary output: " + o.address
 }
@@ -170,5 +244,11 @@ func (o *BinaryOutput) String() string {
 // Close closes this plugin for reading
 func (o *BinaryOutput) Close() error {
 	close(o.quit)
+	if o.sessions != nil {
+		o.sessions.close()
+	}
+	if o.retrier != nil {
+		o.retrier.close()
+	}
 	return nil
 }
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/textproto"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/byteutils"
+	"github.com/buger/goreplay/proto"
+)
+
+// DiffOutputConfig holds configuration of the response diff output
+type DiffOutputConfig struct {
+	IgnoreHeaders MultiOption   `json:"output-diff-ignore-header"`
+	IgnoreBody    bool          `json:"output-diff-ignore-body"`
+	Timeout       time.Duration `json:"output-diff-timeout"`
+	StatsMs       int           `json:"output-diff-stats-ms"`
+	ReportAll     bool          `json:"output-diff-all"`
+}
+
+// DiffHeader describes a header which differs between original and replayed response
+type DiffHeader struct {
+	Name     string `json:"name"`
+	Original string `json:"original"`
+	Replayed string `json:"replayed"`
+}
+
+// DiffBody describes a body difference between original and replayed response
+type DiffBody struct {
+	OriginalLength  int `json:"original_length"`
+	ReplayedLength  int `json:"replayed_length"`
+	FirstDifference int `json:"first_difference"`
+}
+
+// DiffResult is a single line of the diff output file
+type DiffResult struct {
+	ID              string       `json:"id"`
+	Request         string       `json:"request,omitempty"`
+	Match           bool         `json:"match"`
+	OriginalStatus  int          `json:"original_status"`
+	ReplayedStatus  int          `json:"replayed_status"`
+	OriginalLatency int64        `json:"original_latency"`
+	ReplayedLatency int64        `json:"replayed_latency"`
+	Headers         []DiffHeader `json:"headers,omitempty"`
+	Body            *DiffBody    `json:"body,omitempty"`
+}
+
+// diffStats holds counters printed in the console summary
+type diffStats struct {
+	compared        int
+	matched         int
+	statusMismatch  int
+	headerMismatch  int
+	bodyMismatch    int
+	missingOriginal int
+	missingReplayed int
+	reported        int
+}
+
+type diffPair struct {
+	request  []byte
+	original *Message
+	replayed *Message
+	seen     time.Time
+}
+
+// DiffOutput pairs original responses (captured with --input-raw-track-response) with
+// replayed responses (produced with --output-http-track-response) by request ID,
+// and reports status code, header and body differences.
+type DiffOutput struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	writer  *bufio.Writer
+	config  *DiffOutputConfig
+	ignore  map[string]bool
+	pending map[string]*diffPair
+	stats   diffStats
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewDiffOutput constructor for DiffOutput, accepts path of the JSONL report
+func NewDiffOutput(path string, config *DiffOutputConfig) *DiffOutput {
+	o := new(DiffOutput)
+	o.path = path
+	o.config = config
+
+	if o.config.Timeout <= 0 {
+		o.config.Timeout = 10 * time.Second
+	}
+	if o.config.StatsMs <= 0 {
+		o.config.StatsMs = 5000
+	}
+
+	o.ignore = make(map[string]bool)
+	for _, name := range config.IgnoreHeaders {
+		o.ignore[textproto.CanonicalMIMEHeaderKey(name)] = true
+	}
+
+	var err error
+	o.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0660)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("[OUTPUT-DIFF] cannot open file %q: %s", path, err))
+	}
+	o.writer = bufio.NewWriter(o.file)
+
+	o.pending = make(map[string]*diffPair)
+	o.stop = make(chan struct{})
+	o.done = make(chan struct{})
+
+	go o.loop()
+
+	return o
+}
+
+// PluginWrite collects requests, original and replayed responses
+func (o *DiffOutput) PluginWrite(msg *Message) (n int, err error) {
+	meta := payloadMeta(msg.Meta)
+	if len(meta) < 2 {
+		return len(msg.Data), nil
+	}
+	id := string(meta[1])
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	pair, ok := o.pending[id]
+	if !ok {
+		pair = &diffPair{seen: time.Now()}
+		o.pending[id] = pair
+	}
+
+	switch msg.Meta[0] {
+	case RequestPayload:
+		pair.request = requestTitle(msg.Data)
+	case ResponsePayload:
+		pair.original = copyMessage(msg)
+	case ReplayedResponsePayload:
+		pair.replayed = copyMessage(msg)
+	}
+
+	if pair.original != nil && pair.replayed != nil {
+		delete(o.pending, id)
+		err = o.write(o.compare(id, pair))
+	}
+
+	return len(msg.Data) + len(msg.Meta), err
+}
+
+// copyMessage protects stored messages from being modified by other plugins
+func copyMessage(msg *Message) *Message {
+	return &Message{
+		Meta: append([]byte(nil), msg.Meta...),
+		Data: append([]byte(nil), msg.Data...),
+	}
+}
+
+func requestTitle(payload []byte) []byte {
+	if i := bytes.Index(payload, proto.CRLF); i > 0 {
+		// strip protocol version
+		if j := bytes.LastIndexByte(payload[:i], ' '); j > 0 {
+			i = j
+		}
+		return append([]byte(nil), payload[:i]...)
+	}
+	return nil
+}
+
+func (o *DiffOutput) compare(id string, pair *diffPair) *DiffResult {
+	res := &DiffResult{ID: id, Request: string(pair.request)}
+
+	original := prettifyHTTP(pair.original.Data)
+	replayed := prettifyHTTP(pair.replayed.Data)
+
+	res.OriginalStatus, _ = strconv.Atoi(byteutils.SliceToString(proto.Status(original)))
+	res.ReplayedStatus, _ = strconv.Atoi(byteutils.SliceToString(proto.Status(replayed)))
+	res.OriginalLatency = payloadLatency(pair.original.Meta)
+	res.ReplayedLatency = payloadLatency(pair.replayed.Meta)
+
+	o.stats.compared++
+	res.Match = true
+
+	if res.OriginalStatus != res.ReplayedStatus {
+		res.Match = false
+		o.stats.statusMismatch++
+	}
+
+	res.Headers = o.compareHeaders(proto.ParseHeaders(original), proto.ParseHeaders(replayed))
+	if len(res.Headers) > 0 {
+		res.Match = false
+		o.stats.headerMismatch++
+	}
+
+	if !o.config.IgnoreBody {
+		if body := compareBody(proto.Body(original), proto.Body(replayed)); body != nil {
+			res.Body = body
+			res.Match = false
+			o.stats.bodyMismatch++
+		}
+	}
+
+	if res.Match {
+		o.stats.matched++
+	}
+
+	return res
+}
+
+func (o *DiffOutput) compareHeaders(original, replayed textproto.MIMEHeader) (diff []DiffHeader) {
+	names := make(map[string]bool)
+	for name := range original {
+		names[name] = true
+	}
+	for name := range replayed {
+		names[name] = true
+	}
+
+	for name := range names {
+		if o.ignore[name] {
+			continue
+		}
+		ov, rv := joinHeader(original[name]), joinHeader(replayed[name])
+		if ov != rv {
+			diff = append(diff, DiffHeader{Name: name, Original: ov, Replayed: rv})
+		}
+	}
+
+	sort.Slice(diff, func(i, j int) bool { return diff[i].Name < diff[j].Name })
+	return
+}
+
+func joinHeader(values []string) string {
+	var b bytes.Buffer
+	for i, v := range values {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(v)
+	}
+	return b.String()
+}
+
+func compareBody(original, replayed []byte) *DiffBody {
+	if bytes.Equal(original, replayed) {
+		return nil
+	}
+
+	first := 0
+	for first < len(original) && first < len(replayed) && original[first] == replayed[first] {
+		first++
+	}
+
+	return &DiffBody{
+		OriginalLength:  len(original),
+		ReplayedLength:  len(replayed),
+		FirstDifference: first,
+	}
+}
+
+func payloadLatency(payload []byte) int64 {
+	meta := payloadMeta(payload)
+	if len(meta) < 4 {
+		return 0
+	}
+	latency, _ := strconv.ParseInt(byteutils.SliceToString(meta[3]), 10, 64)
+	return latency
+}
+
+func (o *DiffOutput) write(res *DiffResult) error {
+	if res.Match && !o.config.ReportAll {
+		return nil
+	}
+
+	line, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	_, err = o.writer.Write(line)
+	return err
+}
+
+func (o *DiffOutput) loop() {
+	defer close(o.done)
+
+	expire := time.NewTicker(time.Second)
+	defer expire.Stop()
+	report := time.NewTicker(time.Duration(o.config.StatsMs) * time.Millisecond)
+	defer report.Stop()
+
+	for {
+		select {
+		case <-o.stop:
+			return
+		case now := <-expire.C:
+			o.mu.Lock()
+			o.expire(now)
+			o.writer.Flush()
+			o.mu.Unlock()
+		case <-report.C:
+			o.mu.Lock()
+			if o.stats.compared != o.stats.reported {
+				o.stats.reported = o.stats.compared
+				Debug(0, "[OUTPUT-DIFF]", o.summary())
+			}
+			o.mu.Unlock()
+		}
+	}
+}
+
+// expire drops pairs which did not get both responses in time
+func (o *DiffOutput) expire(now time.Time) {
+	for id, pair := range o.pending {
+		if now.Sub(pair.seen) < o.config.Timeout {
+			continue
+		}
+		if pair.original == nil && pair.replayed != nil {
+			o.stats.missingOriginal++
+		}
+		if pair.replayed == nil && pair.original != nil {
+			o.stats.missingReplayed++
+		}
+		delete(o.pending, id)
+	}
+}
+
+func (o *DiffOutput) summary() string {
+	return fmt.Sprintf("compared: %d, matched: %d, status mismatch: %d, header mismatch: %d, body mismatch: %d, missing original: %d, missing replayed: %d",
+		o.stats.compared, o.stats.matched, o.stats.statusMismatch, o.stats.headerMismatch, o.stats.bodyMismatch,
+		o.stats.missingOriginal, o.stats.missingReplayed)
+}
+
+func (o *DiffOutput) String() string {
+	return "Diff output: " + o.path
+}
+
+// Close flushes the report and prints the final summary
+func (o *DiffOutput) Close() error {
+	select {
+	case <-o.stop:
+		return nil
+	default:
+	}
+	close(o.stop)
+	<-o.done
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	Debug(0, "[OUTPUT-DIFF]", o.summary())
+	o.writer.Flush()
+	return o.file.Close()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDiffOutput(t *testing.T) {
+	f, err := ioutil.TempFile("", "gor_diff_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	output := NewDiffOutput(f.Name(), &DiffOutputConfig{IgnoreHeaders: MultiOption{"date"}})
+
+	emit := func(payloadType byte, id []byte, data string) {
+		meta := payloadHeader(payloadType, id, time.Now().UnixNano(), 10)
+		output.PluginWrite(&Message{Meta: meta, Data: []byte(data)})
+	}
+
+	// same responses, only ignored header differs
+	id := uuid()
+	emit(RequestPayload, id, "GET /same HTTP/1.1\r\n\r\n")
+	emit(ResponsePayload, id, "HTTP/1.1 200 OK\r\nDate: Mon, 01 Jan 2001 00:00:00 GMT\r\nContent-Length: 2\r\n\r\nok")
+	emit(ReplayedResponsePayload, id, "HTTP/1.1 200 OK\r\nDate: Tue, 02 Jan 2001 00:00:00 GMT\r\nContent-Length: 2\r\n\r\nok")
+
+	// status, header and body differ
+	id = uuid()
+	emit(RequestPayload, id, "POST /diff HTTP/1.1\r\nContent-Length: 0\r\n\r\n")
+	emit(ReplayedResponsePayload, id, "HTTP/1.1 500 Internal Server Error\r\nX-Version: 2\r\nContent-Length: 4\r\n\r\nfail")
+	emit(ResponsePayload, id, "HTTP/1.1 200 OK\r\nX-Version: 1\r\nContent-Length: 2\r\n\r\nok")
+
+	output.Close()
+
+	file, _ := os.Open(f.Name())
+	defer file.Close()
+
+	var results []DiffResult
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var res DiffResult
+		if err := json.Unmarshal(scanner.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, res)
+	}
+
+	if len(results) != 1 {
+		t.Fatalf("expected 1 difference, got %d", len(results))
+	}
+
+	res := results[0]
+	if res.ID != string(id) || res.Request != "POST /diff" || res.Match {
+		t.Errorf("wrong result: %+v", res)
+	}
+	if res.OriginalStatus != 200 || res.ReplayedStatus != 500 {
+		t.Errorf("wrong statuses: %d %d", res.OriginalStatus, res.ReplayedStatus)
+	}
+	if len(res.Headers) != 2 || res.Headers[0].Name != "Content-Length" || res.Headers[1].Name != "X-Version" {
+		t.Errorf("wrong headers diff: %+v", res.Headers)
+	}
+	if res.Body == nil || res.Body.OriginalLength != 2 || res.Body.ReplayedLength != 4 || res.Body.FirstDifference != 0 {
+		t.Errorf("wrong body diff: %+v", res.Body)
+	}
+
+	if output.stats.compared != 2 || output.stats.matched != 1 {
+		t.Errorf("wrong stats: %s", output.summary())
+	}
+}
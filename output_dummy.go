@@ -19,8 +19,12 @@ func NewDummyOutput() (di *DummyOutput) {
 func (i *DummyOutput) PluginWrite(msg *Message) (int, error) {
 	var n, nn int
 	var err error
+	data := msg.Data
+	if grpcCodec != nil {
+		data = grpcCodec.Render(msg.Meta, data)
+	}
 	n, err = os.Stdout.Write(msg.Meta)
-	nn, err = os.Stdout.Write(msg.Data)
+	nn, err = os.Stdout.Write(data)
 	n += nn
 	nn, err = os.Stdout.Write(payloadSeparatorAsBytes)
 	n += nn
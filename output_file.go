@@ -59,6 +59,12 @@ type FileOutputConfig struct {
 	onClose           func(string)
 }
 
+// fileEncoder writes messages in format other than the default one, like pcap
+type fileEncoder interface {
+	encode(msg *Message) (n int, err error)
+	flush() error
+}
+
 // FileOutput output plugin
 type FileOutput struct {
 	sync.RWMutex
@@ -73,6 +79,8 @@ type FileOutput struct {
 	closed          bool
 	currentFileSize int
 	totalFileSize   size.Size
+	newEncoder      func(io.Writer) (fileEncoder, error) // called for every new file, if set
+	encoder         fileEncoder
 
 	config *FileOutputConfig
 }
@@ -240,15 +248,25 @@ func (o *FileOutput) PluginWrite(msg *Message) (n int, err error) {
 			log.Fatal(o, "Cannot open file %q. Error: %s", o.currentName, err)
 		}
 
+		if o.newEncoder != nil {
+			if o.encoder, err = o.newEncoder(o.writer); err != nil {
+				log.Fatal(o, "Cannot write header of file %q. Error: %s", o.currentName, err)
+			}
+		}
+
 		o.QueueLength = 0
 	}
 
-	var nn int
-	n, err = o.writer.Write(msg.Meta)
-	nn, err = o.writer.Write(msg.Data)
-	n += nn
-	nn, err = o.writer.Write(payloadSeparatorAsBytes)
-	n += nn
+	if o.encoder != nil {
+		n, err = o.encoder.encode(msg)
+	} else {
+		var nn int
+		n, err = o.writer.Write(msg.Meta)
+		nn, err = o.writer.Write(msg.Data)
+		n += nn
+		nn, err = o.writer.Write(payloadSeparatorAsBytes)
+		n += nn
+	}
 
 	o.totalFileSize += size.Size(n)
 	o.currentFileSize += n
@@ -273,6 +291,9 @@ func (o *FileOutput) flush() {
 	defer o.Unlock()
 
 	if o.file != nil {
+		if o.encoder != nil {
+			o.encoder.flush()
+		}
 		if strings.HasSuffix(o.currentName, ".gz") {
 			o.writer.(*gzip.Writer).Flush()
 		} else {
@@ -293,6 +314,9 @@ func (o *FileOutput) String() string {
 
 func (o *FileOutput) closeLocked() error {
 	if o.file != nil {
+		if o.encoder != nil {
+			o.encoder.flush()
+		}
 		if strings.HasSuffix(o.currentName, ".gz") {
 			o.writer.(*gzip.Writer).Close()
 		} else {
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strings"
+)
+
+// GRPCOutput replays gRPC calls over HTTP/2, with prior knowledge for http:// (default) addresses and with TLS for https://.
+// Captured headers, including call metadata, are sent unchanged, and replayed responses include trailers with grpc-status.
+// It uses the same options as HTTP output.
+type GRPCOutput struct {
+	*HTTPOutput
+}
+
+// NewGRPCOutput constructor for GRPCOutput
+func NewGRPCOutput(address string, config *HTTPOutputConfig) PluginReadWriter {
+	conf := *config
+	conf.http2 = true
+	// gRPC does not use redirects
+	conf.RedirectLimit = 0
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	return &GRPCOutput{newHTTPOutput(address, &conf)}
+}
+
+func (o *GRPCOutput) String() string {
+	return "gRPC output: " + o.config.rawURL
+}
@@ -5,8 +5,11 @@ import (
 	"bytes"
 	"crypto/tls"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"math"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -14,6 +17,7 @@ import (
 	"time"
 
 	"github.com/buger/goreplay/size"
+	"golang.org/x/net/http2"
 )
 
 const (
@@ -44,8 +48,13 @@ type HTTPOutputConfig struct {
 	WorkerTimeout  time.Duration `json:"output-http-worker-timeout"`
 	BufferSize     size.Size     `json:"output-http-response-buffer"`
 	SkipVerify     bool          `json:"output-http-skip-verify"`
+	CookieJar      bool          `json:"output-http-cookie-jar"`
+	Substitute     MultiOption   `json:"output-http-substitute"`
 	rawURL         string
 	url            *url.URL
+	http2          bool // send requests over HTTP/2, used by gRPC output
+	substitutions  []*substitution
+	Retry          *RetryConfig // shared by outputs, nil disables retries
 }
 
 // HTTPOutput plugin manage pool of workers which send request to replayed server
@@ -53,10 +62,13 @@ type HTTPOutputConfig struct {
 // You can specify maximum number of workers using `--output-http-workers`
 type HTTPOutput struct {
 	activeWorkers int32
+	pending       int32 // requests written to the queue which are not sent yet
 	config        *HTTPOutputConfig
 	queueStats    *GorStat
 	elasticSearch *ESPlugin
 	client        *HTTPClient
+	sessions      *sessionWorkers // replay of captured TCP sessions
+	retrier       *retrier
 	stopWorker    chan struct{}
 	queue         chan *Message
 	responses     chan *response
@@ -66,6 +78,10 @@ type HTTPOutput struct {
 // NewHTTPOutput constructor for HTTPOutput
 // Initialize workers
 func NewHTTPOutput(address string, config *HTTPOutputConfig) PluginReadWriter {
+	return newHTTPOutput(address, config)
+}
+
+func newHTTPOutput(address string, config *HTTPOutputConfig) *HTTPOutput {
 	o := new(HTTPOutput)
 	var err error
 	config.url, err = url.Parse(address)
@@ -120,7 +136,23 @@ func NewHTTPOutput(address string, config *HTTPOutputConfig) PluginReadWriter {
 		o.elasticSearch = new(ESPlugin)
 		o.elasticSearch.Init(o.config.ElasticSearch)
 	}
+	for _, rule := range o.config.Substitute {
+		sub, err := parseSubstitution(rule)
+		if err != nil {
+			log.Fatal(fmt.Sprintf("[OUTPUT-HTTP] invalid substitution: %q", err))
+		}
+		o.config.substitutions = append(o.config.substitutions, sub)
+	}
 	o.client = NewHTTPClient(o.config)
+	o.retrier = newRetrier(o.String(), o.config.Retry)
+	// state of sessions is kept by their workers
+	if Settings.RecognizeTCPSessions || o.config.CookieJar || len(o.config.substitutions) > 0 {
+		max := o.config.WorkersMax
+		if max == math.MaxInt32 {
+			max = 0
+		}
+		o.sessions = newSessionWorkers(o.String(), o.config.QueueLen, max, o.newSessionClient)
+	}
 	o.activeWorkers += int32(o.config.WorkersMin)
 	for i := 0; i < o.config.WorkersMin; i++ {
 		go o.startWorker()
@@ -163,18 +195,30 @@ func (o *HTTPOutput) startWorker() {
 			return
 		case msg := <-o.queue:
 			o.sendRequest(o.client, msg)
+			atomic.AddInt32(&o.pending, -1)
 		}
 	}
 }
 
 // PluginWrite writes message to this plugin
 func (o *HTTPOutput) PluginWrite(msg *Message) (n int, err error) {
+	if o.sessions != nil && o.config.substitutions != nil && msg.Meta[0] == ResponsePayload {
+		// captured responses are paired with replayed ones for substitutions
+		o.sessions.write(msg)
+		return len(msg.Data) + len(msg.Meta), nil
+	}
 	if !isRequestPayload(msg.Meta) {
 		return len(msg.Data), nil
 	}
+	if o.sessions != nil {
+		o.sessions.write(msg)
+		return len(msg.Data) + len(msg.Meta), nil
+	}
 
+	atomic.AddInt32(&o.pending, 1)
 	select {
 	case <-o.stop:
+		atomic.AddInt32(&o.pending, -1)
 		return 0, ErrorStopped
 	case o.queue <- msg:
 	}
@@ -211,23 +255,45 @@ func (o *HTTPOutput) PluginRead() (*Message, error) {
 	return &msg, nil
 }
 
-func (o *HTTPOutput) sendRequest(client *HTTPClient, msg *Message) {
+// sendRequest returns the replayed response, if the client tracks responses
+func (o *HTTPOutput) sendRequest(client *HTTPClient, msg *Message) []byte {
 	if !isRequestPayload(msg.Meta) {
-		return
+		return nil
 	}
 
 	uuid := payloadID(msg.Meta)
-	start := time.Now()
-	resp, err := client.Send(msg.Data)
-	stop := time.Now()
-
+	var resp []byte
+	var start, stop time.Time
+	send := func() error {
+		var status int
+		var err error
+		start = time.Now()
+		status, resp, err = client.send(msg.Data)
+		stop = time.Now()
+		if err != nil {
+			outputErrors.With(o.String()).Inc()
+			Debug(1, fmt.Sprintf("[HTTP-OUTPUT] error when sending: %q", err))
+			return err
+		}
+		if o.retrier != nil && retryStatus(status) {
+			return errRetriable{status}
+		}
+		return nil
+	}
+	var err error
+	if o.retrier != nil {
+		err = o.retrier.do(send)
+	} else {
+		err = send()
+	}
 	if err != nil {
-		Debug(1, fmt.Sprintf("[HTTP-OUTPUT] error when sending: %q", err))
-		return
+		deadLetter(o.String(), msg, err)
 	}
+
 	if resp == nil {
-		return
+		return nil
 	}
+	replayLatency.With(o.String()).Observe(stop.Sub(start).Seconds())
 
 	if o.config.TrackResponses {
 		o.responses <- &response{resp, uuid, start.UnixNano(), stop.UnixNano() - start.UnixNano()}
@@ -236,6 +302,25 @@ func (o *HTTPOutput) sendRequest(client *HTTPClient, msg *Message) {
 	if o.elasticSearch != nil {
 		o.elasticSearch.ResponseAnalyze(msg.Data, resp, start, stop)
 	}
+	return resp
+}
+
+// QueueStats returns number of queued requests, requests in flight and active workers
+func (o *HTTPOutput) QueueStats() QueueStats {
+	stats := QueueStats{
+		Queue:    len(o.queue),
+		Capacity: cap(o.queue),
+		Workers:  int(atomic.LoadInt32(&o.activeWorkers)),
+		InFlight: len(o.responses),
+	}
+	if pending := int(atomic.LoadInt32(&o.pending)) - stats.Queue; pending > 0 {
+		stats.InFlight += pending
+	}
+	if o.sessions != nil {
+		stats.Workers = o.sessions.len()
+		stats.InFlight += o.sessions.queued()
+	}
+	return stats
 }
 
 func (o *HTTPOutput) String() string {
@@ -246,6 +331,12 @@ func (o *HTTPOutput) String() string {
 func (o *HTTPOutput) Close() error {
 	close(o.stop)
 	close(o.stopWorker)
+	if o.sessions != nil {
+		o.sessions.close()
+	}
+	if o.retrier != nil {
+		o.retrier.close()
+	}
 	return nil
 }
 
@@ -279,23 +370,43 @@ func NewHTTPClient(config *HTTPOutputConfig) *HTTPClient {
 		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 		client.Client.Transport = transport
 	}
+	if config.http2 {
+		useTLS := config.url.Scheme == "https"
+		client.Client.Transport = &http2.Transport{
+			// with http scheme connection uses HTTP/2 with prior knowledge
+			AllowHTTP:       true,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: config.SkipVerify},
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				if useTLS {
+					return tls.Dial(network, addr, cfg)
+				}
+				return net.Dial(network, addr)
+			},
+		}
+	}
 
 	return client
 }
 
 // Send sends an http request using client create by NewHTTPClient
 func (c *HTTPClient) Send(data []byte) ([]byte, error) {
+	_, resp, err := c.send(data)
+	return resp, err
+}
+
+// send returns status of the response as well
+func (c *HTTPClient) send(data []byte) (int, []byte, error) {
 	var req *http.Request
 	var resp *http.Response
 	var err error
 
 	req, err = http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
 	if err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 	// we don't send CONNECT or OPTIONS request
 	if req.Method == http.MethodConnect {
-		return nil, nil
+		return 0, nil, nil
 	}
 
 	if !c.config.OriginalHost {
@@ -317,11 +428,19 @@ func (c *HTTPClient) Send(data []byte) ([]byte, error) {
 
 	resp, err = c.Client.Do(req)
 	if err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 	if c.config.TrackResponses {
-		return httputil.DumpResponse(resp, true)
+		if c.config.http2 {
+			// the same format as captured HTTP/2 responses, chunked encoding keeps trailers
+			resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+			resp.TransferEncoding = []string{"chunked"}
+		}
+		dump, err := httputil.DumpResponse(resp, true)
+		return resp.StatusCode, dump, err
 	}
+	// the body is read, so the connection is kept alive for next requests
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
 	_ = resp.Body.Close()
-	return nil, nil
+	return resp.StatusCode, nil, nil
 }
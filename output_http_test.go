@@ -1,12 +1,15 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	_ "net/http/httputil"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestHTTPOutput(t *testing.T) {
@@ -139,8 +142,29 @@ func TestHTTPOutputSessions(t *testing.T) {
 	input := NewTestInput()
 	input.skipHeader = true
 
+	// requests of a session should come in order, one at a time, over one connection
+	var mu sync.Mutex
+	next := map[string]int{}
+	conns := map[string]string{}
+	active := map[string]bool{}
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		wg.Done()
+		defer wg.Done()
+		var session string
+		var i int
+		fmt.Sscanf(req.URL.Path, "/%1s/%d", &session, &i)
+		mu.Lock()
+		if active[session] || next[session] != i || (conns[session] != "" && conns[session] != req.RemoteAddr) {
+			t.Errorf("session %s: request %d on %s, expected %d on %s", session, i, req.RemoteAddr, next[session], conns[session])
+		}
+		active[session] = true
+		next[session] = i + 1
+		conns[session] = req.RemoteAddr
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		active[session] = false
+		mu.Unlock()
 	}))
 	defer server.Close()
 
@@ -157,28 +181,163 @@ func TestHTTPOutputSessions(t *testing.T) {
 	go emitter.Start(plugins, Settings.Middleware)
 
 	uuid1 := []byte("1234567890123456789a0000")
-	uuid2 := []byte("1234567890123456789d0000")
+	uuid2 := []byte("1234567890123457789d0000")
 
 	for i := 0; i < 10; i++ {
-		wg.Add(1) // OPTIONS should be ignored
+		wg.Add(2)
 		copy(uuid1[20:], randByte(4))
-		input.EmitBytes([]byte("1 " + string(uuid1) + " 1\n" + "GET / HTTP/1.1\r\n\r\n"))
-	}
-
-	for i := 0; i < 10; i++ {
-		wg.Add(1) // OPTIONS should be ignored
+		input.EmitBytes([]byte("1 " + string(uuid1) + " 1\n" + fmt.Sprintf("GET /a/%d HTTP/1.1\r\n\r\n", i)))
 		copy(uuid2[20:], randByte(4))
-		input.EmitBytes([]byte("1 " + string(uuid2) + " 1\n" + "GET / HTTP/1.1\r\n\r\n"))
+		input.EmitBytes([]byte("1 " + string(uuid2) + " 1\n" + fmt.Sprintf("GET /b/%d HTTP/1.1\r\n\r\n", i)))
 	}
 
 	wg.Wait()
 
+	if conns["a"] == conns["b"] {
+		t.Error("sessions should be replayed over separate connections")
+	}
+	if stats := output.(*HTTPOutput).QueueStats(); stats.Workers != 2 {
+		t.Errorf("expected a worker per session, got %d", stats.Workers)
+	}
+
 	emitter.Close()
 
 	Settings.RecognizeTCPSessions = false
 	Settings.SplitOutput = false
 }
 
+// blockingSessionClient sends requests to a channel, and waits for release
+type blockingSessionClient struct {
+	sent    chan *Message
+	release chan struct{}
+}
+
+func (c blockingSessionClient) send(msg *Message) {
+	c.sent <- msg
+	<-c.release
+}
+
+func (c blockingSessionClient) close() {}
+
+func TestSessionWorkersClose(t *testing.T) {
+	var mu sync.Mutex
+	var lost []string
+	setDLQ(NewTestOutput(func(msg *Message) {
+		mu.Lock()
+		lost = append(lost, string(msg.Data))
+		mu.Unlock()
+	}))
+	defer setDLQ(nil)
+
+	client := blockingSessionClient{make(chan *Message, 1), make(chan struct{})}
+	workers := newSessionWorkers("Session workers close", 10, 0, func() sessionClient { return client })
+	uuid := []byte("1234567890123456789a0000")
+	write := func(data string) {
+		workers.write(&Message{Meta: payloadHeader(RequestPayload, uuid, 1, -1), Data: []byte(data)})
+	}
+	write("0")
+	write("1")
+	write("2")
+	// the first request is being sent, the rest are queued
+	<-client.sent
+	workers.close()
+	write("3")
+	close(client.release)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(lost, ","); got != "1,2,3" {
+		t.Errorf("expected requests which were not sent in dead-letter output, got %q", got)
+	}
+}
+
+func TestHTTPOutputSessionState(t *testing.T) {
+	wg := new(sync.WaitGroup)
+
+	// every login gets a new session cookie and token, which later requests should use
+	var mu sync.Mutex
+	var logins int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer wg.Done()
+		mu.Lock()
+		defer mu.Unlock()
+		if req.URL.Path == "/login" {
+			logins++
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: fmt.Sprintf("replayed-%d", logins)})
+			fmt.Fprintf(w, `{"data": {"token": "token-%d"}}`, logins)
+			return
+		}
+		expected := fmt.Sprintf("replayed-%d", logins)
+		if c, err := req.Cookie("sid"); err != nil || c.Value != expected {
+			t.Errorf("%s: expected cookie %s, got %v", req.URL.Path, expected, c)
+		}
+		if c, err := req.Cookie("theme"); err != nil || c.Value != "dark" {
+			t.Errorf("%s: other cookies should be kept, got %v", req.URL.Path, c)
+		}
+		expected = fmt.Sprintf("Bearer token-%d", logins)
+		if auth := req.Header.Get("Authorization"); auth != expected {
+			t.Errorf("%s: expected %q, got %q", req.URL.Path, expected, auth)
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.Method == http.MethodPost && string(body) != fmt.Sprintf(`{"token":"token-%d"}`, logins) {
+			t.Errorf("%s: token in body should be replaced, got %s", req.URL.Path, body)
+		}
+	}))
+	defer server.Close()
+
+	output := newHTTPOutput(server.URL, &HTTPOutputConfig{CookieJar: true, Substitute: MultiOption{"json:data.token"}})
+	defer output.Close()
+
+	uuid := []byte("1234567890123456789a0000")
+	write := func(kind byte, id, data string) {
+		copy(uuid[20:], id)
+		output.PluginWrite(&Message{Meta: payloadHeader(kind, uuid, 1, -1), Data: []byte(data)})
+	}
+	wg.Add(3)
+	write(RequestPayload, "0001", "POST /login HTTP/1.1\r\nContent-Length: 0\r\n\r\n")
+	write(ResponsePayload, "0001", "HTTP/1.1 200 OK\r\nSet-Cookie: sid=captured\r\nContent-Length: 31\r\n\r\n{\"data\": {\"token\": \"captured\"}}")
+	write(RequestPayload, "0002", "GET /me HTTP/1.1\r\nCookie: theme=dark; sid=captured\r\nAuthorization: Bearer captured\r\n\r\n")
+	write(RequestPayload, "0003", "POST /orders HTTP/1.1\r\nCookie: theme=dark\r\nAuthorization: Bearer captured\r\nContent-Length: 20\r\n\r\n{\"token\":\"captured\"}")
+	wg.Wait()
+
+	for _, rule := range []string{"json:", "header:Location", "header:Location:(", "xpath://a"} {
+		if _, err := parseSubstitution(rule); err == nil {
+			t.Errorf("%q should be invalid", rule)
+		}
+	}
+}
+
+func TestSessionStatePending(t *testing.T) {
+	sub, _ := parseSubstitution("json:token")
+	state := newSessionState(false, []*substitution{sub})
+	response := func(token string) []byte {
+		return []byte(fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n{\"token\":\"%s\"}", len(token)+12, token))
+	}
+
+	// replayed responses of the first requests never come
+	for i := 0; i < maxPendingValues+10; i++ {
+		state.captured(fmt.Sprint("lost-", i), response(fmt.Sprint("lost-", i)))
+	}
+	state.captured("recent", response("captured"))
+	for i := 0; i < maxPendingValues-1; i++ {
+		state.captured(fmt.Sprint("later-", i), response(fmt.Sprint("later-", i)))
+	}
+	if len(state.pending) != maxPendingValues || len(state.order) != maxPendingValues {
+		t.Fatalf("expected %d pending values, got %d %d", maxPendingValues, len(state.pending), len(state.order))
+	}
+	if _, ok := state.pending["lost-0"]; ok {
+		t.Error("the oldest pending values should be evicted")
+	}
+
+	state.replayed("recent", response("replayed"))
+	if state.values["captured"] != "replayed" {
+		t.Errorf("recent pending values should be kept, got %v", state.values)
+	}
+	if len(state.order) != maxPendingValues-1 {
+		t.Errorf("paired values should not be pending, got %d", len(state.order))
+	}
+}
+
 func BenchmarkHTTPOutput(b *testing.B) {
 	wg := new(sync.WaitGroup)
 
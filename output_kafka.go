@@ -59,6 +59,9 @@ func NewKafkaOutput(address string, config *OutputKafkaConfig, tlsConfig *KafkaT
 func (o *KafkaOutput) ErrorHandler() {
 	for err := range o.producer.Errors() {
 		Debug(1, "Failed to write access log entry:", err)
+		if msg, ok := err.Msg.Metadata.(*Message); ok {
+			deadLetter(o.String(), msg, err.Err)
+		}
 	}
 }
 
@@ -94,7 +97,13 @@ func (o *KafkaOutput) PluginWrite(msg *Message) (n int, err error) {
 	o.producer.Input() <- &sarama.ProducerMessage{
 		Topic: o.config.Topic,
 		Value: message,
+		// failed messages are passed to dead-letter output
+		Metadata: msg,
 	}
 
 	return len(message), nil
 }
+
+func (o *KafkaOutput) String() string {
+	return "Kafka output: " + o.config.Host + "/" + o.config.Topic
+}
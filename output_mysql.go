@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// replayed sessions without commands for this time are closed
+const mysqlSessionIdle = 5 * time.Minute
+
+// capabilities requested by the output, when handshake of the session was not captured
+const mysqlOutputCapabilities = proto.MySQLClientLongPassword | proto.MySQLClientLongFlag | proto.MySQLClientProtocol41 |
+	proto.MySQLClientTransactions | proto.MySQLClientSecureConnection | proto.MySQLClientMultiStatements |
+	proto.MySQLClientMultiResults | proto.MySQLClientPSMultiResults | proto.MySQLClientPluginAuth
+
+// capabilities of captured sessions which are not requested: encryption, compression and file access
+const mysqlOutputSkipCapabilities = proto.MySQLClientSSL | proto.MySQLClientCompress | proto.MySQLClientLocalFiles |
+	proto.MySQLClientConnectAttrs
+
+var errMySQLAuth = errors.New("unsupported authentication method")
+
+// MySQLOutputConfig struct for holding MySQL output configuration
+type MySQLOutputConfig struct {
+	Timeout        time.Duration `json:"output-mysql-timeout"`
+	TrackResponses bool          `json:"output-mysql-track-response"`
+	QueueLen       int           `json:"output-mysql-queue-len"`
+}
+
+// MySQLOutput replays MySQL commands captured with --input-raw-protocol mysql. Every captured connection
+// gets its own connection to the target, and its commands are sent over it in the original order, so the
+// selected database, transactions and prepared statements are kept. Credentials are taken from the address.
+type MySQLOutput struct {
+	address  string
+	config   *MySQLOutputConfig
+	host     string
+	user     string
+	password string
+	database string
+
+	mu        sync.Mutex
+	sessions  map[string]*mysqlSession
+	responses chan *response
+	stop      chan bool // Channel used only to indicate goroutine should shutdown
+}
+
+// mysqlSession is a replayed MySQL connection
+type mysqlSession struct {
+	id       string
+	messages chan *Message // commands, and captured responses used to map ids of prepared statements
+
+	conn         net.Conn
+	r            *bufio.Reader
+	deprecateEOF bool
+	prepared     map[string]uint32 // replayed statement ids by UUID of the prepare command
+	stmts        map[uint32]uint32 // replayed statement ids by the captured ones
+	unmapped     []uint32          // replayed statements whose captured ids are not known
+}
+
+// NewMySQLOutput constructor for MySQLOutput
+func NewMySQLOutput(address string, config *MySQLOutputConfig) PluginReadWriter {
+	o := new(MySQLOutput)
+	if !strings.Contains(address, "://") {
+		address = "mysql://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil || u.Scheme != "mysql" {
+		log.Fatal(fmt.Sprintf("[OUTPUT-MYSQL] invalid MySQL output address %q", address))
+	}
+	o.host = u.Host
+	if u.Port() == "" {
+		o.host = net.JoinHostPort(u.Hostname(), "3306")
+	}
+	o.user = u.User.Username()
+	o.password, _ = u.User.Password()
+	o.database = strings.TrimPrefix(u.Path, "/")
+
+	if config.Timeout <= 0 {
+		config.Timeout = 5 * time.Second
+	}
+	if config.QueueLen <= 0 {
+		config.QueueLen = 1000
+	}
+	if u.User != nil {
+		// do not log the password
+		u.User = url.User(o.user)
+	}
+	o.address = u.String()
+	o.config = config
+	o.sessions = make(map[string]*mysqlSession)
+	o.responses = make(chan *response, config.QueueLen)
+	o.stop = make(chan bool)
+	return o
+}
+
+// PluginWrite writes message to this plugin
+func (o *MySQLOutput) PluginWrite(msg *Message) (n int, err error) {
+	n = len(msg.Data) + len(msg.Meta)
+	if !isOriginPayload(msg.Meta) {
+		return
+	}
+
+	id := sessionID(payloadID(msg.Meta))
+	var handshake *proto.MySQLHandshakeResponse
+	if isRequestPayload(msg.Meta) {
+		if seq, ok := proto.MySQLPackets(msg.Data); ok && seq == 1 {
+			if h, ok := proto.ParseMySQLHandshakeResponse(msg.Data[4:]); ok {
+				handshake = &h
+			}
+		}
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	s := o.sessions[id]
+	if s == nil && handshake == nil && !isRequestPayload(msg.Meta) {
+		return
+	}
+	if s == nil || handshake != nil {
+		if s != nil {
+			// connection with the same ports was reopened
+			close(s.messages)
+		}
+		s = &mysqlSession{id: id, messages: make(chan *Message, o.config.QueueLen)}
+		o.sessions[id] = s
+		go o.replay(s, handshake, msg)
+	}
+	if handshake != nil {
+		return
+	}
+	select {
+	case s.messages <- msg:
+	default:
+		// session is waiting for its connection, or the target is too slow
+		outputErrors.With(o.String()).Inc()
+		deadLetter(o.String(), msg, "session queue is full")
+		Debug(1, "[OUTPUT-MYSQL] command dropped, session queue is full", id)
+	}
+	return
+}
+
+// replay opens connection of the session and sends its commands. Sessions whose handshake was not
+// captured connect with the database of the output address.
+func (o *MySQLOutput) replay(s *mysqlSession, handshake *proto.MySQLHandshakeResponse, login *Message) {
+	defer o.closeSession(s)
+
+	start := time.Now()
+	resp, err := o.connect(s, handshake)
+	if err != nil {
+		outputErrors.With(o.String()).Inc()
+		Debug(1, fmt.Sprintf("[OUTPUT-MYSQL] failed to open session: %q", err))
+	} else if handshake != nil && o.config.TrackResponses {
+		o.emitResponse(payloadID(login.Meta), start, resp)
+	}
+
+	idle := time.NewTimer(mysqlSessionIdle)
+	defer idle.Stop()
+	for {
+		var msg *Message
+		var ok bool
+		select {
+		case <-o.stop:
+			return
+		case <-idle.C:
+			return
+		case msg, ok = <-s.messages:
+			if !ok {
+				return
+			}
+		}
+		idle.Reset(mysqlSessionIdle)
+
+		if s.conn == nil {
+			// commands of failed session are dropped
+			if isRequestPayload(msg.Meta) {
+				outputErrors.With(o.String()).Inc()
+				deadLetter(o.String(), msg, "session connection failed")
+			}
+			continue
+		}
+		if !isRequestPayload(msg.Meta) {
+			s.mapStatement(payloadID(msg.Meta), msg.Data)
+			continue
+		}
+		if err = o.send(s, msg); err != nil {
+			outputErrors.With(o.String()).Inc()
+			deadLetter(o.String(), msg, err)
+			Debug(1, fmt.Sprintf("[OUTPUT-MYSQL] error when sending command: %q", err))
+			return
+		}
+		if len(msg.Data) > 4 && msg.Data[4] == proto.MySQLComQuit {
+			return
+		}
+	}
+}
+
+// send sends the command and reads its response
+func (o *MySQLOutput) send(s *mysqlSession, msg *Message) error {
+	n, seq, ok := proto.MySQLPacket(msg.Data)
+	if !ok || seq != 0 || n == 0 || len(msg.Data) < 4+n {
+		// LOCAL INFILE is not requested, so its data is not sent
+		return nil
+	}
+	data := msg.Data
+	command := data[4]
+	switch command {
+	case proto.MySQLComStmtExecute, proto.MySQLComStmtSendLongData, proto.MySQLComStmtClose, proto.MySQLComStmtReset, proto.MySQLComStmtFetch:
+		if n >= 5 {
+			data = append([]byte(nil), data...)
+			captured := binary.LittleEndian.Uint32(data[5:])
+			binary.LittleEndian.PutUint32(data[5:], s.statement(captured))
+			if command == proto.MySQLComStmtClose {
+				delete(s.stmts, captured)
+			}
+		}
+	}
+
+	start := time.Now()
+	s.conn.SetDeadline(start.Add(o.config.Timeout))
+	if _, err := s.conn.Write(data); err != nil {
+		return err
+	}
+	if !proto.MySQLHasResponse(command) {
+		return nil
+	}
+
+	r := proto.MySQLResponse{Command: command, DeprecateEOF: s.deprecateEOF}
+	var resp []byte
+	for {
+		packet, err := mysqlReadPacket(s.r)
+		if err != nil {
+			return err
+		}
+		resp = append(resp, packet...)
+		if r.Add(packet[4:]) {
+			break
+		}
+	}
+	replayLatency.With(o.String()).Observe(time.Since(start).Seconds())
+
+	if command == proto.MySQLComStmtPrepare && len(resp) >= 9 && resp[4] == 0x00 {
+		id := binary.LittleEndian.Uint32(resp[5:])
+		s.prepared[string(payloadID(msg.Meta))] = id
+		s.unmapped = append(s.unmapped, id)
+	}
+	if o.config.TrackResponses {
+		o.emitResponse(payloadID(msg.Meta), start, resp)
+	}
+	return nil
+}
+
+// mapStatement maps id of statement in the captured response to prepare command to the replayed one
+func (s *mysqlSession) mapStatement(uuid []byte, data []byte) {
+	id, ok := s.prepared[string(uuid)]
+	if !ok {
+		return
+	}
+	delete(s.prepared, string(uuid))
+	if len(data) < 9 || data[4] != 0x00 {
+		return
+	}
+	s.stmts[binary.LittleEndian.Uint32(data[5:])] = id
+	for i, u := range s.unmapped {
+		if u == id {
+			s.unmapped = append(s.unmapped[:i], s.unmapped[i+1:]...)
+			break
+		}
+	}
+}
+
+// statement returns replayed id of the captured statement. If responses are not captured,
+// unknown statements are mapped to the latest prepared one.
+func (s *mysqlSession) statement(captured uint32) uint32 {
+	if id, ok := s.stmts[captured]; ok {
+		return id
+	}
+	if n := len(s.unmapped); n > 0 {
+		id := s.unmapped[n-1]
+		s.unmapped = s.unmapped[:n-1]
+		s.stmts[captured] = id
+		return id
+	}
+	return captured
+}
+
+func (o *MySQLOutput) emitResponse(uuid []byte, start time.Time, payload []byte) {
+	select {
+	case o.responses <- &response{payload, uuid, start.UnixNano(), time.Since(start).Nanoseconds()}:
+	case <-o.stop:
+	}
+}
+
+// connect opens connection to the target and authenticates with capabilities, character set and database
+// of the captured handshake. It returns packets sent by the target after the handshake response.
+func (o *MySQLOutput) connect(s *mysqlSession, captured *proto.MySQLHandshakeResponse) (resp []byte, err error) {
+	conn, err := net.DialTimeout("tcp", o.host, o.config.Timeout)
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(o.config.Timeout))
+	r := bufio.NewReader(conn)
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+
+	packet, err := mysqlReadPacket(r)
+	if err != nil {
+		return
+	}
+	if packet[4] == 0xff {
+		return nil, fmt.Errorf("connection refused: %q", packet[4:])
+	}
+	greeting, ok := proto.ParseMySQLHandshake(packet[4:])
+	if !ok {
+		return nil, errors.New("invalid handshake")
+	}
+
+	h := proto.MySQLHandshakeResponse{Capabilities: mysqlOutputCapabilities, Charset: 45, Database: o.database}
+	if captured != nil {
+		h.Capabilities = captured.Capabilities&^mysqlOutputSkipCapabilities | proto.MySQLClientProtocol41 | proto.MySQLClientSecureConnection | proto.MySQLClientPluginAuth
+		h.Charset = captured.Charset
+		if h.Database == "" {
+			h.Database = captured.Database
+		}
+	}
+	h.Capabilities &= greeting.Capabilities | proto.MySQLClientConnectWithDB
+	h.User = o.user
+	h.AuthPlugin = greeting.AuthPlugin
+	nonce := greeting.AuthData
+	if h.AuthResponse, err = mysqlScramble(h.AuthPlugin, o.password, nonce); err != nil {
+		return
+	}
+	seq := byte(1)
+	if _, err = conn.Write(proto.AppendMySQLPacket(nil, seq, h.Marshal())); err != nil {
+		return
+	}
+
+	for {
+		if packet, err = mysqlReadPacket(r); err != nil {
+			return
+		}
+		resp = append(resp, packet...)
+		seq = packet[3] + 1
+		payload := packet[4:]
+		if len(payload) == 0 {
+			return nil, errMySQLAuth
+		}
+
+		var answer []byte
+		switch payload[0] {
+		case 0x00:
+			conn.SetDeadline(time.Time{})
+			s.conn, s.r = conn, r
+			s.deprecateEOF = h.Capabilities&proto.MySQLClientDeprecateEOF != 0
+			s.prepared = make(map[string]uint32)
+			s.stmts = make(map[uint32]uint32)
+			return resp, nil
+		case 0xff:
+			return nil, fmt.Errorf("authentication failed: %q", payload)
+		case 0xfe:
+			// AuthSwitchRequest: plugin name and its nonce
+			fields := strings.SplitN(string(payload[1:]), "\x00", 2)
+			h.AuthPlugin = fields[0]
+			nonce = nil
+			if len(fields) > 1 {
+				nonce = []byte(strings.TrimSuffix(fields[1], "\x00"))
+			}
+			if answer, err = mysqlScramble(h.AuthPlugin, o.password, nonce); err != nil {
+				return
+			}
+		case 0x01:
+			// AuthMoreData of caching_sha2_password
+			switch {
+			case len(payload) == 2 && payload[1] == 3:
+				// fast authentication succeeded, OK follows
+				continue
+			case len(payload) == 2 && payload[1] == 4:
+				// full authentication, password is encrypted with public key of the server
+				answer = []byte{2}
+			default:
+				if answer, err = mysqlEncryptPassword(payload[1:], o.password, nonce); err != nil {
+					return
+				}
+			}
+		default:
+			return nil, errMySQLAuth
+		}
+		if _, err = conn.Write(proto.AppendMySQLPacket(nil, seq, answer)); err != nil {
+			return
+		}
+	}
+}
+
+// mysqlReadPacket reads packet of the server, including its header
+func mysqlReadPacket(r *bufio.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	n, _, _ := proto.MySQLPacket(header)
+	packet := make([]byte, 4+n)
+	copy(packet, header)
+	_, err := io.ReadFull(r, packet[4:])
+	return packet, err
+}
+
+// mysqlScramble returns authentication data of the password for the plugin
+func mysqlScramble(plugin, password string, nonce []byte) ([]byte, error) {
+	if password == "" {
+		return nil, nil
+	}
+	switch plugin {
+	case "", "mysql_native_password":
+		// SHA1(password) XOR SHA1(nonce + SHA1(SHA1(password)))
+		h1 := sha1.Sum([]byte(password))
+		h2 := sha1.Sum(h1[:])
+		h3 := sha1.Sum(append(append([]byte(nil), nonce...), h2[:]...))
+		for i := range h1 {
+			h1[i] ^= h3[i]
+		}
+		return h1[:], nil
+	case "caching_sha2_password":
+		// SHA256(password) XOR SHA256(SHA256(SHA256(password)) + nonce)
+		h1 := sha256.Sum256([]byte(password))
+		h2 := sha256.Sum256(h1[:])
+		h3 := sha256.Sum256(append(h2[:], nonce...))
+		for i := range h1 {
+			h1[i] ^= h3[i]
+		}
+		return h1[:], nil
+	}
+	return nil, errMySQLAuth
+}
+
+// mysqlEncryptPassword encrypts the password XOR-ed with nonce using RSA public key of the server
+func mysqlEncryptPassword(key []byte, password string, nonce []byte) ([]byte, error) {
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return nil, errors.New("invalid public key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		if pub, err = x509.ParsePKCS1PublicKey(block.Bytes); err != nil {
+			return nil, err
+		}
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok || len(nonce) == 0 {
+		return nil, errors.New("invalid public key")
+	}
+	plain := append([]byte(password), 0)
+	for i := range plain {
+		plain[i] ^= nonce[i%len(nonce)]
+	}
+	return rsa.EncryptOAEP(sha1.New(), rand.Reader, rsaPub, plain, nil)
+}
+
+// PluginRead reads message from this plugin
+func (o *MySQLOutput) PluginRead() (*Message, error) {
+	if !o.config.TrackResponses {
+		return nil, ErrorStopped
+	}
+	var resp *response
+	select {
+	case <-o.stop:
+		return nil, ErrorStopped
+	case resp = <-o.responses:
+	}
+	var msg Message
+	msg.Data = resp.payload
+	msg.Meta = payloadHeader(ReplayedResponsePayload, resp.uuid, resp.roundTripTime, resp.startedAt)
+	return &msg, nil
+}
+
+func (o *MySQLOutput) closeSession(s *mysqlSession) {
+	o.mu.Lock()
+	if o.sessions[s.id] == s {
+		delete(o.sessions, s.id)
+	}
+	o.mu.Unlock()
+
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+func (o *MySQLOutput) String() string {
+	return "MySQL output: " + o.address
+}
+
+// Close closes all replayed sessions
+func (o *MySQLOutput) Close() error {
+	close(o.stop)
+	return nil
+}
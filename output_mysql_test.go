@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// mysqlTestServer accepts connections authenticated with mysql_native_password, and answers every command
+// with OK. Prepared statements get id 7. User, database and commands received by every connection are sent
+// to sessions when it is closed.
+func mysqlTestServer(t *testing.T, sessions chan []string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go mysqlTestSession(t, conn, sessions)
+		}
+	}()
+	return ln
+}
+
+func mysqlTestSession(t *testing.T, conn net.Conn, sessions chan []string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	nonce := []byte("0123456789abcdefghij")
+	caps := uint32(proto.MySQLClientProtocol41 | proto.MySQLClientSecureConnection | proto.MySQLClientPluginAuth | proto.MySQLClientConnectWithDB)
+
+	greeting := []byte("\x0a8.0.0\x00\x01\x00\x00\x00")
+	greeting = append(greeting, nonce[:8]...)
+	greeting = append(greeting, 0, byte(caps), byte(caps>>8), 45, 2, 0, byte(caps>>16), byte(caps>>24), 21)
+	greeting = append(greeting, make([]byte, 10)...)
+	greeting = append(greeting, nonce[8:]...)
+	greeting = append(greeting, 0)
+	greeting = append(greeting, "mysql_native_password\x00"...)
+	conn.Write(proto.AppendMySQLPacket(nil, 0, greeting))
+
+	packet, err := mysqlReadPacket(r)
+	if err != nil {
+		return
+	}
+	h, ok := proto.ParseMySQLHandshakeResponse(packet[4:])
+	if scramble, _ := mysqlScramble("mysql_native_password", "secret", nonce); !ok || !bytes.Equal(h.AuthResponse, scramble) {
+		t.Errorf("Wrong handshake response: %q", packet)
+		return
+	}
+	received := []string{"user=" + h.User, "database=" + h.Database}
+	conn.Write(proto.AppendMySQLPacket(nil, 2, []byte("\x00\x00\x00\x02\x00\x00\x00")))
+
+	for {
+		packet, err = mysqlReadPacket(r)
+		if err != nil || packet[4] == proto.MySQLComQuit {
+			sessions <- received
+			return
+		}
+		payload := packet[4:]
+		switch payload[0] {
+		case proto.MySQLComQuery, proto.MySQLComInitDB, proto.MySQLComStmtPrepare:
+			received = append(received, fmt.Sprintf("%d %s", payload[0], payload[1:]))
+		default:
+			received = append(received, fmt.Sprintf("%d %d", payload[0], binary.LittleEndian.Uint32(payload[1:])))
+		}
+		switch payload[0] {
+		case proto.MySQLComStmtPrepare:
+			conn.Write(proto.AppendMySQLPacket(nil, 1, []byte("\x00\x07\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")))
+		case proto.MySQLComStmtClose:
+		default:
+			conn.Write(proto.AppendMySQLPacket(nil, 1, []byte("\x00\x00\x00\x02\x00\x00\x00")))
+		}
+	}
+}
+
+func TestMySQLOutput(t *testing.T) {
+	sessions := make(chan []string, 2)
+	ln := mysqlTestServer(t, sessions)
+	defer ln.Close()
+
+	output := NewMySQLOutput("mysql://bob:secret@"+ln.Addr().String(), &MySQLOutputConfig{TrackResponses: true})
+	defer output.(*MySQLOutput).Close()
+
+	start := time.Now().UnixNano()
+	write := func(typ byte, id string, seq byte, payload string) {
+		data := proto.AppendMySQLPacket(nil, seq, []byte(payload))
+		output.PluginWrite(&Message{Meta: payloadHeader(typ, []byte(id), start, 0), Data: data})
+	}
+	stmt := func(cmd byte, id uint32) string {
+		b := []byte{cmd, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(b[1:], id)
+		return string(b)
+	}
+
+	// captured user is replaced by the user of the address
+	login := proto.MySQLHandshakeResponse{
+		Capabilities: proto.MySQLClientProtocol41 | proto.MySQLClientSecureConnection | proto.MySQLClientPluginAuth | proto.MySQLClientSSL,
+		Charset:      33,
+		User:         "app",
+		AuthResponse: make([]byte, 20),
+		Database:     "shop",
+		AuthPlugin:   "mysql_native_password",
+	}
+	write(RequestPayload, "aaaaaaaaaaaaaaaa00000001", 1, string(login.Marshal()))
+	write(RequestPayload, "aaaaaaaaaaaaaaaa00000002", 0, "\x16SELECT ?")
+	// captured response maps statement 3 to the replayed statement 7
+	write(ResponsePayload, "aaaaaaaaaaaaaaaa00000002", 1, "\x00\x03\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00")
+	write(RequestPayload, "aaaaaaaaaaaaaaaa00000003", 0, stmt(proto.MySQLComStmtExecute, 3)+"\x00\x01\x00\x00\x00")
+	write(RequestPayload, "aaaaaaaaaaaaaaaa00000003", 0, stmt(proto.MySQLComStmtClose, 3))
+	// session whose handshake was not captured
+	write(RequestPayload, "bbbbbbbbbbbbbbbb00000001", 0, "\x03SELECT 2")
+	write(RequestPayload, "aaaaaaaaaaaaaaaa00000003", 0, "\x01")
+
+	var responses []string
+	for len(responses) < 4 {
+		resp := make(chan *Message, 1)
+		go func() {
+			m, _ := output.PluginRead()
+			resp <- m
+		}()
+		select {
+		case m := <-resp:
+			if m.Meta[0] != ReplayedResponsePayload || len(m.Data) < 5 || m.Data[4] != 0x00 {
+				t.Errorf("Wrong response: %q %q", m.Meta, m.Data)
+			}
+			responses = append(responses, string(payloadID(m.Meta)))
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected 4 responses, got %d", len(responses))
+		}
+	}
+	sort.Strings(responses)
+	if expected := []string{"aaaaaaaaaaaaaaaa00000001", "aaaaaaaaaaaaaaaa00000002", "aaaaaaaaaaaaaaaa00000003", "bbbbbbbbbbbbbbbb00000001"}; !reflect.DeepEqual(responses, expected) {
+		t.Errorf("Wrong responses: %v", responses)
+	}
+
+	select {
+	case received := <-sessions:
+		if expected := []string{"user=bob", "database=shop", "22 SELECT ?", "23 7", "25 7"}; !reflect.DeepEqual(received, expected) {
+			t.Errorf("Wrong session: %v", received)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Session should be terminated")
+	}
+}
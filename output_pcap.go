@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/fnv"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/capture"
+	"github.com/buger/goreplay/tcp"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+const (
+	pcapMaxSegment = 1460            // payload of synthesized packets
+	pcapFlowExpire = 1 * time.Minute // sequence numbers of connections without messages are forgotten
+)
+
+// addresses of servers of synthesized packets, replayed responses are sent by a separate server
+var (
+	pcapServerIP         = net.IPv4(127, 0, 0, 1).To4()
+	pcapReplayedServerIP = net.IPv4(127, 0, 0, 2).To4()
+)
+
+// PcapOutput writes messages as TCP/IP packets to pcap files, or pcapng files if the path ends with .pcapng.
+// Messages read from raw input are written as they were captured, unless they were modified. Packets of other
+// messages are synthesized: connection is identified by UUID of the message, and is opened with a handshake.
+// Files are rotated the same way as with FileOutput.
+type PcapOutput struct {
+	file *FileOutput
+
+	mu        sync.Mutex
+	flows     map[pcapFlowID]*pcapFlow
+	ipID      uint16
+	lastSweep time.Time
+}
+
+type pcapFlowID struct {
+	client, server         [4]byte
+	clientPort, serverPort uint16
+}
+
+// pcapFlow holds next sequence numbers of client and server of synthesized connection
+type pcapFlow struct {
+	seq      [2]uint32
+	lastSeen time.Time
+}
+
+// pcapPacket is a packet starting with IP header
+type pcapPacket struct {
+	timestamp time.Time
+	data      []byte
+	lost      int
+}
+
+// NewPcapOutput constructor for PcapOutput, accepts the same path templates as FileOutput
+func NewPcapOutput(pathTemplate string, config *FileOutputConfig) *PcapOutput {
+	o := new(PcapOutput)
+	o.flows = make(map[pcapFlowID]*pcapFlow)
+	o.file = NewFileOutput(pathTemplate, config)
+	ng := strings.HasSuffix(strings.TrimSuffix(pathTemplate, ".gz"), ".pcapng")
+	o.file.newEncoder = func(w io.Writer) (fileEncoder, error) {
+		if ng {
+			return newPcapngEncoder(o, w)
+		}
+		return newPcapEncoder(o, w)
+	}
+	return o
+}
+
+// PluginWrite writes message to this plugin
+func (o *PcapOutput) PluginWrite(msg *Message) (n int, err error) {
+	return o.file.PluginWrite(msg)
+}
+
+func (o *PcapOutput) String() string {
+	return "Pcap output: " + o.file.pathTemplate
+}
+
+// Close closes the output file that is being written to
+func (o *PcapOutput) Close() error {
+	return o.file.Close()
+}
+
+// packets returns packets of the message, captured ones if they hold its data
+func (o *PcapOutput) packets(msg *Message) []pcapPacket {
+	if len(msg.packets) > 0 && capturedData(msg.packets, msg.Data) {
+		packets := make([]pcapPacket, len(msg.packets))
+		for i, p := range msg.packets {
+			packets[i] = pcapPacket{p.Timestamp, p.Data, p.Lost}
+		}
+		return packets
+	}
+	return o.synthesize(msg)
+}
+
+// capturedData checks if payloads of packets are the same as data, which is false if the message was modified
+func capturedData(packets []tcp.CapturedPacket, data []byte) bool {
+	for _, p := range packets {
+		if !bytes.HasPrefix(data, p.Payload) {
+			return false
+		}
+		data = data[len(p.Payload):]
+	}
+	return len(data) == 0
+}
+
+// synthesize builds packets of the message. Client address and ports are taken from UUID, since its first
+// bytes identify connection of messages read from raw input.
+func (o *PcapOutput) synthesize(msg *Message) (packets []pcapPacket) {
+	meta := payloadMeta(msg.Meta)
+	if len(meta) < 3 || len(meta[0]) == 0 {
+		return
+	}
+	ts := time.Now()
+	if ns, err := strconv.ParseInt(string(meta[2]), 10, 64); err == nil && ns > 0 {
+		ts = time.Unix(0, ns)
+	}
+	var id pcapFlowID
+	var b [8]byte
+	err := hex.ErrLength
+	if len(meta[1]) >= 16 {
+		_, err = hex.Decode(b[:], meta[1][:16])
+	}
+	if err != nil {
+		h := fnv.New64a()
+		h.Write(meta[1])
+		binary.BigEndian.PutUint64(b[:], h.Sum64())
+	}
+	id.clientPort = binary.BigEndian.Uint16(b[0:])
+	id.serverPort = binary.BigEndian.Uint16(b[2:])
+	copy(id.client[:], b[4:])
+	copy(id.server[:], pcapServerIP)
+	fromClient := false
+	switch meta[0][0] {
+	case RequestPayload, WebSocketFramePayload:
+		fromClient = true
+	case ReplayedResponsePayload:
+		copy(id.server[:], pcapReplayedServerIP)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if time.Since(o.lastSweep) > pcapFlowExpire {
+		o.lastSweep = time.Now()
+		for id, flow := range o.flows {
+			if time.Since(flow.lastSeen) > pcapFlowExpire {
+				delete(o.flows, id)
+			}
+		}
+	}
+
+	flow := o.flows[id]
+	if flow == nil {
+		// initial sequence numbers are taken from UUID, so they are the same for every run
+		h := fnv.New32a()
+		h.Write(meta[1])
+		isn := h.Sum32()
+		flow = &pcapFlow{seq: [2]uint32{isn + 1, ^isn + 1}}
+		o.flows[id] = flow
+		packets = append(packets,
+			o.packet(ts, id, true, isn, 0, pcapSYN, nil),
+			o.packet(ts, id, false, ^isn, isn+1, pcapSYN|pcapACK, nil),
+			o.packet(ts, id, true, isn+1, ^isn+1, pcapACK, nil),
+		)
+	}
+	flow.lastSeen = time.Now()
+
+	side := 1
+	if fromClient {
+		side = 0
+	}
+	for data := msg.Data; len(data) > 0; {
+		n := len(data)
+		if n > pcapMaxSegment {
+			n = pcapMaxSegment
+		}
+		packets = append(packets, o.packet(ts, id, fromClient, flow.seq[side], flow.seq[1-side], pcapPSH|pcapACK, data[:n]))
+		flow.seq[side] += uint32(n)
+		data = data[n:]
+	}
+	return
+}
+
+// TCP flags
+const (
+	pcapSYN = 0x02
+	pcapPSH = 0x08
+	pcapACK = 0x10
+)
+
+// packet builds IPv4 packet with TCP segment, o.mu should be locked
+func (o *PcapOutput) packet(ts time.Time, id pcapFlowID, fromClient bool, seq, ack uint32, flags byte, payload []byte) pcapPacket {
+	data := make([]byte, 40+len(payload))
+	ip, seg := data[:20], data[20:]
+	src, dst := id.client[:], id.server[:]
+	srcPort, dstPort := id.clientPort, id.serverPort
+	if !fromClient {
+		src, dst = dst, src
+		srcPort, dstPort = dstPort, srcPort
+	}
+
+	o.ipID++
+	ip[0] = 4<<4 | 5
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(data)))
+	binary.BigEndian.PutUint16(ip[4:], o.ipID)
+	ip[6] = 0x40 // don't fragment
+	ip[8] = 64
+	ip[9] = 6
+	copy(ip[12:], src)
+	copy(ip[16:], dst)
+	binary.BigEndian.PutUint16(ip[10:], pcapChecksum(0, ip))
+
+	binary.BigEndian.PutUint16(seg[0:], srcPort)
+	binary.BigEndian.PutUint16(seg[2:], dstPort)
+	binary.BigEndian.PutUint32(seg[4:], seq)
+	binary.BigEndian.PutUint32(seg[8:], ack)
+	seg[12] = 5 << 4
+	seg[13] = flags
+	binary.BigEndian.PutUint16(seg[14:], 0xffff)
+	copy(seg[20:], payload)
+	// pseudo header: addresses, protocol and length of the segment
+	var pseudo [12]byte
+	copy(pseudo[0:], src)
+	copy(pseudo[4:], dst)
+	pseudo[9] = 6
+	binary.BigEndian.PutUint16(pseudo[10:], uint16(len(seg)))
+	binary.BigEndian.PutUint16(seg[16:], pcapChecksum(pcapSum(0, pseudo[:]), seg))
+
+	return pcapPacket{timestamp: ts, data: data}
+}
+
+func pcapSum(sum uint32, data []byte) uint32 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	return sum
+}
+
+// pcapChecksum returns internet checksum of data, sum holds sum of the data before it
+func pcapChecksum(sum uint32, data []byte) uint16 {
+	sum = pcapSum(sum, data)
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// pcapEncoder writes packets in pcap format, with nanosecond timestamps
+type pcapEncoder struct {
+	output *PcapOutput
+	w      *capture.Writer
+}
+
+func newPcapEncoder(o *PcapOutput, w io.Writer) (fileEncoder, error) {
+	e := &pcapEncoder{o, capture.NewWriterNanos(w)}
+	return e, e.w.WriteFileHeader(65535, layers.LinkTypeRaw)
+}
+
+func (e *pcapEncoder) encode(msg *Message) (n int, err error) {
+	for _, p := range e.output.packets(msg) {
+		ci := gopacket.CaptureInfo{Timestamp: p.timestamp, CaptureLength: len(p.data), Length: len(p.data) + p.lost}
+		if err = e.w.WritePacket(ci, p.data); err != nil {
+			return
+		}
+		n += 16 + len(p.data)
+	}
+	return
+}
+
+func (e *pcapEncoder) flush() error {
+	return nil
+}
+
+// pcapngEncoder writes packets in pcapng format
+type pcapngEncoder struct {
+	output *PcapOutput
+	w      *pcapgo.NgWriter
+}
+
+func newPcapngEncoder(o *PcapOutput, w io.Writer) (fileEncoder, error) {
+	intf := pcapgo.DefaultNgInterface
+	intf.Name = "goreplay"
+	intf.LinkType = layers.LinkTypeRaw
+	options := pcapgo.DefaultNgWriterOptions
+	options.SectionInfo.Application = "goreplay"
+	ng, err := pcapgo.NewNgWriterInterface(w, intf, options)
+	return &pcapngEncoder{o, ng}, err
+}
+
+func (e *pcapngEncoder) encode(msg *Message) (n int, err error) {
+	for _, p := range e.output.packets(msg) {
+		ci := gopacket.CaptureInfo{Timestamp: p.timestamp, CaptureLength: len(p.data), Length: len(p.data) + p.lost}
+		if err = e.w.WritePacket(ci, p.data); err != nil {
+			return
+		}
+		// enhanced packet block with padding
+		n += 32 + (len(p.data)+3)&^3
+	}
+	return
+}
+
+func (e *pcapngEncoder) flush() error {
+	return e.w.Flush()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/tcp"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestPcapOutputSynthesized(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pcap")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.pcap")
+
+	output := NewPcapOutput(path, &FileOutputConfig{Append: true, FlushInterval: time.Minute})
+	start := time.Now().UnixNano()
+	// client 10.0.0.1:50000, server port 80
+	id := []byte("c35000500a00000100000001")
+	output.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, id, start, 0), Data: []byte("GET / HTTP/1.1\r\n\r\n")})
+	output.PluginWrite(&Message{Meta: payloadHeader(ResponsePayload, id, start+1000, 0), Data: bytes.Repeat([]byte("x"), 2000)})
+	output.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var payloads []string
+	for {
+		data, ci, err := r.ReadPacketData()
+		if err != nil {
+			break
+		}
+		pckt, err := tcp.ParsePacket(data, 101, 0, &ci, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pcapChecksum(0, data[:20]) != 0 {
+			t.Errorf("Wrong IP checksum")
+		}
+		var pseudo [12]byte
+		copy(pseudo[:], data[12:20])
+		pseudo[9] = 6
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(data)-20))
+		if pcapChecksum(pcapSum(0, pseudo[:]), data[20:]) != 0 {
+			t.Errorf("Wrong TCP checksum")
+		}
+		client := pckt.SrcPort == 50000 && pckt.DstPort == 80 && pckt.SrcIP.String() == "10.0.0.1" && pckt.DstIP.String() == "127.0.0.1"
+		server := pckt.SrcPort == 80 && pckt.DstPort == 50000 && pckt.SrcIP.String() == "127.0.0.1" && pckt.DstIP.String() == "10.0.0.1"
+		if !client && !server {
+			t.Errorf("Wrong addresses: %s -> %s", pckt.Src(), pckt.Dst())
+		}
+		payloads = append(payloads, string(pckt.Payload))
+	}
+	// handshake, request, and response split into two segments
+	if len(payloads) != 6 || payloads[3] != "GET / HTTP/1.1\r\n\r\n" || len(payloads[4]) != 1460 || len(payloads[5]) != 540 {
+		t.Errorf("Wrong packets: %q", payloads)
+	}
+}
+
+func TestPcapOutputCaptured(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pcap")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.pcapng")
+
+	output := NewPcapOutput(path, &FileOutputConfig{Append: true, FlushInterval: time.Minute})
+	// packet captured from another connection
+	var flow pcapFlowID
+	copy(flow.client[:], []byte{192, 168, 0, 1})
+	copy(flow.server[:], []byte{192, 168, 0, 2})
+	flow.clientPort, flow.serverPort = 40000, 8080
+	captured := output.packet(time.Now(), flow, true, 1, 1, pcapACK, []byte("GET / HTTP/1.1\r\n\r\n")).data
+	packets := []tcp.CapturedPacket{{Timestamp: time.Now(), Data: captured, Payload: captured[40:]}}
+
+	meta := payloadHeader(RequestPayload, []byte("9c408080c0a8000100000001"), time.Now().UnixNano(), 0)
+	output.PluginWrite(&Message{Meta: meta, Data: []byte("GET / HTTP/1.1\r\n\r\n"), packets: packets})
+	// modified message is synthesized
+	output.PluginWrite(&Message{Meta: meta, Data: []byte("GET /modified HTTP/1.1\r\n\r\n"), packets: packets})
+	output.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written [][]byte
+	for {
+		data, _, err := r.ReadPacketData()
+		if err != nil {
+			break
+		}
+		written = append(written, data)
+	}
+	if len(written) != 5 || !bytes.Equal(written[0], captured) || !bytes.HasSuffix(written[4], []byte("GET /modified HTTP/1.1\r\n\r\n")) {
+		t.Errorf("Wrong packets: %q", written)
+	}
+}
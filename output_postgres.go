@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// replayed sessions without queries for this time are closed
+const pgSessionIdle = 5 * time.Minute
+
+// PostgresOutputConfig struct for holding PostgreSQL output configuration
+type PostgresOutputConfig struct {
+	Timeout        time.Duration `json:"output-postgres-timeout"`
+	TrackResponses bool          `json:"output-postgres-track-response"`
+	QueueLen       int           `json:"output-postgres-queue-len"`
+}
+
+// PostgresOutput replays PostgreSQL queries captured with --input-raw-protocol postgres. Every captured
+// connection gets its own connection to the target, and its queries are sent over it in the original order,
+// so prepared statements and transactions keep working. Credentials of the target are taken from the address.
+type PostgresOutput struct {
+	address  string
+	config   *PostgresOutputConfig
+	host     string
+	user     string
+	password string
+	database string
+
+	mu        sync.Mutex
+	sessions  map[string]*pgSession
+	responses chan *response
+	stop      chan bool // Channel used only to indicate goroutine should shutdown
+}
+
+// pgSession is a replayed PostgreSQL connection
+type pgSession struct {
+	id      string
+	queries chan *Message
+	pending chan pgQuery // queries waiting for ReadyForQuery
+	done    chan bool    // closed when the target closes connection
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+type pgQuery struct {
+	uuid  []byte
+	start time.Time
+}
+
+var errPGAuth = errors.New("unsupported authentication method")
+
+// NewPostgresOutput constructor for PostgresOutput
+func NewPostgresOutput(address string, config *PostgresOutputConfig) PluginReadWriter {
+	o := new(PostgresOutput)
+	if !strings.Contains(address, "://") {
+		address = "postgres://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil || (u.Scheme != "postgres" && u.Scheme != "postgresql") {
+		log.Fatal(fmt.Sprintf("[OUTPUT-POSTGRES] invalid PostgreSQL output address %q", address))
+	}
+	o.host = u.Host
+	if u.Port() == "" {
+		o.host = net.JoinHostPort(u.Hostname(), "5432")
+	}
+	o.user = u.User.Username()
+	o.password, _ = u.User.Password()
+	o.database = strings.TrimPrefix(u.Path, "/")
+
+	if config.Timeout <= 0 {
+		config.Timeout = 5 * time.Second
+	}
+	if config.QueueLen <= 0 {
+		config.QueueLen = 1000
+	}
+	if u.User != nil {
+		// do not log the password
+		u.User = url.User(o.user)
+	}
+	o.address = u.String()
+	o.config = config
+	o.sessions = make(map[string]*pgSession)
+	o.responses = make(chan *response, config.QueueLen)
+	o.stop = make(chan bool)
+	return o
+}
+
+// PluginWrite writes message to this plugin
+func (o *PostgresOutput) PluginWrite(msg *Message) (n int, err error) {
+	n = len(msg.Data) + len(msg.Meta)
+	if !isRequestPayload(msg.Meta) {
+		return
+	}
+
+	id := sessionID(payloadID(msg.Meta))
+	_, code, startup := proto.PostgresStartup(msg.Data)
+	startup = startup && code == proto.PostgresProtocolVersion
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	s := o.sessions[id]
+	if s == nil || startup {
+		if s != nil {
+			// connection with the same ports was reopened
+			close(s.queries)
+		}
+		s = &pgSession{id: id, queries: make(chan *Message, o.config.QueueLen), pending: make(chan pgQuery, o.config.QueueLen), done: make(chan bool)}
+		o.sessions[id] = s
+		var params map[string]string
+		if startup {
+			params = proto.PostgresStartupParams(msg.Data)
+		}
+		go o.replay(s, params, msg)
+	}
+
+	if startup {
+		return
+	}
+	select {
+	case s.queries <- msg:
+	default:
+		// session is waiting for its connection, or the target is too slow
+		outputErrors.With(o.String()).Inc()
+		deadLetter(o.String(), msg, "session queue is full")
+		Debug(1, "[OUTPUT-POSTGRES] query dropped, session queue is full", id)
+	}
+	return
+}
+
+// replay opens connection of the session and sends its queries. Sessions whose startup was not
+// captured connect with the user and database of the output address.
+func (o *PostgresOutput) replay(s *pgSession, params map[string]string, startup *Message) {
+	defer o.closeSession(s)
+
+	start := time.Now()
+	conn, r, resp, err := o.connect(params)
+	if err != nil {
+		outputErrors.With(o.String()).Inc()
+		Debug(1, fmt.Sprintf("[OUTPUT-POSTGRES] failed to open session: %q", err))
+	} else {
+		s.mu.Lock()
+		s.conn = conn
+		s.mu.Unlock()
+		if params != nil && o.config.TrackResponses {
+			o.emitResponse(payloadID(startup.Meta), start, resp)
+		}
+		go o.readResponses(s, r)
+	}
+
+	idle := time.NewTimer(pgSessionIdle)
+	defer idle.Stop()
+	for {
+		var msg *Message
+		var ok bool
+		select {
+		case <-o.stop:
+			return
+		case <-idle.C:
+			return
+		case msg, ok = <-s.queries:
+			if !ok {
+				return
+			}
+		}
+		idle.Reset(pgSessionIdle)
+
+		if conn == nil {
+			// queries of failed session are dropped
+			outputErrors.With(o.String()).Inc()
+			deadLetter(o.String(), msg, "session connection failed")
+			continue
+		}
+		if pgHasResponse(msg.Data) {
+			select {
+			case s.pending <- pgQuery{payloadID(msg.Meta), time.Now()}:
+			default:
+			}
+		}
+		conn.SetWriteDeadline(time.Now().Add(o.config.Timeout))
+		if _, err = conn.Write(msg.Data); err != nil {
+			outputErrors.With(o.String()).Inc()
+			deadLetter(o.String(), msg, err)
+			Debug(1, fmt.Sprintf("[OUTPUT-POSTGRES] error when sending query: %q", err))
+			return
+		}
+		if msg.Data[0] == 'X' {
+			// target closes connection after responses to earlier queries
+			select {
+			case <-s.done:
+			case <-time.After(o.config.Timeout):
+			}
+			return
+		}
+	}
+}
+
+// pgHasResponse checks if server answers the messages with ReadyForQuery
+func pgHasResponse(data []byte) bool {
+	for len(data) > 0 {
+		typ, n, ok := proto.PostgresMessage(data)
+		if !ok || n > len(data) {
+			return false
+		}
+		if typ == 'Q' || typ == 'F' || typ == 'S' {
+			return true
+		}
+		data = data[n:]
+	}
+	return false
+}
+
+// readResponses reads messages of the target, responses end with ReadyForQuery
+func (o *PostgresOutput) readResponses(s *pgSession, r *bufio.Reader) {
+	defer close(s.done)
+	var resp []byte
+	for {
+		typ, msg, err := pgReadMessage(r)
+		if err != nil {
+			return
+		}
+		resp = append(resp, msg...)
+		if typ != 'Z' {
+			continue
+		}
+		select {
+		case q := <-s.pending:
+			replayLatency.With(o.String()).Observe(time.Since(q.start).Seconds())
+			if o.config.TrackResponses {
+				o.emitResponse(q.uuid, q.start, resp)
+			}
+		default:
+		}
+		resp = nil
+	}
+}
+
+func (o *PostgresOutput) emitResponse(uuid []byte, start time.Time, payload []byte) {
+	select {
+	case o.responses <- &response{payload, uuid, start.UnixNano(), time.Since(start).Nanoseconds()}:
+	case <-o.stop:
+	}
+}
+
+// connect opens connection to the target and authenticates, it returns messages sent by the target up to ReadyForQuery
+func (o *PostgresOutput) connect(params map[string]string) (conn net.Conn, r *bufio.Reader, resp []byte, err error) {
+	startup := make(map[string]string)
+	for k, v := range params {
+		startup[k] = v
+	}
+	if o.user != "" {
+		startup["user"] = o.user
+	}
+	if startup["user"] == "" {
+		startup["user"] = "postgres"
+	}
+	if o.database != "" {
+		startup["database"] = o.database
+	}
+
+	conn, err = net.DialTimeout("tcp", o.host, o.config.Timeout)
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(o.config.Timeout))
+	r = bufio.NewReader(conn)
+	resp, err = o.authenticate(conn, r, startup)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return
+}
+
+// authenticate sends startup message and answers authentication requests, supported methods are
+// trust, password, md5 and SCRAM-SHA-256
+func (o *PostgresOutput) authenticate(w io.Writer, r *bufio.Reader, params map[string]string) (resp []byte, err error) {
+	if _, err = w.Write(proto.NewPostgresStartup(params)); err != nil {
+		return
+	}
+	var scram *scramClient
+	for {
+		typ, msg, err := pgReadMessage(r)
+		if err != nil {
+			return nil, err
+		}
+		body := msg[5:]
+		switch typ {
+		case 'E':
+			return nil, fmt.Errorf("startup failed: %s", pgErrorMessage(body))
+		case 'Z':
+			return append(resp, msg...), nil
+		case 'R':
+		default:
+			resp = append(resp, msg...)
+			continue
+		}
+
+		if len(body) < 4 {
+			return nil, errPGAuth
+		}
+		var answer []byte
+		switch method, data := binary.BigEndian.Uint32(body), body[4:]; method {
+		case 0:
+			// AuthenticationOk
+			resp = append(resp, msg...)
+			continue
+		case 3:
+			answer = append([]byte(o.password), 0)
+		case 5:
+			if len(data) < 4 {
+				return nil, errPGAuth
+			}
+			answer = append([]byte(pgMD5Password(params["user"], o.password, data[:4])), 0)
+		case 10:
+			if !bytes.Contains(data, []byte("SCRAM-SHA-256\x00")) {
+				return nil, errPGAuth
+			}
+			scram = newSCRAMClient("", o.password)
+			first := scram.first()
+			answer = append([]byte("SCRAM-SHA-256\x00"), 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(answer[len(answer)-4:], uint32(len(first)))
+			answer = append(answer, first...)
+		case 11:
+			if scram == nil {
+				return nil, errPGAuth
+			}
+			final, err := scram.final(string(data))
+			if err != nil {
+				return nil, err
+			}
+			answer = []byte(final)
+		case 12:
+			if scram == nil {
+				return nil, errPGAuth
+			}
+			if err = scram.verify(string(data)); err != nil {
+				return nil, err
+			}
+			continue
+		default:
+			return nil, errPGAuth
+		}
+		if _, err = w.Write(proto.AppendPostgresMessage(nil, 'p', answer)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// pgReadMessage reads typed message of the server, msg includes the header
+func pgReadMessage(r *bufio.Reader) (typ byte, msg []byte, err error) {
+	header := make([]byte, 5)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	typ, n, ok := proto.PostgresMessage(header)
+	if !ok {
+		return 0, nil, fmt.Errorf("invalid message header %q", header)
+	}
+	msg = make([]byte, n)
+	copy(msg, header)
+	_, err = io.ReadFull(r, msg[5:])
+	return
+}
+
+// pgErrorMessage returns text of ErrorResponse
+func pgErrorMessage(body []byte) string {
+	for _, field := range bytes.Split(body, []byte{0}) {
+		if len(field) > 0 && field[0] == 'M' {
+			return string(field[1:])
+		}
+	}
+	return "unknown error"
+}
+
+func pgMD5Password(user, password string, salt []byte) string {
+	h := md5.Sum([]byte(password + user))
+	h = md5.Sum(append([]byte(hex.EncodeToString(h[:])), salt...))
+	return "md5" + hex.EncodeToString(h[:])
+}
+
+// scramClient is the client side of SCRAM-SHA-256 exchange, RFC 7677. PostgreSQL ignores the user
+// name sent in it, and uses the one of startup message.
+type scramClient struct {
+	user, password string
+	nonce          string
+	firstBare      string
+	serverSig      []byte
+}
+
+func newSCRAMClient(user, password string) *scramClient {
+	nonce := make([]byte, 18)
+	rand.Read(nonce)
+	return &scramClient{user: user, password: password, nonce: base64.StdEncoding.EncodeToString(nonce)}
+}
+
+func (c *scramClient) first() string {
+	c.firstBare = "n=" + c.user + ",r=" + c.nonce
+	return "n,," + c.firstBare
+}
+
+func (c *scramClient) final(serverFirst string) (string, error) {
+	var nonce, salt string
+	var iter int
+	for _, attr := range strings.Split(serverFirst, ",") {
+		if len(attr) < 2 {
+			continue
+		}
+		switch attr[:2] {
+		case "r=":
+			nonce = attr[2:]
+		case "s=":
+			salt = attr[2:]
+		case "i=":
+			fmt.Sscan(attr[2:], &iter)
+		}
+	}
+	rawSalt, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil || !strings.HasPrefix(nonce, c.nonce) || iter <= 0 {
+		return "", errors.New("invalid SCRAM server message")
+	}
+
+	salted := pbkdf2.Key([]byte(c.password), rawSalt, iter, sha256.Size, sha256.New)
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=biws,r=" + nonce
+	authMessage := c.firstBare + "," + serverFirst + "," + withoutProof
+
+	proof := scramHMAC(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	c.serverSig = scramHMAC(scramHMAC(salted, "Server Key"), authMessage)
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+func (c *scramClient) verify(serverFinal string) error {
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(serverFinal, "v="))
+	if err != nil || !hmac.Equal(sig, c.serverSig) {
+		return errors.New("invalid SCRAM server signature")
+	}
+	return nil
+}
+
+func scramHMAC(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+// PluginRead reads message from this plugin
+func (o *PostgresOutput) PluginRead() (*Message, error) {
+	if !o.config.TrackResponses {
+		return nil, ErrorStopped
+	}
+	var resp *response
+	select {
+	case <-o.stop:
+		return nil, ErrorStopped
+	case resp = <-o.responses:
+	}
+	var msg Message
+	msg.Data = resp.payload
+	msg.Meta = payloadHeader(ReplayedResponsePayload, resp.uuid, resp.roundTripTime, resp.startedAt)
+	return &msg, nil
+}
+
+func (o *PostgresOutput) closeSession(s *pgSession) {
+	o.mu.Lock()
+	if o.sessions[s.id] == s {
+		delete(o.sessions, s.id)
+	}
+	o.mu.Unlock()
+
+	s.mu.Lock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.mu.Unlock()
+}
+
+func (o *PostgresOutput) String() string {
+	return "PostgreSQL output: " + o.address
+}
+
+// Close closes all replayed sessions
+func (o *PostgresOutput) Close() error {
+	close(o.stop)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, s := range o.sessions {
+		s.mu.Lock()
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		s.mu.Unlock()
+	}
+	return nil
+}
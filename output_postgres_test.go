@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// pgTestServer accepts connections authenticated with md5, and answers every query with CommandComplete.
+// Startup parameters and messages received by every connection are sent to sessions when it is closed.
+func pgTestServer(t *testing.T, sessions chan []string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go pgTestSession(t, conn, sessions)
+		}
+	}()
+	return ln
+}
+
+func pgTestSession(t *testing.T, conn net.Conn, sessions chan []string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return
+	}
+	startup := make([]byte, binary.BigEndian.Uint32(header))
+	copy(startup, header)
+	io.ReadFull(r, startup[8:])
+	params := proto.PostgresStartupParams(startup)
+	received := []string{"user=" + params["user"], "database=" + params["database"], "application_name=" + params["application_name"]}
+
+	conn.Write(proto.AppendPostgresMessage(nil, 'R', []byte("\x00\x00\x00\x05salt")))
+	if _, msg, err := pgReadMessage(r); err != nil || string(msg[5:]) != pgMD5Password(params["user"], "secret", []byte("salt"))+"\x00" {
+		t.Errorf("Wrong password message: %q", msg)
+		return
+	}
+	conn.Write(proto.AppendPostgresMessage(nil, 'R', []byte("\x00\x00\x00\x00")))
+	conn.Write(proto.AppendPostgresMessage(nil, 'Z', []byte("I")))
+
+	for {
+		typ, msg, err := pgReadMessage(r)
+		if err != nil || typ == 'X' {
+			sessions <- received
+			return
+		}
+		received = append(received, string(typ))
+		switch typ {
+		case 'Q':
+			received[len(received)-1] += string(proto.PostgresQuery(msg))
+			fallthrough
+		case 'S':
+			conn.Write(proto.AppendPostgresMessage(nil, 'C', []byte("OK\x00")))
+			conn.Write(proto.AppendPostgresMessage(nil, 'Z', []byte("I")))
+		}
+	}
+}
+
+func TestPostgresOutput(t *testing.T) {
+	sessions := make(chan []string, 2)
+	ln := pgTestServer(t, sessions)
+	defer ln.Close()
+
+	output := NewPostgresOutput("postgres://bob:secret@"+ln.Addr().String(), &PostgresOutputConfig{TrackResponses: true})
+	defer output.(*PostgresOutput).Close()
+
+	start := time.Now().UnixNano()
+	write := func(id string, data []byte) {
+		output.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, []byte(id), start, 0), Data: data})
+	}
+	msg := func(typ byte, body string) []byte {
+		return proto.AppendPostgresMessage(nil, typ, []byte(body))
+	}
+
+	// captured user is replaced by the user of the address
+	write("aaaaaaaaaaaaaaaa00000001", proto.NewPostgresStartup(map[string]string{"user": "app", "database": "shop", "application_name": "web"}))
+	write("aaaaaaaaaaaaaaaa00000002", msg('Q', "SELECT 1\x00"))
+	// session whose startup was not captured
+	write("bbbbbbbbbbbbbbbb00000001", msg('Q', "SELECT 2\x00"))
+	write("aaaaaaaaaaaaaaaa00000003", bytes.Join([][]byte{msg('P', "\x00SELECT 3\x00\x00\x00"), msg('B', "\x00\x00\x00\x00\x00\x00\x00\x00"), msg('E', "\x00\x00\x00\x00\x00"), msg('S', "")}, nil))
+	write("aaaaaaaaaaaaaaaa00000003", msg('X', ""))
+
+	var responses []string
+	for len(responses) < 4 {
+		resp := make(chan *Message, 1)
+		go func() {
+			m, _ := output.PluginRead()
+			resp <- m
+		}()
+		select {
+		case m := <-resp:
+			if m.Meta[0] != ReplayedResponsePayload || !bytes.HasSuffix(m.Data, msg('Z', "I")) {
+				t.Errorf("Wrong response: %q %q", m.Meta, m.Data)
+			}
+			responses = append(responses, string(payloadID(m.Meta)))
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected 4 responses, got %d", len(responses))
+		}
+	}
+	sort.Strings(responses)
+	if expected := []string{"aaaaaaaaaaaaaaaa00000001", "aaaaaaaaaaaaaaaa00000002", "aaaaaaaaaaaaaaaa00000003", "bbbbbbbbbbbbbbbb00000001"}; !reflect.DeepEqual(responses, expected) {
+		t.Errorf("Wrong responses: %v", responses)
+	}
+
+	select {
+	case received := <-sessions:
+		if expected := []string{"user=bob", "database=shop", "application_name=web", "QSELECT 1", "P", "B", "E", "S"}; !reflect.DeepEqual(received, expected) {
+			t.Errorf("Wrong session: %v", received)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Session should be terminated")
+	}
+}
+
+func TestSCRAMClient(t *testing.T) {
+	// RFC 7677 test vector
+	c := &scramClient{user: "user", password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+	if first := c.first(); first != "n,,n=user,r=rOprNGfwEbeRWgbNEkqO" {
+		t.Errorf("Wrong first message: %s", first)
+	}
+	final, err := c.final("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	if err != nil || final != "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=" {
+		t.Errorf("Wrong final message: %s %v", final, err)
+	}
+	if err = c.verify("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="); err != nil {
+		t.Error(err)
+	}
+	if _, err = c.final("r=other,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"); err == nil {
+		t.Error("Server nonce should start with the client nonce")
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// replayed sessions without commands for this time are closed
+const redisSessionIdle = 5 * time.Minute
+
+// RedisOutputConfig struct for holding Redis output configuration
+type RedisOutputConfig struct {
+	Timeout        time.Duration `json:"output-redis-timeout"`
+	TrackResponses bool          `json:"output-redis-track-response"`
+	QueueLen       int           `json:"output-redis-queue-len"`
+	DropWrites     bool          `json:"output-redis-drop-writes"`
+	RewritePrefix  MultiOption   `json:"output-redis-rewrite-prefix"`
+}
+
+// redisPrefix replaces prefix of keys
+type redisPrefix struct {
+	from, to []byte
+}
+
+// RedisOutput replays Redis commands captured with --input-raw-protocol redis. Every captured connection
+// gets its own connection to the target, and its commands are sent over it in the original order, so the
+// selected database and transactions are kept. Credentials and database are taken from the address.
+type RedisOutput struct {
+	address  string
+	config   *RedisOutputConfig
+	host     string
+	user     string
+	password string
+	database string
+	prefixes []redisPrefix
+
+	mu        sync.Mutex
+	sessions  map[string]*redisSession
+	responses chan *response
+	stop      chan bool // Channel used only to indicate goroutine should shutdown
+}
+
+// redisSession is a replayed Redis connection
+type redisSession struct {
+	id       string
+	messages chan *Message
+	conn     net.Conn
+	r        *bufio.Reader
+}
+
+// NewRedisOutput constructor for RedisOutput
+func NewRedisOutput(address string, config *RedisOutputConfig) PluginReadWriter {
+	o := new(RedisOutput)
+	if !strings.Contains(address, "://") {
+		address = "redis://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil || u.Scheme != "redis" {
+		log.Fatal(fmt.Sprintf("[OUTPUT-REDIS] invalid Redis output address %q", address))
+	}
+	o.host = u.Host
+	if u.Port() == "" {
+		o.host = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	o.user = u.User.Username()
+	o.password, _ = u.User.Password()
+	if o.password == "" && o.user != "" {
+		// redis://password@host
+		o.user, o.password = "", o.user
+	}
+	o.database = strings.TrimPrefix(u.Path, "/")
+	if o.database != "" {
+		if _, err = strconv.Atoi(o.database); err != nil {
+			log.Fatal(fmt.Sprintf("[OUTPUT-REDIS] invalid database number %q", o.database))
+		}
+	}
+	for _, rule := range config.RewritePrefix {
+		i := strings.Index(rule, "=")
+		if i < 0 {
+			log.Fatal(fmt.Sprintf("[OUTPUT-REDIS] prefix rewrite should be old=new, got %q", rule))
+		}
+		o.prefixes = append(o.prefixes, redisPrefix{[]byte(rule[:i]), []byte(rule[i+1:])})
+	}
+
+	if config.Timeout <= 0 {
+		config.Timeout = 5 * time.Second
+	}
+	if config.QueueLen <= 0 {
+		config.QueueLen = 1000
+	}
+	// do not log the password
+	u.User = nil
+	o.address = u.String()
+	o.config = config
+	o.sessions = make(map[string]*redisSession)
+	o.responses = make(chan *response, config.QueueLen)
+	o.stop = make(chan bool)
+	return o
+}
+
+// PluginWrite writes message to this plugin
+func (o *RedisOutput) PluginWrite(msg *Message) (n int, err error) {
+	n = len(msg.Data) + len(msg.Meta)
+	if !isRequestPayload(msg.Meta) {
+		return
+	}
+
+	id := sessionID(payloadID(msg.Meta))
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	s := o.sessions[id]
+	if s == nil {
+		s = &redisSession{id: id, messages: make(chan *Message, o.config.QueueLen)}
+		o.sessions[id] = s
+		go o.replay(s)
+	}
+	select {
+	case s.messages <- msg:
+	default:
+		// session is waiting for its connection, or the target is too slow
+		outputErrors.With(o.String()).Inc()
+		deadLetter(o.String(), msg, "session queue is full")
+		Debug(1, "[OUTPUT-REDIS] command dropped, session queue is full", id)
+	}
+	return
+}
+
+// replay opens connection of the session and sends its commands
+func (o *RedisOutput) replay(s *redisSession) {
+	defer o.closeSession(s)
+
+	if err := o.connect(s); err != nil {
+		outputErrors.With(o.String()).Inc()
+		Debug(1, fmt.Sprintf("[OUTPUT-REDIS] failed to open session: %q", err))
+	}
+
+	idle := time.NewTimer(redisSessionIdle)
+	defer idle.Stop()
+	for {
+		var msg *Message
+		select {
+		case <-o.stop:
+			return
+		case <-idle.C:
+			return
+		case msg = <-s.messages:
+		}
+		idle.Reset(redisSessionIdle)
+
+		if s.conn == nil {
+			// commands of failed session are dropped
+			outputErrors.With(o.String()).Inc()
+			deadLetter(o.String(), msg, "session connection failed")
+			continue
+		}
+		quit, err := o.send(s, msg)
+		if err != nil {
+			outputErrors.With(o.String()).Inc()
+			deadLetter(o.String(), msg, err)
+			Debug(1, fmt.Sprintf("[OUTPUT-REDIS] error when sending command: %q", err))
+			return
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// send sends commands of the message and reads their replies, quit is true if client closed the connection
+func (o *RedisOutput) send(s *redisSession, msg *Message) (quit bool, err error) {
+	var replies []byte
+	start := time.Now()
+	for data := msg.Data; len(data) > 0; {
+		args, n, ok := proto.RedisCommand(data)
+		if !ok || n == 0 {
+			break
+		}
+		data = data[n:]
+		if args = o.rewrite(args); len(args) == 0 {
+			continue
+		}
+		if proto.RedisCommandName(args) == "QUIT" {
+			return true, nil
+		}
+
+		cmdStart := time.Now()
+		s.conn.SetDeadline(cmdStart.Add(o.config.Timeout))
+		if _, err = s.conn.Write(proto.AppendRedisCommand(nil, args)); err != nil {
+			return
+		}
+		var reply []byte
+		for reply == nil || reply[0] == '>' {
+			// RESP3 push messages are not replies
+			if reply, err = redisReadReply(s.r, nil); err != nil {
+				return
+			}
+		}
+		replayLatency.With(o.String()).Observe(time.Since(cmdStart).Seconds())
+		replies = append(replies, reply...)
+	}
+
+	if replies != nil && o.config.TrackResponses {
+		select {
+		case o.responses <- &response{replies, payloadID(msg.Meta), start.UnixNano(), time.Since(start).Nanoseconds()}:
+		case <-o.stop:
+		}
+	}
+	return
+}
+
+// rewrite returns the command to replay, or nothing if the command is not replayed
+func (o *RedisOutput) rewrite(args [][]byte) [][]byte {
+	name := proto.RedisCommandName(args)
+	switch name {
+	case "AUTH":
+		// credentials of the address are used
+		return nil
+	case "SELECT":
+		if o.database != "" {
+			return nil
+		}
+	case "HELLO":
+		// only protocol version is kept, without credentials
+		if len(args) > 2 {
+			args = args[:2]
+		}
+	case "SUBSCRIBE", "PSUBSCRIBE", "SSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE", "SUNSUBSCRIBE", "MONITOR":
+		// messages are not replies, they can not be read after commands
+		Debug(3, "[OUTPUT-REDIS] skipped", name)
+		return nil
+	}
+	if o.config.DropWrites && proto.IsRedisWrite(args) {
+		Debug(3, "[OUTPUT-REDIS] dropped write command", name)
+		return nil
+	}
+	if len(o.prefixes) == 0 {
+		return args
+	}
+
+	rewritten := append([][]byte(nil), args...)
+	for _, i := range proto.RedisKeys(args) {
+		for _, p := range o.prefixes {
+			if bytes.HasPrefix(args[i], p.from) {
+				rewritten[i] = append(append([]byte(nil), p.to...), args[i][len(p.from):]...)
+				break
+			}
+		}
+	}
+	return rewritten
+}
+
+// connect opens connection to the target, authenticates and selects database of the address
+func (o *RedisOutput) connect(s *redisSession) error {
+	conn, err := net.DialTimeout("tcp", o.host, o.config.Timeout)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	var commands [][][]byte
+	if o.password != "" {
+		auth := [][]byte{[]byte("AUTH"), []byte(o.password)}
+		if o.user != "" {
+			auth = [][]byte{[]byte("AUTH"), []byte(o.user), []byte(o.password)}
+		}
+		commands = append(commands, auth)
+	}
+	if o.database != "" {
+		commands = append(commands, [][]byte{[]byte("SELECT"), []byte(o.database)})
+	}
+
+	conn.SetDeadline(time.Now().Add(o.config.Timeout))
+	for _, args := range commands {
+		if _, err = conn.Write(proto.AppendRedisCommand(nil, args)); err != nil {
+			break
+		}
+		var reply []byte
+		if reply, err = redisReadReply(r, nil); err != nil {
+			break
+		}
+		if reply[0] == '-' {
+			err = fmt.Errorf("%s failed: %q", args[0], reply)
+			break
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	s.conn, s.r = conn, r
+	return nil
+}
+
+// redisReadReply reads RESP2 or RESP3 value and appends it to buf
+func redisReadReply(r *bufio.Reader, buf []byte) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return buf, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return buf, fmt.Errorf("invalid reply: %q", line)
+	}
+	buf = append(buf, line...)
+	size, _ := strconv.Atoi(string(line[1 : len(line)-2]))
+	if size > proto.RedisMaxValue {
+		return buf, fmt.Errorf("reply is too big: %q", line)
+	}
+	switch line[0] {
+	case '$', '!', '=':
+		if size < 0 {
+			return buf, nil
+		}
+		n := len(buf)
+		buf = append(buf, make([]byte, size+2)...)
+		_, err = io.ReadFull(r, buf[n:])
+		return buf, err
+	case '%', '|':
+		size *= 2
+		fallthrough
+	case '*', '~', '>':
+		for i := 0; i < size && err == nil; i++ {
+			buf, err = redisReadReply(r, buf)
+		}
+		return buf, err
+	}
+	return buf, nil
+}
+
+// PluginRead reads message from this plugin
+func (o *RedisOutput) PluginRead() (*Message, error) {
+	if !o.config.TrackResponses {
+		return nil, ErrorStopped
+	}
+	var resp *response
+	select {
+	case <-o.stop:
+		return nil, ErrorStopped
+	case resp = <-o.responses:
+	}
+	var msg Message
+	msg.Data = resp.payload
+	msg.Meta = payloadHeader(ReplayedResponsePayload, resp.uuid, resp.roundTripTime, resp.startedAt)
+	return &msg, nil
+}
+
+func (o *RedisOutput) closeSession(s *redisSession) {
+	o.mu.Lock()
+	if o.sessions[s.id] == s {
+		delete(o.sessions, s.id)
+	}
+	o.mu.Unlock()
+
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+func (o *RedisOutput) String() string {
+	return "Redis output: " + o.address
+}
+
+// Close closes all replayed sessions
+func (o *RedisOutput) Close() error {
+	close(o.stop)
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// redisTestServer answers GET with null and other commands with OK. Commands received
+// by every connection are sent to sessions when it is closed.
+func redisTestServer(t *testing.T, sessions chan []string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				var received []string
+				for {
+					// commands are sent as arrays, which are read the same way as replies
+					data, err := redisReadReply(r, nil)
+					if err != nil {
+						sessions <- received
+						return
+					}
+					args, _, _ := proto.RedisCommand(data)
+					received = append(received, string(bytes.Join(args, []byte(" "))))
+					if proto.RedisCommandName(args) == "GET" {
+						conn.Write([]byte("$-1\r\n"))
+					} else {
+						conn.Write([]byte("+OK\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestRedisOutput(t *testing.T) {
+	sessions := make(chan []string, 2)
+	ln := redisTestServer(t, sessions)
+	defer ln.Close()
+
+	config := &RedisOutputConfig{TrackResponses: true, DropWrites: true, RewritePrefix: MultiOption{"prod:=staging:"}}
+	output := NewRedisOutput("redis://:secret@"+ln.Addr().String()+"/2", config)
+	defer output.(*RedisOutput).Close()
+
+	start := time.Now().UnixNano()
+	write := func(id string, args ...string) {
+		var b [][]byte
+		for _, a := range args {
+			b = append(b, []byte(a))
+		}
+		output.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, []byte(id), start, 0), Data: proto.AppendRedisCommand(nil, b)})
+	}
+
+	// captured credentials and database are replaced by the ones of the address
+	write("aaaaaaaaaaaaaaaa00000001", "AUTH", "captured")
+	write("aaaaaaaaaaaaaaaa00000002", "SELECT", "3")
+	write("aaaaaaaaaaaaaaaa00000003", "GET", "prod:user:1")
+	write("aaaaaaaaaaaaaaaa00000004", "SET", "prod:user:1", "bob")
+	write("aaaaaaaaaaaaaaaa00000005", "MGET", "prod:a", "other")
+	// inline command of another session
+	output.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, []byte("bbbbbbbbbbbbbbbb00000001"), start, 0), Data: []byte("PING\r\n")})
+	write("aaaaaaaaaaaaaaaa00000006", "QUIT")
+
+	var responses []string
+	for len(responses) < 3 {
+		resp := make(chan *Message, 1)
+		go func() {
+			m, _ := output.PluginRead()
+			resp <- m
+		}()
+		select {
+		case m := <-resp:
+			if m.Meta[0] != ReplayedResponsePayload {
+				t.Errorf("Wrong response: %q %q", m.Meta, m.Data)
+			}
+			responses = append(responses, string(payloadID(m.Meta)))
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected 3 responses, got %d", len(responses))
+		}
+	}
+	sort.Strings(responses)
+	if expected := []string{"aaaaaaaaaaaaaaaa00000003", "aaaaaaaaaaaaaaaa00000005", "bbbbbbbbbbbbbbbb00000001"}; !reflect.DeepEqual(responses, expected) {
+		t.Errorf("Wrong responses: %v", responses)
+	}
+
+	select {
+	case received := <-sessions:
+		if expected := []string{"AUTH secret", "SELECT 2", "GET staging:user:1", "MGET staging:a other"}; !reflect.DeepEqual(received, expected) {
+			t.Errorf("Wrong session: %v", received)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Session should be terminated")
+	}
+}
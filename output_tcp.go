@@ -20,7 +20,7 @@ type TCPOutput struct {
 	config      *TCPOutputConfig
 	workerIndex uint32
 
-	close bool
+	stop chan struct{} // closed by Close to stop the workers
 }
 
 // TCPOutputConfig tcp output configuration
@@ -38,6 +38,7 @@ func NewTCPOutput(address string, config *TCPOutputConfig) PluginWriter {
 
 	o.address = address
 	o.config = config
+	o.stop = make(chan struct{})
 
 	if Settings.OutputTCPStats {
 		o.bufStats = NewGorStat("output_tcp", 5000)
@@ -56,18 +57,14 @@ func NewTCPOutput(address string, config *TCPOutputConfig) PluginWriter {
 func (o *TCPOutput) worker(bufferIndex int) {
 	retries := 0
 	conn, err := o.connect(o.address)
-	for {
-		if o.close {
+	for err != nil {
+		Debug(1, fmt.Sprintf("Can't connect to aggregator instance, reconnecting in 1 second. Retries:%d", retries))
+		select {
+		case <-o.stop:
 			return
+		case <-time.After(time.Second):
 		}
 
-		if err == nil {
-			break
-		}
-
-		Debug(1, fmt.Sprintf("Can't connect to aggregator instance, reconnecting in 1 second. Retries:%d", retries))
-		time.Sleep(1 * time.Second)
-
 		conn, err = o.connect(o.address)
 		retries++
 	}
@@ -79,7 +76,12 @@ func (o *TCPOutput) worker(bufferIndex int) {
 	defer conn.Close()
 
 	for {
-		msg := <-o.buf[bufferIndex]
+		var msg *Message
+		select {
+		case <-o.stop:
+			return
+		case msg = <-o.buf[bufferIndex]:
+		}
 		if _, err = conn.Write(msg.Meta); err == nil {
 			if _, err = conn.Write(msg.Data); err == nil {
 				_, err = conn.Write(payloadSeparatorAsBytes)
@@ -88,7 +90,9 @@ func (o *TCPOutput) worker(bufferIndex int) {
 
 		if err != nil {
 			Debug(2, "INFO: TCP output connection closed, reconnecting")
-			o.buf[bufferIndex] <- msg
+			// the message may be partially written, it is not resent, and writing to the queue could block the worker
+			outputErrors.With(o.String()).Inc()
+			deadLetter(o.String(), msg, err)
 			go o.worker(bufferIndex)
 			break
 		}
@@ -96,13 +100,17 @@ func (o *TCPOutput) worker(bufferIndex int) {
 }
 
 func (o *TCPOutput) getBufferIndex(msg *Message) int {
-	if !o.config.Sticky {
+	hasher := fnv.New32a()
+	switch {
+	case Settings.RecognizeTCPSessions:
+		// messages of a captured session are forwarded over one connection, in order
+		hasher.Write([]byte(sessionID(payloadID(msg.Meta))))
+	case o.config.Sticky:
+		hasher.Write(payloadID(msg.Meta))
+	default:
 		o.workerIndex++
 		return int(o.workerIndex) % o.config.Workers
 	}
-
-	hasher := fnv.New32a()
-	hasher.Write(payloadID(msg.Meta))
 	return int(hasher.Sum32()) % o.config.Workers
 }
 
@@ -139,10 +147,21 @@ func (o *TCPOutput) connect(address string) (conn net.Conn, err error) {
 	return
 }
 
+// QueueStats returns number of buffered messages of all workers
+func (o *TCPOutput) QueueStats() QueueStats {
+	stats := QueueStats{Workers: len(o.buf)}
+	for _, buf := range o.buf {
+		stats.Queue += len(buf)
+		stats.Capacity += cap(buf)
+	}
+	return stats
+}
+
 func (o *TCPOutput) String() string {
 	return fmt.Sprintf("TCP output %s, limit: %d", o.address, o.limit)
 }
 
+// Close stops the workers, messages still in their buffers are not sent
 func (o *TCPOutput) Close() {
-	o.close = true
+	close(o.stop)
 }
@@ -90,6 +90,39 @@ func BenchmarkTCPOutput(b *testing.B) {
 	emitter.Close()
 }
 
+func TestTCPOutputConnectionClosed(t *testing.T) {
+	// connections are reset as soon as they are accepted
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+		}
+	}()
+
+	output := NewTCPOutput(listener.Addr().String(), &TCPOutputConfig{Workers: 1}).(*TCPOutput)
+	defer output.Close()
+	dropped := outputDropped.With(output.String())
+	before := dropped.Value()
+
+	// failed messages are dropped instead of being queued again, so writes never block
+	for i := 0; i < 200 && dropped.Value() == before; i++ {
+		output.PluginWrite(getTestBytes())
+		time.Sleep(10 * time.Millisecond)
+	}
+	if dropped.Value() == before {
+		t.Error("expected failed message to be dropped")
+	}
+}
+
 func TestStickyDisable(t *testing.T) {
 	tcpOutput := TCPOutput{config: &TCPOutputConfig{Sticky: false, Workers: 10}}
 
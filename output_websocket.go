@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// replayed sessions without frames for this time are closed
+const wsSessionIdle = 5 * time.Minute
+
+// WebSocketOutputConfig struct for holding WebSocket output configuration
+type WebSocketOutputConfig struct {
+	Timeout    time.Duration `json:"output-websocket-timeout"`
+	SkipVerify bool          `json:"output-websocket-skip-verify"`
+	QueueLen   int           `json:"output-websocket-queue-len"`
+}
+
+// WebSocketOutput replays WebSocket sessions. Every captured handshake request opens a new connection
+// to the target, and frames sent by client are replayed over it with their original relative timing.
+type WebSocketOutput struct {
+	address string
+	config  *WebSocketOutputConfig
+	url     *url.URL
+
+	mu       sync.Mutex
+	sessions map[string]*wsSession
+	stop     chan bool // Channel used only to indicate goroutine should shutdown
+}
+
+// wsSession is a replayed WebSocket connection
+type wsSession struct {
+	id     string
+	start  int64 // capture time of the handshake request
+	frames chan *Message
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewWebSocketOutput constructor for WebSocketOutput
+func NewWebSocketOutput(address string, config *WebSocketOutputConfig) PluginWriter {
+	o := new(WebSocketOutput)
+	if !strings.Contains(address, "://") {
+		address = "ws://" + address
+	}
+	var err error
+	o.url, err = url.Parse(address)
+	if err != nil || (o.url.Scheme != "ws" && o.url.Scheme != "wss") {
+		log.Fatal(fmt.Sprintf("[OUTPUT-WEBSOCKET] invalid WebSocket output address %q", address))
+	}
+	if o.url.Port() == "" {
+		port := "80"
+		if o.url.Scheme == "wss" {
+			port = "443"
+		}
+		o.url.Host = net.JoinHostPort(o.url.Hostname(), port)
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 5 * time.Second
+	}
+	if config.QueueLen <= 0 {
+		config.QueueLen = 1000
+	}
+	o.address = address
+	o.config = config
+	o.sessions = make(map[string]*wsSession)
+	o.stop = make(chan bool)
+	return o
+}
+
+// PluginWrite writes message to this plugin
+func (o *WebSocketOutput) PluginWrite(msg *Message) (n int, err error) {
+	n = len(msg.Data) + len(msg.Meta)
+	id := string(payloadID(msg.Meta))
+
+	switch {
+	case isRequestPayload(msg.Meta) && proto.IsWebSocketUpgrade(msg.Data):
+		s := &wsSession{id: id, start: payloadTime(msg.Meta), frames: make(chan *Message, o.config.QueueLen)}
+
+		o.mu.Lock()
+		if _, ok := o.sessions[id]; ok {
+			o.mu.Unlock()
+			return
+		}
+		o.sessions[id] = s
+		o.mu.Unlock()
+		go o.replay(s, msg.Data)
+	case msg.Meta[0] == WebSocketFramePayload:
+		o.mu.Lock()
+		s := o.sessions[id]
+		o.mu.Unlock()
+		if s == nil {
+			Debug(3, "[OUTPUT-WEBSOCKET] frame of unknown session", id)
+			return
+		}
+		select {
+		case s.frames <- msg:
+		default:
+			// session is waiting for time of earlier frames, or its connection failed
+			outputErrors.With(o.String()).Inc()
+			deadLetter(o.String(), msg, "session queue is full")
+			Debug(1, "[OUTPUT-WEBSOCKET] frame dropped, session queue is full", id)
+		}
+	}
+	return
+}
+
+// replay opens connection of the session and sends its frames
+func (o *WebSocketOutput) replay(s *wsSession, handshake []byte) {
+	defer o.closeSession(s)
+
+	conn, err := o.connect(handshake)
+	if err != nil {
+		outputErrors.With(o.String()).Inc()
+		Debug(1, fmt.Sprintf("[OUTPUT-WEBSOCKET] failed to open session: %q", err))
+		return
+	}
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+
+	replayStart := time.Now()
+	idle := time.NewTimer(wsSessionIdle)
+	defer idle.Stop()
+	for {
+		var msg *Message
+		select {
+		case <-o.stop:
+			return
+		case <-idle.C:
+			return
+		case msg = <-s.frames:
+		}
+		idle.Reset(wsSessionIdle)
+
+		// keep the time between handshake and the frame
+		if delay := time.Duration(payloadTime(msg.Meta)-s.start) - time.Since(replayStart); delay > 0 {
+			select {
+			case <-o.stop:
+				return
+			case <-time.After(delay):
+			}
+		}
+
+		var key [4]byte
+		rand.Read(key[:])
+		conn.SetWriteDeadline(time.Now().Add(o.config.Timeout))
+		if _, err = conn.Write(proto.MaskWebSocketFrame(msg.Data, key)); err != nil {
+			outputErrors.With(o.String()).Inc()
+			deadLetter(o.String(), msg, err)
+			Debug(1, fmt.Sprintf("[OUTPUT-WEBSOCKET] error when sending frame: %q", err))
+			return
+		}
+		if f, ok := proto.ParseWebSocketFrame(msg.Data); ok && f.Opcode == proto.WebSocketClose {
+			return
+		}
+	}
+}
+
+// connect opens connection to the target and sends the captured handshake request
+func (o *WebSocketOutput) connect(handshake []byte) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: o.config.Timeout}
+	var conn net.Conn
+	var err error
+	if o.url.Scheme == "wss" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", o.url.Host, &tls.Config{InsecureSkipVerify: o.config.SkipVerify})
+	} else {
+		conn, err = dialer.Dial("tcp", o.url.Host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	handshake = proto.SetHeader(append([]byte(nil), handshake...), []byte("Host"), []byte(o.url.Host))
+	conn.SetDeadline(time.Now().Add(o.config.Timeout))
+	if _, err = conn.Write(handshake); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("upgrade rejected with %q", resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// frames sent by server are not used
+	go io.Copy(ioutil.Discard, r)
+	return conn, nil
+}
+
+// payloadTime returns capture time of the payload in nanoseconds
+func payloadTime(meta []byte) int64 {
+	fields := payloadMeta(meta)
+	if len(fields) < 3 {
+		return 0
+	}
+	ts, _ := strconv.ParseInt(string(fields[2]), 10, 64)
+	return ts
+}
+
+func (o *WebSocketOutput) closeSession(s *wsSession) {
+	o.mu.Lock()
+	if o.sessions[s.id] == s {
+		delete(o.sessions, s.id)
+	}
+	o.mu.Unlock()
+
+	s.mu.Lock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.mu.Unlock()
+}
+
+func (o *WebSocketOutput) String() string {
+	return "WebSocket output: " + o.address
+}
+
+// Close closes all replayed sessions
+func (o *WebSocketOutput) Close() error {
+	close(o.stop)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, s := range o.sessions {
+		s.mu.Lock()
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		s.mu.Unlock()
+	}
+	return nil
+}
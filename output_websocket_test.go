@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+type wsTestFrame struct {
+	received time.Time
+	masked   bool
+	data     []byte
+}
+
+func wsTestServer(t *testing.T, frames chan wsTestFrame) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Upgrade") != "websocket" || req.Header.Get("X-Session") != "1" || req.Host == "example.com" {
+			t.Errorf("Wrong handshake: %s %v", req.Host, req.Header)
+		}
+		conn, rw, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n\x81\x05hello")
+		rw.Flush()
+
+		var buf []byte
+		r := bufio.NewReader(rw)
+		for {
+			b, err := r.ReadByte()
+			if err != nil {
+				return
+			}
+			buf = append(buf, b)
+			f, ok := proto.ParseWebSocketFrame(buf)
+			if !ok || len(buf) < f.Len() {
+				continue
+			}
+			frames <- wsTestFrame{time.Now(), f.Masked, proto.UnmaskWebSocketFrame(buf)}
+			buf = nil
+		}
+	}))
+}
+
+func TestWebSocketOutput(t *testing.T) {
+	frames := make(chan wsTestFrame, 10)
+	server := wsTestServer(t, frames)
+	defer server.Close()
+
+	input := NewTestInput()
+	input.skipHeader = true
+	output := NewWebSocketOutput(strings.Replace(server.URL, "http://", "ws://", 1), &WebSocketOutputConfig{})
+
+	plugins := &InOutPlugins{
+		Inputs:  []PluginReader{input},
+		Outputs: []PluginWriter{output},
+	}
+	plugins.All = append(plugins.All, input, output)
+
+	emitter := NewEmitter()
+	go emitter.Start(plugins, Settings.Middleware)
+	defer emitter.Close()
+
+	id := uuid()
+	start := time.Now().UnixNano()
+	text := []byte{0x81, 2, 'h', 'i'}
+	closing := []byte{0x88, 0}
+	input.EmitBytes(append(payloadHeader(RequestPayload, id, start, 0),
+		"GET /chat HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\nX-Session: 1\r\n\r\n"...))
+	// frames sent by server and frames of other sessions are not replayed
+	input.EmitBytes(append(payloadHeader(WebSocketResponseFramePayload, id, start, 0), "\x81\x05hello"...))
+	input.EmitBytes(append(payloadHeader(WebSocketFramePayload, uuid(), start, 0), text...))
+	input.EmitBytes(append(payloadHeader(WebSocketFramePayload, id, start+int64(50*time.Millisecond), 0), text...))
+	input.EmitBytes(append(payloadHeader(WebSocketFramePayload, id, start+int64(350*time.Millisecond), 0), closing...))
+
+	var received []wsTestFrame
+	for len(received) < 2 {
+		select {
+		case f := <-frames:
+			received = append(received, f)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected 2 frames, got %d", len(received))
+		}
+	}
+	if !received[0].masked || !bytes.Equal(received[0].data, text) || !received[1].masked || !bytes.Equal(received[1].data, closing) {
+		t.Errorf("Wrong frames: %+v", received)
+	}
+	if gap := received[1].received.Sub(received[0].received); gap < 250*time.Millisecond {
+		t.Errorf("Frames should keep original timing, got %s between them", gap)
+	}
+}
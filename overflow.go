@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/buger/goreplay/size"
+)
+
+// Overflow policies of outputs, applied when output can't keep up with inputs
+const (
+	OverflowBlock      = "block"       // wait for the output, stalling inputs and other outputs
+	OverflowDropNewest = "drop-newest" // drop the message being written
+	OverflowDropOldest = "drop-oldest" // drop the oldest queued message
+	OverflowSpill      = "spill"       // write messages to a file on disk, until it is full
+)
+
+// OverflowConfig is the overflow policy of outputs, --config can set policy of every output
+type OverflowConfig struct {
+	Policy    string    `json:"output-overflow"`
+	QueueLen  int       `json:"output-overflow-queue-len"`
+	SpillDir  string    `json:"output-overflow-spill-dir"`
+	SpillSize size.Size `json:"output-overflow-spill-size"`
+}
+
+// OverflowQueue is a wrapper of output plugin with a queue of its own, written to the plugin by a single goroutine,
+// so slow output never stalls reading of inputs and other outputs. When the queue is full messages are dropped
+// or spilled to disk, according to the policy. Dropped messages are passed to the dead-letter output.
+type OverflowQueue struct {
+	plugin  interface{}
+	name    string // of the wrapped output, used in metrics
+	policy  string
+	queue   chan *Message
+	spill   *spillFile
+	writing int32 // accessed atomically, set while a message is written to the plugin
+
+	mu   sync.Mutex // orders writes of spill policy
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewOverflowQueue wraps the output plugin, policy should not be OverflowBlock
+func NewOverflowQueue(plugin interface{}, policy string, config *OverflowConfig) *OverflowQueue {
+	q := &OverflowQueue{
+		plugin: plugin,
+		name:   fmt.Sprint(unwrap(plugin)),
+		policy: policy,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	queueLen := config.QueueLen
+	if queueLen <= 0 {
+		queueLen = 1000
+	}
+	q.queue = make(chan *Message, queueLen)
+
+	switch policy {
+	case OverflowDropNewest, OverflowDropOldest:
+	case OverflowSpill:
+		var err error
+		if q.spill, err = newSpillFile(config.SpillDir, int64(config.SpillSize)); err != nil {
+			log.Fatal("[OVERFLOW] failed to create spill file: ", err)
+		}
+	default:
+		log.Fatalf("[OVERFLOW] unknown policy %q, expected block, drop-newest, drop-oldest or spill", policy)
+	}
+
+	go q.run()
+	return q
+}
+
+// PluginWrite queues the message, it never blocks
+func (q *OverflowQueue) PluginWrite(msg *Message) (n int, err error) {
+	n = len(msg.Meta) + len(msg.Data)
+	switch q.policy {
+	case OverflowDropNewest:
+		select {
+		case q.queue <- msg:
+		default:
+			q.drop(msg, "output queue is full")
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case q.queue <- msg:
+				return
+			default:
+			}
+			select {
+			case old := <-q.queue:
+				q.drop(old, "output queue is full")
+			default:
+			}
+		}
+	case OverflowSpill:
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		// once spilling, messages go to disk until it is read, to keep their order
+		if q.spill.empty() {
+			select {
+			case q.queue <- msg:
+				return
+			default:
+			}
+		}
+		if err := q.spill.write(msg); err != nil {
+			q.drop(msg, err)
+		}
+	}
+	return
+}
+
+func (q *OverflowQueue) drop(msg *Message, reason interface{}) {
+	Debug(2, "[OVERFLOW] message dropped:", q.name, reason)
+	deadLetter(q.name, msg, reason)
+}
+
+// run writes queued messages, then spilled ones, to the output
+func (q *OverflowQueue) run() {
+	defer close(q.done)
+	w, _ := q.plugin.(PluginWriter)
+	for {
+		// closed plugin is not written anymore, even if messages are queued
+		select {
+		case <-q.stop:
+			return
+		default:
+		}
+
+		var msg *Message
+		select {
+		case msg = <-q.queue:
+		case <-q.stop:
+			return
+		default:
+			if q.spill != nil {
+				msg = q.spill.read()
+			}
+		}
+		if msg == nil {
+			var ready chan struct{}
+			if q.spill != nil {
+				ready = q.spill.ready
+			}
+			select {
+			case msg = <-q.queue:
+			case <-ready:
+				continue
+			case <-q.stop:
+				return
+			}
+		}
+
+		atomic.StoreInt32(&q.writing, 1)
+		if _, err := w.PluginWrite(msg); err != nil && err != io.ErrClosedPipe && err != ErrorStopped {
+			outputErrors.With(q.name).Inc()
+			deadLetter(q.name, msg, err)
+		}
+		atomic.StoreInt32(&q.writing, 0)
+	}
+}
+
+// PluginRead reads from the wrapped plugin, like responses of outputs
+func (q *OverflowQueue) PluginRead() (*Message, error) {
+	if r, ok := q.plugin.(PluginReader); ok {
+		return r.PluginRead()
+	}
+	// avoid further reading
+	return nil, io.ErrClosedPipe
+}
+
+// QueueStats returns stats of the wrapped plugin, including messages in overflow queue
+func (q *OverflowQueue) QueueStats() QueueStats {
+	var stats QueueStats
+	if s, ok := unwrap(q.plugin).(queueStater); ok {
+		stats = s.QueueStats()
+	}
+	stats.Queue += len(q.queue)
+	stats.Capacity += cap(q.queue)
+	stats.InFlight += int(atomic.LoadInt32(&q.writing))
+	if q.spill != nil {
+		stats.Queue += q.spill.len()
+	}
+	return stats
+}
+
+func (q *OverflowQueue) String() string {
+	return fmt.Sprintf("%s (overflow: %s)", q.plugin, q.policy)
+}
+
+// Close stops writing to the plugin and closes it, messages which were not written, queued or spilled,
+// are passed to the dead-letter output
+func (q *OverflowQueue) Close() (err error) {
+	close(q.stop)
+	// closed first, to stop the write it may be blocked in
+	if c, ok := q.plugin.(io.Closer); ok {
+		err = c.Close()
+	}
+	<-q.done
+	for len(q.queue) > 0 {
+		q.drop(<-q.queue, "output is closed")
+	}
+	if q.spill != nil {
+		for msg := q.spill.read(); msg != nil; msg = q.spill.read() {
+			q.drop(msg, "output is closed")
+		}
+		q.spill.close()
+	}
+	return err
+}
+
+var errSpillFull = errors.New("output spill file is full")
+
+// spillFile keeps messages on disk, they are read in the order they were written.
+// File is truncated every time all messages are read, and unread messages are moved to its start
+// when it would grow above the limit, so it is never larger than the limit.
+type spillFile struct {
+	mu      sync.Mutex
+	file    *os.File
+	limit   int64
+	wOffset int64
+	rOffset int64
+	count   int
+	ready   chan struct{} // notifies reader about written message
+}
+
+func newSpillFile(dir string, limit int64) (*spillFile, error) {
+	file, err := ioutil.TempFile(dir, "gor-spill-")
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = 1 << 30
+	}
+	return &spillFile{file: file, limit: limit, ready: make(chan struct{}, 1)}, nil
+}
+
+// write appends the message, sizes of its meta and data go first
+func (s *spillFile) write(msg *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buf := make([]byte, 8, 8+len(msg.Meta)+len(msg.Data))
+	binary.BigEndian.PutUint32(buf, uint32(len(msg.Meta)))
+	binary.BigEndian.PutUint32(buf[4:], uint32(len(msg.Data)))
+	buf = append(append(buf, msg.Meta...), msg.Data...)
+	if s.wOffset+int64(len(buf)) > s.limit {
+		// moving is worth it only when read messages take at least as much as unread ones,
+		// so every byte is moved at most once on average
+		if live := s.wOffset - s.rOffset; s.rOffset < live || live+int64(len(buf)) > s.limit {
+			return errSpillFull
+		}
+		if err := s.compact(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.file.WriteAt(buf, s.wOffset); err != nil {
+		return err
+	}
+	s.wOffset += int64(len(buf))
+	s.count++
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// read returns the oldest message, or nil if there are none
+func (s *spillFile) read() *Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.count == 0 {
+		return nil
+	}
+	var sizes [8]byte
+	if _, err := s.file.ReadAt(sizes[:], s.rOffset); err != nil {
+		Debug(1, "[OVERFLOW] failed to read spill file:", err)
+		s.reset()
+		return nil
+	}
+	buf := make([]byte, binary.BigEndian.Uint32(sizes[:])+binary.BigEndian.Uint32(sizes[4:]))
+	if _, err := s.file.ReadAt(buf, s.rOffset+8); err != nil {
+		Debug(1, "[OVERFLOW] failed to read spill file:", err)
+		s.reset()
+		return nil
+	}
+	s.rOffset += 8 + int64(len(buf))
+	if s.count--; s.count == 0 {
+		s.reset()
+	}
+	metaLen := binary.BigEndian.Uint32(sizes[:])
+	return &Message{Meta: buf[:metaLen:metaLen], Data: buf[metaLen:]}
+}
+
+// compact moves unread messages to the start of the file, and truncates it after them
+func (s *spillFile) compact() error {
+	buf := make([]byte, 64<<10)
+	live := s.wOffset - s.rOffset
+	for off := int64(0); off < live; {
+		n := int64(len(buf))
+		if live-off < n {
+			n = live - off
+		}
+		if _, err := s.file.ReadAt(buf[:n], s.rOffset+off); err != nil {
+			return err
+		}
+		if _, err := s.file.WriteAt(buf[:n], off); err != nil {
+			return err
+		}
+		off += n
+	}
+	s.rOffset, s.wOffset = 0, live
+	return s.file.Truncate(live)
+}
+
+// reset truncates the file when all messages are read, unread messages are lost if it is called because of error
+func (s *spillFile) reset() {
+	s.count, s.rOffset, s.wOffset = 0, 0, 0
+	s.file.Truncate(0)
+}
+
+func (s *spillFile) empty() bool {
+	return s.len() == 0
+}
+
+func (s *spillFile) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+func (s *spillFile) close() {
+	s.file.Close()
+	os.Remove(s.file.Name())
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/size"
+)
+
+// slowOutput blocks writes until it is released
+type slowOutput struct {
+	name     string
+	received chan string
+	release  chan struct{}
+}
+
+func newSlowOutput(name string) *slowOutput {
+	return &slowOutput{name: name, received: make(chan string, 100), release: make(chan struct{})}
+}
+
+func (o *slowOutput) PluginWrite(msg *Message) (int, error) {
+	o.received <- string(msg.Data)
+	<-o.release
+	return len(msg.Data), nil
+}
+
+func (o *slowOutput) String() string {
+	return o.name
+}
+
+func (o *slowOutput) receive(t *testing.T) string {
+	select {
+	case data := <-o.received:
+		return data
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for message")
+	}
+	return ""
+}
+
+func overflowMessage(i int) *Message {
+	return &Message{Meta: payloadHeader(RequestPayload, uuid(), time.Now().UnixNano(), -1), Data: []byte(fmt.Sprint(i))}
+}
+
+func TestOverflowSlowOutput(t *testing.T) {
+	slow := newSlowOutput("Slow output")
+	dropped := outputDropped.With(slow.name)
+	before := dropped.Value()
+	queue := NewOverflowQueue(slow, OverflowDropNewest, &OverflowConfig{QueueLen: 2})
+	defer queue.Close()
+	defer close(slow.release)
+
+	input := NewTestInput()
+	wg := new(sync.WaitGroup)
+	fast := NewTestOutput(func(*Message) { wg.Done() })
+	go CopyMulty(input, queue, fast)
+	defer input.Close()
+
+	wg.Add(10)
+	input.EmitGET()
+	slow.receive(t)
+	for i := 1; i < 10; i++ {
+		input.EmitGET()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("slow output should not stall other outputs")
+	}
+
+	// 1 message is being written, 2 are queued
+	if n := dropped.Value() - before; n != 7 {
+		t.Errorf("expected 7 dropped messages, got %d", n)
+	}
+	if stats := queue.QueueStats(); stats.Queue != 2 || stats.Capacity != 2 {
+		t.Errorf("expected full queue, got %+v", stats)
+	}
+}
+
+func TestOverflowDropOldest(t *testing.T) {
+	slow := newSlowOutput("Slow output drop-oldest")
+	dropped := outputDropped.With(slow.name)
+	before := dropped.Value()
+	queue := NewOverflowQueue(slow, OverflowDropOldest, &OverflowConfig{QueueLen: 2})
+	defer queue.Close()
+
+	queue.PluginWrite(overflowMessage(0))
+	slow.receive(t)
+	for i := 1; i < 5; i++ {
+		queue.PluginWrite(overflowMessage(i))
+	}
+	close(slow.release)
+
+	if got := slow.receive(t) + slow.receive(t); got != "34" {
+		t.Errorf("expected newest messages to be kept, got %q", got)
+	}
+	if n := dropped.Value() - before; n != 2 {
+		t.Errorf("expected 2 dropped messages, got %d", n)
+	}
+}
+
+func TestOverflowSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	slow := newSlowOutput("Slow output spill")
+	dropped := outputDropped.With(slow.name)
+	before := dropped.Value()
+	// room for 3 messages of 2 bytes in spill file
+	config := &OverflowConfig{QueueLen: 1, SpillDir: dir, SpillSize: size.Size(3 * (len(overflowMessage(10).Meta) + 2 + 8))}
+	queue := NewOverflowQueue(slow, OverflowSpill, config)
+
+	queue.PluginWrite(overflowMessage(10))
+	slow.receive(t)
+	for i := 11; i < 16; i++ {
+		queue.PluginWrite(overflowMessage(i))
+	}
+	if stats := queue.QueueStats(); stats.Queue != 4 {
+		t.Errorf("expected 1 queued and 3 spilled messages, got %+v", stats)
+	}
+	if n := dropped.Value() - before; n != 1 {
+		t.Errorf("expected message to be dropped when spill file is full, got %d", n)
+	}
+	close(slow.release)
+
+	var got string
+	for i := 0; i < 4; i++ {
+		got += slow.receive(t)
+	}
+	if got != "11121314" {
+		t.Errorf("expected spilled messages in order, got %q", got)
+	}
+
+	// memory is used again, once spilled messages are written
+	queue.PluginWrite(overflowMessage(16))
+	if data := slow.receive(t); data != "16" {
+		t.Errorf("expected message after spill, got %q", data)
+	}
+
+	queue.Close()
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected spill file to be removed, got %d files", len(files))
+	}
+}
+
+// closableOutput releases the blocked write of the slow output when it is closed
+type closableOutput struct {
+	*slowOutput
+}
+
+func (o closableOutput) Close() error {
+	close(o.release)
+	return nil
+}
+
+func TestOverflowClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	var lost []string
+	setDLQ(NewTestOutput(func(msg *Message) {
+		mu.Lock()
+		lost = append(lost, string(msg.Data))
+		mu.Unlock()
+	}))
+	defer setDLQ(nil)
+
+	for _, policy := range []string{OverflowDropNewest, OverflowSpill} {
+		lost = nil
+		slow := newSlowOutput("Slow output close " + policy)
+		dropped := outputDropped.With(slow.name)
+		before := dropped.Value()
+		queue := NewOverflowQueue(closableOutput{slow}, policy, &OverflowConfig{QueueLen: 1, SpillDir: dir})
+
+		queue.PluginWrite(overflowMessage(0))
+		slow.receive(t)
+		// queued, and spilled with spill policy
+		queue.PluginWrite(overflowMessage(1))
+		queue.PluginWrite(overflowMessage(2))
+		queue.Close()
+
+		expected := "1,2"
+		if policy == OverflowDropNewest {
+			// dropped when it was written
+			expected = "2,1"
+		}
+		if got := strings.Join(lost, ","); got != expected {
+			t.Errorf("%s: expected messages which were not written in dead-letter output, got %q", policy, got)
+		}
+		if n := dropped.Value() - before; n != 2 {
+			t.Errorf("%s: expected 2 dropped messages, got %d", policy, n)
+		}
+	}
+}
+
+func TestSpillFileLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	msgSize := int64(len(overflowMessage(100).Meta) + 3 + 8)
+	limit := 10 * msgSize
+	s, err := newSpillFile(dir, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	// reader lags behind, so the file is never empty
+	next := 100
+	for i := 100; i < 400; i++ {
+		if err := s.write(overflowMessage(i)); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if i-next >= 3 {
+			if data := string(s.read().Data); data != fmt.Sprint(next) {
+				t.Fatalf("expected message %d, got %s", next, data)
+			}
+			next++
+		}
+		if stat, _ := s.file.Stat(); stat.Size() > limit {
+			t.Fatalf("spill file grew to %d bytes, above limit of %d", stat.Size(), limit)
+		}
+	}
+	if s.len() != 400-next {
+		t.Errorf("expected %d unread messages, got %d", 400-next, s.len())
+	}
+}
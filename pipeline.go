@@ -0,0 +1,569 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// flagsRoute is the name of the implicit route of plugins defined with flags
+const flagsRoute = "flags"
+
+// Route connects a set of inputs to a set of outputs.
+// Modifiers are applied in order, only to the traffic passing through this route.
+type Route struct {
+	Name      string
+	Inputs    []PluginReader
+	Outputs   []PluginWriter
+	Modifiers []*HTTPModifierConfig
+
+	chain    atomic.Value // *routeModifiers
+	limiters []*Limiter
+}
+
+// routeModifiers is replaced as a whole, so that reload never exposes partially applied rules
+type routeModifiers struct {
+	configs   []*HTTPModifierConfig
+	modifiers []*HTTPModifier
+}
+
+// SetModifiers atomically replaces modifiers applied to the route traffic
+func (r *Route) SetModifiers(configs []*HTTPModifierConfig) {
+	chain := &routeModifiers{configs: configs}
+	for _, config := range configs {
+		if modifier := NewHTTPModifier(config); modifier != nil {
+			modifier.route = r.Name
+			chain.modifiers = append(chain.modifiers, modifier)
+		}
+	}
+	r.chain.Store(chain)
+}
+
+func (r *Route) modifierChain() *routeModifiers {
+	chain, _ := r.chain.Load().(*routeModifiers)
+	return chain
+}
+
+// PipelineConfig is the structure of the file given with --config
+type PipelineConfig struct {
+	Inputs    []PipelinePlugin                 `yaml:"inputs"`
+	Outputs   []PipelinePlugin                 `yaml:"outputs"`
+	Modifiers map[string]map[string]stringList `yaml:"modifiers"`
+	Routes    []PipelineRoute                  `yaml:"routes"`
+	DLQ       string                           `yaml:"dlq"` // name of the output receiving messages other outputs failed to deliver
+}
+
+// PipelinePlugin declares a named input or output.
+// Plugin specific options are taken from the corresponding command line flags.
+type PipelinePlugin struct {
+	Name     string `yaml:"name"`
+	Type     string `yaml:"type"`
+	Address  string `yaml:"address"`
+	Limit    string `yaml:"limit"`
+	Overflow string `yaml:"overflow"` // overflow policy of output, --output-overflow if empty
+}
+
+// PipelineRoute declares which inputs feed which outputs
+type PipelineRoute struct {
+	Name      string     `yaml:"name"`
+	From      stringList `yaml:"from"`
+	To        stringList `yaml:"to"`
+	Modifiers stringList `yaml:"modifiers"`
+	Limit     string     `yaml:"limit"`
+}
+
+// stringList accepts both a single value and a list of values
+type stringList []string
+
+func (s *stringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		*s = list
+		return nil
+	}
+
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	*s = stringList{value}
+	return nil
+}
+
+// LoadPipelineConfig reads and parses pipeline configuration file
+func LoadPipelineConfig(path string) (*PipelineConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := new(PipelineConfig)
+	if err = yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("can't parse %q: %s", path, err)
+	}
+	return config, nil
+}
+
+// modifierFlags maps names of modifier flags (e.g. http-set-header) to fields of the config
+func modifierFlags(config *HTTPModifierConfig) map[string]flag.Value {
+	flags := make(map[string]flag.Value)
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("json")
+		if value, ok := v.Field(i).Addr().Interface().(flag.Value); ok && name != "" {
+			flags[name] = value
+		}
+	}
+	return flags
+}
+
+// NewModifierConfig builds modifier configuration from flag names and values,
+// values are parsed the same way as command line flags
+func NewModifierConfig(options map[string]stringList) (*HTTPModifierConfig, error) {
+	config := new(HTTPModifierConfig)
+	flags := modifierFlags(config)
+	for name, values := range options {
+		value, ok := flags[strings.TrimPrefix(name, "--")]
+		if !ok {
+			return nil, fmt.Errorf("unknown modifier %q", name)
+		}
+		for _, v := range values {
+			if err := value.Set(v); err != nil {
+				return nil, fmt.Errorf("invalid value %q of %q: %s", v, name, err)
+			}
+		}
+	}
+	return config, nil
+}
+
+func (plugins *InOutPlugins) registerInput(p PipelinePlugin) interface{} {
+	address := p.Address
+	if p.Limit != "" {
+		address += "|" + p.Limit
+	}
+
+	switch p.Type {
+	case "dummy":
+		return plugins.registerPlugin(NewDummyInput, address)
+	case "raw":
+		return plugins.registerPlugin(NewRAWInput, address, Settings.RAWInputConfig)
+	case "tcp":
+		return plugins.registerPlugin(NewTCPInput, address, &Settings.InputTCPConfig)
+	case "file":
+		return plugins.registerPlugin(NewFileInput, address, Settings.InputFileLoop, Settings.InputFileReadDepth, Settings.InputFileMaxWait, Settings.InputFileDryRun)
+	case "http":
+		return plugins.registerPlugin(NewHTTPInput, address, &Settings.InputHTTPConfig)
+	case "kafka":
+		config := Settings.InputKafkaConfig
+		if p.Address != "" {
+			config.Host = p.Address
+		}
+		return plugins.registerPlugin(NewKafkaInput, address, &config, &Settings.KafkaTLSConfig)
+	}
+	return nil
+}
+
+func (plugins *InOutPlugins) registerOutput(p PipelinePlugin) interface{} {
+	address := p.Address
+	if p.Limit != "" {
+		address += "|" + p.Limit
+	}
+	register := func(constructor interface{}, options ...interface{}) interface{} {
+		return plugins.registerOverflowPlugin(p.Overflow, constructor, options...)
+	}
+
+	switch p.Type {
+	case "dummy", "stdout":
+		return register(NewDummyOutput)
+	case "null":
+		return register(NewNullOutput)
+	case "tcp":
+		return register(NewTCPOutput, address, &Settings.OutputTCPConfig)
+	case "file":
+		if strings.HasPrefix(address, "s3://") {
+			return register(NewS3Output, address, &Settings.OutputFileConfig)
+		}
+		return register(NewFileOutput, address, &Settings.OutputFileConfig)
+	case "pcap":
+		return register(NewPcapOutput, address, &Settings.OutputFileConfig)
+	case "http":
+		return register(NewHTTPOutput, address, &Settings.OutputHTTPConfig)
+	case "websocket":
+		return register(NewWebSocketOutput, address, &Settings.OutputWebSocketConfig)
+	case "grpc":
+		return register(NewGRPCOutput, address, &Settings.OutputHTTPConfig)
+	case "postgres":
+		return register(NewPostgresOutput, address, &Settings.OutputPostgresConfig)
+	case "mysql":
+		return register(NewMySQLOutput, address, &Settings.OutputMySQLConfig)
+	case "redis":
+		return register(NewRedisOutput, address, &Settings.OutputRedisConfig)
+	case "binary":
+		return register(NewBinaryOutput, address, &Settings.OutputBinaryConfig)
+	case "diff":
+		return register(NewDiffOutput, address, &Settings.OutputDiffConfig)
+	case "kafka":
+		config := Settings.OutputKafkaConfig
+		if p.Address != "" {
+			config.Host = p.Address
+		}
+		return register(NewKafkaOutput, address, &config, &Settings.KafkaTLSConfig)
+	}
+	return nil
+}
+
+// registerPipeline initializes plugins and routes declared in the pipeline configuration
+func (plugins *InOutPlugins) registerPipeline(config *PipelineConfig) {
+	inputs := make(map[string]interface{})
+	outputs := make(map[string]interface{})
+
+	for _, p := range config.Inputs {
+		if _, ok := inputs[p.Name]; ok || p.Name == "" {
+			log.Fatalf("[PIPELINE] input name %q is empty or not unique", p.Name)
+		}
+		if inputs[p.Name] = plugins.registerInput(p); inputs[p.Name] == nil {
+			log.Fatalf("[PIPELINE] unknown type %q of input %q", p.Type, p.Name)
+		}
+	}
+
+	for _, p := range config.Outputs {
+		if _, ok := outputs[p.Name]; ok || p.Name == "" {
+			log.Fatalf("[PIPELINE] output name %q is empty or not unique", p.Name)
+		}
+		if outputs[p.Name] = plugins.registerOutput(p); outputs[p.Name] == nil {
+			log.Fatalf("[PIPELINE] unknown type %q of output %q", p.Type, p.Name)
+		}
+	}
+
+	if err := config.checkRouteNames(); err != nil {
+		log.Fatal("[PIPELINE] ", err)
+	}
+	modifiers, err := config.modifierChains()
+	if err != nil {
+		log.Fatal("[PIPELINE] ", err)
+	}
+
+	used := make(map[string]bool)
+	for i, r := range config.Routes {
+		route := &Route{Name: r.routeName(i)}
+
+		for _, name := range r.From {
+			in, ok := inputs[name]
+			if !ok {
+				log.Fatalf("[PIPELINE] route %q: unknown input %q", route.Name, name)
+			}
+			route.Inputs = append(route.Inputs, in.(PluginReader))
+			used[name] = true
+		}
+
+		for _, name := range r.To {
+			out, ok := outputs[name]
+			if !ok {
+				log.Fatalf("[PIPELINE] route %q: unknown output %q", route.Name, name)
+			}
+			// Some of the output can be Readers as well because return responses
+			if _, ok := unwrap(out).(PluginReader); ok {
+				route.Inputs = append(route.Inputs, out.(PluginReader))
+			}
+			if r.Limit != "" {
+				limiter := NewLimiter(out, r.Limit).(*Limiter)
+				route.limiters = append(route.limiters, limiter)
+				out = limiter
+			}
+			route.Outputs = append(route.Outputs, out.(PluginWriter))
+		}
+
+		if route.Modifiers, err = r.modifiers(modifiers); err != nil {
+			log.Fatalf("[PIPELINE] route %q: %s", route.Name, err)
+		}
+
+		if len(route.Inputs) == 0 || len(route.Outputs) == 0 {
+			log.Fatalf("[PIPELINE] route %q requires at least 1 input and 1 output", route.Name)
+		}
+
+		plugins.Routes = append(plugins.Routes, route)
+	}
+
+	for name := range inputs {
+		if !used[name] {
+			log.Fatalf("[PIPELINE] input %q is not used by any route", name)
+		}
+	}
+
+	if config.DLQ != "" {
+		out, ok := outputs[config.DLQ]
+		if !ok {
+			log.Fatalf("[PIPELINE] unknown dlq output %q", config.DLQ)
+		}
+		plugins.dlq = out.(PluginWriter)
+	}
+
+	plugins.pipeline = &pipelineState{config: config, inputs: inputs, outputs: outputs}
+}
+
+// checkRouteNames checks that names of routes are unique, and the name of the implicit route of flags is not used
+func (config *PipelineConfig) checkRouteNames() error {
+	names := make(map[string]bool)
+	for i, r := range config.Routes {
+		name := r.routeName(i)
+		if name == flagsRoute {
+			return fmt.Errorf("route name %q is reserved for plugins defined with flags", name)
+		}
+		if names[name] {
+			return fmt.Errorf("route name %q is not unique", name)
+		}
+		names[name] = true
+	}
+	return nil
+}
+
+func (r PipelineRoute) routeName(i int) string {
+	if r.Name == "" {
+		return fmt.Sprintf("route-%d", i+1)
+	}
+	return r.Name
+}
+
+// modifiers returns configs of modifier chains used by the route
+func (r PipelineRoute) modifiers(chains map[string]*HTTPModifierConfig) ([]*HTTPModifierConfig, error) {
+	var configs []*HTTPModifierConfig
+	for _, name := range r.Modifiers {
+		modifier, ok := chains[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown modifier chain %q", name)
+		}
+		configs = append(configs, modifier)
+	}
+	return configs, nil
+}
+
+func (config *PipelineConfig) modifierChains() (map[string]*HTTPModifierConfig, error) {
+	chains := make(map[string]*HTTPModifierConfig)
+	for name, options := range config.Modifiers {
+		modifier, err := NewModifierConfig(options)
+		if err != nil {
+			return nil, fmt.Errorf("modifier chain %q: %s", name, err)
+		}
+		chains[name] = modifier
+	}
+	return chains, nil
+}
+
+// rules returns modifier rules and limits in a form suitable for logging a diff between reloads
+func (config *PipelineConfig) rules() []string {
+	var rules []string
+	for _, p := range config.Inputs {
+		if p.Limit != "" {
+			rules = append(rules, fmt.Sprintf("input %q limit %s", p.Name, p.Limit))
+		}
+	}
+	for _, p := range config.Outputs {
+		if p.Limit != "" {
+			rules = append(rules, fmt.Sprintf("output %q limit %s", p.Name, p.Limit))
+		}
+	}
+	for i, r := range config.Routes {
+		name := r.routeName(i)
+		if r.Limit != "" {
+			rules = append(rules, fmt.Sprintf("route %q limit %s", name, r.Limit))
+		}
+		for _, chain := range r.Modifiers {
+			for flagName, values := range config.Modifiers[chain] {
+				for _, v := range values {
+					rules = append(rules, fmt.Sprintf("route %q modifier %s --%s %q", name, chain, flagName, v))
+				}
+			}
+		}
+	}
+	sort.Strings(rules)
+	return rules
+}
+
+// rulesDiff returns rules removed (prefixed with "-") and added (prefixed with "+")
+func rulesDiff(old, new []string) (diff []string) {
+	oldSet := make(map[string]bool)
+	for _, r := range old {
+		oldSet[r] = true
+	}
+	newSet := make(map[string]bool)
+	for _, r := range new {
+		newSet[r] = true
+	}
+	for _, r := range old {
+		if !newSet[r] {
+			diff = append(diff, "- "+r)
+		}
+	}
+	for _, r := range new {
+		if !oldSet[r] {
+			diff = append(diff, "+ "+r)
+		}
+	}
+	return
+}
+
+// pipelineState keeps what is needed to reload the running pipeline
+type pipelineState struct {
+	mu      sync.Mutex
+	config  *PipelineConfig
+	inputs  map[string]interface{}
+	outputs map[string]interface{}
+}
+
+// ReloadPipeline re-reads --config file and replaces modifier chains and limits of the running pipeline.
+// Otherwise inputs, outputs and routes are not changed, such changes require restart. Modifiers of the implicit
+// route of flags are rebuilt from the flags, which can't change without restart.
+func (plugins *InOutPlugins) ReloadPipeline() error {
+	state := plugins.pipeline
+	if state == nil {
+		return fmt.Errorf("nothing to reload, pipeline is not configured with --config")
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	config, err := LoadPipelineConfig(Settings.Config)
+	if err != nil {
+		return err
+	}
+	if err = state.validate(config); err != nil {
+		return err
+	}
+	chains, err := config.modifierChains()
+	if err != nil {
+		return err
+	}
+
+	// everything is validated before any change is applied
+	routeModifiers := make([][]*HTTPModifierConfig, len(config.Routes))
+	for i, r := range config.Routes {
+		if routeModifiers[i], err = r.modifiers(chains); err != nil {
+			return fmt.Errorf("route %q: %s", r.routeName(i), err)
+		}
+	}
+
+	for _, p := range config.Inputs {
+		if l, ok := state.inputs[p.Name].(*Limiter); ok {
+			l.Reload(p.Limit)
+		}
+	}
+	for _, p := range config.Outputs {
+		if l, ok := state.outputs[p.Name].(*Limiter); ok {
+			l.Reload(p.Limit)
+		}
+	}
+	routes := plugins.pipelineRoutes()
+	for i, r := range config.Routes {
+		route := routes[r.routeName(i)]
+		for _, l := range route.limiters {
+			l.Reload(r.Limit)
+		}
+		route.SetModifiers(routeModifiers[i])
+	}
+	if route, ok := routes[flagsRoute]; ok {
+		route.SetModifiers(route.Modifiers)
+	}
+
+	diff := rulesDiff(state.config.rules(), config.rules())
+	state.config = config
+
+	if len(diff) == 0 {
+		Debug(0, "[PIPELINE] Reloaded, no rules changed")
+	} else {
+		Debug(0, "[PIPELINE] Reloaded, changed rules:\n"+strings.Join(diff, "\n"))
+	}
+	return nil
+}
+
+func (plugins *InOutPlugins) pipelineRoutes() map[string]*Route {
+	routes := make(map[string]*Route)
+	for _, r := range plugins.Routes {
+		routes[r.Name] = r
+	}
+	return routes
+}
+
+// validate checks that only reloadable parts of the config were changed
+func (state *pipelineState) validate(config *PipelineConfig) error {
+	old := state.config
+	if err := config.checkRouteNames(); err != nil {
+		return err
+	}
+	if len(config.Inputs) != len(old.Inputs) || len(config.Outputs) != len(old.Outputs) || len(config.Routes) != len(old.Routes) {
+		return fmt.Errorf("inputs, outputs and routes can't be added or removed without restart")
+	}
+	if config.DLQ != old.DLQ {
+		return fmt.Errorf("dlq can't be changed without restart")
+	}
+	for i, p := range config.Inputs {
+		o := old.Inputs[i]
+		if p.Name != o.Name || p.Type != o.Type || p.Address != o.Address || p.Overflow != o.Overflow {
+			return fmt.Errorf("input %q can't be changed without restart, only limit can be reloaded", p.Name)
+		}
+		if (p.Limit == "") != (o.Limit == "") {
+			return fmt.Errorf("input %q: limit can't be added or removed without restart", p.Name)
+		}
+	}
+	for i, p := range config.Outputs {
+		o := old.Outputs[i]
+		if p.Name != o.Name || p.Type != o.Type || p.Address != o.Address || p.Overflow != o.Overflow {
+			return fmt.Errorf("output %q can't be changed without restart, only limit can be reloaded", p.Name)
+		}
+		if (p.Limit == "") != (o.Limit == "") {
+			return fmt.Errorf("output %q: limit can't be added or removed without restart", p.Name)
+		}
+	}
+	for i, r := range config.Routes {
+		o := old.Routes[i]
+		if r.routeName(i) != o.routeName(i) || strings.Join(r.From, ",") != strings.Join(o.From, ",") || strings.Join(r.To, ",") != strings.Join(o.To, ",") {
+			return fmt.Errorf("route %q: inputs and outputs can't be changed without restart", r.routeName(i))
+		}
+		if (r.Limit == "") != (o.Limit == "") {
+			return fmt.Errorf("route %q: limit can't be added or removed without restart", r.routeName(i))
+		}
+	}
+	return nil
+}
+
+// WatchPipeline reloads the pipeline on SIGHUP, and on changes of --config file if interval is set
+func (plugins *InOutPlugins) WatchPipeline(signals <-chan os.Signal, interval time.Duration) {
+	var modTime time.Time
+	if stat, err := os.Stat(Settings.Config); err == nil {
+		modTime = stat.ModTime()
+	}
+
+	var check <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		check = ticker.C
+	}
+
+	for {
+		select {
+		case _, ok := <-signals:
+			if !ok {
+				return
+			}
+		case <-check:
+			stat, err := os.Stat(Settings.Config)
+			if err != nil || stat.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = stat.ModTime()
+		}
+
+		if err := plugins.ReloadPipeline(); err != nil {
+			Debug(0, "[PIPELINE] Reload failed, keeping previous rules:", err)
+		}
+	}
+}
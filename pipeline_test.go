@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+const testPipelineConfig = `
+inputs:
+  - name: replay
+    type: dummy
+    limit: 1000
+outputs:
+  - name: discard
+    type: "null"
+  - name: sample
+    type: "null"
+    overflow: drop-newest
+  - name: lost
+    type: "null"
+dlq: lost
+modifiers:
+  v2:
+    http-set-header: "X-Version: 2"
+    http-allow-method: [GET, HEAD]
+routes:
+  - name: v2
+    from: replay
+    to: [discard, sample]
+    modifiers: v2
+    limit: 10%
+  - from: replay
+    to: discard
+`
+
+func TestPipelineConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "gor_pipeline_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(testPipelineConfig)
+	f.Close()
+
+	config, err := LoadPipelineConfig(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plugins := new(InOutPlugins)
+	plugins.registerPipeline(config)
+
+	if len(plugins.Inputs) != 1 || len(plugins.Outputs) != 3 {
+		t.Fatalf("Should be 1 input and 3 outputs, got %d and %d", len(plugins.Inputs), len(plugins.Outputs))
+	}
+	if plugins.dlq != plugins.Outputs[2] {
+		t.Errorf("Output %q should be dead-letter output", config.DLQ)
+	}
+
+	if len(plugins.Routes) != 2 {
+		t.Fatalf("Should be 2 routes, got %d", len(plugins.Routes))
+	}
+
+	route := plugins.Routes[0]
+	if route.Name != "v2" || len(route.Inputs) != 1 || len(route.Outputs) != 2 || len(route.Modifiers) != 1 {
+		t.Errorf("Wrong route: %+v", route)
+	}
+	if l, ok := route.Outputs[0].(*Limiter); !ok || l.limit != 10 || !l.isPercent {
+		t.Errorf("Route outputs should be wrapped in limiter")
+	}
+	if q, ok := plugins.Outputs[1].(*OverflowQueue); !ok || q.policy != OverflowDropNewest {
+		t.Errorf("Output with overflow policy should be wrapped in overflow queue")
+	}
+	modifier := route.Modifiers[0]
+	if len(modifier.Headers) != 1 || modifier.Headers[0].Name != "X-Version" || len(modifier.Methods) != 2 {
+		t.Errorf("Wrong modifier config: %+v", modifier)
+	}
+
+	route = plugins.Routes[1]
+	if route.Name != "route-2" || len(route.Modifiers) != 0 {
+		t.Errorf("Wrong route: %+v", route)
+	}
+	if _, ok := route.Outputs[0].(*NullOutput); !ok {
+		t.Errorf("Output without route limit should not be wrapped")
+	}
+}
+
+func TestNewModifierConfigUnknown(t *testing.T) {
+	if _, err := NewModifierConfig(map[string]stringList{"http-unknown": {"1"}}); err == nil {
+		t.Error("Should fail on unknown modifier")
+	}
+	if _, err := NewModifierConfig(map[string]stringList{"http-set-header": {"no-colon"}}); err == nil {
+		t.Error("Should fail on invalid modifier value")
+	}
+}
+
+func TestEmitterRoutes(t *testing.T) {
+	wg := new(sync.WaitGroup)
+
+	input1 := NewTestInput()
+	input2 := NewTestInput()
+
+	var mu sync.Mutex
+	var received1, received2 [][]byte
+	output1 := NewTestOutput(func(msg *Message) {
+		mu.Lock()
+		received1 = append(received1, msg.Data)
+		mu.Unlock()
+		wg.Done()
+	})
+	output2 := NewTestOutput(func(msg *Message) {
+		mu.Lock()
+		received2 = append(received2, msg.Data)
+		mu.Unlock()
+		wg.Done()
+	})
+
+	modifier, _ := NewModifierConfig(map[string]stringList{"http-set-header": {"X-Route: 1"}})
+
+	plugins := &InOutPlugins{
+		Inputs:  []PluginReader{input1, input2},
+		Outputs: []PluginWriter{output1, output2},
+		Routes: []*Route{
+			{Name: "first", Inputs: []PluginReader{input1}, Outputs: []PluginWriter{output1}, Modifiers: []*HTTPModifierConfig{modifier}},
+			{Name: "second", Inputs: []PluginReader{input1, input2}, Outputs: []PluginWriter{output2}},
+		},
+	}
+	plugins.All = append(plugins.All, input1, input2, output1, output2)
+
+	emitter := NewEmitter()
+	go emitter.Start(plugins, "")
+
+	wg.Add(3)
+	input1.EmitGET()
+	input2.EmitOPTIONS()
+	wg.Wait()
+	emitter.Close()
+
+	if len(received1) != 1 || !bytes.Contains(received1[0], []byte("X-Route: 1")) {
+		t.Errorf("First route should receive modified request from first input: %q", received1)
+	}
+	if len(received2) != 2 {
+		t.Fatalf("Second route should receive requests from both inputs: %q", received2)
+	}
+	for _, data := range received2 {
+		if bytes.Contains(data, []byte("X-Route")) {
+			t.Errorf("Modifier of the first route should not affect second route: %q", data)
+		}
+	}
+}
+
+func TestPipelineReload(t *testing.T) {
+	f, err := ioutil.TempFile("", "gor_pipeline_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(testPipelineConfig)
+	f.Close()
+
+	Settings.Config = f.Name()
+	defer func() { Settings.Config = "" }()
+
+	config, _ := LoadPipelineConfig(f.Name())
+	plugins := new(InOutPlugins)
+	plugins.registerPipeline(config)
+	route := plugins.Routes[0]
+	newRouteWriter(route)
+	flags := &Route{Name: flagsRoute, Modifiers: []*HTTPModifierConfig{{Methods: HTTPMethods{[]byte("GET")}}}}
+	plugins.Routes = append(plugins.Routes, flags)
+	newRouteWriter(flags)
+	flagsChain := flags.modifierChain()
+
+	reloaded := strings.Replace(testPipelineConfig, "X-Version: 2", "X-Version: 3", 1)
+	reloaded = strings.Replace(reloaded, "limit: 10%", "limit: 50%", 1)
+	reloaded = strings.Replace(reloaded, "limit: 1000", "limit: 500", 1)
+	ioutil.WriteFile(f.Name(), []byte(reloaded), 0644)
+
+	if err := plugins.ReloadPipeline(); err != nil {
+		t.Fatal(err)
+	}
+
+	chain := route.modifierChain()
+	if len(chain.configs) != 1 || chain.configs[0].Headers[0].Value != "3" {
+		t.Errorf("Modifiers should be reloaded: %+v", chain.configs)
+	}
+	if l := route.Outputs[0].(*Limiter); l.limit != 50 {
+		t.Errorf("Route limit should be reloaded: %s", l)
+	}
+	if l := plugins.Inputs[0].(*Limiter); l.limitOptions() != "500" {
+		t.Errorf("Input limit should be reloaded: %s", l)
+	}
+	if chain := flags.modifierChain(); chain == flagsChain || len(chain.modifiers) != 1 {
+		t.Errorf("Modifiers of flags should be rebuilt: %+v", chain)
+	}
+
+	// changing inputs requires restart
+	ioutil.WriteFile(f.Name(), []byte(strings.Replace(reloaded, "type: dummy", "type: tcp", 1)), 0644)
+	if err := plugins.ReloadPipeline(); err == nil {
+		t.Error("Should not reload changed inputs")
+	}
+
+	// changing outputs requires restart
+	ioutil.WriteFile(f.Name(), []byte(strings.Replace(reloaded, "to: discard", "to: sample", 1)), 0644)
+	if err := plugins.ReloadPipeline(); err == nil {
+		t.Error("Should not reload changed routes")
+	}
+	if chain := route.modifierChain(); chain.configs[0].Headers[0].Value != "3" {
+		t.Error("Failed reload should keep previous rules")
+	}
+}
+
+func TestPipelineRouteNames(t *testing.T) {
+	for _, routes := range []string{
+		"routes: [{name: a, from: x, to: y}, {name: a, from: x, to: y}]",
+		"routes: [{from: x, to: y}, {name: route-1, from: x, to: y}]",
+		"routes: [{name: flags, from: x, to: y}]",
+	} {
+		config := new(PipelineConfig)
+		if err := yaml.Unmarshal([]byte(routes), config); err != nil {
+			t.Fatal(err)
+		}
+		if err := config.checkRouteNames(); err == nil {
+			t.Errorf("Route names should be rejected: %s", routes)
+		}
+	}
+}
+
+func TestRulesDiff(t *testing.T) {
+	diff := rulesDiff([]string{"a", "b"}, []string{"b", "c"})
+	if strings.Join(diff, ",") != "- a,+ c" {
+		t.Errorf("Wrong diff: %q", diff)
+	}
+}
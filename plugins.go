@@ -1,14 +1,20 @@
 package main
 
 import (
+	"log"
 	"reflect"
 	"strings"
+	"sync"
+
+	"github.com/buger/goreplay/tcp"
 )
 
 // Message represents data across plugins
 type Message struct {
 	Meta []byte // metadata
 	Data []byte // actual data
+
+	packets []tcp.CapturedPacket // packets of the message, if it was read from raw input
 }
 
 // PluginReader is an interface for input plugins
@@ -32,6 +38,19 @@ type InOutPlugins struct {
 	Inputs  []PluginReader
 	Outputs []PluginWriter
 	All     []interface{}
+	Routes  []*Route
+
+	mu sync.Mutex // guards All, which is changed by Emitter while the admin API reads it
+
+	pipeline *pipelineState
+	dlq      PluginWriter // dead-letter output
+}
+
+// snapshot returns a copy of All, which can be used while Emitter changes it
+func (plugins *InOutPlugins) snapshot() []interface{} {
+	plugins.mu.Lock()
+	defer plugins.mu.Unlock()
+	return append([]interface{}(nil), plugins.All...)
 }
 
 // extractLimitOptions detects if plugin get called with limiter support
@@ -49,7 +68,12 @@ func extractLimitOptions(options string) (string, string) {
 // Automatically detects type of plugin and initialize it
 //
 // See this article if curious about reflect stuff below: http://blog.burntsushi.net/type-parametric-functions-golang
-func (plugins *InOutPlugins) registerPlugin(constructor interface{}, options ...interface{}) {
+func (plugins *InOutPlugins) registerPlugin(constructor interface{}, options ...interface{}) interface{} {
+	return plugins.registerOverflowPlugin("", constructor, options...)
+}
+
+// registerOverflowPlugin is registerPlugin with overflow policy of the output, --output-overflow is used if it is empty
+func (plugins *InOutPlugins) registerOverflowPlugin(overflow string, constructor interface{}, options ...interface{}) interface{} {
 	var path, limit string
 	vc := reflect.ValueOf(constructor)
 
@@ -70,25 +94,43 @@ func (plugins *InOutPlugins) registerPlugin(constructor interface{}, options ...
 	// Calling our constructor with list of given options
 	plugin := vc.Call(vo)[0].Interface()
 
+	if overflow == "" {
+		overflow = Settings.OutputOverflowConfig.Policy
+	}
+	if _, ok := plugin.(PluginWriter); ok && overflow != "" && overflow != OverflowBlock {
+		plugin = NewOverflowQueue(plugin, overflow, &Settings.OutputOverflowConfig)
+	}
+
 	if limit != "" {
 		plugin = NewLimiter(plugin, limit)
 	}
 
-	// Some of the output can be Readers as well because return responses
-	if r, ok := plugin.(PluginReader); ok {
-		plugins.Inputs = append(plugins.Inputs, r)
+	// Some of the output can be Readers as well because return responses,
+	// wrappers implement both interfaces, so the wrapped plugin is checked
+	if _, ok := unwrap(plugin).(PluginReader); ok {
+		plugins.Inputs = append(plugins.Inputs, plugin.(PluginReader))
 	}
 
-	if w, ok := plugin.(PluginWriter); ok {
-		plugins.Outputs = append(plugins.Outputs, w)
+	if _, ok := unwrap(plugin).(PluginWriter); ok {
+		plugins.Outputs = append(plugins.Outputs, plugin.(PluginWriter))
 	}
 	plugins.All = append(plugins.All, plugin)
+
+	return plugin
 }
 
 // NewPlugins specify and initialize all available plugins
 func NewPlugins() *InOutPlugins {
 	plugins := new(InOutPlugins)
 
+	if Settings.GRPCDescriptorSet != "" {
+		codec, err := NewGRPCCodec(Settings.GRPCDescriptorSet)
+		if err != nil {
+			log.Fatal("[GRPC] ", err)
+		}
+		grpcCodec = codec
+	}
+
 	for _, options := range Settings.InputDummy {
 		plugins.registerPlugin(NewDummyInput, options)
 	}
@@ -121,6 +163,10 @@ func NewPlugins() *InOutPlugins {
 		plugins.registerPlugin(NewFileInput, options, Settings.InputFileLoop, Settings.InputFileReadDepth, Settings.InputFileMaxWait, Settings.InputFileDryRun)
 	}
 
+	for _, path := range Settings.OutputPcap {
+		plugins.registerPlugin(NewPcapOutput, path, &Settings.OutputFileConfig)
+	}
+
 	for _, path := range Settings.OutputFile {
 		if strings.HasPrefix(path, "s3://") {
 			plugins.registerPlugin(NewS3Output, path, &Settings.OutputFileConfig)
@@ -130,7 +176,7 @@ func NewPlugins() *InOutPlugins {
 	}
 
 	for _, options := range Settings.InputHTTP {
-		plugins.registerPlugin(NewHTTPInput, options)
+		plugins.registerPlugin(NewHTTPInput, options, &Settings.InputHTTPConfig)
 	}
 
 	// If we explicitly set Host header http output should not rewrite it
@@ -146,10 +192,34 @@ func NewPlugins() *InOutPlugins {
 		plugins.registerPlugin(NewHTTPOutput, options, &Settings.OutputHTTPConfig)
 	}
 
+	for _, options := range Settings.OutputWebSocket {
+		plugins.registerPlugin(NewWebSocketOutput, options, &Settings.OutputWebSocketConfig)
+	}
+
+	for _, options := range Settings.OutputGRPC {
+		plugins.registerPlugin(NewGRPCOutput, options, &Settings.OutputHTTPConfig)
+	}
+
+	for _, options := range Settings.OutputPostgres {
+		plugins.registerPlugin(NewPostgresOutput, options, &Settings.OutputPostgresConfig)
+	}
+
+	for _, options := range Settings.OutputMySQL {
+		plugins.registerPlugin(NewMySQLOutput, options, &Settings.OutputMySQLConfig)
+	}
+
+	for _, options := range Settings.OutputRedis {
+		plugins.registerPlugin(NewRedisOutput, options, &Settings.OutputRedisConfig)
+	}
+
 	for _, options := range Settings.OutputBinary {
 		plugins.registerPlugin(NewBinaryOutput, options, &Settings.OutputBinaryConfig)
 	}
 
+	for _, path := range Settings.OutputDiff {
+		plugins.registerPlugin(NewDiffOutput, path, &Settings.OutputDiffConfig)
+	}
+
 	if Settings.OutputKafkaConfig.Host != "" && Settings.OutputKafkaConfig.Topic != "" {
 		plugins.registerPlugin(NewKafkaOutput, "", &Settings.OutputKafkaConfig, &Settings.KafkaTLSConfig)
 	}
@@ -158,5 +228,44 @@ func NewPlugins() *InOutPlugins {
 		plugins.registerPlugin(NewKafkaInput, "", &Settings.InputKafkaConfig, &Settings.KafkaTLSConfig)
 	}
 
+	if Settings.Config != "" {
+		config, err := LoadPipelineConfig(Settings.Config)
+		if err != nil {
+			log.Fatal("[PIPELINE] ", err)
+		}
+		if Settings.Middleware != "" {
+			log.Fatal("[PIPELINE] --middleware can't be used together with --config")
+		}
+
+		// Plugins defined with flags are connected with each other, like without --config
+		if len(plugins.Inputs) > 0 && len(plugins.Outputs) > 0 {
+			plugins.Routes = append(plugins.Routes, &Route{
+				Name:      flagsRoute,
+				Inputs:    append([]PluginReader(nil), plugins.Inputs...),
+				Outputs:   append([]PluginWriter(nil), plugins.Outputs...),
+				Modifiers: []*HTTPModifierConfig{&Settings.ModifierConfig},
+			})
+		}
+
+		plugins.registerPipeline(config)
+	}
+
+	dlqOption := Settings.OutputDLQ
+	if Settings.OutputDeadLetter != "" {
+		if dlqOption != "" {
+			log.Fatal("[DLQ] --output-dead-letter is a shorthand of --output-dlq file:<path>, they can't be used together")
+		}
+		dlqOption = "file:" + Settings.OutputDeadLetter
+	}
+	if dlqOption != "" {
+		if plugins.dlq != nil {
+			log.Fatal("[DLQ] --output-dlq can't be used together with dlq of --config")
+		}
+		// it gets only failed messages, so it is not one of outputs
+		plugins.dlq = NewDLQOutput(dlqOption)
+		plugins.All = append(plugins.All, plugins.dlq)
+	}
+	setDLQ(plugins.dlq)
+
 	return plugins
 }
@@ -41,3 +41,22 @@ func TestPluginsRegistration(t *testing.T) {
 	}
 
 }
+
+func TestPluginsOverflow(t *testing.T) {
+	Settings.OutputOverflowConfig.Policy = OverflowDropOldest
+	defer func() { Settings.OutputOverflowConfig.Policy = OverflowBlock }()
+
+	plugins := new(InOutPlugins)
+	plugins.registerPlugin(NewNullOutput)
+	plugins.registerOverflowPlugin(OverflowBlock, NewNullOutput)
+	defer plugins.All[0].(*OverflowQueue).Close()
+
+	if q, ok := plugins.Outputs[0].(*OverflowQueue); !ok || q.policy != OverflowDropOldest {
+		t.Errorf("output should be wrapped in overflow queue, got %T", plugins.Outputs[0])
+	} else if _, ok := unwrap(q).(*NullOutput); !ok {
+		t.Errorf("NullOutput should be wrapped, got %T", unwrap(q))
+	}
+	if _, ok := plugins.Outputs[1].(*NullOutput); !ok {
+		t.Errorf("output with block policy should not be wrapped, got %T", plugins.Outputs[1])
+	}
+}
@@ -0,0 +1,106 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/textproto"
+)
+
+// GRPCFrameHeaderLen is the length of the prefix of every gRPC message: compression flag and message length
+const GRPCFrameHeaderLen = 5
+
+var (
+	errGRPCFrame = errors.New("invalid gRPC message prefix")
+	errChunked   = errors.New("invalid chunked encoding")
+)
+
+// GRPCFrame is a single length-prefixed message of gRPC call
+type GRPCFrame struct {
+	Compressed bool
+	Data       []byte
+}
+
+// IsGRPC checks if HTTP payload belongs to gRPC call, using its Content-Type
+func IsGRPC(payload []byte) bool {
+	return bytes.HasPrefix(Header(payload, []byte("Content-Type")), []byte("application/grpc"))
+}
+
+// GRPCFrames splits body of gRPC request or response into length-prefixed messages
+func GRPCFrames(body []byte) (frames []GRPCFrame, err error) {
+	for len(body) > 0 {
+		if len(body) < GRPCFrameHeaderLen || body[0] > 1 {
+			return frames, errGRPCFrame
+		}
+		n := int(binary.BigEndian.Uint32(body[1:]))
+		if len(body)-GRPCFrameHeaderLen < n {
+			return frames, errGRPCFrame
+		}
+		frames = append(frames, GRPCFrame{body[0] == 1, body[GRPCFrameHeaderLen : GRPCFrameHeaderLen+n]})
+		body = body[GRPCFrameHeaderLen+n:]
+	}
+	return
+}
+
+// AppendGRPCFrame appends length-prefixed message to buf
+func AppendGRPCFrame(buf []byte, f GRPCFrame) []byte {
+	var prefix [GRPCFrameHeaderLen]byte
+	if f.Compressed {
+		prefix[0] = 1
+	}
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(f.Data)))
+	return append(append(buf, prefix[:]...), f.Data...)
+}
+
+// SplitMessage splits HTTP payload into headers section (including the empty line), decoded body and raw trailers section.
+// Trailers are returned only for chunked bodies, and include the final empty line.
+func SplitMessage(payload []byte) (headers, body, trailers []byte, err error) {
+	pos := MIMEHeadersEndPos(payload)
+	if pos == -1 {
+		return payload, nil, nil, nil
+	}
+	headers, body = payload[:pos], payload[pos:]
+	if !bytes.Equal(Header(headers, []byte("Transfer-Encoding")), []byte("chunked")) {
+		return
+	}
+	body, trailers, err = dechunk(body)
+	return
+}
+
+// dechunk decodes chunked body, and returns trailers section which follows the last chunk
+func dechunk(data []byte) (body, trailers []byte, err error) {
+	for {
+		i := bytes.Index(data, CRLF)
+		if i < 0 {
+			return body, nil, errChunked
+		}
+		size := data[:i]
+		if j := bytes.IndexByte(size, ';'); j >= 0 {
+			// chunk extensions
+			size = size[:j]
+		}
+		n, ok := atoI(bytes.TrimSpace(size), 16)
+		if !ok || n < 0 || len(data)-i-2 < n+2 {
+			return body, nil, errChunked
+		}
+		data = data[i+2:]
+		if n == 0 {
+			return body, data, nil
+		}
+		body = append(body, data[:n]...)
+		data = data[n+2:]
+	}
+}
+
+// GRPCStatus returns grpc-status of response, it is sent in trailers or in headers of trailers-only responses
+func GRPCStatus(payload []byte) []byte {
+	headers, _, trailers, _ := SplitMessage(payload)
+	if len(trailers) > 0 {
+		tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(trailers)))
+		if h, _ := tp.ReadMIMEHeader(); h.Get("Grpc-Status") != "" {
+			return []byte(h.Get("Grpc-Status"))
+		}
+	}
+	return Header(headers, []byte("Grpc-Status"))
+}
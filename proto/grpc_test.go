@@ -0,0 +1,47 @@
+package proto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGRPCFrames(t *testing.T) {
+	body := AppendGRPCFrame(nil, GRPCFrame{Data: []byte("first")})
+	body = AppendGRPCFrame(body, GRPCFrame{Compressed: true, Data: []byte("second")})
+	body = AppendGRPCFrame(body, GRPCFrame{})
+
+	frames, err := GRPCFrames(body)
+	if err != nil || len(frames) != 3 {
+		t.Fatal(frames, err)
+	}
+	if string(frames[0].Data) != "first" || frames[0].Compressed || string(frames[1].Data) != "second" || !frames[1].Compressed || len(frames[2].Data) != 0 {
+		t.Errorf("Wrong frames: %v", frames)
+	}
+	if _, err = GRPCFrames(body[:len(body)-7]); err == nil {
+		t.Error("Should fail on truncated message")
+	}
+}
+
+func TestGRPCStatus(t *testing.T) {
+	payload := []byte("HTTP/1.1 200 OK\r\nContent-Type: application/grpc\r\nTransfer-Encoding: chunked\r\nTrailer: Grpc-Status\r\n\r\n" +
+		"3\r\nabc\r\n0\r\nGrpc-Status: 5\r\nGrpc-Message: not found\r\n\r\n")
+	if !IsGRPC(payload) {
+		t.Error("Should be gRPC payload")
+	}
+	if s := GRPCStatus(payload); string(s) != "5" {
+		t.Errorf("Wrong status: %q", s)
+	}
+	headers, body, trailers, err := SplitMessage(payload)
+	if err != nil || !bytes.HasSuffix(headers, EmptyLine) || string(body) != "abc" || string(trailers) != "Grpc-Status: 5\r\nGrpc-Message: not found\r\n\r\n" {
+		t.Errorf("Wrong split: %q %q %q %v", headers, body, trailers, err)
+	}
+
+	// trailers-only response
+	payload = []byte("HTTP/1.1 200 OK\r\nContent-Type: application/grpc+proto\r\nGrpc-Status: 12\r\nContent-Length: 0\r\n\r\n")
+	if s := GRPCStatus(payload); string(s) != "12" {
+		t.Errorf("Wrong status: %q", s)
+	}
+	if IsGRPC([]byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n")) {
+		t.Error("Should not be gRPC payload")
+	}
+}
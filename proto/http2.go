@@ -0,0 +1,374 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+// HTTP2Preface is sent by client at the start of HTTP/2 connection
+var HTTP2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+// HTTP/2 frame types, RFC 7540 6
+const (
+	http2FrameData         = 0x0
+	http2FrameHeaders      = 0x1
+	http2FrameRSTStream    = 0x3
+	http2FrameSettings     = 0x4
+	http2FramePushPromise  = 0x5
+	http2FrameContinuation = 0x9
+)
+
+// HTTP/2 frame flags
+const (
+	http2FlagEndStream  = 0x1
+	http2FlagAck        = 0x1
+	http2FlagEndHeaders = 0x4
+	http2FlagPadded     = 0x8
+	http2FlagPriority   = 0x20
+)
+
+const (
+	http2FrameHeaderLen       = 9
+	http2SettingHeaderTable   = 0x1
+	http2DefaultHeaderTable   = 4096
+	http2MaxConcurrentStreams = 1024
+)
+
+var (
+	errHTTP2Preface = errors.New("invalid HTTP/2 connection preface")
+	errHTTP2Frame   = errors.New("invalid HTTP/2 frame")
+	errHTTP2Streams = errors.New("too many HTTP/2 streams in progress")
+)
+
+// connection specific headers which are not allowed in HTTP/2, and headers set by the conversion
+var http2SkipHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+	"content-length":    true,
+	"trailer":           true,
+}
+
+// HTTP2Message is a request or response of a single HTTP/2 stream converted to HTTP/1.1 format.
+// Messages with trailers use chunked transfer encoding, others get Content-Length.
+type HTTP2Message struct {
+	StreamID uint32
+	Head     []byte // request or status line and headers
+	Body     []byte
+	Start    time.Time // time of the first frame
+	End      time.Time // time of the last frame
+}
+
+// Payload returns the whole HTTP/1.1 message
+func (m *HTTP2Message) Payload() []byte {
+	return append(m.Head[:len(m.Head):len(m.Head)], m.Body...)
+}
+
+type http2Stream struct {
+	headers  []hpack.HeaderField
+	trailers []hpack.HeaderField
+	body     []byte
+	start    time.Time
+}
+
+// HTTP2Decoder decodes frames sent in one direction of HTTP/2 connection, header blocks
+// are decompressed with HPACK state of the connection, so decoding has to start with the connection.
+type HTTP2Decoder struct {
+	client  bool
+	peer    *HTTP2Decoder
+	preface bool
+	hpack   *hpack.Decoder
+	streams map[uint32]*http2Stream
+
+	// header block continued with CONTINUATION frames
+	block       []byte
+	blockStream uint32
+	blockEnd    bool // END_STREAM flag of the HEADERS frame
+	blockPush   bool // block of PUSH_PROMISE frame
+}
+
+// NewHTTP2Decoders returns decoders of frames sent by client and server of the same connection
+func NewHTTP2Decoders() (client, server *HTTP2Decoder) {
+	client = &HTTP2Decoder{client: true, preface: true}
+	server = &HTTP2Decoder{}
+	for _, d := range []*HTTP2Decoder{client, server} {
+		d.hpack = hpack.NewDecoder(http2DefaultHeaderTable, nil)
+		d.streams = make(map[uint32]*http2Stream)
+	}
+	client.peer, server.peer = server, client
+	return
+}
+
+// Decode decodes complete frames from the start of data, and returns number of decoded bytes
+// together with messages completed by them. ts is the time when data was received.
+func (d *HTTP2Decoder) Decode(data []byte, ts time.Time) (n int, messages []*HTTP2Message, err error) {
+	if d.preface {
+		if len(data) < len(HTTP2Preface) {
+			return 0, nil, nil
+		}
+		if !bytes.HasPrefix(data, HTTP2Preface) {
+			return 0, nil, errHTTP2Preface
+		}
+		d.preface = false
+		n = len(HTTP2Preface)
+	}
+
+	for len(data)-n >= http2FrameHeaderLen {
+		hdr := data[n:]
+		length := int(hdr[0])<<16 | int(hdr[1])<<8 | int(hdr[2])
+		if len(hdr) < http2FrameHeaderLen+length {
+			break
+		}
+		typ, flags := hdr[3], hdr[4]
+		id := binary.BigEndian.Uint32(hdr[5:]) & (1<<31 - 1)
+		payload := hdr[http2FrameHeaderLen : http2FrameHeaderLen+length]
+		n += http2FrameHeaderLen + length
+
+		m, err := d.frame(typ, flags, id, payload, ts)
+		if err != nil {
+			return n, messages, err
+		}
+		if m != nil {
+			messages = append(messages, m)
+		}
+	}
+	return
+}
+
+func (d *HTTP2Decoder) frame(typ, flags byte, id uint32, payload []byte, ts time.Time) (*HTTP2Message, error) {
+	if d.block != nil && (typ != http2FrameContinuation || id != d.blockStream) {
+		return nil, errHTTP2Frame
+	}
+
+	var err error
+	switch typ {
+	case http2FrameData:
+		if payload, err = http2Unpad(flags, payload); err != nil {
+			return nil, err
+		}
+		s := d.streams[id]
+		if s == nil {
+			// stream started before the capture
+			return nil, nil
+		}
+		s.body = append(s.body, payload...)
+		if flags&http2FlagEndStream != 0 {
+			return d.finish(id, ts), nil
+		}
+	case http2FrameHeaders:
+		if payload, err = http2Unpad(flags, payload); err != nil {
+			return nil, err
+		}
+		if flags&http2FlagPriority != 0 {
+			if len(payload) < 5 {
+				return nil, errHTTP2Frame
+			}
+			payload = payload[5:]
+		}
+		return d.headerBlock(id, flags, payload, flags&http2FlagEndStream != 0, false, ts)
+	case http2FramePushPromise:
+		if payload, err = http2Unpad(flags, payload); err != nil {
+			return nil, err
+		}
+		if len(payload) < 4 {
+			return nil, errHTTP2Frame
+		}
+		// promised requests are not sent by client, but the block still changes HPACK state
+		return d.headerBlock(id, flags, payload[4:], false, true, ts)
+	case http2FrameContinuation:
+		if d.block == nil {
+			return nil, errHTTP2Frame
+		}
+		return d.headerBlock(id, flags, payload, d.blockEnd, d.blockPush, ts)
+	case http2FrameRSTStream:
+		delete(d.streams, id)
+		delete(d.peer.streams, id)
+	case http2FrameSettings:
+		if flags&http2FlagAck != 0 || len(payload)%6 != 0 {
+			break
+		}
+		// header table size limits HPACK encoder of the peer
+		for i := 0; i < len(payload); i += 6 {
+			if binary.BigEndian.Uint16(payload[i:]) == http2SettingHeaderTable {
+				d.peer.hpack.SetAllowedMaxDynamicTableSize(binary.BigEndian.Uint32(payload[i+2:]))
+			}
+		}
+	}
+	return nil, nil
+}
+
+func http2Unpad(flags byte, payload []byte) ([]byte, error) {
+	if flags&http2FlagPadded == 0 {
+		return payload, nil
+	}
+	if len(payload) < 1 || int(payload[0]) >= len(payload) {
+		return nil, errHTTP2Frame
+	}
+	return payload[1 : len(payload)-int(payload[0])], nil
+}
+
+// headerBlock collects header block fragments and decodes the block when it is complete
+func (d *HTTP2Decoder) headerBlock(id uint32, flags byte, fragment []byte, endStream, push bool, ts time.Time) (*HTTP2Message, error) {
+	if flags&http2FlagEndHeaders == 0 {
+		d.block = append(d.block, fragment...)
+		if d.block == nil {
+			d.block = []byte{}
+		}
+		d.blockStream, d.blockEnd, d.blockPush = id, endStream, push
+		return nil, nil
+	}
+	if d.block != nil {
+		fragment = append(d.block, fragment...)
+		d.block = nil
+	}
+
+	fields, err := d.hpack.DecodeFull(fragment)
+	if err != nil || push {
+		return nil, err
+	}
+	// streams initiated by server are pushed responses, they have no requests
+	if !d.client && id%2 == 0 {
+		return nil, nil
+	}
+
+	s := d.streams[id]
+	switch {
+	case s == nil:
+		if len(d.streams) >= http2MaxConcurrentStreams {
+			return nil, errHTTP2Streams
+		}
+		s = &http2Stream{start: ts}
+		d.streams[id] = s
+		s.headers = fields
+	case !d.client && http2Informational(s.headers):
+		// final response follows 1xx responses
+		s.headers = fields
+	default:
+		s.trailers = fields
+	}
+	if !d.client && http2Informational(s.headers) {
+		return nil, nil
+	}
+
+	if endStream {
+		return d.finish(id, ts), nil
+	}
+	return nil, nil
+}
+
+func http2Informational(fields []hpack.HeaderField) bool {
+	for _, f := range fields {
+		if f.Name == ":status" {
+			return len(f.Value) == 3 && f.Value[0] == '1'
+		}
+	}
+	return false
+}
+
+func (d *HTTP2Decoder) finish(id uint32, ts time.Time) *HTTP2Message {
+	s := d.streams[id]
+	delete(d.streams, id)
+
+	m := &HTTP2Message{StreamID: id, Start: s.start, End: ts}
+	head := d.head(s)
+	m.Head = head[:len(head):len(head)]
+	m.Body = s.body
+	if len(s.trailers) > 0 {
+		m.Body = http2Chunked(s.body, s.trailers)
+	}
+	return m
+}
+
+// head converts pseudo headers to request or status line, and adds headers describing the body
+func (d *HTTP2Decoder) head(s *http2Stream) []byte {
+	var method, path, authority, status string
+	var cookies []string
+	var buf bytes.Buffer
+
+	for _, f := range s.headers {
+		switch f.Name {
+		case ":method":
+			method = f.Value
+		case ":path":
+			path = f.Value
+		case ":authority":
+			authority = f.Value
+		case ":status":
+			status = f.Value
+		}
+	}
+	if d.client {
+		if path == "" {
+			// CONNECT requests have only authority
+			path = authority
+		}
+		buf.WriteString(method + " " + path + " HTTP/1.1\r\n")
+		if authority != "" && !http2HasField(s.headers, "host") {
+			buf.WriteString("Host: " + authority + "\r\n")
+		}
+	} else {
+		code, _ := strconv.Atoi(status)
+		buf.WriteString("HTTP/1.1 " + status + " " + http.StatusText(code) + "\r\n")
+	}
+
+	for _, f := range s.headers {
+		switch {
+		case strings.HasPrefix(f.Name, ":") || http2SkipHeaders[f.Name]:
+		case f.Name == "cookie":
+			// HTTP/2 allows cookie to be split into several fields, RFC 7540 8.1.2.5
+			cookies = append(cookies, f.Value)
+		default:
+			buf.WriteString(http.CanonicalHeaderKey(f.Name) + ": " + f.Value + "\r\n")
+		}
+	}
+	if len(cookies) > 0 {
+		buf.WriteString("Cookie: " + strings.Join(cookies, "; ") + "\r\n")
+	}
+
+	switch {
+	case len(s.trailers) > 0:
+		names := make([]string, 0, len(s.trailers))
+		for _, f := range s.trailers {
+			names = append(names, http.CanonicalHeaderKey(f.Name))
+		}
+		buf.WriteString("Transfer-Encoding: chunked\r\nTrailer: " + strings.Join(names, ", ") + "\r\n")
+	case len(s.body) > 0 || !d.client || http2HasField(s.headers, "content-length"):
+		buf.WriteString("Content-Length: " + strconv.Itoa(len(s.body)) + "\r\n")
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+func http2HasField(fields []hpack.HeaderField, name string) bool {
+	for _, f := range fields {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// http2Chunked encodes body as a single chunk followed by trailers
+func http2Chunked(body []byte, trailers []hpack.HeaderField) []byte {
+	var buf bytes.Buffer
+	if len(body) > 0 {
+		buf.WriteString(strconv.FormatInt(int64(len(body)), 16) + "\r\n")
+		buf.Write(body)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("0\r\n")
+	for _, f := range trailers {
+		buf.WriteString(http.CanonicalHeaderKey(f.Name) + ": " + f.Value + "\r\n")
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,129 @@
+package proto
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+type http2TestConn struct {
+	buf     bytes.Buffer
+	framer  *http2.Framer
+	encoder *hpack.Encoder
+	block   bytes.Buffer
+}
+
+func newHTTP2TestConn(client bool) *http2TestConn {
+	c := new(http2TestConn)
+	if client {
+		c.buf.Write(HTTP2Preface)
+	}
+	c.framer = http2.NewFramer(&c.buf, nil)
+	c.encoder = hpack.NewEncoder(&c.block)
+	return c
+}
+
+func (c *http2TestConn) encode(fields ...string) []byte {
+	c.block.Reset()
+	for i := 0; i < len(fields); i += 2 {
+		c.encoder.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	return append([]byte(nil), c.block.Bytes()...)
+}
+
+func TestHTTP2DecodeRequest(t *testing.T) {
+	client, _ := NewHTTP2Decoders()
+	c := newHTTP2TestConn(true)
+	c.framer.WriteSettings(http2.Setting{ID: http2.SettingInitialWindowSize, Val: 1 << 20})
+
+	// headers split into CONTINUATION frame, padded body split into two frames
+	block := c.encode(":method", "POST", ":scheme", "http", ":path", "/upload?a=1", ":authority", "example.com",
+		"content-type", "text/plain", "cookie", "a=1", "cookie", "b=2", "content-length", "11")
+	c.framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: block[:5]})
+	c.framer.WriteContinuation(1, true, block[5:])
+	c.framer.WriteDataPadded(1, false, []byte("Hello "), []byte{0, 0, 0})
+	c.framer.WriteData(1, true, []byte("world"))
+
+	// second request reuses HPACK dynamic table
+	c.framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 3, EndHeaders: true, EndStream: true,
+		BlockFragment: c.encode(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "example.com", "content-type", "text/plain")})
+
+	data := c.buf.Bytes()
+	var messages []*HTTP2Message
+	for start, end := 0, 0; end < len(data); {
+		// data arrives in small pieces
+		end += 7
+		if end > len(data) {
+			end = len(data)
+		}
+		n, m, err := client.Decode(data[start:end], time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		start += n
+		messages = append(messages, m...)
+	}
+
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(messages))
+	}
+	expected := "POST /upload?a=1 HTTP/1.1\r\nHost: example.com\r\nContent-Type: text/plain\r\nCookie: a=1; b=2\r\nContent-Length: 11\r\n\r\nHello world"
+	if got := string(messages[0].Payload()); messages[0].StreamID != 1 || got != expected {
+		t.Errorf("Wrong request:\n%q\nexpected:\n%q", got, expected)
+	}
+	expected = "GET / HTTP/1.1\r\nHost: example.com\r\nContent-Type: text/plain\r\n\r\n"
+	if got := string(messages[1].Payload()); messages[1].StreamID != 3 || got != expected {
+		t.Errorf("Wrong request:\n%q\nexpected:\n%q", got, expected)
+	}
+	if !HasFullPayload(nil, messages[0].Payload()) || !HasFullPayload(nil, messages[1].Payload()) {
+		t.Error("Converted requests should be complete")
+	}
+}
+
+func TestHTTP2DecodeResponse(t *testing.T) {
+	client, server := NewHTTP2Decoders()
+	c := newHTTP2TestConn(false)
+	c.framer.WriteSettings()
+
+	// 100 Continue is skipped, trailers make the body chunked
+	c.framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, EndHeaders: true, BlockFragment: c.encode(":status", "100")})
+	c.framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, EndHeaders: true, BlockFragment: c.encode(":status", "200", "content-type", "application/grpc")})
+	c.framer.WriteData(1, false, []byte("body"))
+	c.framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, EndHeaders: true, EndStream: true, BlockFragment: c.encode("grpc-status", "0", "grpc-message", "ok")})
+
+	// pushed responses and reset streams are ignored
+	c.framer.WritePushPromise(http2.PushPromiseParam{StreamID: 1, PromiseID: 2, EndHeaders: true,
+		BlockFragment: c.encode(":method", "GET", ":path", "/style.css", ":scheme", "http", ":authority", "example.com")})
+	c.framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 2, EndHeaders: true, EndStream: true, BlockFragment: c.encode(":status", "200")})
+	c.framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 3, EndHeaders: true, BlockFragment: c.encode(":status", "200")})
+	c.framer.WriteRSTStream(3, http2.ErrCodeCancel)
+
+	c.framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 5, EndHeaders: true, EndStream: true, BlockFragment: c.encode(":status", "404")})
+
+	n, messages, err := server.Decode(c.buf.Bytes(), time.Now())
+	if err != nil || n != c.buf.Len() {
+		t.Fatal(n, err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(messages))
+	}
+	expected := "HTTP/1.1 200 OK\r\nContent-Type: application/grpc\r\nTransfer-Encoding: chunked\r\nTrailer: Grpc-Status, Grpc-Message\r\n\r\n" +
+		"4\r\nbody\r\n0\r\nGrpc-Status: 0\r\nGrpc-Message: ok\r\n\r\n"
+	if got := string(messages[0].Payload()); got != expected {
+		t.Errorf("Wrong response:\n%q\nexpected:\n%q", got, expected)
+	}
+	if !HasFullPayload(nil, messages[0].Payload()) {
+		t.Error("Converted response should be complete")
+	}
+	expected = "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n"
+	if got := string(messages[1].Payload()); messages[1].StreamID != 5 || got != expected {
+		t.Errorf("Wrong response:\n%q\nexpected:\n%q", got, expected)
+	}
+
+	if _, _, err := client.Decode([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), time.Now()); err == nil {
+		t.Error("Should fail without connection preface")
+	}
+}
@@ -0,0 +1,429 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// MySQLMaxPacket is the biggest payload of MySQL packet, longer payloads continue in the next packet
+const MySQLMaxPacket = 0xffffff
+
+// MySQL command bytes, https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_command_phase.html
+const (
+	MySQLComQuit             = 0x01
+	MySQLComInitDB           = 0x02
+	MySQLComQuery            = 0x03
+	MySQLComFieldList        = 0x04
+	MySQLComStatistics       = 0x09
+	MySQLComPing             = 0x0e
+	MySQLComChangeUser       = 0x11
+	MySQLComStmtPrepare      = 0x16
+	MySQLComStmtExecute      = 0x17
+	MySQLComStmtSendLongData = 0x18
+	MySQLComStmtClose        = 0x19
+	MySQLComStmtReset        = 0x1a
+	MySQLComSetOption        = 0x1b
+	MySQLComStmtFetch        = 0x1c
+	MySQLComResetConnection  = 0x1f
+)
+
+// MySQL capability flags
+const (
+	MySQLClientLongPassword             = 0x1
+	MySQLClientLongFlag                 = 0x4
+	MySQLClientConnectWithDB            = 0x8
+	MySQLClientCompress                 = 0x20
+	MySQLClientLocalFiles               = 0x80
+	MySQLClientProtocol41               = 0x200
+	MySQLClientSSL                      = 0x800
+	MySQLClientTransactions             = 0x2000
+	MySQLClientSecureConnection         = 0x8000
+	MySQLClientMultiStatements          = 1 << 16
+	MySQLClientMultiResults             = 1 << 17
+	MySQLClientPSMultiResults           = 1 << 18
+	MySQLClientPluginAuth               = 1 << 19
+	MySQLClientConnectAttrs             = 1 << 20
+	MySQLClientPluginAuthLenencData     = 1 << 21
+	MySQLClientDeprecateEOF             = 1 << 24
+	mysqlServerMoreResultsExists        = 0x8
+	mysqlServerStatusCursorExists       = 0x40
+	mysqlHandshakeResponseFixedFieldLen = 32
+)
+
+// MySQLPacket parses header of the packet at the start of data: payload length and sequence id,
+// ok is false if the header is not complete
+func MySQLPacket(data []byte) (length int, seq byte, ok bool) {
+	if len(data) < 4 {
+		return
+	}
+	return int(data[0]) | int(data[1])<<8 | int(data[2])<<16, data[3], true
+}
+
+// MySQLPackets checks if data holds only complete packets, and returns sequence id of the first one
+func MySQLPackets(data []byte) (seq byte, ok bool) {
+	if len(data) < 4 {
+		return
+	}
+	seq = data[3]
+	for len(data) > 0 {
+		n, _, ok := MySQLPacket(data)
+		if !ok || len(data) < 4+n {
+			return seq, false
+		}
+		data = data[4+n:]
+	}
+	return seq, true
+}
+
+// AppendMySQLPacket appends packet with the payload to buf, payload should be shorter than MySQLMaxPacket
+func AppendMySQLPacket(buf []byte, seq byte, payload []byte) []byte {
+	n := len(payload)
+	return append(append(buf, byte(n), byte(n>>8), byte(n>>16), seq), payload...)
+}
+
+// MySQLHasResponse checks if server answers the command
+func MySQLHasResponse(command byte) bool {
+	switch command {
+	case MySQLComQuit, MySQLComStmtSendLongData, MySQLComStmtClose:
+		return false
+	}
+	return true
+}
+
+// IsMySQLCommand checks if b is a known command byte
+func IsMySQLCommand(b byte) bool {
+	return b >= MySQLComQuit && b <= MySQLComResetConnection && b != 0x1e
+}
+
+// MySQLHandshake is the initial handshake packet sent by server
+type MySQLHandshake struct {
+	Capabilities uint32
+	Charset      byte
+	AuthData     []byte // nonce used to scramble the password
+	AuthPlugin   string
+}
+
+// ParseMySQLHandshake parses payload of protocol 10 handshake packet
+func ParseMySQLHandshake(payload []byte) (h MySQLHandshake, ok bool) {
+	if len(payload) < 1 || payload[0] != 10 {
+		return
+	}
+	i := bytes.IndexByte(payload[1:], 0)
+	if i < 0 {
+		return
+	}
+	p := payload[i+2:]
+	// connection id, first part of auth data, filler, lower capabilities
+	if len(p) < 4+8+1+2 {
+		return
+	}
+	h.AuthData = append(h.AuthData, p[4:12]...)
+	h.Capabilities = uint32(binary.LittleEndian.Uint16(p[13:]))
+	p = p[15:]
+	if len(p) < 1+2+2+1+10 {
+		return h, true
+	}
+	h.Charset = p[0]
+	h.Capabilities |= uint32(binary.LittleEndian.Uint16(p[3:])) << 16
+	authLen := int(p[5])
+	p = p[16:]
+	if h.Capabilities&MySQLClientSecureConnection != 0 {
+		n := authLen - 8
+		if n < 13 {
+			n = 13
+		}
+		if len(p) < n {
+			return h, true
+		}
+		// the second part ends with zero byte
+		h.AuthData = append(h.AuthData, bytes.TrimRight(p[:n], "\x00")...)
+		p = p[n:]
+	}
+	if h.Capabilities&MySQLClientPluginAuth != 0 {
+		h.AuthPlugin = string(cString(p))
+	}
+	return h, true
+}
+
+// MySQLHandshakeResponse is the response of client to the initial handshake
+type MySQLHandshakeResponse struct {
+	Capabilities uint32
+	Charset      byte
+	User         string
+	AuthResponse []byte
+	Database     string
+	AuthPlugin   string
+}
+
+// ParseMySQLHandshakeResponse parses payload of HandshakeResponse41 packet. SSLRequest has only the fixed fields.
+func ParseMySQLHandshakeResponse(payload []byte) (h MySQLHandshakeResponse, ok bool) {
+	if len(payload) < mysqlHandshakeResponseFixedFieldLen {
+		return
+	}
+	h.Capabilities = binary.LittleEndian.Uint32(payload)
+	if h.Capabilities&MySQLClientProtocol41 == 0 || !bytes.Equal(payload[9:32], make([]byte, 23)) {
+		return
+	}
+	h.Charset = payload[8]
+	p := payload[32:]
+	if len(p) == 0 {
+		return h, h.Capabilities&MySQLClientSSL != 0
+	}
+
+	i := bytes.IndexByte(p, 0)
+	if i < 0 {
+		return
+	}
+	h.User, p = string(p[:i]), p[i+1:]
+	switch {
+	case h.Capabilities&MySQLClientPluginAuthLenencData != 0:
+		n, l := mysqlLenencInt(p)
+		if l == 0 || uint64(len(p)-l) < n {
+			return
+		}
+		h.AuthResponse, p = p[l:l+int(n)], p[l+int(n):]
+	case h.Capabilities&MySQLClientSecureConnection != 0:
+		if len(p) < 1 || len(p)-1 < int(p[0]) {
+			return
+		}
+		h.AuthResponse, p = p[1:1+int(p[0])], p[1+int(p[0]):]
+	default:
+		h.AuthResponse = cString(p)
+		p = p[min(len(h.AuthResponse)+1, len(p)):]
+	}
+	if h.Capabilities&MySQLClientConnectWithDB != 0 && len(p) > 0 {
+		h.Database = string(cString(p))
+		p = p[min(len(h.Database)+1, len(p)):]
+	}
+	if h.Capabilities&MySQLClientPluginAuth != 0 && len(p) > 0 {
+		h.AuthPlugin = string(cString(p))
+	}
+	return h, true
+}
+
+// Marshal returns payload of HandshakeResponse41 packet, connection attributes are not supported
+func (h *MySQLHandshakeResponse) Marshal() []byte {
+	caps := h.Capabilities&^MySQLClientConnectAttrs | MySQLClientProtocol41
+	if h.Database != "" {
+		caps |= MySQLClientConnectWithDB
+	} else {
+		caps &^= MySQLClientConnectWithDB
+	}
+
+	p := make([]byte, mysqlHandshakeResponseFixedFieldLen, 64)
+	binary.LittleEndian.PutUint32(p, caps)
+	binary.LittleEndian.PutUint32(p[4:], MySQLMaxPacket)
+	p[8] = h.Charset
+	p = append(append(p, h.User...), 0)
+	switch {
+	case caps&MySQLClientPluginAuthLenencData != 0:
+		p = appendMySQLLenencInt(p, uint64(len(h.AuthResponse)))
+		p = append(p, h.AuthResponse...)
+	case caps&MySQLClientSecureConnection != 0:
+		p = append(append(p, byte(len(h.AuthResponse))), h.AuthResponse...)
+	default:
+		p = append(append(p, h.AuthResponse...), 0)
+	}
+	if caps&MySQLClientConnectWithDB != 0 {
+		p = append(append(p, h.Database...), 0)
+	}
+	if caps&MySQLClientPluginAuth != 0 {
+		p = append(append(p, h.AuthPlugin...), 0)
+	}
+	return p
+}
+
+// MySQLQuery returns text of the query of COM_QUERY or COM_STMT_PREPARE packet at the start of data
+func MySQLQuery(data []byte) []byte {
+	n, _, ok := MySQLPacket(data)
+	if !ok || n < 1 || len(data) < 4+n {
+		return nil
+	}
+	switch data[4] {
+	case MySQLComQuery, MySQLComStmtPrepare:
+		return data[5 : 4+n]
+	}
+	return nil
+}
+
+// MySQLResponse finds the end of response to a command, it is fed with payloads of response packets
+type MySQLResponse struct {
+	Command      byte
+	DeprecateEOF bool // CLIENT_DEPRECATE_EOF capability is negotiated
+
+	state int
+	left  int  // definitions left
+	cont  bool // previous packet continues in the next one
+}
+
+const (
+	mysqlFirst = iota
+	mysqlColumns
+	mysqlColumnsEnd
+	mysqlRows
+	mysqlDefinitions
+	mysqlWaitOK
+)
+
+// Add adds payload of the next packet, it returns true when the response is complete
+func (r *MySQLResponse) Add(payload []byte) bool {
+	if r.cont || len(payload) == 0 {
+		r.cont = len(payload) == MySQLMaxPacket
+		return false
+	}
+	r.cont = len(payload) == MySQLMaxPacket
+	first := payload[0]
+
+	switch r.state {
+	case mysqlFirst:
+		switch r.Command {
+		case MySQLComQuery, MySQLComStmtExecute:
+			switch {
+			case first == 0x00 || first == 0xff:
+				return r.end(payload)
+			case first == 0xfb && r.Command == MySQLComQuery:
+				// LOCAL INFILE request, client sends the file and server answers with OK
+				r.state = mysqlWaitOK
+			default:
+				n, l := mysqlLenencInt(payload)
+				if l == 0 || n == 0 {
+					return true
+				}
+				r.state, r.left = mysqlColumns, int(n)
+			}
+			return false
+		case MySQLComStmtPrepare:
+			if first != 0x00 || len(payload) < 9 {
+				return true
+			}
+			columns := int(binary.LittleEndian.Uint16(payload[5:]))
+			params := int(binary.LittleEndian.Uint16(payload[7:]))
+			r.left = params + columns
+			if !r.DeprecateEOF {
+				r.left += min(params, 1) + min(columns, 1)
+			}
+			r.state = mysqlDefinitions
+			return r.left == 0
+		case MySQLComFieldList, MySQLComStmtFetch:
+			r.state = mysqlRows
+			return r.Add(payload)
+		case MySQLComChangeUser:
+			// authentication exchange
+			return first == 0x00 || first == 0xff
+		}
+		return true
+	case mysqlColumns:
+		r.left--
+		if r.left == 0 {
+			r.state = mysqlColumnsEnd
+		}
+		return false
+	case mysqlColumnsEnd:
+		if mysqlEOF(payload) {
+			// columns are followed by EOF, unless CLIENT_DEPRECATE_EOF is set
+			if r.Command == MySQLComStmtExecute && mysqlStatus(payload)&mysqlServerStatusCursorExists != 0 {
+				// rows are read with COM_STMT_FETCH
+				return true
+			}
+			r.state = mysqlRows
+			return false
+		}
+		r.state = mysqlRows
+		return r.Add(payload)
+	case mysqlRows:
+		if first == 0xff || first == 0xfe && len(payload) < MySQLMaxPacket {
+			return r.end(payload)
+		}
+		return false
+	case mysqlDefinitions:
+		r.left--
+		return r.left == 0
+	case mysqlWaitOK:
+		if first == 0x00 || first == 0xff {
+			return r.end(payload)
+		}
+		return false
+	}
+	return true
+}
+
+// end checks if OK, EOF or ERR packet which ends the result is followed by more results
+func (r *MySQLResponse) end(payload []byte) bool {
+	if payload[0] != 0xff && mysqlStatus(payload)&mysqlServerMoreResultsExists != 0 {
+		r.state = mysqlFirst
+		return false
+	}
+	return true
+}
+
+// mysqlEOF checks if payload is EOF packet, which is shorter than OK packet with 0xfe header
+func mysqlEOF(payload []byte) bool {
+	return len(payload) == 5 && payload[0] == 0xfe
+}
+
+// mysqlStatus returns status flags of OK or EOF packet
+func mysqlStatus(payload []byte) uint16 {
+	if mysqlEOF(payload) {
+		return binary.LittleEndian.Uint16(payload[3:])
+	}
+	p := payload[1:]
+	for i := 0; i < 2; i++ {
+		// affected rows and last insert id
+		_, l := mysqlLenencInt(p)
+		if l == 0 {
+			return 0
+		}
+		p = p[l:]
+	}
+	if len(p) < 2 {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(p)
+}
+
+// mysqlLenencInt decodes length-encoded integer, l is 0 if it is not complete
+func mysqlLenencInt(p []byte) (n uint64, l int) {
+	if len(p) == 0 {
+		return
+	}
+	switch p[0] {
+	case 0xfc:
+		l = 3
+	case 0xfd:
+		l = 4
+	case 0xfe:
+		l = 9
+	default:
+		return uint64(p[0]), 1
+	}
+	if len(p) < l {
+		return 0, 0
+	}
+	for i := l - 1; i > 0; i-- {
+		n = n<<8 | uint64(p[i])
+	}
+	return n, l
+}
+
+func appendMySQLLenencInt(p []byte, n uint64) []byte {
+	switch {
+	case n < 0xfb:
+		return append(p, byte(n))
+	case n < 1<<16:
+		return append(p, 0xfc, byte(n), byte(n>>8))
+	case n < 1<<24:
+		return append(p, 0xfd, byte(n), byte(n>>8), byte(n>>16))
+	}
+	p = append(p, 0xfe)
+	for i := 0; i < 8; i++ {
+		p = append(p, byte(n>>(8*i)))
+	}
+	return p
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
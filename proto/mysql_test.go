@@ -0,0 +1,74 @@
+package proto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMySQLHandshake(t *testing.T) {
+	greeting := []byte("\x0a8.0.30\x00\x01\x00\x00\x00abcdefgh\x00\xff\xff\x2d\x02\x00\xff\xdf\x15\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00ijklmnopqrst\x00caching_sha2_password\x00")
+	h, ok := ParseMySQLHandshake(greeting)
+	if !ok || string(h.AuthData) != "abcdefghijklmnopqrst" || h.AuthPlugin != "caching_sha2_password" || h.Charset != 0x2d || h.Capabilities&MySQLClientPluginAuth == 0 {
+		t.Errorf("Wrong handshake: %+v", h)
+	}
+
+	resp := MySQLHandshakeResponse{
+		Capabilities: MySQLClientProtocol41 | MySQLClientSecureConnection | MySQLClientPluginAuth | MySQLClientDeprecateEOF,
+		Charset:      45,
+		User:         "app",
+		AuthResponse: []byte("0123456789abcdefghij"),
+		Database:     "shop",
+		AuthPlugin:   "mysql_native_password",
+	}
+	parsed, ok := ParseMySQLHandshakeResponse(resp.Marshal())
+	resp.Capabilities |= MySQLClientConnectWithDB
+	if !ok || parsed.Capabilities != resp.Capabilities || parsed.User != resp.User || !bytes.Equal(parsed.AuthResponse, resp.AuthResponse) || parsed.Database != resp.Database || parsed.AuthPlugin != resp.AuthPlugin {
+		t.Errorf("Wrong handshake response: %+v", parsed)
+	}
+
+	ssl := make([]byte, 32)
+	ssl[1] = 0x0a // SSL and PROTOCOL_41
+	if h, ok := ParseMySQLHandshakeResponse(ssl); !ok || h.Capabilities&MySQLClientSSL == 0 {
+		t.Errorf("Expected SSLRequest")
+	}
+	if _, ok := ParseMySQLHandshakeResponse([]byte("\x03SELECT 1")); ok {
+		t.Errorf("Command is not a handshake response")
+	}
+}
+
+func TestMySQLResponse(t *testing.T) {
+	column := "\x03def\x00\x00\x00\x01a\x00\x0c\x3f\x00\x01\x00\x00\x00\x08\x81\x00\x00\x00\x00"
+	eof := "\xfe\x00\x00\x02\x00"
+	moreEOF := "\xfe\x00\x00\x0a\x00"
+	tests := []struct {
+		name         string
+		command      byte
+		deprecateEOF bool
+		packets      []string
+	}{
+		{"ok", MySQLComQuery, false, []string{"\x00\x01\x00\x02\x00\x00\x00"}},
+		{"error", MySQLComQuery, false, []string{"\xff\x7a\x04#42S02Table 'shop.x' doesn't exist"}},
+		{"result set", MySQLComQuery, false, []string{"\x01", column, eof, "\x011", "\x012", eof}},
+		{"result set with OK", MySQLComQuery, true, []string{"\x01", column, "\x011", "\xfe\x00\x00\x02\x00\x00\x00"}},
+		{"empty result set with OK", MySQLComQuery, true, []string{"\x01", column, "\xfe\x00\x00\x02\x00\x00\x00"}},
+		{"error in rows", MySQLComQuery, false, []string{"\x01", column, eof, "\x011", "\xff\x7a\x04"}},
+		{"multiple results", MySQLComQuery, false, []string{"\x00\x01\x00\x0a\x00\x00\x00", "\x01", column, eof, "\x011", moreEOF, "\x00\x00\x00\x02\x00\x00\x00"}},
+		{"local infile", MySQLComQuery, false, []string{"\xfbdata.csv", "\x00\x03\x00\x02\x00\x00\x00"}},
+		{"binary rows", MySQLComStmtExecute, false, []string{"\x01", column, eof, "\x00\x00\x01\x00\x00\x00", eof}},
+		{"cursor", MySQLComStmtExecute, false, []string{"\x01", column, "\xfe\x00\x00\x42\x00"}},
+		{"prepare", MySQLComStmtPrepare, false, []string{"\x00\x01\x00\x00\x00\x01\x00\x02\x00\x00\x00\x00", column, column, eof, column, eof}},
+		{"prepare without EOF", MySQLComStmtPrepare, true, []string{"\x00\x01\x00\x00\x00\x01\x00\x02\x00\x00\x00\x00", column, column, column}},
+		{"prepare without columns", MySQLComStmtPrepare, false, []string{"\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"}},
+		{"field list", MySQLComFieldList, false, []string{column, column, eof}},
+		{"ping", MySQLComPing, false, []string{"\x00\x00\x00\x02\x00\x00\x00"}},
+	}
+	for _, tt := range tests {
+		r := MySQLResponse{Command: tt.command, DeprecateEOF: tt.deprecateEOF}
+		for i, p := range tt.packets {
+			if done := r.Add([]byte(p)); done != (i == len(tt.packets)-1) {
+				t.Errorf("%s: packet %d, expected complete response %v", tt.name, i, !done)
+				break
+			}
+		}
+	}
+}
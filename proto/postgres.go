@@ -0,0 +1,169 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+)
+
+// Codes sent by PostgreSQL client in place of protocol version of the untyped startup message,
+// https://www.postgresql.org/docs/current/protocol-message-formats.html
+const (
+	PostgresProtocolVersion = 196608 // 3.0
+	PostgresCancelRequest   = 80877102
+	PostgresSSLRequest      = 80877103
+	PostgresGSSENCRequest   = 80877104
+)
+
+// PostgresMaxMessage limits length of messages, bigger ones are treated as invalid
+const PostgresMaxMessage = 1 << 30
+
+var (
+	postgresFrontend [256]bool
+	postgresBackend  [256]bool
+)
+
+func init() {
+	for _, t := range []byte("BCdcfDEHFPpQSX") {
+		postgresFrontend[t] = true
+	}
+	for _, t := range []byte("RK23CGHWdcfDIEVvnNAtS1sTZ") {
+		postgresBackend[t] = true
+	}
+}
+
+// IsPostgresFrontend checks if typ is a type of message sent by client
+func IsPostgresFrontend(typ byte) bool {
+	return postgresFrontend[typ]
+}
+
+// IsPostgresBackend checks if typ is a type of message sent by server
+func IsPostgresBackend(typ byte) bool {
+	return postgresBackend[typ]
+}
+
+// PostgresStartup parses header of untyped message sent by client first: startup message, or
+// SSLRequest, GSSENCRequest and CancelRequest. It returns length of the whole message and its code,
+// ok is false if data does not start with such message.
+func PostgresStartup(data []byte) (n int, code uint32, ok bool) {
+	if len(data) < 8 {
+		return
+	}
+	n = int(binary.BigEndian.Uint32(data))
+	code = binary.BigEndian.Uint32(data[4:])
+	switch code {
+	case PostgresSSLRequest, PostgresGSSENCRequest:
+		ok = n == 8
+	case PostgresCancelRequest:
+		ok = n == 16
+	case PostgresProtocolVersion:
+		ok = n >= 9 && n <= 10000
+	}
+	return
+}
+
+// PostgresMessage parses header of typed message at the start of data. It returns type of the message
+// and length including the type byte, ok is false if the header is not complete or is invalid.
+func PostgresMessage(data []byte) (typ byte, n int, ok bool) {
+	if len(data) < 5 {
+		return
+	}
+	l := binary.BigEndian.Uint32(data[1:])
+	if l < 4 || l > PostgresMaxMessage {
+		return
+	}
+	return data[0], int(l) + 1, true
+}
+
+// PostgresMessages checks if data holds only complete typed messages of valid types,
+// frontend selects the types of messages sent by client
+func PostgresMessages(data []byte, frontend bool) bool {
+	if len(data) == 0 {
+		return false
+	}
+	for len(data) > 0 {
+		typ, n, ok := PostgresMessage(data)
+		if !ok || n > len(data) {
+			return false
+		}
+		if frontend && !IsPostgresFrontend(typ) || !frontend && !IsPostgresBackend(typ) {
+			return false
+		}
+		data = data[n:]
+	}
+	return true
+}
+
+// AppendPostgresMessage appends typed message with the body to buf
+func AppendPostgresMessage(buf []byte, typ byte, body []byte) []byte {
+	var header [5]byte
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(len(body)+4))
+	return append(append(buf, header[:]...), body...)
+}
+
+// PostgresStartupParams returns parameters of startup message, such as user and database
+func PostgresStartupParams(msg []byte) map[string]string {
+	n, code, ok := PostgresStartup(msg)
+	if !ok || code != PostgresProtocolVersion || len(msg) < n {
+		return nil
+	}
+	params := make(map[string]string)
+	fields := bytes.Split(msg[8:n], []byte{0})
+	for i := 0; i+1 < len(fields); i += 2 {
+		if len(fields[i]) == 0 {
+			break
+		}
+		params[string(fields[i])] = string(fields[i+1])
+	}
+	return params
+}
+
+// NewPostgresStartup builds startup message with the parameters
+func NewPostgresStartup(params map[string]string) []byte {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	msg := make([]byte, 8, 64)
+	binary.BigEndian.PutUint32(msg[4:], PostgresProtocolVersion)
+	for _, k := range keys {
+		msg = append(append(msg, k...), 0)
+		msg = append(append(msg, params[k]...), 0)
+	}
+	msg = append(msg, 0)
+	binary.BigEndian.PutUint32(msg, uint32(len(msg)))
+	return msg
+}
+
+// PostgresQuery returns text of the query sent with Query or Parse message at the start of data
+func PostgresQuery(data []byte) []byte {
+	for len(data) > 0 {
+		typ, n, ok := PostgresMessage(data)
+		if !ok || n > len(data) {
+			return nil
+		}
+		body := data[5:n]
+		switch typ {
+		case 'Q':
+			return cString(body)
+		case 'P':
+			// statement name precedes the query
+			if i := bytes.IndexByte(body, 0); i >= 0 {
+				return cString(body[i+1:])
+			}
+			return nil
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func cString(b []byte) []byte {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return b[:i]
+	}
+	return b
+}
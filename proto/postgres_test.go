@@ -0,0 +1,61 @@
+package proto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPostgresStartup(t *testing.T) {
+	params := map[string]string{"user": "app", "database": "shop", "application_name": "web"}
+	msg := NewPostgresStartup(params)
+	n, code, ok := PostgresStartup(msg)
+	if !ok || n != len(msg) || code != PostgresProtocolVersion {
+		t.Errorf("Wrong startup message header: %d %d %v", n, code, ok)
+	}
+	parsed := PostgresStartupParams(msg)
+	if len(parsed) != len(params) {
+		t.Errorf("Wrong parameters: %v", parsed)
+	}
+	for k, v := range params {
+		if parsed[k] != v {
+			t.Errorf("Wrong parameter %s: %q", k, parsed[k])
+		}
+	}
+
+	if _, code, ok = PostgresStartup([]byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}); !ok || code != PostgresSSLRequest {
+		t.Errorf("Expected SSLRequest")
+	}
+	if _, _, ok = PostgresStartup([]byte("Q\x00\x00\x00\x0dSELECT 1\x00")); ok {
+		t.Errorf("Typed message is not a startup message")
+	}
+}
+
+func TestPostgresMessages(t *testing.T) {
+	query := AppendPostgresMessage(nil, 'Q', []byte("SELECT 1\x00"))
+	extended := AppendPostgresMessage(AppendPostgresMessage(nil, 'P', []byte("stmt\x00SELECT $1\x00\x00\x00")), 'S', nil)
+
+	typ, n, ok := PostgresMessage(query)
+	if !ok || typ != 'Q' || n != len(query) {
+		t.Errorf("Wrong message header: %c %d %v", typ, n, ok)
+	}
+	if _, _, ok = PostgresMessage(query[:4]); ok {
+		t.Errorf("Header should be incomplete")
+	}
+
+	if !PostgresMessages(append(query, extended...), true) {
+		t.Errorf("Expected frontend messages")
+	}
+	if PostgresMessages(query[:len(query)-1], true) {
+		t.Errorf("Incomplete message should not match")
+	}
+	if PostgresMessages(AppendPostgresMessage(nil, 'Z', []byte("I")), true) || !PostgresMessages(AppendPostgresMessage(nil, 'Z', []byte("I")), false) {
+		t.Errorf("ReadyForQuery is sent only by server")
+	}
+
+	if q := PostgresQuery(query); !bytes.Equal(q, []byte("SELECT 1")) {
+		t.Errorf("Wrong query: %q", q)
+	}
+	if q := PostgresQuery(extended); !bytes.Equal(q, []byte("SELECT $1")) {
+		t.Errorf("Wrong query of Parse: %q", q)
+	}
+}
@@ -0,0 +1,269 @@
+package proto
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// RedisMaxValue limits length of bulk strings and aggregates, bigger ones are treated as invalid
+const RedisMaxValue = 512 << 20
+
+// redisMaxInline limits length of inline commands, as Redis server does
+const redisMaxInline = 64 << 10
+
+// redisLine returns the line at the start of data without CRLF, and length of the line with CRLF.
+// n is 0 if the line is not complete.
+func redisLine(data []byte) (line []byte, n int) {
+	i := bytes.Index(data, []byte("\r\n"))
+	if i < 0 {
+		return nil, 0
+	}
+	return data[:i], i + 2
+}
+
+func redisInt(line []byte) (int, bool) {
+	n, err := strconv.Atoi(string(line))
+	return n, err == nil && n >= -1 && n <= RedisMaxValue
+}
+
+// RedisValue parses RESP2 or RESP3 value at the start of data. It returns length of the value,
+// which is 0 if data does not hold the whole value, ok is false if data is not a valid value.
+func RedisValue(data []byte) (n int, ok bool) {
+	// values still to be parsed, aggregates add their elements
+	for left := 1; left > 0; left-- {
+		if len(data) == n {
+			return 0, true
+		}
+		typ := data[n]
+		line, l := redisLine(data[n+1:])
+		if l == 0 {
+			return 0, len(data)-n < redisMaxInline
+		}
+		n += 1 + l
+		switch typ {
+		case '+', '-', ':', '_', ',', '#', '(':
+		case '$', '!', '=':
+			size, ok := redisInt(line)
+			if !ok {
+				return 0, false
+			}
+			if size < 0 {
+				continue
+			}
+			if len(data) < n+size+2 {
+				return 0, true
+			}
+			if data[n+size] != '\r' || data[n+size+1] != '\n' {
+				return 0, false
+			}
+			n += size + 2
+		case '*', '~', '>', '%', '|':
+			size, ok := redisInt(line)
+			if !ok {
+				return 0, false
+			}
+			if typ == '%' || typ == '|' {
+				size *= 2
+			}
+			if size > 0 {
+				left += size
+			}
+		default:
+			return 0, false
+		}
+	}
+	return n, true
+}
+
+// RedisCommand parses command at the start of data, sent as array of bulk strings or as inline command.
+// It returns arguments of the command and its length, which is 0 if data does not hold the whole command,
+// ok is false if data is not a valid command.
+func RedisCommand(data []byte) (args [][]byte, n int, ok bool) {
+	if len(data) == 0 {
+		return nil, 0, true
+	}
+	if data[0] != '*' {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			return nil, 0, len(data) < redisMaxInline
+		}
+		return bytes.Fields(data[:i]), i + 1, true
+	}
+
+	line, l := redisLine(data[1:])
+	if l == 0 {
+		return nil, 0, len(data) < redisMaxInline
+	}
+	size, ok := redisInt(line)
+	if !ok || size < 1 {
+		return nil, 0, false
+	}
+	n = 1 + l
+	for i := 0; i < size; i++ {
+		if len(data) == n {
+			return nil, 0, true
+		}
+		if data[n] != '$' {
+			return nil, 0, false
+		}
+		line, l = redisLine(data[n+1:])
+		if l == 0 {
+			return nil, 0, len(data)-n < redisMaxInline
+		}
+		argLen, ok := redisInt(line)
+		if !ok || argLen < 0 {
+			return nil, 0, false
+		}
+		n += 1 + l
+		if len(data) < n+argLen+2 {
+			return nil, 0, true
+		}
+		if data[n+argLen] != '\r' || data[n+argLen+1] != '\n' {
+			return nil, 0, false
+		}
+		args = append(args, data[n:n+argLen])
+		n += argLen + 2
+	}
+	return args, n, true
+}
+
+// RedisCommands checks if data holds only complete commands sent as arrays of bulk strings
+func RedisCommands(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	for len(data) > 0 {
+		if data[0] != '*' {
+			return false
+		}
+		_, n, ok := RedisCommand(data)
+		if !ok || n == 0 {
+			return false
+		}
+		data = data[n:]
+	}
+	return true
+}
+
+// AppendRedisCommand appends command with the arguments as array of bulk strings to buf
+func AppendRedisCommand(buf []byte, args [][]byte) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+// redisSpec describes a command: if it modifies data, and positions of its keys
+type redisSpec struct {
+	write bool
+	// keys are arguments from first to last with step, negative last is relative to the end
+	first, last, step int
+	// position of the number of keys which follow it
+	numkeys int
+}
+
+var redisSpecs = map[string]redisSpec{}
+
+func init() {
+	specs := func(write bool, first, last, step, numkeys int, names string) {
+		for _, name := range bytes.Fields([]byte(names)) {
+			redisSpecs[string(name)] = redisSpec{write, first, last, step, numkeys}
+		}
+	}
+	// commands without keys
+	specs(false, 0, 0, 0, 0, "PING ECHO SELECT AUTH HELLO QUIT RESET INFO TIME LASTSAVE DBSIZE RANDOMKEY KEYS SCAN "+
+		"MULTI EXEC DISCARD UNWATCH CLIENT COMMAND READONLY READWRITE ROLE LOLWUT SCRIPT "+
+		"SUBSCRIBE UNSUBSCRIBE PSUBSCRIBE PUNSUBSCRIBE SSUBSCRIBE SUNSUBSCRIBE PUBSUB MONITOR")
+	specs(true, 0, 0, 0, 0, "FLUSHDB FLUSHALL SWAPDB PUBLISH SPUBLISH CONFIG FUNCTION")
+
+	// reading commands
+	specs(false, 1, 1, 1, 0, "GET STRLEN GETRANGE SUBSTR TYPE TTL PTTL EXPIRETIME PEXPIRETIME DUMP "+
+		"HGET HMGET HGETALL HKEYS HVALS HLEN HEXISTS HSTRLEN HSCAN HRANDFIELD "+
+		"LRANGE LLEN LINDEX LPOS SMEMBERS SISMEMBER SMISMEMBER SCARD SRANDMEMBER SSCAN "+
+		"ZRANGE ZRANGEBYSCORE ZREVRANGEBYSCORE ZRANGEBYLEX ZREVRANGEBYLEX ZREVRANGE ZSCORE ZMSCORE ZCARD ZCOUNT "+
+		"ZLEXCOUNT ZRANK ZREVRANK ZSCAN ZRANDMEMBER GETBIT BITCOUNT BITPOS BITFIELD_RO SORT_RO "+
+		"GEOPOS GEODIST GEOHASH GEOSEARCH GEORADIUS_RO GEORADIUSBYMEMBER_RO XRANGE XREVRANGE XLEN XPENDING")
+	specs(false, 1, -1, 1, 0, "MGET EXISTS TOUCH WATCH SINTER SUNION SDIFF PFCOUNT LCS")
+	specs(false, 2, 2, 1, 0, "OBJECT MEMORY XINFO")
+	specs(false, 0, 0, 0, 1, "ZUNION ZINTER ZDIFF ZINTERCARD SINTERCARD")
+	specs(false, 0, 0, 0, 2, "EVAL_RO EVALSHA_RO FCALL_RO")
+
+	// writing commands
+	specs(true, 1, 1, 1, 0, "SET SETNX SETEX PSETEX GETSET GETDEL GETEX APPEND INCR DECR INCRBY DECRBY INCRBYFLOAT "+
+		"SETRANGE EXPIRE PEXPIRE EXPIREAT PEXPIREAT PERSIST MOVE RESTORE "+
+		"HSET HSETNX HMSET HDEL HINCRBY HINCRBYFLOAT LPUSH RPUSH LPUSHX RPUSHX LPOP RPOP LINSERT LSET LREM LTRIM "+
+		"SADD SREM SPOP ZADD ZINCRBY ZREM ZREMRANGEBYSCORE ZREMRANGEBYRANK ZREMRANGEBYLEX ZPOPMIN ZPOPMAX "+
+		"SETBIT BITFIELD PFADD GEOADD GEORADIUS GEORADIUSBYMEMBER XADD XDEL XTRIM XACK XCLAIM XAUTOCLAIM XSETID SORT")
+	specs(true, 1, 2, 1, 0, "RENAME RENAMENX COPY RPOPLPUSH LMOVE BRPOPLPUSH BLMOVE SMOVE ZRANGESTORE GEOSEARCHSTORE")
+	specs(true, 1, -1, 1, 0, "DEL UNLINK SINTERSTORE SUNIONSTORE SDIFFSTORE PFMERGE")
+	specs(true, 1, -1, 2, 0, "MSET MSETNX")
+	specs(true, 1, -2, 1, 0, "BLPOP BRPOP BZPOPMIN BZPOPMAX")
+	specs(true, 2, -1, 1, 0, "BITOP")
+	specs(true, 2, 2, 1, 0, "XGROUP")
+	specs(true, 1, 1, 1, 2, "ZUNIONSTORE ZINTERSTORE ZDIFFSTORE")
+	specs(true, 0, 0, 0, 1, "LMPOP ZMPOP")
+	specs(true, 0, 0, 0, 2, "EVAL EVALSHA FCALL BLMPOP BZMPOP")
+	// keys follow STREAMS argument
+	specs(false, 0, 0, 0, 0, "XREAD")
+	specs(true, 0, 0, 0, 0, "XREADGROUP")
+}
+
+// RedisCommandName returns name of the command in upper case
+func RedisCommandName(args [][]byte) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return string(bytes.ToUpper(args[0]))
+}
+
+// IsRedisWrite checks if the command can modify data. Unknown commands are treated as writing.
+func IsRedisWrite(args [][]byte) bool {
+	spec, ok := redisSpecs[RedisCommandName(args)]
+	return !ok || spec.write
+}
+
+// RedisKeys returns positions of keys in arguments of the command
+func RedisKeys(args [][]byte) (keys []int) {
+	name := RedisCommandName(args)
+	spec := redisSpecs[name]
+	if name == "XREAD" || name == "XREADGROUP" {
+		// STREAMS key [key ...] id [id ...]
+		for i := 1; i < len(args); i++ {
+			if bytes.EqualFold(args[i], []byte("STREAMS")) {
+				n := (len(args) - i - 1) / 2
+				for j := i + 1; j <= i+n; j++ {
+					keys = append(keys, j)
+				}
+				break
+			}
+		}
+		return
+	}
+
+	if spec.first > 0 {
+		last := spec.last
+		if last < 0 {
+			last += len(args)
+		}
+		for i := spec.first; i <= last && i < len(args); i += spec.step {
+			keys = append(keys, i)
+		}
+	}
+	if spec.numkeys > 0 && spec.numkeys < len(args) {
+		n, err := strconv.Atoi(string(args[spec.numkeys]))
+		if err != nil {
+			return
+		}
+		for i := spec.numkeys + 1; i <= spec.numkeys+n && i < len(args); i++ {
+			keys = append(keys, i)
+		}
+	}
+	return
+}
@@ -0,0 +1,81 @@
+package proto
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestRedisValue(t *testing.T) {
+	tests := []struct {
+		data string
+		n    int
+		ok   bool
+	}{
+		{"+OK\r\n", 5, true},
+		{"-ERR unknown\r\n:1\r\n", 14, true},
+		{"$5\r\nhello\r\n", 11, true},
+		{"$5\r\nhel", 0, true},
+		{"$-1\r\n", 5, true},
+		{"*2\r\n$1\r\na\r\n*1\r\n:1\r\n", 19, true},
+		{"*2\r\n$1\r\na\r\n", 0, true},
+		{"*-1\r\n", 5, true},
+		{"%1\r\n+key\r\n#t\r\n", 14, true},
+		{">2\r\n+invalidate\r\n*0\r\n", 21, true},
+		{"$5\r\nhello!!", 0, false},
+		{"?\r\n", 0, false},
+	}
+	for _, tt := range tests {
+		if n, ok := RedisValue([]byte(tt.data)); n != tt.n || ok != tt.ok {
+			t.Errorf("%q: expected %d %v, got %d %v", tt.data, tt.n, tt.ok, n, ok)
+		}
+	}
+}
+
+func TestRedisCommand(t *testing.T) {
+	set := AppendRedisCommand(nil, [][]byte{[]byte("SET"), []byte("user:1"), []byte("a\r\nb")})
+	args, n, ok := RedisCommand(append(set, "*1\r\n"...))
+	if !ok || n != len(set) || len(args) != 3 || !bytes.Equal(args[2], []byte("a\r\nb")) {
+		t.Errorf("Wrong command: %q %d %v", args, n, ok)
+	}
+	if _, n, ok = RedisCommand(set[:len(set)-1]); n != 0 || !ok {
+		t.Errorf("Command should be incomplete")
+	}
+	if args, n, ok = RedisCommand([]byte("PING  hello\r\n")); n != 13 || !ok || len(args) != 2 {
+		t.Errorf("Wrong inline command: %q %d %v", args, n, ok)
+	}
+	if _, _, ok = RedisCommand([]byte("*1\r\n:1\r\n")); ok {
+		t.Errorf("Commands hold only bulk strings")
+	}
+
+	if !RedisCommands(append(set, set...)) || RedisCommands(set[:len(set)-1]) || RedisCommands([]byte("PING\r\n")) {
+		t.Errorf("Wrong check of complete commands")
+	}
+}
+
+func TestRedisKeys(t *testing.T) {
+	tests := []struct {
+		command string
+		keys    []int
+		write   bool
+	}{
+		{"GET a", []int{1}, false},
+		{"mset a 1 b 2", []int{1, 3}, true},
+		{"BLPOP a b 0", []int{1, 2}, true},
+		{"EVAL script 2 a b arg", []int{3, 4}, true},
+		{"ZUNIONSTORE dst 2 a b", []int{1, 3, 4}, true},
+		{"XREAD COUNT 1 STREAMS a b 0 0", []int{4, 5}, false},
+		{"OBJECT ENCODING a", []int{2}, false},
+		{"PING", nil, false},
+		{"UNKNOWN a", nil, true},
+	}
+	for _, tt := range tests {
+		args := bytes.Fields([]byte(tt.command))
+		if keys := RedisKeys(args); !reflect.DeepEqual(keys, tt.keys) {
+			t.Errorf("%s: wrong keys %v", tt.command, keys)
+		}
+		if IsRedisWrite(args) != tt.write {
+			t.Errorf("%s: expected write %v", tt.command, tt.write)
+		}
+	}
+}
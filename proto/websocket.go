@@ -0,0 +1,126 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// WebSocket frame opcodes, RFC 6455 5.2
+const (
+	WebSocketContinuation = 0x0
+	WebSocketText         = 0x1
+	WebSocketBinary       = 0x2
+	WebSocketClose        = 0x8
+	WebSocketPing         = 0x9
+	WebSocketPong         = 0xA
+)
+
+// WebSocketFrame describes header of WebSocket frame
+type WebSocketFrame struct {
+	Fin        bool
+	Opcode     byte
+	Masked     bool
+	Mask       [4]byte
+	HeaderLen  int // including masking key
+	PayloadLen int
+}
+
+// Len returns length of the whole frame
+func (f WebSocketFrame) Len() int {
+	return f.HeaderLen + f.PayloadLen
+}
+
+// IsWebSocketUpgrade checks if payload is a request or response of WebSocket opening handshake
+func IsWebSocketUpgrade(payload []byte) bool {
+	return bytes.EqualFold(Header(payload, []byte("Upgrade")), []byte("websocket"))
+}
+
+// ParseWebSocketFrame parses header of the frame at the start of data, ok is false if the header is not complete
+func ParseWebSocketFrame(data []byte) (f WebSocketFrame, ok bool) {
+	if len(data) < 2 {
+		return
+	}
+	f.Fin = data[0]&0x80 != 0
+	f.Opcode = data[0] & 0xf
+	f.Masked = data[1]&0x80 != 0
+	f.HeaderLen = 2
+
+	switch n := data[1] & 0x7f; n {
+	case 126:
+		if len(data) < 4 {
+			return
+		}
+		f.PayloadLen = int(binary.BigEndian.Uint16(data[2:]))
+		f.HeaderLen += 2
+	case 127:
+		if len(data) < 10 {
+			return
+		}
+		n := binary.BigEndian.Uint64(data[2:])
+		if n > 1<<62 {
+			n = 1 << 62
+		}
+		f.PayloadLen = int(n)
+		f.HeaderLen += 8
+	default:
+		f.PayloadLen = int(n)
+	}
+
+	if f.Masked {
+		if len(data) < f.HeaderLen+4 {
+			return
+		}
+		copy(f.Mask[:], data[f.HeaderLen:])
+		f.HeaderLen += 4
+	}
+	return f, true
+}
+
+// UnmaskWebSocketFrame returns copy of the complete frame with unmasked payload and without masking key
+func UnmaskWebSocketFrame(frame []byte) []byte {
+	f, ok := ParseWebSocketFrame(frame)
+	if !ok || len(frame) < f.Len() {
+		return frame
+	}
+	if !f.Masked {
+		return append([]byte(nil), frame[:f.Len()]...)
+	}
+	out := make([]byte, f.Len()-4)
+	copy(out, frame[:f.HeaderLen-4])
+	out[1] &^= 0x80
+	payload := out[f.HeaderLen-4:]
+	copy(payload, frame[f.HeaderLen:f.Len()])
+	maskWebSocketPayload(payload, f.Mask)
+	return out
+}
+
+// MaskWebSocketFrame returns copy of the complete unmasked frame, masked with the key. Frames sent by client have to be masked.
+func MaskWebSocketFrame(frame []byte, key [4]byte) []byte {
+	f, ok := ParseWebSocketFrame(frame)
+	if !ok || f.Masked || len(frame) < f.Len() {
+		return frame
+	}
+	out := make([]byte, f.Len()+4)
+	copy(out, frame[:f.HeaderLen])
+	out[1] |= 0x80
+	copy(out[f.HeaderLen:], key[:])
+	payload := out[f.HeaderLen+4:]
+	copy(payload, frame[f.HeaderLen:f.Len()])
+	maskWebSocketPayload(payload, key)
+	return out
+}
+
+// WebSocketPayload returns payload of the complete unmasked frame
+func WebSocketPayload(frame []byte) []byte {
+	f, ok := ParseWebSocketFrame(frame)
+	if !ok || f.Masked || len(frame) < f.Len() {
+		return nil
+	}
+	return frame[f.HeaderLen:f.Len()]
+}
+
+func maskWebSocketPayload(payload []byte, key [4]byte) {
+	for i := range payload {
+		payload[i] ^= key[i%4]
+	}
+}
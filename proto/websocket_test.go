@@ -0,0 +1,45 @@
+package proto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWebSocketFrames(t *testing.T) {
+	key := [4]byte{1, 2, 3, 4}
+	for _, size := range []int{0, 125, 126, 65535, 65536} {
+		payload := bytes.Repeat([]byte("a"), size)
+		var frame []byte
+		switch {
+		case size < 126:
+			frame = []byte{0x81, byte(size)}
+		case size < 65536:
+			frame = []byte{0x81, 126, byte(size >> 8), byte(size)}
+		default:
+			frame = []byte{0x81, 127, 0, 0, 0, 0, 0, byte(size >> 16), byte(size >> 8), byte(size)}
+		}
+		frame = append(frame, payload...)
+
+		masked := MaskWebSocketFrame(frame, key)
+		f, ok := ParseWebSocketFrame(masked)
+		if !ok || !f.Fin || f.Opcode != WebSocketText || !f.Masked || f.Mask != key || f.PayloadLen != size || f.Len() != len(frame)+4 {
+			t.Errorf("%d: wrong frame %+v", size, f)
+		}
+		if size > 0 && bytes.Contains(masked, payload) {
+			t.Errorf("%d: payload should be masked", size)
+		}
+		if unmasked := UnmaskWebSocketFrame(masked); !bytes.Equal(unmasked, frame) {
+			t.Errorf("%d: wrong unmasked frame", size)
+		}
+		if !bytes.Equal(WebSocketPayload(frame), payload) {
+			t.Errorf("%d: wrong payload", size)
+		}
+		if _, ok = ParseWebSocketFrame(masked[:f.HeaderLen-1]); ok {
+			t.Errorf("%d: header should be incomplete", size)
+		}
+	}
+
+	if !IsWebSocketUpgrade([]byte("GET /chat HTTP/1.1\r\nHost: example.com\r\nUpgrade: WebSocket\r\nConnection: Upgrade\r\n\r\n")) {
+		t.Error("Should detect handshake")
+	}
+}
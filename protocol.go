@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"net/url"
 )
 
 // These constants help to indicate the type of payload
@@ -12,6 +13,10 @@ const (
 	RequestPayload          = '1'
 	ResponsePayload         = '2'
 	ReplayedResponsePayload = '3'
+
+	// WebSocket frames have the id of the handshake request of their session
+	WebSocketFramePayload         = '4' // frame sent by client
+	WebSocketResponseFramePayload = '5' // frame sent by server
 )
 
 func randByte(len int) []byte {
@@ -53,6 +58,15 @@ func payloadHeader(payloadType byte, uuid []byte, timing int64, latency int64) (
 	return []byte(fmt.Sprintf("%c %s %d %d\n", payloadType, uuid, timing, latency))
 }
 
+// appendPayloadMeta adds key=value field to the end of the header, value is query escaped
+func appendPayloadMeta(header []byte, key, value string) []byte {
+	header = append(header[:len(header)-1:len(header)-1], ' ')
+	header = append(header, key...)
+	header = append(header, '=')
+	header = append(header, url.QueryEscape(value)...)
+	return append(header, '\n')
+}
+
 func payloadBody(payload []byte) []byte {
 	headerSize := bytes.IndexByte(payload, '\n')
 	return payload[headerSize+1:]
@@ -86,7 +100,11 @@ func payloadID(payload []byte) (id []byte) {
 }
 
 func isOriginPayload(payload []byte) bool {
-	return payload[0] == RequestPayload || payload[0] == ResponsePayload
+	switch payload[0] {
+	case RequestPayload, ResponsePayload, WebSocketFramePayload, WebSocketResponseFramePayload:
+		return true
+	}
+	return false
 }
 
 func isRequestPayload(payload []byte) bool {
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryConfig is the retry policy of http, grpc and binary outputs
+type RetryConfig struct {
+	Retries       int           `json:"output-retries"`
+	Backoff       time.Duration `json:"output-retry-backoff"`
+	MaxBackoff    time.Duration `json:"output-retry-max-backoff"`
+	BreakerErrors int           `json:"output-breaker-errors"` // consecutive failures pausing workers, 0 disables the breaker
+	BreakerPause  time.Duration `json:"output-breaker-pause"`
+}
+
+var errRetryStopped = errors.New("output is closed")
+
+// errRetriable is returned for responses which should be retried, like 5xx and 429
+type errRetriable struct {
+	status int
+}
+
+func (e errRetriable) Error() string {
+	return fmt.Sprintf("response status %d", e.status)
+}
+
+// retryStatus reports whether the request with response of given status should be retried
+func retryStatus(status int) bool {
+	return status >= 500 || status == 429
+}
+
+// retrier sends requests with the retry policy. When BreakerErrors consecutive attempts fail, workers are paused
+// for BreakerPause, then a single probe request is sent, and workers are resumed when it succeeds.
+type retrier struct {
+	config *RetryConfig
+	output string
+	stop   chan struct{}
+
+	mu       sync.Mutex
+	failures int
+	open     bool
+	probing  bool
+	openedAt time.Time
+	resumed  chan struct{} // closed when the breaker is closed
+}
+
+// newRetrier returns nil if config has neither retries nor breaker
+func newRetrier(output string, config *RetryConfig) *retrier {
+	if config == nil || config.Retries <= 0 && config.BreakerErrors <= 0 {
+		return nil
+	}
+	r := &retrier{config: config, output: output, stop: make(chan struct{})}
+	if r.config.Backoff <= 0 {
+		r.config.Backoff = 100 * time.Millisecond
+	}
+	if r.config.MaxBackoff < r.config.Backoff {
+		r.config.MaxBackoff = 10 * time.Second
+	}
+	if r.config.BreakerPause <= 0 {
+		r.config.BreakerPause = 5 * time.Second
+	}
+	return r
+}
+
+// do calls send until it succeeds or retries are exhausted, then the last error is returned,
+// and the caller passes the request to the dead-letter output
+func (r *retrier) do(send func() error) (err error) {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && !r.sleep(r.backoff(attempt)) {
+			break
+		}
+		if !r.wait() {
+			if err == nil {
+				err = errRetryStopped
+			}
+			break
+		}
+		if err = send(); err == nil {
+			r.done(nil)
+			return nil
+		}
+		r.done(err)
+		if attempt >= r.config.Retries {
+			break
+		}
+		Debug(2, fmt.Sprintf("[OUTPUT-RETRY] %s: retrying after error: %q", r.output, err))
+	}
+	return err
+}
+
+// backoff returns exponential delay of the attempt with jitter, between half and full delay
+func (r *retrier) backoff(attempt int) time.Duration {
+	d := r.config.Backoff
+	for i := 1; i < attempt && d < r.config.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.config.MaxBackoff {
+		d = r.config.MaxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (r *retrier) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-r.stop:
+		return false
+	}
+}
+
+// wait blocks while the breaker is open, until the worker may send a probe or the breaker is closed
+func (r *retrier) wait() bool {
+	for {
+		r.mu.Lock()
+		if !r.open {
+			r.mu.Unlock()
+			return true
+		}
+		pause := r.config.BreakerPause - time.Since(r.openedAt)
+		if !r.probing && pause <= 0 {
+			r.probing = true
+			r.mu.Unlock()
+			Debug(1, fmt.Sprintf("[OUTPUT-RETRY] %s: sending probe request", r.output))
+			return true
+		}
+		if pause <= 0 {
+			// other worker is probing
+			pause = r.config.BreakerPause
+		}
+		resumed := r.resumed
+		r.mu.Unlock()
+
+		timer := time.NewTimer(pause)
+		select {
+		case <-resumed:
+		case <-timer.C:
+		case <-r.stop:
+			timer.Stop()
+			return false
+		}
+		timer.Stop()
+	}
+}
+
+// done updates the breaker with result of an attempt
+func (r *retrier) done(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil {
+		r.failures = 0
+		if r.open {
+			Debug(1, fmt.Sprintf("[OUTPUT-RETRY] %s: target is up, resuming workers", r.output))
+			r.open, r.probing = false, false
+			close(r.resumed)
+		}
+		return
+	}
+	r.failures++
+	switch {
+	case r.probing:
+		r.probing = false
+		r.openedAt = time.Now()
+	case !r.open && r.config.BreakerErrors > 0 && r.failures >= r.config.BreakerErrors:
+		Debug(1, fmt.Sprintf("[OUTPUT-RETRY] %s: target is down, pausing workers for %s", r.output, r.config.BreakerPause))
+		r.open = true
+		r.openedAt = time.Now()
+		r.resumed = make(chan struct{})
+	}
+}
+
+// close stops retries
+func (r *retrier) close() {
+	close(r.stop)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPOutputRetry(t *testing.T) {
+	wg := new(sync.WaitGroup)
+
+	var flaky int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer wg.Done()
+		switch {
+		case req.URL.Path == "/down":
+			w.WriteHeader(http.StatusInternalServerError)
+		case atomic.AddInt32(&flaky, 1) <= 2:
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	deadLetter := filepath.Join(dir, "failed.gor")
+	dlqOutput := NewDLQOutput("file:" + deadLetter)
+	setDLQ(dlqOutput)
+	defer setDLQ(nil)
+
+	retry := &RetryConfig{Retries: 2, Backoff: time.Millisecond}
+	output := NewHTTPOutput(server.URL, &HTTPOutputConfig{Retry: retry})
+
+	wg.Add(6)
+	output.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, uuid(), 1, -1), Data: []byte("GET /flaky HTTP/1.1\r\n\r\n")})
+	output.PluginWrite(&Message{Meta: payloadHeader(RequestPayload, uuid(), 1, -1), Data: []byte("GET /down HTTP/1.1\r\n\r\n")})
+	wg.Wait()
+	time.Sleep(50 * time.Millisecond)
+	output.(*HTTPOutput).Close()
+	dlqOutput.(*FileOutput).Close()
+
+	data, _ := ioutil.ReadFile(deadLetter)
+	if !bytes.HasPrefix(data, []byte("1 ")) || bytes.Count(data, []byte("GET /down")) != 1 || bytes.Contains(data, []byte("/flaky")) {
+		t.Errorf("expected only request which exhausted retries in dead-letter file, once, got %q", data)
+	}
+}
+
+func TestRetryBreaker(t *testing.T) {
+	pause := 50 * time.Millisecond
+	r := newRetrier("test", &RetryConfig{BreakerErrors: 2, BreakerPause: pause})
+	defer r.close()
+
+	down := errors.New("down")
+	for i := 0; i < 2; i++ {
+		r.do(func() error { return down })
+	}
+	opened := time.Now()
+
+	// the first probe fails, workers wait for the second one
+	var sent, probed int32
+	send := func() error {
+		switch atomic.AddInt32(&sent, 1) {
+		case 1:
+			if time.Since(opened) < pause {
+				t.Error("probe should be sent after pause")
+			}
+			return down
+		case 2:
+			if time.Since(opened) < 2*pause {
+				t.Error("failed probe should pause workers again")
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.StoreInt32(&probed, 1)
+			return nil
+		}
+		if atomic.LoadInt32(&probed) == 0 {
+			t.Error("workers should be paused until probe succeeds")
+		}
+		return nil
+	}
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.do(send)
+		}()
+	}
+	wg.Wait()
+	if sent != 5 {
+		t.Errorf("expected 5 requests, got %d", sent)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// replayed sessions without requests for this time are closed
+const sessionIdle = time.Minute
+
+// sessionID returns the part of UUID identifying captured connection: ports and client address of messages
+// read from raw input. Other messages are sessions of their own.
+func sessionID(uuid []byte) string {
+	if len(uuid) == 24 {
+		return string(uuid[:16])
+	}
+	return string(uuid)
+}
+
+// sessionClient sends requests of a replayed session, it is used by a single goroutine
+type sessionClient interface {
+	send(msg *Message)
+	close()
+}
+
+// sessionWorkers replays every captured TCP session with a worker of its own, enabled by --recognize-tcp-sessions.
+// Worker sends requests of the session one at a time in captured order, each after the response to the
+// previous one, over a client which keeps a single connection, like the captured client did.
+type sessionWorkers struct {
+	output    string // name of the output, used in metrics
+	queueLen  int
+	max       int // maximum number of sessions, 0 is unlimited
+	newClient func() sessionClient
+
+	mu       sync.Mutex
+	sessions map[string]*replaySession
+	stop     chan struct{}
+	pending  int64 // accessed atomically, requests queued or being sent by workers
+}
+
+// replaySession is a worker of a captured session
+type replaySession struct {
+	id       string
+	requests chan *Message
+}
+
+func newSessionWorkers(output string, queueLen, max int, newClient func() sessionClient) *sessionWorkers {
+	return &sessionWorkers{
+		output:    output,
+		queueLen:  queueLen,
+		max:       max,
+		newClient: newClient,
+		sessions:  make(map[string]*replaySession),
+		stop:      make(chan struct{}),
+	}
+}
+
+// write queues the request to the worker of its session, starting a new one if needed
+func (w *sessionWorkers) write(msg *Message) {
+	id := sessionID(payloadID(msg.Meta))
+
+	w.mu.Lock()
+	select {
+	case <-w.stop:
+		w.mu.Unlock()
+		deadLetter(w.output, msg, "output is closed")
+		return
+	default:
+	}
+	s := w.sessions[id]
+	if s == nil {
+		if w.max > 0 && len(w.sessions) >= w.max {
+			w.mu.Unlock()
+			outputErrors.With(w.output).Inc()
+			deadLetter(w.output, msg, "too many sessions")
+			Debug(1, "[OUTPUT-SESSION] request dropped, too many sessions", id)
+			return
+		}
+		s = &replaySession{id: id, requests: make(chan *Message, w.queueLen)}
+		w.sessions[id] = s
+		go w.replay(s)
+	}
+	// sent under the lock, so the worker is not stopped in the meantime
+	atomic.AddInt64(&w.pending, 1)
+	select {
+	case s.requests <- msg:
+	default:
+		atomic.AddInt64(&w.pending, -1)
+		outputErrors.With(w.output).Inc()
+		deadLetter(w.output, msg, "session queue is full")
+		Debug(1, "[OUTPUT-SESSION] request dropped, session queue is full", id)
+	}
+	w.mu.Unlock()
+}
+
+// replay sends requests of the session until it is idle for sessionIdle
+func (w *sessionWorkers) replay(s *replaySession) {
+	client := w.newClient()
+	defer client.close()
+	timer := time.NewTimer(sessionIdle)
+	defer timer.Stop()
+	for {
+		select {
+		case msg := <-s.requests:
+			client.send(msg)
+			atomic.AddInt64(&w.pending, -1)
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(sessionIdle)
+		case <-timer.C:
+			w.mu.Lock()
+			if len(s.requests) > 0 {
+				w.mu.Unlock()
+				timer.Reset(sessionIdle)
+				continue
+			}
+			delete(w.sessions, s.id)
+			w.mu.Unlock()
+			return
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// len returns number of replayed sessions
+func (w *sessionWorkers) len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.sessions)
+}
+
+// queued returns number of requests queued or being sent by workers
+func (w *sessionWorkers) queued() int {
+	return int(atomic.LoadInt64(&w.pending))
+}
+
+// close stops all workers, requests still in their queues are passed to the dead-letter output
+func (w *sessionWorkers) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	close(w.stop)
+	for _, s := range w.sessions {
+		// a worker may take a request before it notices the stop, every request is taken once
+		for drained := false; !drained; {
+			select {
+			case msg := <-s.requests:
+				atomic.AddInt64(&w.pending, -1)
+				deadLetter(w.output, msg, "output is closed")
+			default:
+				drained = true
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// testSegment is data written by one side of a connection
+type testSegment struct {
+	fromClient bool
+	data       []byte
+}
+
+// decodeTestMessages passes packets of the segments to a parser with the protocol decoder, and returns n messages,
+// port is the port of the server
+func decodeTestMessages(t *testing.T, segments []testSegment, port uint16, n int, decoder ParserOption) []*Message {
+	parser := NewMessageParser(nil, Ports{{Min: port, Max: port}}, []net.IP{net.IPv4(127, 0, 0, 1)}, time.Second, false, decoder)
+	defer parser.Close()
+	// packets are handled here rather than by goroutines of the parser,
+	// so the order of client and server packets is kept, as in real sessions
+	for _, p := range testPackets(segments, port) {
+		parser.handlePacket(parser.parsePacket(p))
+	}
+
+	var messages []*Message
+	for len(messages) < n {
+		select {
+		case m := <-parser.messages:
+			messages = append(messages, m)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected %d messages, got %d", n, len(messages))
+		}
+	}
+	return messages
+}
+
+// splitTestMessages splits messages into requests and responses
+func splitTestMessages(messages []*Message) (requests, responses []*Message) {
+	for _, m := range messages {
+		if m.Direction == DirIncoming {
+			requests = append(requests, m)
+		} else {
+			responses = append(responses, m)
+		}
+	}
+	return
+}
+
+// testPackets converts written data into TCP packets, segments are split and reordered a bit
+func testPackets(segments []testSegment, port uint16) []*PcapPacket {
+	var packets []*PcapPacket
+	seq := map[bool]uint32{true: 1000, false: 4294960000} // server seq wraps around
+	for _, s := range segments {
+		var chunks [][]byte
+		for data := s.data; len(data) > 0; {
+			n := 1400
+			if len(data) < n {
+				n = len(data)
+			}
+			chunks = append(chunks, data[:n])
+			data = data[n:]
+		}
+		var pckts []*PcapPacket
+		for _, chunk := range chunks {
+			pckts = append(pckts, testPacket(s.fromClient, port, seq[s.fromClient], seq[!s.fromClient], chunk))
+			seq[s.fromClient] += uint32(len(chunk))
+		}
+		for i := 0; i+1 < len(pckts); i += 2 {
+			pckts[i], pckts[i+1] = pckts[i+1], pckts[i]
+		}
+		packets = append(packets, pckts...)
+	}
+	return packets
+}
+
+func testPacket(fromClient bool, port uint16, seq, ack uint32, payload []byte) *PcapPacket {
+	data := make([]byte, 4+20+20+len(payload))
+	binary.BigEndian.PutUint32(data, uint32(layers.ProtocolFamilyIPv4))
+
+	ip := data[4:]
+	ip[0] = 4<<4 | 5
+	binary.BigEndian.PutUint16(ip[2:4], uint16(len(ip)))
+	ip[9] = uint8(layers.IPProtocolTCP)
+	copy(ip[12:16], []byte{127, 0, 0, 1})
+	copy(ip[16:20], []byte{127, 0, 0, 1})
+
+	tcp := ip[20:]
+	if fromClient {
+		binary.BigEndian.PutUint16(tcp, 50000)
+		binary.BigEndian.PutUint16(tcp[2:], port)
+	} else {
+		binary.BigEndian.PutUint16(tcp, port)
+		binary.BigEndian.PutUint16(tcp[2:], 50000)
+	}
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = 0x18 // PSH, ACK
+	copy(tcp[20:], payload)
+
+	ci := &gopacket.CaptureInfo{Length: len(data), CaptureLength: len(data), Timestamp: time.Now()}
+	return &PcapPacket{Data: data, LType: int(layers.LinkTypeLoop), LTypeLen: 4, Ci: ci}
+}
@@ -0,0 +1,178 @@
+package tcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// http2Decoder replaces packets of HTTP/2 connections with packets carrying HTTP/1.1 messages,
+// one for every request and response stream. Stream id is used as Seq and Ack of both,
+// so request and response are matched by it.
+type http2Decoder struct {
+	mu    sync.Mutex
+	conns map[string]*http2Conn
+}
+
+func newHTTP2Decoder() *http2Decoder {
+	return &http2Decoder{conns: make(map[string]*http2Conn)}
+}
+
+// isHTTP2Settings checks if data starts with SETTINGS frame which is sent by server at the start of connection
+func isHTTP2Settings(data []byte) bool {
+	if len(data) < 9 || data[3] != 0x4 || data[4] != 0 || binary.BigEndian.Uint32(data[5:]) != 0 {
+		return false
+	}
+	return (int(data[0])<<16|int(data[1])<<8|int(data[2]))%6 == 0
+}
+
+// decode passes converted packets to emit, packets which do not belong to HTTP/2 connections are passed unchanged
+func (d *http2Decoder) decode(pckt *Packet, emit func(*Packet)) {
+	id, src := connID(pckt)
+	preface := bytes.HasPrefix(pckt.Payload, proto.HTTP2Preface)
+
+	d.mu.Lock()
+	conn, ok := d.conns[id]
+	switch {
+	case !ok && !preface && !isHTTP2Settings(pckt.Payload):
+		// not an HTTP/2 connection, or its start was not captured
+		d.mu.Unlock()
+		emit(pckt)
+		return
+	case !ok || preface && conn.restarted(src, pckt):
+		conn = newHTTP2Conn()
+		d.conns[id] = conn
+		stats.Add("http2_connections", 1)
+	}
+	d.mu.Unlock()
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.failed {
+		return
+	}
+	conn.lastSeen = time.Now()
+	if err := conn.push(conn.stream(src), pckt, emit); err != nil {
+		stats.Add("http2_errors", 1)
+		conn.failed = true
+		for _, s := range conn.streams {
+			if s != nil {
+				s.reset()
+			}
+		}
+	}
+}
+
+// tick forgets expired connections
+func (d *http2Decoder) tick(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, conn := range d.conns {
+		conn.mu.Lock()
+		if now.Sub(conn.lastSeen) > connExpire {
+			delete(d.conns, id)
+		}
+		conn.mu.Unlock()
+	}
+}
+
+// http2Conn holds state of both directions of an HTTP/2 connection
+type http2Conn struct {
+	mu       sync.Mutex
+	lastSeen time.Time
+	failed   bool
+
+	streams       [2]*http2Stream
+	client        *http2Stream
+	clientDecoder *proto.HTTP2Decoder
+	serverDecoder *proto.HTTP2Decoder
+}
+
+type http2Stream struct {
+	tcpStream
+	decoder *proto.HTTP2Decoder
+}
+
+func newHTTP2Conn() *http2Conn {
+	c := new(http2Conn)
+	c.clientDecoder, c.serverDecoder = proto.NewHTTP2Decoders()
+	return c
+}
+
+func (c *http2Conn) stream(src string) *http2Stream {
+	for _, s := range c.streams {
+		if s != nil && s.src == src {
+			return s
+		}
+	}
+	s := &http2Stream{tcpStream: tcpStream{src: src}}
+	if c.streams[0] == nil {
+		c.streams[0] = s
+	} else {
+		c.streams[1] = s
+	}
+	return s
+}
+
+// restarted checks if the client opens a new connection from the same port
+func (c *http2Conn) restarted(src string, pckt *Packet) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client != nil && c.client.src == src && c.client.startSeq != pckt.Seq
+}
+
+// push decodes frames of the stream, client stream starts with the preface and server stream with SETTINGS frame
+func (c *http2Conn) push(s *http2Stream, pckt *Packet, emit func(*Packet)) error {
+	if !s.started {
+		switch {
+		case bytes.HasPrefix(pckt.Payload, proto.HTTP2Preface):
+			c.client = s
+			s.decoder = c.clientDecoder
+			s.start(pckt.Seq)
+		case isHTTP2Settings(pckt.Payload):
+			s.decoder = c.serverDecoder
+			s.start(pckt.Seq)
+		}
+	}
+
+	return s.push(pckt, func(p *Packet) error {
+		n, messages, err := s.decoder.Decode(s.buf, p.Timestamp)
+		s.buf = s.buf[n:]
+		if len(s.buf) == 0 {
+			s.buf = nil
+		}
+		for _, m := range messages {
+			c.emit(s, p, m, emit)
+		}
+		return err
+	})
+}
+
+// emit passes the message as a packet with headers, and a packet with body sent when the stream ended
+func (c *http2Conn) emit(s *http2Stream, pckt *Packet, m *proto.HTTP2Message, emit func(*Packet)) {
+	stats.Add("http2_messages", 1)
+
+	head := *pckt
+	head.messageID = 0
+	head.Lost = 0
+	head.buf = nil
+	head.Payload = m.Head
+	head.Seq, head.Ack = m.StreamID, m.StreamID
+	head.Timestamp = m.Start
+	head.Direction = DirOutcoming
+	if s == c.client {
+		head.Direction = DirIncoming
+	}
+	emit(&head)
+
+	if len(m.Body) > 0 {
+		body := head
+		body.Payload = m.Body
+		body.Seq += uint32(len(m.Head))
+		body.Timestamp = m.End
+		emit(&body)
+	}
+}
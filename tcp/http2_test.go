@@ -0,0 +1,155 @@
+package tcp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+	"golang.org/x/net/http2"
+)
+
+// http2Session sends requests over HTTP/2 connection, with prior knowledge or over TLS
+func http2Session(t *testing.T, config *tls.Config, keyLog *bytes.Buffer) []testSegment {
+	var (
+		mu       sync.Mutex
+		segments []testSegment
+	)
+	c, s := net.Pipe()
+	var client, server net.Conn = &recordingConn{c, true, &mu, &segments}, &recordingConn{s, false, &mu, &segments}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method == http.MethodPost {
+			w.Header().Set("Trailer", "Grpc-Status")
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(append([]byte(r.URL.Path+":"), body...))
+		if r.Method == http.MethodPost {
+			w.Header().Set("Grpc-Status", "0")
+		}
+	})
+
+	if config != nil {
+		config.NextProtos = []string{"h2"}
+		client = tls.Client(client, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}, KeyLogWriter: keyLog})
+		server = tls.Server(server, config)
+	}
+	go func() {
+		if tc, ok := server.(*tls.Conn); ok {
+			tc.Handshake()
+		}
+		new(http2.Server).ServeConn(server, &http2.ServeConnOpts{Handler: handler})
+	}()
+	if tc, ok := client.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cc, err := (&http2.Transport{AllowHTTP: true}).NewClientConn(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, req := range []*http.Request{
+		mustRequest(http.NewRequest("GET", "http://example.com/first", nil)),
+		mustRequest(http.NewRequest("POST", "http://example.com/second", strings.NewReader("hello"))),
+	} {
+		resp, err := cc.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	c.Close()
+	s.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	return segments
+}
+
+func mustRequest(req *http.Request, err error) *http.Request {
+	if err != nil {
+		panic(err)
+	}
+	return req
+}
+
+func TestHTTP2Messages(t *testing.T) {
+	cert := tlsTestCertificate(t)
+
+	for _, useTLS := range []bool{false, true} {
+		var config *tls.Config
+		var secrets bytes.Buffer
+		if useTLS {
+			config = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+		segments := http2Session(t, config, &secrets)
+
+		options := []ParserOption{WithHTTP2()}
+		if useTLS {
+			keyLog := &KeyLog{secrets: make(map[string][]byte)}
+			for _, line := range bytes.Split(secrets.Bytes(), []byte("\n")) {
+				keyLog.parseLine(line)
+			}
+			options = append(options, WithTLSKeyLog(keyLog))
+		}
+		parser := NewMessageParser(nil, Ports{{Min: 443, Max: 443}}, []net.IP{net.IPv4(127, 0, 0, 1)}, time.Second, false, options...)
+		parser.Start = func(pckt *Packet) (bool, bool) {
+			return proto.HasRequestTitle(pckt.Payload), proto.HasResponseTitle(pckt.Payload)
+		}
+		parser.End = func(m *Message) bool {
+			return proto.HasFullPayload(m, m.PacketData()...)
+		}
+
+		for _, p := range testPackets(segments, 443) {
+			parser.PacketHandler(p)
+		}
+
+		reqs := make(map[string]string)
+		resps := make(map[string]string)
+		for i := 0; i < 4; i++ {
+			select {
+			case m := <-parser.messages:
+				if m.Direction == DirIncoming {
+					reqs[string(m.UUID())] = string(m.Data())
+				} else {
+					resps[string(m.UUID())] = string(m.Data())
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("TLS %v: expected 4 messages, got %d", useTLS, i)
+			}
+		}
+		parser.Close()
+
+		for id, req := range reqs {
+			resp := resps[id]
+			switch {
+			case strings.HasPrefix(req, "GET /first HTTP/1.1\r\nHost: example.com\r\n"):
+				if !strings.HasSuffix(resp, "\r\n\r\n/first:") || !strings.Contains(resp, "Content-Length: 7\r\n") {
+					t.Errorf("TLS %v: wrong response %q", useTLS, resp)
+				}
+			case strings.HasPrefix(req, "POST /second HTTP/1.1\r\nHost: example.com\r\n"):
+				if !strings.HasSuffix(req, "Content-Length: 5\r\n\r\nhello") {
+					t.Errorf("TLS %v: wrong request %q", useTLS, req)
+				}
+				if !strings.HasSuffix(resp, "\r\n\r\nd\r\n/second:hello\r\n0\r\nGrpc-Status: 0\r\n\r\n") {
+					t.Errorf("TLS %v: wrong response %q", useTLS, resp)
+				}
+			default:
+				t.Errorf("TLS %v: wrong request %q", useTLS, req)
+			}
+		}
+		if len(reqs) != 2 || len(resps) != 2 {
+			t.Errorf("TLS %v: requests and responses should have different ids: %q %q", useTLS, reqs, resps)
+		}
+	}
+}
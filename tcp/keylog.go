@@ -0,0 +1,128 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// NSS key log labels, see https://developer.mozilla.org/en-US/docs/Mozilla/Projects/NSS/Key_Log_Format
+const (
+	keyLogClientRandom          = "CLIENT_RANDOM"
+	keyLogClientHandshakeSecret = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogServerHandshakeSecret = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogClientTrafficSecret   = "CLIENT_TRAFFIC_SECRET_0"
+	keyLogServerTrafficSecret   = "SERVER_TRAFFIC_SECRET_0"
+)
+
+// keyLogRefreshInterval limits how often the file is re-read while looking for missing secrets
+const keyLogRefreshInterval = 100 * time.Millisecond
+
+// KeyLog holds TLS secrets from an NSS key log file, the format written by
+// applications when SSLKEYLOGFILE environment variable is set (or tls.Config.KeyLogWriter in Go).
+// Applications append secrets while they make new connections, so the file is re-read
+// when a secret is not found.
+type KeyLog struct {
+	mu          sync.Mutex
+	path        string
+	offset      int64
+	partial     []byte
+	secrets     map[string][]byte
+	lastRefresh time.Time
+}
+
+// NewKeyLog reads secrets from the key log file
+func NewKeyLog(path string) (*KeyLog, error) {
+	k := &KeyLog{path: path, secrets: make(map[string][]byte)}
+	if err := k.refresh(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// refresh reads lines appended to the file since the last read
+func (k *KeyLog) refresh() error {
+	k.lastRefresh = time.Now()
+
+	f, err := os.Open(k.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	// file was truncated or replaced
+	if stat.Size() < k.offset {
+		k.offset = 0
+		k.partial = nil
+	}
+	if _, err = f.Seek(k.offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		k.offset += int64(len(line))
+		if err != nil {
+			// keep incomplete line until the rest of it is written
+			k.partial = append(k.partial, line...)
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if len(k.partial) > 0 {
+			line = append(k.partial, line...)
+			k.partial = nil
+		}
+		k.parseLine(line)
+	}
+}
+
+// parseLine parses "<label> <client random hex> <secret hex>" lines, comments and invalid lines are ignored
+func (k *KeyLog) parseLine(line []byte) {
+	fields := bytes.Fields(line)
+	if len(fields) != 3 || fields[0][0] == '#' {
+		return
+	}
+	clientRandom, err := hex.DecodeString(string(fields[1]))
+	if err != nil || len(clientRandom) != 32 {
+		return
+	}
+	secret, err := hex.DecodeString(string(fields[2]))
+	if err != nil {
+		return
+	}
+	k.secrets[string(fields[0])+string(clientRandom)] = secret
+}
+
+// Add adds a secret for the connection identified by the client random
+func (k *KeyLog) Add(label string, clientRandom, secret []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.secrets[label+string(clientRandom)] = secret
+}
+
+// Secret returns the secret with the given label for the connection identified by the client random,
+// or nil if the secret is not known yet
+func (k *KeyLog) Secret(label string, clientRandom []byte) []byte {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if secret, ok := k.secrets[label+string(clientRandom)]; ok {
+		return secret
+	}
+	if k.path == "" || time.Since(k.lastRefresh) < keyLogRefreshInterval {
+		return nil
+	}
+	k.refresh()
+	return k.secrets[label+string(clientRandom)]
+}
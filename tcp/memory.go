@@ -0,0 +1,180 @@
+package tcp
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// packetOverhead is memory used by a packet besides its payload
+const packetOverhead = 256
+
+// MemoryLimits bounds memory held by partial messages. It can be shared by parsers, like parsers of all
+// interfaces of a listener, so busy parsers can use memory idle ones don't. Messages are kept in LRU order
+// of their last packets, and the least recently updated ones are evicted when the budget is exceeded.
+type MemoryLimits struct {
+	maxMemory      int64 // budget of all partial messages, 0 is unlimited
+	maxConnMemory  int64 // budget of partial messages of a single connection, 0 is unlimited
+	maxMessageSize int   // payload of a message, further packets are dropped, 0 is unlimited
+
+	mu     sync.Mutex
+	memory int64 // accessed atomically, updated under mu
+	conns  map[string]int64
+	over   map[string]bool // connections above their budget
+	isOver int32           // accessed atomically, set when over is not empty
+	lru    list.List
+}
+
+// NewMemoryLimits limits memory of partial messages to maxMemory, and memory of partial messages of every
+// connection to maxConnMemory, evicting the least recently updated messages when they are exceeded, and payload
+// of every message to maxMessageSize. Evicted messages are emitted like timed out ones, and packets above
+// maxMessageSize are dropped and counted as lost data of the truncated message. Zero values disable the limits.
+func NewMemoryLimits(maxMemory, maxConnMemory, maxMessageSize int) *MemoryLimits {
+	return &MemoryLimits{
+		maxMemory:      int64(maxMemory),
+		maxConnMemory:  int64(maxConnMemory),
+		maxMessageSize: maxMessageSize,
+		conns:          make(map[string]int64),
+		over:           make(map[string]bool),
+	}
+}
+
+// WithMemoryLimits sets memory limits of the parser, by default memory is unlimited
+func WithMemoryLimits(limits *MemoryLimits) ParserOption {
+	return func(parser *MessageParser) {
+		parser.limits = limits
+	}
+}
+
+// truncate checks if the packet fits into maximum size of the message, otherwise the message
+// is marked as truncated, and payload of the packet is counted as lost
+func (parser *MessageParser) truncate(m *Message, pckt *Packet) bool {
+	max := parser.limits.maxMessageSize
+	if max == 0 || m.Length+len(pckt.Payload) <= max || len(m.packets) == 0 {
+		return false
+	}
+	for _, p := range m.packets {
+		if p.Seq == pckt.Seq {
+			return true // duplicate
+		}
+	}
+	if !m.Truncated {
+		m.Truncated = true
+		stats.Add("message_truncated_count", 1)
+	}
+	m.LostData += len(pckt.Payload) + int(pckt.Lost)
+	if pckt.Timestamp.After(m.End) {
+		m.End = pckt.Timestamp
+	}
+	return true
+}
+
+// account adds memory of the packet to the message, which becomes the most recently updated one
+func (parser *MessageParser) account(m *Message, pckt *Packet) {
+	size := int64(len(pckt.Payload) + packetOverhead)
+	l := parser.limits
+	l.mu.Lock()
+	m.size += size
+	atomic.AddInt64(&l.memory, size)
+	if m.lru == nil {
+		m.conn, _ = connID(m.packets[0])
+		m.lru = l.lru.PushBack(m)
+	} else {
+		l.lru.MoveToBack(m.lru)
+	}
+	l.conns[m.conn] += size
+	if l.maxConnMemory > 0 && l.conns[m.conn] > l.maxConnMemory {
+		l.over[m.conn] = true
+		atomic.StoreInt32(&l.isOver, 1)
+	}
+	l.mu.Unlock()
+	stats.Add("memory", size)
+}
+
+// release removes memory of the message from the budget, when it is not held by the parser anymore
+func (parser *MessageParser) release(m *Message) {
+	l := parser.limits
+	l.mu.Lock()
+	size := m.size
+	m.size = 0
+	atomic.AddInt64(&l.memory, -size)
+	if m.lru != nil {
+		l.lru.Remove(m.lru)
+		m.lru = nil
+	}
+	if size != 0 {
+		if l.conns[m.conn] -= size; l.conns[m.conn] <= 0 {
+			delete(l.conns, m.conn)
+		}
+	}
+	l.mu.Unlock()
+	if size != 0 {
+		stats.Add("memory", -size)
+	}
+}
+
+// evict removes the least recently updated messages until memory of all messages and of every connection
+// is within the budget, it should be called without message locks
+func (parser *MessageParser) evict() {
+	l := parser.limits
+	memoryOver := l.maxMemory > 0 && atomic.LoadInt64(&l.memory) > l.maxMemory
+	if !memoryOver && atomic.LoadInt32(&l.isOver) == 0 {
+		return
+	}
+	var victims []*Message
+	l.mu.Lock()
+	evicted := make(map[string]int64) // memory of connections, which is released by evicted messages
+	remove := func(m *Message) {
+		l.lru.Remove(m.lru)
+		m.lru = nil
+		evicted[m.conn] += m.size
+		victims = append(victims, m)
+	}
+	if l.maxMemory > 0 {
+		excess := atomic.LoadInt64(&l.memory) - l.maxMemory
+		for e := l.lru.Front(); e != nil && excess > 0; e = l.lru.Front() {
+			m := e.Value.(*Message)
+			excess -= m.size
+			remove(m)
+		}
+	}
+	for conn := range l.over {
+		excess := l.conns[conn] - evicted[conn] - l.maxConnMemory
+		for e := l.lru.Front(); e != nil && excess > 0; {
+			next := e.Next()
+			if m := e.Value.(*Message); m.conn == conn {
+				excess -= m.size
+				remove(m)
+			}
+			e = next
+		}
+		delete(l.over, conn)
+	}
+	atomic.StoreInt32(&l.isOver, 0)
+	l.mu.Unlock()
+
+	// messages are taken one lock at a time, they may have been emitted in the meantime;
+	// with shared limits they can belong to other parsers
+	for _, m := range victims {
+		p := m.parser
+		p.mL[m.Idx].Lock()
+		id := m.packets[0].MessageID()
+		if p.m[m.Idx][id] == m {
+			m.TimedOut = true
+			stats.Add("message_evicted_count", 1)
+			p.expire(m)
+		}
+		p.mL[m.Idx].Unlock()
+	}
+}
+
+// expire removes the message which did not complete in time or was evicted, it is emitted
+// if incomplete messages are allowed
+func (parser *MessageParser) expire(m *Message) {
+	if parser.End == nil || parser.allowIncompete || m.Truncated {
+		parser.Emit(m)
+		return
+	}
+	delete(parser.m[m.Idx], m.packets[0].MessageID())
+	parser.release(m)
+}
@@ -0,0 +1,111 @@
+package tcp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestMessageTruncated(t *testing.T) {
+	p := NewMessageParser(nil, nil, nil, 10*time.Millisecond, true, WithMemoryLimits(NewMemoryLimits(0, 0, 10)))
+	for _, pckt := range GetPackets(true, 1, 3, []byte("12345678")) {
+		p.processPacket(pckt)
+	}
+	m := p.Read()
+
+	if !m.Truncated || m.Length != 8 || m.LostData != 16 || len(m.packets) != 1 {
+		t.Errorf("expected truncated message with 16 bytes lost, got %+v", m.Stats)
+	}
+}
+
+func TestMessageEviction(t *testing.T) {
+	payload := bytes.Repeat([]byte("a"), 100)
+	first := GetPackets(true, 1, 1, payload)[0]
+	second := GetPackets(true, 1, 1, payload)[0]
+	second.Ack = 1
+
+	size := int64(len(payload) + packetOverhead)
+	p := NewMessageParser(nil, nil, nil, time.Hour, true, WithMemoryLimits(NewMemoryLimits(int(size)+10, 0, 0)))
+	p.processPacket(first)
+	p.processPacket(second)
+
+	// the least recently updated message is evicted
+	m := p.Read()
+	if !m.TimedOut || m.packets[0] != first {
+		t.Errorf("expected first message to be evicted, got %+v", m.Stats)
+	}
+	if p.limits.memory != size || p.limits.lru.Len() != 1 {
+		t.Errorf("expected memory of one message, got %d", p.limits.memory)
+	}
+
+	// incomplete messages are dropped when their end can be detected
+	p = NewMessageParser(nil, nil, nil, time.Hour, false, WithMemoryLimits(NewMemoryLimits(int(size)+10, 0, 0)))
+	p.End = func(*Message) bool { return false }
+	first.messageID, second.messageID = 0, 0
+	p.processPacket(first)
+	p.processPacket(second)
+	select {
+	case m = <-p.messages:
+		t.Errorf("evicted message should be dropped, got %+v", m.Stats)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if p.limits.memory != size {
+		t.Errorf("expected memory of one message, got %d", p.limits.memory)
+	}
+}
+
+func TestSharedMemoryLimits(t *testing.T) {
+	payload := bytes.Repeat([]byte("a"), 100)
+	first := GetPackets(true, 1, 1, payload)[0]
+	second := GetPackets(true, 1, 1, payload)[0]
+	second.SrcPort++
+
+	// parsers of interfaces share the budget, the busy one evicts messages of the other
+	size := int64(len(payload) + packetOverhead)
+	limits := NewMemoryLimits(int(size)+10, 0, 0)
+	p1 := NewMessageParser(nil, nil, nil, time.Hour, true, WithMemoryLimits(limits))
+	p2 := NewMessageParser(nil, nil, nil, time.Hour, true, WithMemoryLimits(limits))
+	p1.processPacket(first)
+	p2.processPacket(second)
+
+	select {
+	case m := <-p1.messages:
+		if !m.TimedOut || m.packets[0] != first {
+			t.Errorf("expected message of first parser to be evicted, got %+v", m.Stats)
+		}
+	case <-time.After(10 * time.Millisecond):
+		t.Error("expected message of first parser to be evicted")
+	}
+	if limits.memory != size {
+		t.Errorf("expected memory of one message, got %d", limits.memory)
+	}
+}
+
+func TestConnectionMemoryLimit(t *testing.T) {
+	payload := bytes.Repeat([]byte("a"), 100)
+	first := GetPackets(true, 1, 1, payload)[0]
+	second := GetPackets(true, 1, 1, payload)[0]
+	second.Ack = 1
+	other := GetPackets(true, 1, 1, payload)[0]
+	other.SrcPort++
+
+	size := int64(len(payload) + packetOverhead)
+	p := NewMessageParser(nil, nil, nil, time.Hour, true, WithMemoryLimits(NewMemoryLimits(0, int(size)+10, 0)))
+	p.processPacket(first)
+	p.processPacket(other)
+	p.processPacket(second)
+
+	// the oldest message of the connection is evicted, other connections keep their messages
+	m := p.Read()
+	if !m.TimedOut || m.packets[0] != first {
+		t.Errorf("expected first message to be evicted, got %+v", m.Stats)
+	}
+	select {
+	case m = <-p.messages:
+		t.Errorf("message of other connection should be kept, got %+v", m.Stats)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if p.limits.memory != 2*size || len(p.limits.conns) != 2 {
+		t.Errorf("expected memory of two messages in two connections, got %d in %d", p.limits.memory, len(p.limits.conns))
+	}
+}
@@ -0,0 +1,283 @@
+package tcp
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// commands and responses bigger than this are not reassembled, and their connections are not decoded anymore
+const mysqlMaxUnit = 64 << 20
+
+var (
+	errMySQLPacket = errors.New("invalid MySQL packet")
+	errMySQLUnit   = errors.New("MySQL command is too big")
+	errMySQLSSL    = errors.New("MySQL connection is encrypted")
+)
+
+// mysqlDecoder splits MySQL connections into commands and their responses. Handshake response of client
+// and every command (packets starting with sequence id 0) are emitted as separate messages, and packets of
+// server up to the end of the response as a message with the same UUID.
+type mysqlDecoder struct {
+	mu    sync.Mutex
+	ports Ports
+	conns map[string]*mysqlConn
+}
+
+func newMySQLDecoder(ports Ports) *mysqlDecoder {
+	return &mysqlDecoder{ports: ports, conns: make(map[string]*mysqlConn)}
+}
+
+// mysqlConn holds state of both directions of connection. Client stream starts with the handshake response,
+// or at a packet holding only complete packets of a command, so connections opened before the capture are
+// decoded too. Server stream starts at the sequence acknowledged by that packet, so server greeting is skipped.
+type mysqlConn struct {
+	mu           sync.Mutex
+	lastSeen     time.Time
+	failed       bool
+	base         uint32 // added to numbers of units, so UUIDs differ from the previous connection with the same ports
+	auth         bool   // handshake response is sent, and authentication is not complete
+	deprecateEOF bool
+	commands     []byte // commands waiting for response
+	response     *proto.MySQLResponse
+	client       unitStream
+	server       unitStream
+	clientCont   bool // last client packet continues in the next one
+}
+
+// decode emits commands and responses of packets, start is the time of the first packet of the unit
+func (d *mysqlDecoder) decode(pckt *Packet, emit func(p *Packet, start time.Time)) {
+	id, _ := connID(pckt)
+	client := fromClient(pckt, d.ports)
+	login := false
+	if client {
+		if seq, ok := proto.MySQLPackets(pckt.Payload); ok && seq == 1 {
+			_, login = proto.ParseMySQLHandshakeResponse(pckt.Payload[4:])
+		}
+	}
+
+	d.mu.Lock()
+	conn := d.conns[id]
+	if conn == nil || login && conn.client.started && conn.client.startSeq != pckt.Seq {
+		// new connection with the same ports
+		conn = &mysqlConn{base: uint32(time.Now().UnixNano())}
+		d.conns[id] = conn
+		stats.Add("mysql_connections", 1)
+	}
+	d.mu.Unlock()
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.lastSeen = time.Now()
+	if conn.failed {
+		return
+	}
+	if err := conn.push(client, login, pckt, emit); err != nil {
+		stats.Add("mysql_errors", 1)
+		conn.failed = true
+		conn.client.reset()
+		conn.server.reset()
+	}
+}
+
+// tick forgets expired connections
+func (d *mysqlDecoder) tick(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, conn := range d.conns {
+		conn.mu.Lock()
+		if now.Sub(conn.lastSeen) > connExpire {
+			delete(d.conns, id)
+		}
+		conn.mu.Unlock()
+	}
+}
+
+func (c *mysqlConn) push(client, login bool, pckt *Packet, emit func(*Packet, time.Time)) error {
+	parseServer := func(p *Packet) error {
+		c.server.last = p
+		return c.parseServer(p, emit)
+	}
+	if !client {
+		// kept until the client stream starts
+		return c.server.push(pckt, parseServer)
+	}
+
+	if !c.client.started {
+		seq, ok := proto.MySQLPackets(pckt.Payload)
+		switch {
+		case login:
+		case ok && seq == 0 && proto.IsMySQLCommand(pckt.Payload[4]):
+		default:
+			// stream start is not found yet
+			return nil
+		}
+		c.client.start(pckt.Seq)
+		c.server.start(pckt.Ack)
+	}
+	err := c.client.push(pckt, func(p *Packet) error {
+		return c.parseClient(p, emit)
+	})
+	if err != nil {
+		return err
+	}
+	if err = c.server.flush(parseServer); err != nil {
+		return err
+	}
+	if c.server.last != nil {
+		// server data can wait for the client commands it answers
+		return c.parseServer(c.server.last, emit)
+	}
+	return nil
+}
+
+func (c *mysqlConn) parseClient(pckt *Packet, emit func(*Packet, time.Time)) error {
+	s := &c.client
+	for len(s.buf) > 0 {
+		n, seq, ok := proto.MySQLPacket(s.buf)
+		if !ok {
+			return nil
+		}
+		if len(s.unit)+4+n > mysqlMaxUnit {
+			return errMySQLUnit
+		}
+		if len(s.buf) < 4+n {
+			return nil
+		}
+		packet := s.buf[:4+n]
+		payload := packet[4:]
+		cont := c.clientCont
+		c.clientCont = n == proto.MySQLMaxPacket
+		if len(s.unit) == 0 {
+			s.unitStart = pckt.Timestamp
+		}
+
+		switch {
+		case cont:
+			s.unit = append(s.unit, packet...)
+		case seq == 1 && !c.auth && c.client.units == 0:
+			h, ok := proto.ParseMySQLHandshakeResponse(payload)
+			if !ok {
+				return errMySQLPacket
+			}
+			if h.Capabilities&proto.MySQLClientSSL != 0 {
+				return errMySQLSSL
+			}
+			c.auth = true
+			c.deprecateEOF = h.Capabilities&proto.MySQLClientDeprecateEOF != 0
+			s.unit = append(s.unit, packet...)
+		case seq == 0:
+			if n == 0 || !proto.IsMySQLCommand(payload[0]) {
+				return errMySQLPacket
+			}
+			c.flushResponse(emit)
+			s.unit = append(s.unit, packet...)
+			if proto.MySQLHasResponse(payload[0]) {
+				c.commands = append(c.commands, payload[0])
+			}
+		case c.auth:
+			// authentication data is not captured
+		default:
+			// LOCAL INFILE data
+			s.unit = append(s.unit, packet...)
+		}
+		s.consume(4 + n)
+
+		if c.clientCont || len(s.unit) == 0 {
+			continue
+		}
+		// sequence id of the first packet tells the unit type
+		switch s.unit[3] {
+		case 0:
+			c.emit(true, proto.MySQLHasResponse(s.unit[4]), pckt, emit)
+		case 1:
+			if c.auth && s.units == 0 {
+				c.emit(true, true, pckt, emit)
+				break
+			}
+			fallthrough
+		default:
+			c.emit(true, false, pckt, emit)
+		}
+	}
+	return nil
+}
+
+// flushResponse emits response which is not complete when client sends the next command,
+// which happens when the end of response can not be found without capabilities of the connection
+func (c *mysqlConn) flushResponse(emit func(*Packet, time.Time)) {
+	if c.response == nil || len(c.server.unit) == 0 || c.server.last == nil {
+		return
+	}
+	c.response = nil
+	c.emit(false, true, c.server.last, emit)
+}
+
+func (c *mysqlConn) parseServer(pckt *Packet, emit func(*Packet, time.Time)) error {
+	s := &c.server
+	for len(s.buf) > 0 {
+		n, seq, ok := proto.MySQLPacket(s.buf)
+		if !ok {
+			return nil
+		}
+		if len(s.unit)+4+n > mysqlMaxUnit {
+			return errMySQLUnit
+		}
+		if len(s.buf) < 4+n {
+			return nil
+		}
+		packet := s.buf[:4+n]
+		payload := packet[4:]
+
+		if c.auth {
+			if c.client.units == 0 {
+				// waiting for the handshake response
+				return nil
+			}
+			if len(s.unit) == 0 {
+				s.unitStart = pckt.Timestamp
+			}
+			s.unit = append(s.unit, packet...)
+			s.consume(4 + n)
+			// authentication ends with OK or ERR, other packets switch method or hold its data
+			if n > 0 && (payload[0] == 0x00 || payload[0] == 0xff) {
+				c.auth = false
+				c.emit(false, true, pckt, emit)
+			}
+			continue
+		}
+
+		if c.response == nil {
+			if len(c.commands) == 0 {
+				// waiting for the command
+				return nil
+			}
+			if seq != 1 {
+				// the rest of response emitted before the next command
+				s.consume(4 + n)
+				continue
+			}
+			c.response = &proto.MySQLResponse{Command: c.commands[0], DeprecateEOF: c.deprecateEOF}
+			c.commands = c.commands[1:]
+			s.unitStart = pckt.Timestamp
+		}
+		s.unit = append(s.unit, packet...)
+		s.consume(4 + n)
+		if c.response.Add(payload) {
+			c.response = nil
+			c.emit(false, true, pckt, emit)
+		}
+	}
+	return nil
+}
+
+func (c *mysqlConn) emit(fromClient, response bool, pckt *Packet, emit func(*Packet, time.Time)) {
+	stats.Add("mysql_messages", 1)
+	if fromClient {
+		c.client.emit(c.base, true, response, pckt, emit)
+	} else {
+		c.server.emit(c.base, false, response, pckt, emit)
+	}
+}
@@ -0,0 +1,114 @@
+package tcp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// mysqlTestPackets builds packets with the payloads and sequence ids starting from seq
+func mysqlTestPackets(seq byte, payloads ...string) []byte {
+	var data []byte
+	for i, p := range payloads {
+		data = proto.AppendMySQLPacket(data, seq+byte(i), []byte(p))
+	}
+	return data
+}
+
+func TestMySQLMessages(t *testing.T) {
+	handshake := (&proto.MySQLHandshakeResponse{
+		Capabilities: proto.MySQLClientProtocol41 | proto.MySQLClientSecureConnection | proto.MySQLClientPluginAuth,
+		Charset:      45,
+		User:         "app",
+		AuthResponse: []byte("scrambled"),
+		Database:     "shop",
+		AuthPlugin:   "mysql_native_password",
+	}).Marshal()
+	login := mysqlTestPackets(1, string(handshake))
+	loginResp := mysqlTestPackets(2, "\xfemysql_clear_password\x00", "\x00\x00\x00\x02\x00\x00\x00")
+	query := mysqlTestPackets(0, "\x03SELECT 1")
+	queryResp := mysqlTestPackets(1, "\x01", "\x03def\x00\x00\x00\x011\x00\x0c\x3f\x00\x01\x00\x00\x00\x08\x81\x00\x00\x00\x00", "\xfe\x00\x00\x02\x00", "\x011", "\xfe\x00\x00\x02\x00")
+	prepare := mysqlTestPackets(0, "\x16SELECT ?")
+	prepareResp := mysqlTestPackets(1, "\x00\x2a\x00\x00\x00\x01\x00\x01\x00\x00\x00\x00", "\x03def\x00\x00\x00\x01?\x00\x0c\x3f\x00\x00\x00\x00\x00\xfd\x80\x00\x00\x00\x00", "\xfe\x00\x00\x02\x00", "\x03def\x00\x00\x00\x01?\x00\x0c\x3f\x00\x00\x00\x00\x00\xfd\x80\x00\x00\x00\x00", "\xfe\x00\x00\x02\x00")
+	// execute spans two packets, which are captured in reverse order
+	execute := mysqlTestPackets(0, "\x17\x2a\x00\x00\x00\x00\x01\x00\x00\x00\x00\x01\xfd\x00\xfc\xd0\x07"+strings.Repeat("x", 2000))
+	executeResp := mysqlTestPackets(1, "\x00\x00\x00\x02\x00\x00\x00")
+	closing := mysqlTestPackets(0, "\x19\x2a\x00\x00\x00")
+	quit := mysqlTestPackets(0, "\x01")
+
+	segments := []testSegment{
+		{false, mysqlTestPackets(0, "\x0a8.0.30\x00\x01\x00\x00\x00abcdefgh\x00\xff\xff\x2d\x02\x00\xff\xdf\x15\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00ijklmnopqrst\x00mysql_native_password\x00")},
+		{true, login},
+		{false, loginResp[:len(loginResp)-11]},
+		{true, mysqlTestPackets(3, "secret\x00")},
+		{false, loginResp[len(loginResp)-11:]},
+		{true, query},
+		{false, queryResp},
+		{true, prepare},
+		{false, prepareResp},
+		{true, execute},
+		{false, executeResp},
+		{true, closing},
+		{true, quit},
+	}
+	requests, responses := splitTestMessages(decodeTestMessages(t, segments, 3306, 10, WithMySQL()))
+
+	for _, m := range append(requests, responses...) {
+		if bytes.Contains(m.Data(), []byte("secret")) {
+			t.Errorf("Authentication data should not be captured: %q", m.Data())
+		}
+	}
+	if len(requests) != 6 || len(responses) != 4 {
+		t.Fatalf("Expected 6 requests and 4 responses, got %d and %d", len(requests), len(responses))
+	}
+	// units of the same direction are emitted in order
+	for i, data := range [][]byte{login, query, prepare, execute, closing, quit} {
+		if !bytes.Equal(requests[i].Data(), data) {
+			t.Errorf("Wrong request %d: %q", i, requests[i].Data())
+		}
+	}
+	for i, data := range [][]byte{loginResp, queryResp, prepareResp, executeResp} {
+		if !bytes.Equal(responses[i].Data(), data) {
+			t.Errorf("Wrong response %d: %q", i, responses[i].Data())
+		}
+		if !bytes.Equal(responses[i].UUID(), requests[i].UUID()) {
+			t.Errorf("Response %d should have UUID of its command %s, got %s", i, requests[i].UUID(), responses[i].UUID())
+		}
+	}
+	if !bytes.Equal(requests[4].UUID(), requests[3].UUID()) {
+		t.Errorf("Commands without response should have UUID of the previous command")
+	}
+}
+
+func TestMySQLMessagesWithoutHandshake(t *testing.T) {
+	// capabilities are not known, and responses use OK packets instead of EOF
+	query := mysqlTestPackets(0, "\x03SELECT 1")
+	queryResp := mysqlTestPackets(1, "\x01", "\x03def\x00\x00\x00\x011\x00\x0c\x3f\x00\x01\x00\x00\x00\x08\x81\x00\x00\x00\x00", "\x011", "\xfe\x00\x00\x02\x00\x00\x00")
+	prepare := mysqlTestPackets(0, "\x16SELECT ?")
+	prepareResp := mysqlTestPackets(1, "\x00\x2a\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00", "\x03def\x00\x00\x00\x01?\x00\x0c\x3f\x00\x00\x00\x00\x00\xfd\x80\x00\x00\x00\x00")
+	ping := mysqlTestPackets(0, "\x0e")
+	pingResp := mysqlTestPackets(1, "\x00\x00\x00\x02\x00\x00\x00")
+
+	segments := []testSegment{
+		// end of the previous response and a partial command are skipped
+		{false, mysqlTestPackets(5, "\xfe\x00\x00\x02\x00")[2:]},
+		{true, query[3:]},
+		{true, query},
+		{false, queryResp},
+		{true, prepare},
+		{false, prepareResp},
+		{true, ping},
+		{false, pingResp},
+	}
+	requests, responses := splitTestMessages(decodeTestMessages(t, segments, 3306, 6, WithMySQL()))
+	for i, data := range [][]byte{queryResp, prepareResp, pingResp} {
+		if !bytes.Equal(responses[i].Data(), data) {
+			t.Errorf("Wrong response %d: %q", i, responses[i].Data())
+		}
+		if !bytes.Equal(responses[i].UUID(), requests[i].UUID()) {
+			t.Errorf("Response %d should have UUID of its command", i)
+		}
+	}
+}
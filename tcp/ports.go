@@ -0,0 +1,129 @@
+package tcp
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PortRange is an inclusive range of ports, excluded ranges are subtracted from the included ones
+type PortRange struct {
+	Min, Max uint16
+	Exclude  bool
+}
+
+// Ports is a set of ports given by ranges. A port belongs to the set if it is in one of the included ranges,
+// or there are no included ranges, and it is not in any of the excluded ranges. Empty set has all ports.
+type Ports []PortRange
+
+// HostPorts is a host with ports of its own, used when captured hosts have different ports
+type HostPorts struct {
+	IP    net.IP
+	Ports Ports
+}
+
+// matchHosts checks if the port belongs to the set of ports of the host
+func matchHosts(hosts []HostPorts, ip net.IP, port uint16) bool {
+	for _, h := range hosts {
+		if h.IP.Equal(ip) && h.Ports.Match(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePorts parses comma separated ports, ranges like 8000-8100 and wildcards (* or 0),
+// ports and ranges prefixed with ! are excluded: "8000-8100,9000,!8080"
+func ParsePorts(s string) (ports Ports, err error) {
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		var r PortRange
+		if strings.HasPrefix(item, "!") {
+			r.Exclude = true
+			item = strings.TrimSpace(item[1:])
+		}
+		switch dash := strings.IndexByte(item, '-'); {
+		case item == "*" || item == "0":
+			r.Max = 1<<16 - 1
+		case dash != -1:
+			if r.Min, err = parsePort(item[:dash]); err != nil {
+				return nil, err
+			}
+			if r.Max, err = parsePort(item[dash+1:]); err != nil {
+				return nil, err
+			}
+			if r.Min > r.Max {
+				return nil, fmt.Errorf("invalid port range %q", item)
+			}
+		default:
+			if r.Min, err = parsePort(item); err != nil {
+				return nil, err
+			}
+			r.Max = r.Min
+		}
+		ports = append(ports, r)
+	}
+	return
+}
+
+func parsePort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(strings.TrimSpace(s), 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return uint16(port), nil
+}
+
+// Match checks if the port belongs to the set
+func (ports Ports) Match(port uint16) bool {
+	included, hasIncluded := false, false
+	for _, r := range ports {
+		in := r.Min <= port && port <= r.Max
+		if r.Exclude {
+			if in {
+				return false
+			}
+			continue
+		}
+		hasIncluded = true
+		included = included || in
+	}
+	return included || !hasIncluded
+}
+
+// All checks if the set has all ports, so they don't tell requests from responses
+func (ports Ports) All() bool {
+	all := true
+	for _, r := range ports {
+		if r.Exclude {
+			return false
+		}
+		if r.Min == 0 && r.Max == 1<<16-1 {
+			return true
+		}
+		all = false
+	}
+	return all
+}
+
+// String formats the set like ParsePorts expects it
+func (ports Ports) String() string {
+	items := make([]string, 0, len(ports))
+	for _, r := range ports {
+		var item string
+		switch {
+		case r.Min == 0 && r.Max == 1<<16-1:
+			item = "*"
+		case r.Min == r.Max:
+			item = strconv.Itoa(int(r.Min))
+		default:
+			item = fmt.Sprintf("%d-%d", r.Min, r.Max)
+		}
+		if r.Exclude {
+			item = "!" + item
+		}
+		items = append(items, item)
+	}
+	return strings.Join(items, ",")
+}
@@ -0,0 +1,61 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestParsePorts(t *testing.T) {
+	ports, err := ParsePorts("8000-8100, 9000,!8080,!8090-8095")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ports.String() != "8000-8100,9000,!8080,!8090-8095" || ports.All() {
+		t.Errorf("unexpected ports %s", ports)
+	}
+	for port, match := range map[uint16]bool{8000: true, 8100: true, 9000: true, 8080: false, 8092: false, 7999: false, 80: false} {
+		if ports.Match(port) != match {
+			t.Errorf("port %d: expected match %v", port, match)
+		}
+	}
+
+	// wildcards, exclusions alone exclude from all ports
+	for _, s := range []string{"*", "0"} {
+		if ports, _ = ParsePorts(s); !ports.All() || !ports.Match(1) {
+			t.Errorf("%s should match all ports", s)
+		}
+	}
+	ports, _ = ParsePorts("!9090")
+	if ports.All() || !ports.Match(80) || ports.Match(9090) {
+		t.Errorf("all ports except 9090 should match, got %s", ports)
+	}
+	if !Ports(nil).All() || !Ports(nil).Match(80) {
+		t.Error("empty set should match all ports")
+	}
+
+	for _, s := range []string{"", "abc", "70000", "90-80", "1-", "!"} {
+		if _, err = ParsePorts(s); err == nil {
+			t.Errorf("%q should be invalid", s)
+		}
+	}
+}
+
+func TestPortRangeDirection(t *testing.T) {
+	ports, _ := ParsePorts("8000-8100,!8050")
+	parser := NewMessageParser(nil, ports, []net.IP{net.IPv4(127, 0, 0, 1)}, time.Second, false)
+	defer parser.Close()
+	for port, incoming := range map[uint16]bool{8042: true, 8050: false, 9000: false} {
+		d := append(generateHeader(true, 1, 4), "ping"...)
+		binary.BigEndian.PutUint16(d[4+24+2:], port)
+		ci := &gopacket.CaptureInfo{Length: len(d), CaptureLength: len(d), Timestamp: time.Now()}
+		pckt := parser.parsePacket(&PcapPacket{Data: d, LType: int(layers.LinkTypeLoop), LTypeLen: 4, Ci: ci})
+		if pckt == nil || (pckt.Direction == DirIncoming) != incoming {
+			t.Errorf("port %d: expected incoming %v", port, incoming)
+		}
+	}
+}
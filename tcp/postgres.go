@@ -0,0 +1,249 @@
+package tcp
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// queries and responses bigger than this are not reassembled, and their connections are not decoded anymore
+const pgMaxUnit = 16 << 20
+
+var (
+	errPGMessage = errors.New("invalid PostgreSQL message")
+	errPGUnit    = errors.New("PostgreSQL query is too big")
+	errPGSSL     = errors.New("PostgreSQL connection is encrypted")
+)
+
+// pgDecoder splits PostgreSQL connections into queries and their responses. Client messages are grouped
+// into units answered with one ReadyForQuery: startup message, simple query, function call, and messages
+// of extended query up to Sync. Server messages up to ReadyForQuery are the response of the oldest unit.
+// Every unit is emitted as a separate message, responses get the same UUID as their query.
+type pgDecoder struct {
+	mu    sync.Mutex
+	ports Ports
+	conns map[string]*pgConn
+}
+
+func newPGDecoder(ports Ports) *pgDecoder {
+	return &pgDecoder{ports: ports, conns: make(map[string]*pgConn)}
+}
+
+// pgConn holds state of both directions of connection. Client stream starts with the startup message,
+// or at a packet holding only complete messages, so connections opened before the capture are decoded too.
+// Server stream starts at the sequence acknowledged by that packet.
+type pgConn struct {
+	mu       sync.Mutex
+	lastSeen time.Time
+	failed   bool
+	base     uint32 // added to numbers of units, so UUIDs differ from the previous connection with the same ports
+	startup  bool   // next client message is untyped
+	// SSLRequest and GSSENCRequest messages, and single byte responses to them
+	sslRequests, sslAnswers int
+	client                  unitStream
+	server                  unitStream
+}
+
+// decode emits queries and responses of packets, start is the time of the first packet of the unit
+func (d *pgDecoder) decode(pckt *Packet, emit func(p *Packet, start time.Time)) {
+	id, _ := connID(pckt)
+	client := fromClient(pckt, d.ports)
+	_, _, startup := proto.PostgresStartup(pckt.Payload)
+	startup = startup && client
+
+	d.mu.Lock()
+	conn := d.conns[id]
+	if conn == nil || startup && (conn.failed || !conn.startup) && conn.client.started && conn.client.startSeq != pckt.Seq {
+		// new connection with the same ports
+		conn = &pgConn{base: uint32(time.Now().UnixNano())}
+		d.conns[id] = conn
+		stats.Add("postgres_connections", 1)
+	}
+	d.mu.Unlock()
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.lastSeen = time.Now()
+	if conn.failed {
+		return
+	}
+	if err := conn.push(client, startup, pckt, emit); err != nil {
+		stats.Add("postgres_errors", 1)
+		conn.failed = true
+		conn.client.reset()
+		conn.server.reset()
+	}
+}
+
+// tick forgets expired connections
+func (d *pgDecoder) tick(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, conn := range d.conns {
+		conn.mu.Lock()
+		if now.Sub(conn.lastSeen) > connExpire {
+			delete(d.conns, id)
+		}
+		conn.mu.Unlock()
+	}
+}
+
+func (c *pgConn) push(client, startup bool, pckt *Packet, emit func(*Packet, time.Time)) error {
+	parseServer := func(p *Packet) error {
+		c.server.last = p
+		return c.parseServer(p, emit)
+	}
+	if !client {
+		// kept until the client stream starts
+		return c.server.push(pckt, parseServer)
+	}
+
+	if !c.client.started {
+		switch {
+		case startup:
+			c.startup = true
+		case proto.PostgresMessages(pckt.Payload, true):
+		default:
+			// stream start is not found yet
+			return nil
+		}
+		c.client.start(pckt.Seq)
+		c.server.start(pckt.Ack)
+	}
+	err := c.client.push(pckt, func(p *Packet) error {
+		return c.parseClient(p, emit)
+	})
+	if err != nil {
+		return err
+	}
+	if err = c.server.flush(parseServer); err != nil {
+		return err
+	}
+	if c.server.last != nil {
+		// server data can wait for the client messages it answers
+		return c.parseServer(c.server.last, emit)
+	}
+	return nil
+}
+
+func (c *pgConn) parseClient(pckt *Packet, emit func(*Packet, time.Time)) error {
+	s := &c.client
+	for len(s.buf) > 0 {
+		if c.startup {
+			n, code, ok := proto.PostgresStartup(s.buf)
+			if !ok {
+				if len(s.buf) >= 8 {
+					return errPGMessage
+				}
+				return nil
+			}
+			if len(s.buf) < n {
+				return nil
+			}
+			switch code {
+			case proto.PostgresSSLRequest, proto.PostgresGSSENCRequest:
+				c.sslRequests++
+			case proto.PostgresCancelRequest:
+			default:
+				c.startup = false
+				s.unitStart = pckt.Timestamp
+				s.unit = append(s.unit, s.buf[:n]...)
+				c.emit(true, true, pckt, emit)
+			}
+			s.consume(n)
+			continue
+		}
+
+		typ, n, ok := proto.PostgresMessage(s.buf)
+		if !ok {
+			if len(s.buf) >= 5 {
+				return errPGMessage
+			}
+			return nil
+		}
+		if !proto.IsPostgresFrontend(typ) {
+			return errPGMessage
+		}
+		if len(s.unit)+n > pgMaxUnit {
+			return errPGUnit
+		}
+		if len(s.buf) < n {
+			return nil
+		}
+		if len(s.unit) == 0 {
+			s.unitStart = pckt.Timestamp
+		}
+		switch typ {
+		case 'p':
+			// passwords are not captured
+		case 'Q', 'F', 'S':
+			s.unit = append(s.unit, s.buf[:n]...)
+			c.emit(true, true, pckt, emit)
+		case 'X', 'd', 'c', 'f':
+			// terminate and copy data are sent alone, or within extended query
+			s.unit = append(s.unit, s.buf[:n]...)
+			if len(s.unit) == n {
+				c.emit(true, false, pckt, emit)
+			}
+		default:
+			s.unit = append(s.unit, s.buf[:n]...)
+		}
+		s.consume(n)
+	}
+	return nil
+}
+
+func (c *pgConn) parseServer(pckt *Packet, emit func(*Packet, time.Time)) error {
+	s := &c.server
+	for len(s.buf) > 0 {
+		if c.sslAnswers < c.sslRequests {
+			if s.buf[0] != 'N' {
+				return errPGSSL
+			}
+			c.sslAnswers++
+			s.consume(1)
+			continue
+		}
+		if c.startup {
+			// until the startup message server only answers to SSLRequest and GSSENCRequest
+			return nil
+		}
+
+		typ, n, ok := proto.PostgresMessage(s.buf)
+		if !ok {
+			if len(s.buf) >= 5 {
+				return errPGMessage
+			}
+			return nil
+		}
+		if !proto.IsPostgresBackend(typ) {
+			return errPGMessage
+		}
+		if len(s.unit)+n > pgMaxUnit {
+			return errPGUnit
+		}
+		if len(s.buf) < n {
+			return nil
+		}
+		if len(s.unit) == 0 {
+			s.unitStart = pckt.Timestamp
+		}
+		s.unit = append(s.unit, s.buf[:n]...)
+		if typ == 'Z' {
+			c.emit(false, true, pckt, emit)
+		}
+		s.consume(n)
+	}
+	return nil
+}
+
+func (c *pgConn) emit(fromClient, response bool, pckt *Packet, emit func(*Packet, time.Time)) {
+	stats.Add("postgres_messages", 1)
+	if fromClient {
+		c.client.emit(c.base, true, response, pckt, emit)
+	} else {
+		c.server.emit(c.base, false, response, pckt, emit)
+	}
+}
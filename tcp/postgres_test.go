@@ -0,0 +1,120 @@
+package tcp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/buger/goreplay/proto"
+)
+
+func pgTestMessage(typ byte, body string) []byte {
+	return proto.AppendPostgresMessage(nil, typ, []byte(body))
+}
+
+func TestPostgresMessages(t *testing.T) {
+	startup := proto.NewPostgresStartup(map[string]string{"user": "app", "database": "shop"})
+	query := pgTestMessage('Q', "SELECT 1\x00")
+	// extended query spans two packets, which are captured in reverse order
+	long := "SELECT * FROM orders WHERE note = '" + strings.Repeat("x", 2000) + "'\x00"
+	extended := bytes.Join([][]byte{
+		pgTestMessage('P', "\x00"+long+"\x00\x00"),
+		pgTestMessage('B', "\x00\x00\x00\x00\x00\x00\x00\x00"),
+		pgTestMessage('E', "\x00\x00\x00\x00\x00"),
+		pgTestMessage('S', ""),
+	}, nil)
+	terminate := pgTestMessage('X', "")
+
+	md5Request := pgTestMessage('R', "\x00\x00\x00\x05salt")
+	startupResp := bytes.Join([][]byte{
+		pgTestMessage('R', "\x00\x00\x00\x00"),
+		pgTestMessage('S', "server_version\x0013\x00"),
+		pgTestMessage('K', "\x00\x00\x00\x01\x00\x00\x00\x02"),
+		pgTestMessage('Z', "I"),
+	}, nil)
+	queryResp := bytes.Join([][]byte{
+		pgTestMessage('T', "\x00\x01?column?\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x17\x00\x04\xff\xff\xff\xff\x00\x00"),
+		pgTestMessage('D', "\x00\x01\x00\x00\x00\x011"),
+		pgTestMessage('C', "SELECT 1\x00"),
+		pgTestMessage('Z', "I"),
+	}, nil)
+	extendedResp := bytes.Join([][]byte{
+		pgTestMessage('1', ""),
+		pgTestMessage('2', ""),
+		pgTestMessage('C', "SELECT 0\x00"),
+		pgTestMessage('Z', "I"),
+	}, nil)
+
+	segments := []testSegment{
+		{true, []byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}}, // SSLRequest
+		{false, []byte("N")},
+		{true, startup},
+		{false, md5Request},
+		{true, pgTestMessage('p', "md5secret\x00")},
+		{false, startupResp},
+		{true, query},
+		{false, queryResp},
+		{true, extended},
+		{false, extendedResp},
+		{true, terminate},
+	}
+	messages := decodeTestMessages(t, segments, 5432, 7, WithPostgres())
+
+	var requests, responses []*Message
+	for _, m := range messages {
+		if bytes.Contains(m.Data(), []byte("secret")) {
+			t.Errorf("Password should not be captured: %q", m.Data())
+		}
+		if m.Direction == DirIncoming {
+			requests = append(requests, m)
+		} else {
+			responses = append(responses, m)
+		}
+	}
+	if len(requests) != 4 || len(responses) != 3 {
+		t.Fatalf("Expected 4 requests and 3 responses, got %d and %d", len(requests), len(responses))
+	}
+
+	// units of the same direction are emitted in order
+	for i, data := range [][]byte{startup, query, extended, terminate} {
+		if !bytes.Equal(requests[i].Data(), data) {
+			t.Errorf("Wrong request %d: %q", i, requests[i].Data())
+		}
+	}
+	for i, data := range [][]byte{append(md5Request, startupResp...), queryResp, extendedResp} {
+		if !bytes.Equal(responses[i].Data(), data) {
+			t.Errorf("Wrong response %d: %q", i, responses[i].Data())
+		}
+		if !bytes.Equal(responses[i].UUID(), requests[i].UUID()) {
+			t.Errorf("Response %d should have UUID of its query %s, got %s", i, requests[i].UUID(), responses[i].UUID())
+		}
+	}
+	if !bytes.Equal(requests[3].UUID(), requests[2].UUID()) {
+		t.Errorf("Terminate should have UUID of the previous query")
+	}
+	if bytes.Equal(requests[0].UUID(), requests[1].UUID()) {
+		t.Errorf("Queries should have different UUIDs")
+	}
+}
+
+func TestPostgresMessagesWithoutStartup(t *testing.T) {
+	query := pgTestMessage('Q', "BEGIN\x00")
+	queryResp := bytes.Join([][]byte{pgTestMessage('C', "BEGIN\x00"), pgTestMessage('Z', "T")}, nil)
+	segments := []testSegment{
+		// end of the previous response and a partial query are skipped
+		{false, pgTestMessage('Z', "I")[2:]},
+		{true, pgTestMessage('Q', "SELECT 1\x00")[3:]},
+		{true, query},
+		{false, queryResp},
+	}
+	messages := decodeTestMessages(t, segments, 5432, 2, WithPostgres())
+	if messages[0].Direction != DirIncoming || !bytes.Equal(messages[0].Data(), query) {
+		t.Errorf("Wrong query: %q", messages[0].Data())
+	}
+	if messages[1].Direction != DirOutcoming || !bytes.Equal(messages[1].Data(), queryResp) {
+		t.Errorf("Wrong response: %q", messages[1].Data())
+	}
+	if !bytes.Equal(messages[0].UUID(), messages[1].UUID()) {
+		t.Errorf("Response should have UUID of its query")
+	}
+}
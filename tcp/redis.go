@@ -0,0 +1,222 @@
+package tcp
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+const (
+	// commands and replies bigger than this are not reassembled, and their connections are not decoded anymore
+	redisMaxUnit = 64 << 20
+	// client packet holding whole commands far from the expected sequence starts a new connection with the same ports
+	redisSeqWindow = 1 << 26
+)
+
+var (
+	errRedisCommand = errors.New("invalid Redis command")
+	errRedisReply   = errors.New("invalid Redis reply")
+	errRedisUnit    = errors.New("Redis command is too big")
+)
+
+// redisDecoder splits Redis connections into commands and their replies. Pipelined commands are emitted
+// as separate messages, and every reply as a message with the same UUID as its command.
+type redisDecoder struct {
+	mu    sync.Mutex
+	ports Ports
+	conns map[string]*redisConn
+}
+
+func newRedisDecoder(ports Ports) *redisDecoder {
+	return &redisDecoder{ports: ports, conns: make(map[string]*redisConn)}
+}
+
+// redisConn holds state of both directions of connection. Client stream starts at a packet holding only
+// complete commands, server stream starts at the sequence acknowledged by that packet.
+type redisConn struct {
+	mu         sync.Mutex
+	lastSeen   time.Time
+	failed     bool
+	base       uint32 // added to numbers of units, so UUIDs differ from the previous connection with the same ports
+	commands   int    // commands waiting for reply
+	subscribed bool   // server sends messages instead of replies
+	client     unitStream
+	server     unitStream
+}
+
+// decode emits commands and replies of packets, start is the time of the first packet of the unit
+func (d *redisDecoder) decode(pckt *Packet, emit func(p *Packet, start time.Time)) {
+	id, _ := connID(pckt)
+	client := fromClient(pckt, d.ports)
+	commands := client && proto.RedisCommands(pckt.Payload)
+
+	d.mu.Lock()
+	conn := d.conns[id]
+	if conn == nil {
+		conn = d.open(id)
+	}
+	d.mu.Unlock()
+
+	conn.mu.Lock()
+	if commands && conn.client.started && (conn.failed || !inWindow(pckt.Seq, conn.client.nextSeq)) {
+		// new connection with the same ports, or the first commands after decoding errors
+		conn.mu.Unlock()
+		d.mu.Lock()
+		conn = d.open(id)
+		d.mu.Unlock()
+		conn.mu.Lock()
+	}
+	defer conn.mu.Unlock()
+	conn.lastSeen = time.Now()
+	if conn.failed {
+		return
+	}
+	if err := conn.push(client, commands, pckt, emit); err != nil {
+		stats.Add("redis_errors", 1)
+		conn.failed = true
+		conn.client.reset()
+		conn.server.reset()
+	}
+}
+
+// open replaces state of the connection, d.mu should be locked
+func (d *redisDecoder) open(id string) *redisConn {
+	conn := &redisConn{base: uint32(time.Now().UnixNano())}
+	d.conns[id] = conn
+	stats.Add("redis_connections", 1)
+	return conn
+}
+
+func inWindow(seq, expected uint32) bool {
+	diff := seqDiff(seq, expected)
+	return diff > -redisSeqWindow && diff < redisSeqWindow
+}
+
+// tick forgets expired connections
+func (d *redisDecoder) tick(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, conn := range d.conns {
+		conn.mu.Lock()
+		if now.Sub(conn.lastSeen) > connExpire {
+			delete(d.conns, id)
+		}
+		conn.mu.Unlock()
+	}
+}
+
+func (c *redisConn) push(client, commands bool, pckt *Packet, emit func(*Packet, time.Time)) error {
+	parseServer := func(p *Packet) error {
+		c.server.last = p
+		return c.parseServer(p, emit)
+	}
+	if !client {
+		// kept until the client stream starts
+		return c.server.push(pckt, parseServer)
+	}
+
+	if !c.client.started {
+		if !commands {
+			// stream start is not found yet
+			return nil
+		}
+		c.client.start(pckt.Seq)
+		c.server.start(pckt.Ack)
+	}
+	err := c.client.push(pckt, func(p *Packet) error {
+		return c.parseClient(p, emit)
+	})
+	if err != nil {
+		return err
+	}
+	if err = c.server.flush(parseServer); err != nil {
+		return err
+	}
+	if c.server.last != nil {
+		// server data can wait for the client commands it answers
+		return c.parseServer(c.server.last, emit)
+	}
+	return nil
+}
+
+func (c *redisConn) parseClient(pckt *Packet, emit func(*Packet, time.Time)) error {
+	s := &c.client
+	for len(s.buf) > 0 {
+		args, n, ok := proto.RedisCommand(s.buf)
+		if !ok {
+			return errRedisCommand
+		}
+		if n == 0 {
+			if len(s.buf) > redisMaxUnit {
+				return errRedisUnit
+			}
+			return nil
+		}
+		if len(args) == 0 {
+			// empty inline command
+			s.consume(n)
+			continue
+		}
+
+		s.unitStart = pckt.Timestamp
+		s.unit = append(s.unit, s.buf[:n]...)
+		s.consume(n)
+		switch proto.RedisCommandName(args) {
+		case "SUBSCRIBE", "PSUBSCRIBE", "SSUBSCRIBE", "MONITOR":
+			// replies can not be matched to commands anymore
+			c.subscribed = true
+		}
+		if c.subscribed {
+			c.emit(true, false, pckt, emit)
+			continue
+		}
+		c.commands++
+		c.emit(true, true, pckt, emit)
+	}
+	return nil
+}
+
+func (c *redisConn) parseServer(pckt *Packet, emit func(*Packet, time.Time)) error {
+	s := &c.server
+	for len(s.buf) > 0 {
+		if c.commands == 0 {
+			if c.subscribed {
+				s.consume(len(s.buf))
+			}
+			// waiting for the command
+			return nil
+		}
+		n, ok := proto.RedisValue(s.buf)
+		if !ok {
+			return errRedisReply
+		}
+		if n == 0 {
+			if len(s.buf) > redisMaxUnit {
+				return errRedisUnit
+			}
+			return nil
+		}
+		if s.buf[0] == '>' {
+			// RESP3 push messages are not replies
+			s.consume(n)
+			continue
+		}
+		c.commands--
+		s.unitStart = pckt.Timestamp
+		s.unit = append(s.unit, s.buf[:n]...)
+		s.consume(n)
+		c.emit(false, true, pckt, emit)
+	}
+	return nil
+}
+
+func (c *redisConn) emit(fromClient, response bool, pckt *Packet, emit func(*Packet, time.Time)) {
+	stats.Add("redis_messages", 1)
+	if fromClient {
+		c.client.emit(c.base, true, response, pckt, emit)
+	} else {
+		c.server.emit(c.base, false, response, pckt, emit)
+	}
+}
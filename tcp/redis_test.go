@@ -0,0 +1,58 @@
+package tcp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/buger/goreplay/proto"
+)
+
+func redisTestCommand(args ...string) []byte {
+	var b [][]byte
+	for _, a := range args {
+		b = append(b, []byte(a))
+	}
+	return proto.AppendRedisCommand(nil, b)
+}
+
+func TestRedisMessages(t *testing.T) {
+	set := redisTestCommand("SET", "user:1", "alice")
+	get := redisTestCommand("GET", "user:1")
+	// big command spans several packets, which are captured in reverse order
+	setBig := redisTestCommand("SET", "big", strings.Repeat("x", 3000))
+	ping := []byte("PING\r\n")
+	subscribe := redisTestCommand("SUBSCRIBE", "news")
+
+	segments := []testSegment{
+		// end of the previous reply is skipped
+		{false, []byte("lo\r\n")},
+		// pipelined commands and their replies
+		{true, append(append([]byte(nil), set...), get...)},
+		{false, []byte("+OK\r\n$5\r\nalice\r\n")},
+		{true, setBig},
+		{false, []byte("+OK\r\n")},
+		{true, ping},
+		{false, []byte("+PONG\r\n")},
+		{true, subscribe},
+		{false, []byte("*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$2\r\nhi\r\n")},
+	}
+	requests, responses := splitTestMessages(decodeTestMessages(t, segments, 6379, 9, WithRedis()))
+	if len(requests) != 5 || len(responses) != 4 {
+		t.Fatalf("Expected 5 requests and 4 responses, got %d and %d", len(requests), len(responses))
+	}
+	// units of the same direction are emitted in order
+	for i, data := range [][]byte{set, get, setBig, ping, subscribe} {
+		if !bytes.Equal(requests[i].Data(), data) {
+			t.Errorf("Wrong request %d: %q", i, requests[i].Data())
+		}
+	}
+	for i, data := range []string{"+OK\r\n", "$5\r\nalice\r\n", "+OK\r\n", "+PONG\r\n"} {
+		if string(responses[i].Data()) != data {
+			t.Errorf("Wrong response %d: %q", i, responses[i].Data())
+		}
+		if !bytes.Equal(responses[i].UUID(), requests[i].UUID()) {
+			t.Errorf("Response %d should have UUID of its command %s, got %s", i, requests[i].UUID(), responses[i].UUID())
+		}
+	}
+}
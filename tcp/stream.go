@@ -0,0 +1,157 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	connExpire       = 5 * time.Minute // connections of stream decoders are forgotten after this time without packets
+	streamMaxPending = 1024            // segments waiting for missing segments or for the stream start
+)
+
+var errStreamOverflow = errors.New("too many TCP segments waiting")
+
+func endpointID(ip net.IP, port uint16) string {
+	id := make([]byte, len(ip)+2)
+	copy(id, ip)
+	binary.BigEndian.PutUint16(id[len(ip):], port)
+	return string(id)
+}
+
+// connID returns the same id for both directions of connection, and id of the direction
+func connID(pckt *Packet) (id, src string) {
+	src = endpointID(pckt.SrcIP, pckt.SrcPort)
+	dst := endpointID(pckt.DstIP, pckt.DstPort)
+	if src < dst {
+		return src + dst, src
+	}
+	return dst + src, src
+}
+
+// fromClient checks if packet is sent to one of the captured ports
+func fromClient(pckt *Packet, ports Ports) bool {
+	return pckt.Direction == DirIncoming || (!ports.All() && ports.Match(pckt.DstPort))
+}
+
+func seqDiff(a, b uint32) int32 {
+	return int32(a - b)
+}
+
+// tcpStream reassembles data sent in one direction of TCP connection,
+// it is used by decoders which need the whole stream instead of separate messages
+type tcpStream struct {
+	src      string
+	started  bool
+	startSeq uint32
+	nextSeq  uint32             // seq of the next expected segment
+	pending  map[uint32]*Packet // segments received out of order or before the stream start
+	buf      []byte             // reassembled data which is not consumed yet
+}
+
+// start makes the segment with the given seq the first one of the stream
+func (s *tcpStream) start(seq uint32) {
+	s.started = true
+	s.startSeq, s.nextSeq = seq, seq
+}
+
+// push appends segments which became contiguous to buf, next is called after every appended segment.
+// Segments are kept until the stream starts, since they can arrive before the first one.
+func (s *tcpStream) push(pckt *Packet, next func(*Packet) error) error {
+	if len(s.pending) >= streamMaxPending {
+		return errStreamOverflow
+	}
+	if s.pending == nil {
+		s.pending = make(map[uint32]*Packet)
+	}
+	s.pending[pckt.Seq] = pckt
+	return s.flush(next)
+}
+
+// flush appends pending segments which became contiguous to buf, next is called after every appended segment
+func (s *tcpStream) flush(next func(*Packet) error) error {
+	if !s.started {
+		return nil
+	}
+
+	for progress := true; progress; {
+		progress = false
+		for seq, p := range s.pending {
+			if seqDiff(seq, s.nextSeq) > 0 {
+				continue
+			}
+			delete(s.pending, seq)
+			end := seq + uint32(len(p.Payload))
+			if seqDiff(end, s.nextSeq) <= 0 {
+				// retransmission
+				continue
+			}
+			s.buf = append(s.buf, p.Payload[s.nextSeq-seq:]...)
+			s.nextSeq = end
+			progress = true
+			if err := next(p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// waiting checks if there are segments waiting for missing ones
+func (s *tcpStream) waiting() bool {
+	return len(s.pending) > 0
+}
+
+func (s *tcpStream) reset() {
+	s.pending, s.buf = nil, nil
+}
+
+// unitStream is a stream of request and response protocol, where data is grouped into units: a query or
+// command sent by client, or response of server. Units are numbered, so responses get UUID of their request.
+type unitStream struct {
+	tcpStream
+	unit      []byte // data of the unit in progress
+	unitStart time.Time
+	units     uint32 // number of units with response
+	last      *Packet
+}
+
+// emit passes the complete unit as a packet, with Seq and Ack making UUID of response equal to UUID of
+// its request. Units without response get UUID of the previous request.
+func (s *unitStream) emit(base uint32, fromClient, response bool, pckt *Packet, emit func(*Packet, time.Time)) {
+	id := base + s.units
+	if response {
+		s.units++
+	} else {
+		id--
+	}
+
+	p := *pckt
+	p.messageID = 0
+	p.Lost = 0
+	p.buf = nil
+	p.Payload = s.unit[:len(s.unit):len(s.unit)]
+	if fromClient {
+		p.Direction = DirIncoming
+		p.Ack = id
+	} else {
+		p.Direction = DirOutcoming
+		p.Seq = id
+	}
+	s.unit = nil
+	emit(&p, s.unitStart)
+}
+
+func (s *unitStream) consume(n int) {
+	s.buf = s.buf[n:]
+	if len(s.buf) == 0 {
+		s.buf = nil
+	}
+}
+
+func (s *unitStream) reset() {
+	s.tcpStream.reset()
+	s.unit, s.last = nil, nil
+}
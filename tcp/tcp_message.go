@@ -1,6 +1,7 @@
 package tcp
 
 import (
+	"container/list"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
@@ -22,6 +23,14 @@ const (
 	ProtocolHTTP TCPProtocol = iota
 	// ProtocolBinary ...
 	ProtocolBinary
+	// ProtocolHTTP2 is HTTP/2 converted to HTTP/1.1 messages
+	ProtocolHTTP2
+	// ProtocolPostgres is PostgreSQL split into queries and their responses
+	ProtocolPostgres
+	// ProtocolMySQL is MySQL split into commands and their responses
+	ProtocolMySQL
+	// ProtocolRedis is Redis split into commands and their replies
+	ProtocolRedis
 )
 
 // Set is here so that TCPProtocol can implement flag.Var
@@ -31,6 +40,14 @@ func (protocol *TCPProtocol) Set(v string) error {
 		*protocol = ProtocolHTTP
 	case "binary":
 		*protocol = ProtocolBinary
+	case "http2":
+		*protocol = ProtocolHTTP2
+	case "postgres":
+		*protocol = ProtocolPostgres
+	case "mysql":
+		*protocol = ProtocolMySQL
+	case "redis":
+		*protocol = ProtocolRedis
 	default:
 		return fmt.Errorf("unsupported protocol %s", v)
 	}
@@ -43,6 +60,14 @@ func (protocol *TCPProtocol) String() string {
 		return "binary"
 	case ProtocolHTTP:
 		return "http"
+	case ProtocolHTTP2:
+		return "http2"
+	case ProtocolPostgres:
+		return "postgres"
+	case ProtocolMySQL:
+		return "mysql"
+	case ProtocolRedis:
+		return "redis"
 	default:
 		return ""
 	}
@@ -69,7 +94,12 @@ type Message struct {
 	feedback         interface{}
 	Idx              uint16
 	continueAdjusted bool
+	WebSocket        bool // message is a single frame of WebSocket session
 	Stats
+
+	size int64         // memory accounted to memory limits of the parser
+	lru  *list.Element // position in LRU list of memory limits
+	conn string        // connection of the message, for limits of connection memory
 }
 
 // UUID returns the UUID of a TCP request and its response.
@@ -138,6 +168,38 @@ func (m *Message) Packets() []*Packet {
 	return m.packets
 }
 
+// CapturedPackets returns packets of the message as they were captured,
+// or nil if any of them was decrypted or decoded
+func (m *Message) CapturedPackets() []CapturedPacket {
+	captured := make([]CapturedPacket, 0, len(m.packets))
+	for _, pckt := range m.packets {
+		p, ok := pckt.Captured()
+		if !ok {
+			return nil
+		}
+		captured = append(captured, p)
+	}
+	return captured
+}
+
+// Interface returns name of the interface packets of the message were captured on, if it is known
+func (m *Message) Interface() string {
+	for _, pckt := range m.packets {
+		if pckt.Interface != "" {
+			return pckt.Interface
+		}
+	}
+	return ""
+}
+
+// Comments returns comments of packets of the message
+func (m *Message) Comments() (comments []string) {
+	for _, pckt := range m.packets {
+		comments = append(comments, pckt.Comments...)
+	}
+	return
+}
+
 func (m *Message) MissingChunk() bool {
 	nextSeq := m.packets[0].Seq
 
@@ -221,12 +283,26 @@ type MessageParser struct {
 	messages       chan *Message
 	packets        chan *PcapPacket
 	close          chan struct{} // to signal that we are able to close
-	ports          []uint16
+	ports          Ports
 	ips            []net.IP
+	hosts          []HostPorts // ports of every host, used instead of ports and ips when set
+	tls            *tlsDecoder
+	http2          *http2Decoder
+	websocket      *wsDecoder
+	postgres       *pgDecoder
+	mysql          *mysqlDecoder
+	redis          *redisDecoder
+
+	// decapsulation of tunneled packets
+	tunnels         *Tunnels
+	tunnelHosts     []net.IP
+	tunnelResponses bool
+
+	limits *MemoryLimits
 }
 
 // NewMessageParser returns a new instance of message parser
-func NewMessageParser(messages chan *Message, ports []uint16, ips []net.IP, messageExpire time.Duration, allowIncompete bool) (parser *MessageParser) {
+func NewMessageParser(messages chan *Message, ports Ports, ips []net.IP, messageExpire time.Duration, allowIncompete bool, options ...ParserOption) (parser *MessageParser) {
 	parser = new(MessageParser)
 
 	parser.messageExpire = messageExpire
@@ -248,6 +324,14 @@ func NewMessageParser(messages chan *Message, ports []uint16, ips []net.IP, mess
 	parser.ports = ports
 	parser.ips = ips
 
+	// decoders and limits are read by the goroutines, so they are set before starting them
+	for _, option := range options {
+		option(parser)
+	}
+	if parser.limits == nil {
+		parser.limits = NewMemoryLimits(0, 0, 0)
+	}
+
 	for i := 0; i < 10; i++ {
 		parser.m = append(parser.m, make(map[uint64]*Message))
 		parser.mL = append(parser.mL, sync.RWMutex{})
@@ -260,14 +344,98 @@ func NewMessageParser(messages chan *Message, ports []uint16, ips []net.IP, mess
 	return parser
 }
 
-var packetLen int
-
 // Packet returns packet handler
 func (parser *MessageParser) PacketHandler(packet *PcapPacket) {
-	packetLen++
 	parser.packets <- packet
 }
 
+// ParserOption configures decoders and limits of the parser, options are applied by NewMessageParser
+// before the parser starts processing packets
+type ParserOption func(*MessageParser)
+
+// WithTLSKeyLog enables decryption of TLS connections with secrets from the key log,
+// packets of TLS connections are replaced with decrypted application data
+func WithTLSKeyLog(keyLog *KeyLog) ParserOption {
+	return func(parser *MessageParser) {
+		parser.tls = newTLSDecoder(keyLog)
+	}
+}
+
+// WithHTTP2 converts streams of HTTP/2 connections into HTTP/1.1 messages,
+// packets of other connections are processed as usual
+func WithHTTP2() ParserOption {
+	return func(parser *MessageParser) {
+		parser.http2 = newHTTP2Decoder()
+	}
+}
+
+// WithWebSocket splits upgraded WebSocket connections into frames, every frame is emitted
+// as a separate message with UUID of the handshake request
+func WithWebSocket() ParserOption {
+	return func(parser *MessageParser) {
+		parser.websocket = newWSDecoder()
+	}
+}
+
+// WithPostgres splits PostgreSQL connections into queries and responses, every query
+// and response is emitted as a separate message. Packets of other protocols are dropped.
+func WithPostgres() ParserOption {
+	return func(parser *MessageParser) {
+		parser.postgres = newPGDecoder(parser.ports)
+	}
+}
+
+// WithMySQL splits MySQL connections into commands and responses, every command
+// and response is emitted as a separate message. Packets of other protocols are dropped.
+func WithMySQL() ParserOption {
+	return func(parser *MessageParser) {
+		parser.mysql = newMySQLDecoder(parser.ports)
+	}
+}
+
+// WithRedis splits Redis connections into commands and replies, every pipelined command
+// and its reply are emitted as separate messages. Packets of other protocols are dropped.
+func WithRedis() ParserOption {
+	return func(parser *MessageParser) {
+		parser.redis = newRedisDecoder(parser.ports)
+	}
+}
+
+// WithTunnels decapsulates tunneled packets. BPF filters only see outer headers of tunneled packets,
+// so packets are filtered by ports of the parser and by hosts here, hosts are ignored if empty.
+// Packets sent from the ports are dropped unless responses is true.
+func WithTunnels(tunnels Tunnels, hosts []net.IP, responses bool) ParserOption {
+	return func(parser *MessageParser) {
+		parser.tunnels = &tunnels
+		parser.tunnelHosts = hosts
+		parser.tunnelResponses = responses
+	}
+}
+
+// WithHosts sets ports of every captured host, when hosts have different ports. Packets are incoming
+// if they are sent to one of the ports of their destination host, ports and ips of the parser are not used.
+func WithHosts(hosts []HostPorts) ParserOption {
+	return func(parser *MessageParser) {
+		parser.hosts = hosts
+	}
+}
+
+// tunnelMatch checks if decapsulated packet is sent to, or from, the ports and hosts
+func (parser *MessageParser) tunnelMatch(pckt *Packet) bool {
+	match := func(port uint16, ip net.IP) bool {
+		if parser.hosts != nil {
+			return matchHosts(parser.hosts, ip, port)
+		}
+		portMatch := parser.ports.Match(port)
+		hostMatch := len(parser.tunnelHosts) == 0
+		for _, host := range parser.tunnelHosts {
+			hostMatch = hostMatch || host.Equal(ip)
+		}
+		return portMatch && hostMatch
+	}
+	return match(pckt.DstPort, pckt.DstIP) || (parser.tunnelResponses && match(pckt.SrcPort, pckt.SrcIP))
+}
+
 func (parser *MessageParser) wait(index int) {
 	var (
 		now time.Time
@@ -275,7 +443,7 @@ func (parser *MessageParser) wait(index int) {
 	for {
 		select {
 		case pckt := <-parser.packets:
-			parser.processPacket(parser.parsePacket(pckt))
+			parser.handlePacket(parser.parsePacket(pckt))
 		case now = <-parser.ticker.C:
 			parser.timer(now, index)
 		case <-parser.close:
@@ -289,33 +457,93 @@ func (parser *MessageParser) wait(index int) {
 }
 
 func (parser *MessageParser) parsePacket(pcapPkt *PcapPacket) *Packet {
-	pckt, err := ParsePacket(pcapPkt.Data, pcapPkt.LType, pcapPkt.LTypeLen, pcapPkt.Ci, false)
-	if err != nil {
+	pckt := new(Packet)
+	if err := pckt.parse(pcapPkt.Data, pcapPkt.LType, pcapPkt.LTypeLen, pcapPkt.Ci, false, parser.tunnels); err != nil {
 		if _, empty := err.(EmptyPacket); !empty {
 			stats.Add("packet_error", 1)
 		}
 		return nil
 	}
+	if parser.tunnels != nil && !parser.tunnelMatch(pckt) {
+		return nil
+	}
+	pckt.Interface = pcapPkt.Interface
+	pckt.Comments = pcapPkt.Comments
 
-	for _, p := range parser.ports {
-		if pckt.DstPort == p {
-			for _, ip := range parser.ips {
-				if pckt.DstIP.Equal(ip) {
-					pckt.Direction = DirIncoming
-					break
-				}
+	switch {
+	case parser.hosts != nil:
+		if matchHosts(parser.hosts, pckt.DstIP, pckt.DstPort) {
+			pckt.Direction = DirIncoming
+		}
+	case !parser.ports.All() && parser.ports.Match(pckt.DstPort):
+		for _, ip := range parser.ips {
+			if pckt.DstIP.Equal(ip) {
+				pckt.Direction = DirIncoming
+				break
 			}
-			break
 		}
 	}
 
 	return pckt
 }
 
+func (parser *MessageParser) handlePacket(pckt *Packet) {
+	switch {
+	case pckt == nil:
+	case parser.tls != nil:
+		parser.tls.decrypt(pckt, parser.decodePacket)
+	default:
+		parser.decodePacket(pckt)
+	}
+}
+
+// decodePacket passes packets to decoders of protocols which need the whole TCP stream
+func (parser *MessageParser) decodePacket(pckt *Packet) {
+	switch {
+	case parser.http2 != nil:
+		parser.http2.decode(pckt, parser.processPacket)
+	case parser.websocket != nil:
+		parser.websocket.decode(pckt, parser.processPacket, parser.emitFrame)
+	case parser.postgres != nil:
+		parser.postgres.decode(pckt, parser.emitQuery)
+	case parser.mysql != nil:
+		parser.mysql.decode(pckt, parser.emitQuery)
+	case parser.redis != nil:
+		parser.redis.decode(pckt, parser.emitQuery)
+	default:
+		parser.processPacket(pckt)
+	}
+}
+
+// emitFrame emits packet holding the whole WebSocket frame as a message
+func (parser *MessageParser) emitFrame(pckt *Packet) {
+	parser.emitPacket(pckt, pckt.Timestamp, true)
+}
+
+// emitQuery emits packet holding the whole query or response of database protocol as a message
+func (parser *MessageParser) emitQuery(pckt *Packet, start time.Time) {
+	parser.emitPacket(pckt, start, false)
+}
+
+func (parser *MessageParser) emitPacket(pckt *Packet, start time.Time, websocket bool) {
+	m := new(Message)
+	m.Direction = pckt.Direction
+	m.SrcAddr = pckt.SrcIP.String()
+	m.DstAddr = pckt.DstIP.String()
+	m.Start = start
+	m.WebSocket = websocket
+	m.parser = parser
+	m.add(pckt)
+
+	stats.Add("message_count", 1)
+	parser.messages <- m
+}
+
 func (parser *MessageParser) processPacket(pckt *Packet) {
 	if pckt == nil {
 		return
 	}
+	defer parser.evict()
 
 	// Trying to build unique hash, but there is small chance of collision
 	// No matter if it is request or response, all packets in the same message have same
@@ -376,9 +604,10 @@ func (parser *MessageParser) processPacket(pckt *Packet) {
 }
 
 func (parser *MessageParser) addPacket(m *Message, pckt *Packet) bool {
-	if !m.add(pckt) {
+	if parser.truncate(m, pckt) || !m.add(pckt) {
 		return false
 	}
+	parser.account(m, pckt)
 
 	// If we are using protocol parsing, like HTTP, depend on its parsing func.
 	// For the binary procols wait for message to expire
@@ -408,6 +637,7 @@ func (parser *MessageParser) Fix100Continue(m *Message) {
 
 		// If next section was aready approved and received, merge messages
 		if next, found := parser.m[m.Idx][m.packets[0].MessageID()]; found {
+			parser.release(next)
 			for _, p := range next.packets {
 				parser.addPacket(m, p)
 			}
@@ -428,6 +658,7 @@ func (parser *MessageParser) Emit(m *Message) {
 	stats.Add("message_count", 1)
 
 	delete(parser.m[m.Idx], m.packets[0].MessageID())
+	parser.release(m)
 
 	parser.messages <- m
 }
@@ -436,10 +667,26 @@ func GetUnexportedField(field reflect.Value) interface{} {
 	return reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem().Interface()
 }
 
-var failMsg int
-
 func (parser *MessageParser) timer(now time.Time, index int) {
-	packetLen = 0
+	// decrypted packets take message locks, so it is done before locking
+	if index == 0 && parser.tls != nil {
+		parser.tls.tick(now, parser.decodePacket)
+	}
+	if index == 0 && parser.http2 != nil {
+		parser.http2.tick(now)
+	}
+	if index == 0 && parser.websocket != nil {
+		parser.websocket.tick(now)
+	}
+	if index == 0 && parser.postgres != nil {
+		parser.postgres.tick(now)
+	}
+	if index == 0 && parser.mysql != nil {
+		parser.mysql.tick(now)
+	}
+	if index == 0 && parser.redis != nil {
+		parser.redis.tick(now)
+	}
 	parser.mL[index].Lock()
 
 	packetQueueLen.Set(int64(len(parser.packets)))
@@ -449,10 +696,7 @@ func (parser *MessageParser) timer(now time.Time, index int) {
 		if now.Sub(m.End) > parser.messageExpire {
 			m.TimedOut = true
 			stats.Add("message_timeout_count", 1)
-			failMsg++
-			if parser.End == nil || parser.allowIncompete {
-				parser.Emit(m)
-			}
+			parser.expire(m)
 
 			delete(parser.m[index], id)
 		}
@@ -70,6 +70,9 @@ type Packet struct {
 	Timestamp          time.Time
 	Payload            []byte
 	buf                []byte
+	raw                []byte   // captured packet starting with the network layer
+	Interface          string   // name of the interface the packet was captured on, if known
+	Comments           []string // comments of the packet in the capture file
 
 	created time.Time
 	gc      bool
@@ -80,80 +83,251 @@ type PcapPacket struct {
 	LType    int
 	LTypeLen int
 	Ci       *gopacket.CaptureInfo
+
+	// interface and comments of packets read from pcapng files
+	Interface string
+	Comments  []string
 }
 
 // ParsePacket parse raw packets
 func ParsePacket(data []byte, lType, lTypeLen int, ci *gopacket.CaptureInfo, allowEmpty bool) (pckt *Packet, err error) {
 	pckt = new(Packet)
-	if err := pckt.parse(data, lType, lTypeLen, ci, allowEmpty); err != nil {
+	if err := pckt.parse(data, lType, lTypeLen, ci, allowEmpty, nil); err != nil {
 		return nil, err
 	}
 
 	return pckt, nil
 }
 
-func (pckt *Packet) parse(data []byte, lType, lTypeLen int, cp *gopacket.CaptureInfo, allowEmpty bool) error {
-	pckt.Retry = 0
-	pckt.messageID = 0
-	pckt.buf = pckt.buf[:]
+// Tunnels configures decapsulation of tunneled packets, like traffic mirrored by cloud providers.
+// GRE and ERSPAN are recognized by IP protocol, VXLAN and Geneve by destination UDP port.
+type Tunnels struct {
+	VXLANPort  uint16
+	GenevePort uint16
+}
 
-	// TODO: check resolution
-	pckt.Timestamp = cp.Timestamp
+// DefaultTunnels uses IANA assigned ports of VXLAN and Geneve
+var DefaultTunnels = Tunnels{VXLANPort: 4789, GenevePort: 6081}
 
-	if len(data) < lTypeLen {
-		return ErrHdrLength("Link")
-	}
-	if len(data) <= lTypeLen {
-		return ErrHdrMissing("IPv4 or IPv6")
-	}
+// maxTunnelDepth limits number of nested tunnels
+const maxTunnelDepth = 4
 
-	ldata := data[lTypeLen:]
-	var proto byte
-	var netLayer, transLayer []byte
+// ethernet and GRE protocol types
+const (
+	etherTypeIPv4     = 0x0800
+	etherTypeIPv6     = 0x86DD
+	etherTypeVLAN     = 0x8100
+	etherTypeQinQ     = 0x88A8
+	etherTypeBridging = 0x6558 // transparent ethernet bridging
+	etherTypeERSPAN2  = 0x88BE
+	etherTypeERSPAN3  = 0x22EB
+)
 
+// ipHeader returns network layer of IPv4 or IPv6 packet, and protocol of its payload
+func ipHeader(ldata []byte) (netLayer []byte, proto byte, err error) {
+	if len(ldata) == 0 {
+		return nil, 0, ErrHdrMissing("IPv4 or IPv6")
+	}
 	if ldata[0]>>4 == 4 {
 		// IPv4 header
 		if len(ldata) < 20 {
-			return ErrHdrLength("IPv4")
+			return nil, 0, ErrHdrLength("IPv4")
 		}
 		proto = ldata[9]
 		ihl := int(ldata[0]&0x0F) * 4
 		if ihl < 20 {
-			return ErrHdrInvalid("IPv4's IHL")
+			return nil, 0, ErrHdrInvalid("IPv4's IHL")
 		}
 		if len(ldata) < ihl {
-			return ErrHdrLength("IPv4 opts")
+			return nil, 0, ErrHdrLength("IPv4 opts")
 		}
-		netLayer = ldata[:ihl]
+		// fragments are reassembled before parsing
+		if binary.BigEndian.Uint16(ldata[6:8])&0x3FFF != 0 {
+			return nil, 0, ErrHdrExpected("unfragmented IPv4")
+		}
+		return ldata[:ihl], proto, nil
 	} else if ldata[0]>>4 == 6 {
 		if len(ldata) < 40 {
-			return ErrHdrLength("IPv6")
+			return nil, 0, ErrHdrLength("IPv6")
 		}
 		proto = ldata[6]
 		totalLen := 40
 		for ipv6ExtensionHdr(proto) {
 			hdr := len(ldata) - totalLen
 			if hdr < 8 {
-				return ErrHdrExpected("IPv6 opts")
+				return nil, 0, ErrHdrExpected("IPv6 opts")
 			}
 			extLen := 8
 			if proto != 44 {
 				extLen = int(ldata[totalLen+1]+1) * 8
 			}
 			if hdr < extLen {
-				return ErrHdrLength("IPv6 opts")
+				return nil, 0, ErrHdrLength("IPv6 opts")
+			}
+			if proto == 44 && binary.BigEndian.Uint16(ldata[totalLen+2:])&0xFFF9 != 0 {
+				return nil, 0, ErrHdrExpected("unfragmented IPv6")
 			}
 			proto = ldata[totalLen]
 			totalLen += extLen
 		}
-		netLayer = ldata[:totalLen]
-	} else {
-		return ErrHdrExpected("IPv4 or IPv6")
+		return ldata[:totalLen], proto, nil
+	}
+	return nil, 0, ErrHdrExpected("IPv4 or IPv6")
+}
+
+// decapsulate returns inner IP packet of a tunnel, ok is false if the payload is not tunneled
+func (t *Tunnels) decapsulate(proto byte, payload []byte) (inner []byte, ok bool, err error) {
+	switch proto {
+	case 47:
+		inner, err = decapsulateGRE(payload)
+		return inner, true, err
+	case 17:
+		if len(payload) < 8 {
+			return nil, false, nil
+		}
+		port := binary.BigEndian.Uint16(payload[2:4])
+		switch {
+		case port == 0:
+		case port == t.VXLANPort:
+			// flags with valid VNI bit, reserved fields, VNI
+			if len(payload) < 16 || payload[8]&0x08 == 0 {
+				return nil, true, ErrHdrInvalid("VXLAN")
+			}
+			inner, err = decapsulateEthernet(payload[16:])
+			return inner, true, err
+		case port == t.GenevePort:
+			if len(payload) < 16 || payload[8]>>6 != 0 {
+				return nil, true, ErrHdrInvalid("Geneve")
+			}
+			hdr := 16 + int(payload[8]&0x3F)*4
+			if len(payload) < hdr {
+				return nil, true, ErrHdrLength("Geneve opts")
+			}
+			inner, err = decapsulateProtocol(binary.BigEndian.Uint16(payload[10:12]), payload[hdr:])
+			return inner, true, err
+		}
+	}
+	return nil, false, nil
+}
+
+// decapsulateGRE returns packet tunneled by GRE, or mirrored by ERSPAN over GRE
+func decapsulateGRE(data []byte) ([]byte, error) {
+	if len(data) < 4 {
+		return nil, ErrHdrLength("GRE")
+	}
+	flags, protocol := binary.BigEndian.Uint16(data[0:2]), binary.BigEndian.Uint16(data[2:4])
+	if flags&0x7 != 0 {
+		return nil, ErrHdrInvalid("GRE's version")
+	}
+	hdr := 4
+	for _, bit := range []uint16{0x8000, 0x2000, 0x1000} { // checksum, key and sequence number
+		if flags&bit != 0 {
+			hdr += 4
+		}
+	}
+	if len(data) < hdr {
+		return nil, ErrHdrLength("GRE opts")
+	}
+	data = data[hdr:]
+	switch protocol {
+	case etherTypeERSPAN2:
+		// ERSPAN type I has no header, it is sent without sequence number
+		if flags&0x1000 != 0 {
+			if len(data) < 8 {
+				return nil, ErrHdrLength("ERSPAN")
+			}
+			data = data[8:]
+		}
+		return decapsulateEthernet(data)
+	case etherTypeERSPAN3:
+		if len(data) < 12 {
+			return nil, ErrHdrLength("ERSPAN")
+		}
+		// optional platform specific subheader
+		hdr = 12
+		if data[11]&0x01 != 0 {
+			hdr += 8
+		}
+		if len(data) < hdr {
+			return nil, ErrHdrLength("ERSPAN opts")
+		}
+		return decapsulateEthernet(data[hdr:])
+	}
+	return decapsulateProtocol(protocol, data)
+}
+
+// decapsulateProtocol returns IP packet of ethernet frame or IP packet with the protocol type
+func decapsulateProtocol(protocol uint16, data []byte) ([]byte, error) {
+	switch protocol {
+	case etherTypeIPv4, etherTypeIPv6:
+		return data, nil
+	case etherTypeBridging:
+		return decapsulateEthernet(data)
+	}
+	return nil, ErrHdrExpected("IPv4 or IPv6")
+}
+
+// decapsulateEthernet returns IP packet of ethernet frame, skipping VLAN tags
+func decapsulateEthernet(data []byte) ([]byte, error) {
+	if len(data) < 14 {
+		return nil, ErrHdrLength("Ethernet")
+	}
+	etherType := binary.BigEndian.Uint16(data[12:14])
+	data = data[14:]
+	for etherType == etherTypeVLAN || etherType == etherTypeQinQ {
+		if len(data) < 4 {
+			return nil, ErrHdrLength("VLAN")
+		}
+		etherType = binary.BigEndian.Uint16(data[2:4])
+		data = data[4:]
+	}
+	if etherType != etherTypeIPv4 && etherType != etherTypeIPv6 {
+		return nil, ErrHdrExpected("IPv4 or IPv6")
+	}
+	return data, nil
+}
+
+// parse parses TCP/IP packet, tunneled packets are decapsulated if tunnels is not nil
+func (pckt *Packet) parse(data []byte, lType, lTypeLen int, cp *gopacket.CaptureInfo, allowEmpty bool, tunnels *Tunnels) error {
+	pckt.Retry = 0
+	pckt.messageID = 0
+	pckt.buf = pckt.buf[:]
+
+	// TODO: check resolution
+	pckt.Timestamp = cp.Timestamp
+
+	if len(data) < lTypeLen {
+		return ErrHdrLength("Link")
+	}
+	if len(data) <= lTypeLen {
+		return ErrHdrMissing("IPv4 or IPv6")
+	}
+
+	ldata := data[lTypeLen:]
+	var proto byte
+	var netLayer, transLayer []byte
+
+	for depth := 0; ; depth++ {
+		var err error
+		if netLayer, proto, err = ipHeader(ldata); err != nil {
+			return err
+		}
+		if tunnels == nil || depth == maxTunnelDepth {
+			break
+		}
+		inner, ok, err := tunnels.decapsulate(proto, ldata[len(netLayer):])
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		ldata = inner
 	}
 	if proto != 6 {
 		return ErrHdrExpected("TCP")
 	}
-	if len(data) <= len(netLayer) {
+	if len(ldata) <= len(netLayer) {
 		return ErrHdrMissing("TCP")
 	}
 	ndata := ldata[len(netLayer):]
@@ -208,10 +382,29 @@ func (pckt *Packet) parse(data []byte, lType, lTypeLen int, cp *gopacket.Capture
 	pckt.Lost = uint32(cp.Length - cp.CaptureLength)
 
 	pckt.Payload = ndata[dOf:]
+	pckt.raw = ldata
 
 	return nil
 }
 
+// CapturedPacket is a packet as it was captured, starting with the network layer
+type CapturedPacket struct {
+	Timestamp time.Time
+	Data      []byte
+	Payload   []byte // TCP payload, part of Data
+	Lost      int    // bytes of the packet which were not captured
+}
+
+// Captured returns the captured packet, ok is false if payload of the packet
+// was decrypted or decoded, and does not match the captured packet anymore
+func (pckt *Packet) Captured() (p CapturedPacket, ok bool) {
+	n := len(pckt.Payload)
+	if n == 0 || len(pckt.raw) < n || &pckt.raw[len(pckt.raw)-n] != &pckt.Payload[0] {
+		return p, false
+	}
+	return CapturedPacket{pckt.Timestamp, pckt.raw, pckt.Payload, int(pckt.Lost)}, true
+}
+
 func (pckt *Packet) MessageID() uint64 {
 	if pckt.messageID == 0 {
 		// All packets in the same message will share the same ID
@@ -3,6 +3,8 @@ package tcp
 import (
 	"bytes"
 	"encoding/binary"
+	"net"
+	"reflect"
 
 	// "runtime"
 	"testing"
@@ -231,6 +233,124 @@ func TestMessageTimeoutReached(t *testing.T) {
 	}
 }
 
+func TestCapturedPackets(t *testing.T) {
+	packets := GetPackets(true, 1, 2, []byte("data"))
+	p := NewMessageParser(nil, nil, nil, 10*time.Millisecond, true)
+	for _, v := range packets {
+		p.processPacket(v)
+	}
+	m := p.Read()
+
+	captured := m.CapturedPackets()
+	if len(captured) != 2 {
+		t.Fatalf("expected 2 captured packets, got %d", len(captured))
+	}
+	for _, c := range captured {
+		if len(c.Data) != 48+4 || !bytes.Equal(c.Payload, []byte("data")) || c.Data[0]>>4 != 4 {
+			t.Errorf("wrong captured packet %q", c.Data)
+		}
+	}
+
+	decoded := *packets[0]
+	decoded.Payload = []byte("data")
+	if _, ok := decoded.Captured(); ok {
+		t.Error("packet with replaced payload is not captured")
+	}
+}
+
+func TestMessageInterfaceAndComments(t *testing.T) {
+	packets := GetPackets(true, 1, 2, []byte("data"))
+	packets[0].Comments = []string{"first"}
+	packets[1].Interface = "eth1"
+	packets[1].Comments = []string{"second", "third"}
+	p := NewMessageParser(nil, nil, nil, 10*time.Millisecond, true)
+	for _, v := range packets {
+		p.processPacket(v)
+	}
+	m := p.Read()
+
+	if m.Interface() != "eth1" {
+		t.Errorf("expected interface eth1, got %q", m.Interface())
+	}
+	if comments := m.Comments(); !reflect.DeepEqual(comments, []string{"first", "second", "third"}) {
+		t.Errorf("wrong comments %q", comments)
+	}
+}
+
+func TestTunnelDecapsulation(t *testing.T) {
+	ipv4 := func(proto byte, payload []byte) []byte {
+		hdr := make([]byte, 20)
+		hdr[0] = 4<<4 | 5
+		hdr[9] = proto
+		return append(hdr, payload...)
+	}
+	udp := func(port uint16, payload []byte) []byte {
+		hdr := make([]byte, 8)
+		binary.BigEndian.PutUint16(hdr[2:], port)
+		return append(hdr, payload...)
+	}
+	ethernet := func(payload []byte) []byte {
+		// with VLAN tag
+		hdr := make([]byte, 18)
+		binary.BigEndian.PutUint16(hdr[12:], 0x8100)
+		binary.BigEndian.PutUint16(hdr[16:], 0x0800)
+		return append(hdr, payload...)
+	}
+	gre := func(flags, protocol uint16, payload []byte) []byte {
+		hdr := make([]byte, 4, 16)
+		binary.BigEndian.PutUint16(hdr[0:], flags)
+		binary.BigEndian.PutUint16(hdr[2:], protocol)
+		for _, bit := range []uint16{0x8000, 0x2000, 0x1000} {
+			if flags&bit != 0 {
+				hdr = append(hdr, 0, 0, 0, 1)
+			}
+		}
+		return append(hdr, payload...)
+	}
+	inner := append(generateHeader(true, 1, 4)[4:], "data"...)
+	vxlan := ipv4(17, udp(4789, append([]byte{0x08, 0, 0, 0, 0, 0, 1, 0}, ethernet(inner)...)))
+	tunnels := map[string][]byte{
+		"VXLAN":      vxlan,
+		"Geneve":     ipv4(17, udp(6081, append([]byte{1, 0, 0x08, 0x00, 0, 0, 1, 0, 0, 0, 0, 0}, inner...))),
+		"GRE":        ipv4(47, gre(0xA000, 0x0800, inner)),
+		"GRE bridge": ipv4(47, gre(0, 0x6558, ethernet(inner))),
+		"ERSPAN I":   ipv4(47, gre(0, 0x88BE, ethernet(inner))),
+		"ERSPAN II":  ipv4(47, gre(0x1000, 0x88BE, append(make([]byte, 8), ethernet(inner)...))),
+		"ERSPAN III": ipv4(47, gre(0x1000, 0x22EB, append(append(make([]byte, 11), 1), append(make([]byte, 8), ethernet(inner)...)...))),
+		"nested":     ipv4(47, gre(0, 0x0800, vxlan)),
+	}
+	for name, data := range tunnels {
+		ci := &gopacket.CaptureInfo{Length: len(data), CaptureLength: len(data)}
+		pckt := new(Packet)
+		if err := pckt.parse(data, int(layers.LinkTypeRaw), 0, ci, true, &DefaultTunnels); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if pckt.SrcPort != 5535 || pckt.DstPort != 8000 || string(pckt.Payload) != "data" {
+			t.Errorf("%s: wrong inner packet %s -> %s %q", name, pckt.Src(), pckt.Dst(), pckt.Payload)
+		}
+		if c, ok := pckt.Captured(); !ok || !bytes.Equal(c.Data, inner) {
+			t.Errorf("%s: captured packet should start with inner header", name)
+		}
+		if _, err := ParsePacket(data, int(layers.LinkTypeRaw), 0, ci, true); err == nil {
+			t.Errorf("%s: packets should not be decapsulated by default", name)
+		}
+	}
+
+	parser := NewMessageParser(nil, Ports{{Min: 8000, Max: 8000}}, nil, time.Second, true, WithTunnels(DefaultTunnels, []net.IP{net.IPv4(127, 0, 0, 1)}, false))
+	response := ipv4(47, gre(0, 0x0800, append(generateHeader(false, 1, 4)[4:], "data"...)))
+	if parser.parsePacket(&PcapPacket{Data: vxlan, Ci: &gopacket.CaptureInfo{}}) == nil {
+		t.Error("request should match ports and host")
+	}
+	if parser.parsePacket(&PcapPacket{Data: response, Ci: &gopacket.CaptureInfo{}}) != nil {
+		t.Error("response should be dropped")
+	}
+	parser = NewMessageParser(nil, Ports{{Min: 8000, Max: 8000}}, nil, time.Second, true, WithTunnels(DefaultTunnels, []net.IP{net.IPv4(10, 0, 0, 1)}, true))
+	if parser.parsePacket(&PcapPacket{Data: vxlan, Ci: &gopacket.CaptureInfo{}}) != nil {
+		t.Error("request to other host should be dropped")
+	}
+}
+
 func BenchmarkMessageUUID(b *testing.B) {
 	packets := GetPackets(true, 1, 5, nil)
 
@@ -0,0 +1,689 @@
+package tcp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// TLS record content types
+const (
+	tlsChangeCipherSpec byte = 20
+	tlsAlert            byte = 21
+	tlsHandshake        byte = 22
+	tlsApplicationData  byte = 23
+)
+
+// TLS handshake message types
+const (
+	tlsClientHello byte = 1
+	tlsServerHello byte = 2
+	tlsFinished    byte = 20
+	tlsKeyUpdate   byte = 24
+)
+
+const (
+	tlsVersion12            = 0x0303
+	tlsVersion13            = 0x0304
+	tlsExtSupportedVersions = 43
+	tlsRecordHeaderLen      = 5
+	tlsMaxRecordLen         = 1<<14 + 2048
+)
+
+const (
+	tlsMaxRecords = 1024                   // records waiting for secrets
+	tlsPeerWait   = 500 * time.Millisecond // how long a record waits for the peer segments it acknowledges
+	tlsMaxMarks   = 64
+)
+
+// random of ServerHello which is actually a HelloRetryRequest, RFC 8446 4.1.3
+var tlsHelloRetryRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+var (
+	errTLSRecord      = errors.New("invalid TLS record")
+	errTLSHandshake   = errors.New("invalid TLS handshake message")
+	errTLSUnsupported = errors.New("unsupported TLS version or cipher suite")
+	errTLSOverflow    = errors.New("too many TLS records waiting")
+)
+
+// tlsSuite describes AEAD cipher suites which can be decrypted
+type tlsSuite struct {
+	hash          func() hash.Hash
+	keyLen        int
+	ivLen         int
+	explicitNonce bool // TLS 1.2 AES-GCM sends 8 bytes of nonce with every record
+	aead          func(key []byte) (cipher.AEAD, error)
+}
+
+func aesGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+var tlsSuites = map[uint16]*tlsSuite{
+	// TLS 1.2 AES-GCM
+	0x009c: {sha256.New, 16, 4, true, aesGCM},    // TLS_RSA_WITH_AES_128_GCM_SHA256
+	0x009d: {sha512.New384, 32, 4, true, aesGCM}, // TLS_RSA_WITH_AES_256_GCM_SHA384
+	0x009e: {sha256.New, 16, 4, true, aesGCM},    // TLS_DHE_RSA_WITH_AES_128_GCM_SHA256
+	0x009f: {sha512.New384, 32, 4, true, aesGCM}, // TLS_DHE_RSA_WITH_AES_256_GCM_SHA384
+	0xc02b: {sha256.New, 16, 4, true, aesGCM},    // TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+	0xc02c: {sha512.New384, 32, 4, true, aesGCM}, // TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384
+	0xc02f: {sha256.New, 16, 4, true, aesGCM},    // TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	0xc030: {sha512.New384, 32, 4, true, aesGCM}, // TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
+	// TLS 1.2 ChaCha20-Poly1305
+	0xcca8: {sha256.New, 32, 12, false, chacha20poly1305.New}, // TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256
+	0xcca9: {sha256.New, 32, 12, false, chacha20poly1305.New}, // TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256
+	0xccaa: {sha256.New, 32, 12, false, chacha20poly1305.New}, // TLS_DHE_RSA_WITH_CHACHA20_POLY1305_SHA256
+	// TLS 1.3
+	0x1301: {sha256.New, 16, 12, false, aesGCM},               // TLS_AES_128_GCM_SHA256
+	0x1302: {sha512.New384, 32, 12, false, aesGCM},            // TLS_AES_256_GCM_SHA384
+	0x1303: {sha256.New, 32, 12, false, chacha20poly1305.New}, // TLS_CHACHA20_POLY1305_SHA256
+}
+
+// prf12 is the TLS 1.2 pseudorandom function, RFC 5246 5
+func prf12(h func() hash.Hash, secret []byte, label string, seed []byte, n int) []byte {
+	seed = append([]byte(label), seed...)
+	mac := hmac.New(h, secret)
+	mac.Write(seed)
+	a := mac.Sum(nil)
+
+	out := make([]byte, 0, n+mac.Size())
+	for len(out) < n {
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out = mac.Sum(out)
+
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+	}
+	return out[:n]
+}
+
+// hkdfExpandLabel derives TLS 1.3 keys with empty context, RFC 8446 7.1
+func hkdfExpandLabel(h func() hash.Hash, secret []byte, label string, n int) []byte {
+	label = "tls13 " + label
+	info := make([]byte, 0, 4+len(label))
+	info = append(info, byte(n>>8), byte(n), byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+
+	out := make([]byte, n)
+	io.ReadFull(hkdf.Expand(h, secret, info), out)
+	return out
+}
+
+// tlsCipher decrypts records sent in one direction
+type tlsCipher struct {
+	aead          cipher.AEAD
+	iv            []byte
+	seq           uint64
+	explicitNonce bool
+	tls13         bool
+}
+
+// decrypt returns plain text and content type of the record
+func (c *tlsCipher) decrypt(record []byte) ([]byte, byte, error) {
+	hdr, payload := record[:tlsRecordHeaderLen], record[tlsRecordHeaderLen:]
+
+	var nonce []byte
+	if c.explicitNonce {
+		if len(payload) < 8 {
+			return nil, 0, errTLSRecord
+		}
+		nonce = append(append(make([]byte, 0, 12), c.iv...), payload[:8]...)
+		payload = payload[8:]
+	} else {
+		nonce = append([]byte(nil), c.iv...)
+		for i := 0; i < 8; i++ {
+			nonce[len(nonce)-1-i] ^= byte(c.seq >> (8 * uint(i)))
+		}
+	}
+	if len(payload) < c.aead.Overhead() {
+		return nil, 0, errTLSRecord
+	}
+
+	aad := hdr
+	if !c.tls13 {
+		aad = make([]byte, 13)
+		binary.BigEndian.PutUint64(aad, c.seq)
+		copy(aad[8:11], hdr[:3])
+		binary.BigEndian.PutUint16(aad[11:], uint16(len(payload)-c.aead.Overhead()))
+	}
+
+	plain, err := c.aead.Open(nil, nonce, payload, aad)
+	if err != nil {
+		return nil, 0, err
+	}
+	c.seq++
+	if !c.tls13 {
+		return plain, hdr[0], nil
+	}
+
+	// TLS 1.3 inner plain text is followed by the real content type and zero padding
+	i := len(plain) - 1
+	for i >= 0 && plain[i] == 0 {
+		i--
+	}
+	if i < 0 {
+		return nil, 0, errTLSRecord
+	}
+	// capacity is cut, since message data is appended to the payload of its first packet
+	return plain[:i:i], plain[i], nil
+}
+
+// tlsDecoder replaces packets of TLS connections with packets carrying decrypted application data.
+// Decrypted packets get virtual Seq and Ack numbers counted in decrypted bytes,
+// so request and response still can be matched by them.
+type tlsDecoder struct {
+	keyLog *KeyLog
+
+	mu    sync.Mutex
+	conns map[string]*tlsConn
+}
+
+func newTLSDecoder(keyLog *KeyLog) *tlsDecoder {
+	return &tlsDecoder{keyLog: keyLog, conns: make(map[string]*tlsConn)}
+}
+
+// decrypt passes decrypted packets to emit, packets which do not belong to TLS connections are passed unchanged
+func (d *tlsDecoder) decrypt(pckt *Packet, emit func(*Packet)) {
+	id, src := connID(pckt)
+
+	d.mu.Lock()
+	conn, ok := d.conns[id]
+	switch {
+	case !ok && !isTLSRecord(pckt.Payload):
+		// not a TLS connection, or its start was not captured
+		d.mu.Unlock()
+		emit(pckt)
+		return
+	case !ok || conn.restarted(src, pckt):
+		conn = &tlsConn{}
+		d.conns[id] = conn
+		stats.Add("tls_connections", 1)
+	}
+	d.mu.Unlock()
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.failed {
+		return
+	}
+	conn.lastSeen = time.Now()
+
+	err := conn.stream(src).push(pckt, conn.lastSeen)
+	if err == nil {
+		err = conn.process(d.keyLog, conn.lastSeen, emit)
+	}
+	if err != nil {
+		conn.fail()
+	}
+}
+
+// tick retries records which wait for secrets and forgets expired connections
+func (d *tlsDecoder) tick(now time.Time, emit func(*Packet)) {
+	d.mu.Lock()
+	conns := make(map[string]*tlsConn, len(d.conns))
+	for id, conn := range d.conns {
+		conns[id] = conn
+	}
+	d.mu.Unlock()
+
+	for id, conn := range conns {
+		conn.mu.Lock()
+		expired := now.Sub(conn.lastSeen) > connExpire
+		switch {
+		case conn.failed || !conn.waiting():
+		case expired:
+			stats.Add("tls_missing_keys", 1)
+		default:
+			if err := conn.process(d.keyLog, now, emit); err != nil {
+				conn.fail()
+			}
+		}
+		conn.mu.Unlock()
+
+		if expired {
+			d.mu.Lock()
+			if d.conns[id] == conn {
+				delete(d.conns, id)
+			}
+			d.mu.Unlock()
+		}
+	}
+}
+
+func isTLSRecord(data []byte) bool {
+	return len(data) >= tlsRecordHeaderLen && data[0] >= tlsChangeCipherSpec && data[0] <= tlsApplicationData &&
+		data[1] == 3 && data[2] <= 4
+}
+
+func isTLSHello(data []byte, typ byte) bool {
+	return isTLSRecord(data) && data[0] == tlsHandshake && len(data) > tlsRecordHeaderLen && data[tlsRecordHeaderLen] == typ
+}
+
+// tlsConn holds state of both directions of a TLS connection
+type tlsConn struct {
+	mu       sync.Mutex
+	lastSeen time.Time
+	failed   bool
+
+	streams        [2]*tlsStream
+	client, server *tlsStream
+
+	clientRandom, serverRandom []byte
+	version                    uint16
+	suite                      *tlsSuite
+}
+
+func (c *tlsConn) stream(src string) *tlsStream {
+	for _, s := range c.streams {
+		if s != nil && s.src == src {
+			return s
+		}
+	}
+	s := &tlsStream{tcpStream: tcpStream{src: src}}
+	if c.streams[0] == nil {
+		c.streams[0] = s
+	} else {
+		c.streams[1] = s
+	}
+	return s
+}
+
+func (c *tlsConn) peer(s *tlsStream) *tlsStream {
+	if c.streams[0] == s {
+		return c.streams[1]
+	}
+	return c.streams[0]
+}
+
+// restarted checks if the client opens a new connection from the same port
+func (c *tlsConn) restarted(src string, pckt *Packet) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client != nil && c.client.src == src && c.client.startSeq != pckt.Seq && isTLSHello(pckt.Payload, tlsClientHello)
+}
+
+// waiting checks if any data is not processed yet
+func (c *tlsConn) waiting() bool {
+	for _, s := range c.streams {
+		if s != nil && (len(s.records) > 0 || s.tcpStream.waiting()) {
+			return true
+		}
+	}
+	return false
+}
+
+// fail stops decryption of the connection, its packets are dropped from now on
+func (c *tlsConn) fail() {
+	stats.Add("tls_errors", 1)
+	c.failed = true
+	for _, s := range c.streams {
+		if s != nil {
+			s.reset()
+			s.records, s.handshake, s.marks = nil, nil, nil
+		}
+	}
+}
+
+// process processes complete records of both directions in order, until records wait for something
+func (c *tlsConn) process(keyLog *KeyLog, now time.Time, emit func(*Packet)) error {
+	for progress := true; progress; {
+		progress = false
+		for _, s := range c.streams {
+			for s != nil && len(s.records) > 0 {
+				done, err := c.processRecord(s, s.records[0], keyLog, now, emit)
+				if err != nil {
+					return err
+				}
+				if !done {
+					break
+				}
+				s.records[0] = nil
+				s.records = s.records[1:]
+				progress = true
+			}
+		}
+	}
+	return nil
+}
+
+// processRecord returns false if the record can't be processed yet
+func (c *tlsConn) processRecord(s *tlsStream, rec *tlsRecord, keyLog *KeyLog, now time.Time, emit func(*Packet)) (bool, error) {
+	typ := rec.data[0]
+	switch {
+	case typ == tlsChangeCipherSpec:
+		if c.version == 0 {
+			return false, nil
+		}
+		// TLS 1.3 sends it only for compatibility with middleboxes
+		s.encrypted = c.version == tlsVersion12
+	case typ == tlsApplicationData && c.version == 0:
+		return false, nil
+	case s.encrypted || typ == tlsApplicationData:
+		return c.decryptRecord(s, rec, keyLog, now, emit)
+	case typ == tlsHandshake:
+		if err := c.parseHello(s, rec.data[tlsRecordHeaderLen:]); err != nil {
+			return false, err
+		}
+	}
+	s.mark(rec.endSeq)
+	return true, nil
+}
+
+func (c *tlsConn) decryptRecord(s *tlsStream, rec *tlsRecord, keyLog *KeyLog, now time.Time, emit func(*Packet)) (bool, error) {
+	if s.cipher == nil {
+		if ready, err := c.initCipher(s, keyLog); !ready || err != nil {
+			return false, err
+		}
+	}
+	if c.waitPeer(s, rec, now) {
+		return false, nil
+	}
+
+	plain, typ, err := s.cipher.decrypt(rec.data)
+	if err != nil {
+		return false, err
+	}
+	stats.Add("tls_records", 1)
+
+	switch typ {
+	case tlsApplicationData:
+		if len(plain) > 0 {
+			emit(c.packet(s, rec, plain))
+		}
+	case tlsHandshake:
+		if c.version == tlsVersion13 {
+			if err = c.handshake13(s, plain); err != nil {
+				return false, err
+			}
+		}
+	}
+	s.mark(rec.endSeq)
+	return true, nil
+}
+
+// waitPeer checks if the record acknowledges peer records which are not processed yet,
+// virtual Ack of the record is known only after they are processed.
+// Peer segments which are not received yet might be lost, so they are awaited only for a while.
+func (c *tlsConn) waitPeer(s *tlsStream, rec *tlsRecord, now time.Time) bool {
+	peer := c.peer(s)
+	if peer == nil || !peer.started || seqDiff(rec.packet.Ack, peer.doneSeq) <= 0 {
+		return false
+	}
+	return len(peer.records) > 0 || (peer.tcpStream.waiting() || len(peer.buf) > 0) && now.Sub(rec.arrived) <= tlsPeerWait
+}
+
+// packet returns a copy of the packet which completed the record, carrying decrypted data
+func (c *tlsConn) packet(s *tlsStream, rec *tlsRecord, plain []byte) *Packet {
+	pckt := *rec.packet
+	pckt.messageID = 0
+	pckt.Lost = 0
+	pckt.buf = nil
+	pckt.Payload = plain
+	pckt.Seq = s.plainSeq
+	pckt.Ack = 1
+	if peer := c.peer(s); peer != nil {
+		pckt.Ack = peer.translate(rec.packet.Ack)
+	}
+	s.plainSeq += uint32(len(plain))
+	return &pckt
+}
+
+// parseHello reads randoms, version and cipher suite from plain text handshake records
+func (c *tlsConn) parseHello(s *tlsStream, data []byte) error {
+	if len(data) < 4 {
+		return nil
+	}
+	typ, msg := data[0], data[4:]
+	if n := int(data[1])<<16 | int(data[2])<<8 | int(data[3]); n < len(msg) {
+		msg = msg[:n]
+	}
+
+	switch typ {
+	case tlsClientHello:
+		if len(msg) < 34 {
+			return errTLSHandshake
+		}
+		c.client = s
+		c.clientRandom = append([]byte(nil), msg[2:34]...)
+	case tlsServerHello:
+		return c.parseServerHello(s, msg)
+	}
+	return nil
+}
+
+func (c *tlsConn) parseServerHello(s *tlsStream, msg []byte) error {
+	if len(msg) < 35 {
+		return errTLSHandshake
+	}
+	random := msg[2:34]
+	if bytes.Equal(random, tlsHelloRetryRandom) {
+		return nil
+	}
+	version := binary.BigEndian.Uint16(msg)
+
+	// session id, cipher suite and compression method
+	off := 35 + int(msg[34])
+	if len(msg) < off+3 {
+		return errTLSHandshake
+	}
+	suite := binary.BigEndian.Uint16(msg[off:])
+	off += 3
+
+	// TLS 1.3 is negotiated with supported_versions extension
+	if len(msg) >= off+2 {
+		exts := msg[off+2:]
+		if n := int(binary.BigEndian.Uint16(msg[off:])); n < len(exts) {
+			exts = exts[:n]
+		}
+		for len(exts) >= 4 {
+			typ, n := binary.BigEndian.Uint16(exts), int(binary.BigEndian.Uint16(exts[2:]))
+			if len(exts) < 4+n {
+				break
+			}
+			if typ == tlsExtSupportedVersions && n == 2 {
+				version = binary.BigEndian.Uint16(exts[4:])
+			}
+			exts = exts[4+n:]
+		}
+	}
+
+	if version != tlsVersion12 && version != tlsVersion13 || tlsSuites[suite] == nil {
+		return errTLSUnsupported
+	}
+	c.server = s
+	c.version = version
+	c.suite = tlsSuites[suite]
+	c.serverRandom = append([]byte(nil), random...)
+	return nil
+}
+
+// initCipher derives keys of the stream from the logged secrets, returns false if the secrets are not logged yet
+func (c *tlsConn) initCipher(s *tlsStream, keyLog *KeyLog) (bool, error) {
+	if c.clientRandom == nil || c.suite == nil || s != c.client && s != c.server {
+		return false, nil
+	}
+	isClient := s == c.client
+
+	if c.version == tlsVersion12 {
+		master := keyLog.Secret(keyLogClientRandom, c.clientRandom)
+		if master == nil {
+			return false, nil
+		}
+		k, iv := c.suite.keyLen, c.suite.ivLen
+		seed := append(append([]byte(nil), c.serverRandom...), c.clientRandom...)
+		block := prf12(c.suite.hash, master, "key expansion", seed, 2*k+2*iv)
+		if isClient {
+			return true, s.setKey(c.suite, block[:k], block[2*k:2*k+iv], false)
+		}
+		return true, s.setKey(c.suite, block[k:2*k], block[2*k+iv:], false)
+	}
+
+	label := keyLogServerHandshakeSecret
+	switch {
+	case isClient && s.appKeys:
+		label = keyLogClientTrafficSecret
+	case isClient:
+		label = keyLogClientHandshakeSecret
+	case s.appKeys:
+		label = keyLogServerTrafficSecret
+	}
+	secret := keyLog.Secret(label, c.clientRandom)
+	if secret == nil {
+		return false, nil
+	}
+	return true, s.setSecret(c.suite, secret)
+}
+
+// handshake13 looks for the end of handshake and key updates in decrypted TLS 1.3 handshake messages
+func (c *tlsConn) handshake13(s *tlsStream, data []byte) error {
+	s.handshake = append(s.handshake, data...)
+	for len(s.handshake) >= 4 {
+		n := 4 + (int(s.handshake[1])<<16 | int(s.handshake[2])<<8 | int(s.handshake[3]))
+		if len(s.handshake) < n {
+			break
+		}
+		typ := s.handshake[0]
+		s.handshake = s.handshake[n:]
+
+		switch {
+		case typ == tlsFinished && !s.appKeys:
+			// next records are protected with application traffic secret
+			s.appKeys = true
+			s.cipher = nil
+		case typ == tlsKeyUpdate && s.appKeys:
+			next := hkdfExpandLabel(c.suite.hash, s.secret, "traffic upd", c.suite.hash().Size())
+			if err := s.setSecret(c.suite, next); err != nil {
+				return err
+			}
+		}
+	}
+	if len(s.handshake) == 0 {
+		s.handshake = nil
+	}
+	return nil
+}
+
+// tlsStream is one direction of a TLS connection
+type tlsStream struct {
+	tcpStream
+	bufSeq  uint32       // TCP seq after the last complete record
+	doneSeq uint32       // TCP seq after the last processed record
+	records []*tlsRecord // complete records waiting to be processed
+
+	cipher    *tlsCipher
+	encrypted bool   // TLS 1.2 ChangeCipherSpec was received
+	secret    []byte // TLS 1.3 current traffic secret
+	appKeys   bool   // TLS 1.3 handshake is finished and application traffic secrets are used
+	handshake []byte // TLS 1.3 decrypted handshake messages, they can span records
+
+	plainSeq uint32       // virtual seq of the next decrypted byte
+	marks    []tlsSeqMark // positions of processed records in TCP and decrypted streams
+}
+
+type tlsRecord struct {
+	data    []byte
+	endSeq  uint32
+	packet  *Packet // packet which completed the record
+	arrived time.Time
+}
+
+type tlsSeqMark struct {
+	seq, plain uint32
+}
+
+// push reassembles TCP segments and splits them into records, stream starts with the hello message
+func (s *tlsStream) push(pckt *Packet, now time.Time) error {
+	if !s.started && (isTLSHello(pckt.Payload, tlsClientHello) || isTLSHello(pckt.Payload, tlsServerHello)) {
+		s.start(pckt.Seq)
+		s.bufSeq, s.doneSeq = pckt.Seq, pckt.Seq
+		s.plainSeq = 1
+	}
+	return s.tcpStream.push(pckt, func(p *Packet) error {
+		return s.split(p, now)
+	})
+}
+
+// split moves complete records from the buffer to the queue
+func (s *tlsStream) split(pckt *Packet, now time.Time) error {
+	for len(s.buf) >= tlsRecordHeaderLen {
+		n := tlsRecordHeaderLen + int(binary.BigEndian.Uint16(s.buf[3:5]))
+		if !isTLSRecord(s.buf) || n > tlsRecordHeaderLen+tlsMaxRecordLen {
+			return errTLSRecord
+		}
+		if len(s.buf) < n {
+			break
+		}
+		s.bufSeq += uint32(n)
+		s.records = append(s.records, &tlsRecord{data: s.buf[:n:n], endSeq: s.bufSeq, packet: pckt, arrived: now})
+		s.buf = s.buf[n:]
+	}
+	if len(s.buf) == 0 {
+		s.buf = nil
+	}
+	if len(s.records) > tlsMaxRecords {
+		return errTLSOverflow
+	}
+	return nil
+}
+
+func (s *tlsStream) setKey(suite *tlsSuite, key, iv []byte, tls13 bool) error {
+	aead, err := suite.aead(key)
+	if err != nil {
+		return err
+	}
+	s.cipher = &tlsCipher{aead: aead, iv: iv, explicitNonce: suite.explicitNonce, tls13: tls13}
+	return nil
+}
+
+// setSecret sets TLS 1.3 traffic secret, sequence number starts from zero
+func (s *tlsStream) setSecret(suite *tlsSuite, secret []byte) error {
+	s.secret = secret
+	key := hkdfExpandLabel(suite.hash, secret, "key", suite.keyLen)
+	iv := hkdfExpandLabel(suite.hash, secret, "iv", suite.ivLen)
+	return s.setKey(suite, key, iv, true)
+}
+
+// mark remembers decrypted stream position after the record ending at TCP seq
+func (s *tlsStream) mark(seq uint32) {
+	s.doneSeq = seq
+	if n := len(s.marks); n > 0 && s.marks[n-1].plain == s.plainSeq {
+		return
+	}
+	if len(s.marks) == tlsMaxMarks {
+		s.marks = append(s.marks[:0], s.marks[1:]...)
+	}
+	s.marks = append(s.marks, tlsSeqMark{seq, s.plainSeq})
+}
+
+// translate converts TCP seq acknowledged by the peer to the virtual seq of decrypted stream
+func (s *tlsStream) translate(seq uint32) uint32 {
+	for i := len(s.marks) - 1; i >= 0; i-- {
+		if seqDiff(seq, s.marks[i].seq) >= 0 {
+			return s.marks[i].plain
+		}
+	}
+	return 1
+}
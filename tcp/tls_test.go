@@ -0,0 +1,222 @@
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+type recordingConn struct {
+	net.Conn
+	fromClient bool
+	mu         *sync.Mutex
+	segments   *[]testSegment
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	*c.segments = append(*c.segments, testSegment{c.fromClient, append([]byte(nil), b...)})
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func tlsTestCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// tlsSession runs HTTP requests over TLS and returns the written data and the key log
+func tlsSession(t *testing.T, config *tls.Config, requests []string, body []byte) ([]testSegment, []byte) {
+	var (
+		mu       sync.Mutex
+		segments []testSegment
+		keyLog   bytes.Buffer
+	)
+	c, s := net.Pipe()
+	client := tls.Client(&recordingConn{c, true, &mu, &segments}, &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         config.MaxVersion,
+		CipherSuites:       config.CipherSuites,
+		KeyLogWriter:       &keyLog,
+	})
+	server := tls.Server(&recordingConn{s, false, &mu, &segments}, config)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r := bufio.NewReader(server)
+		for range requests {
+			req, err := http.ReadRequest(r)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			req.Body.Close()
+			server.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n"))
+			server.Write(body)
+		}
+	}()
+
+	r := bufio.NewReader(client)
+	for _, req := range requests {
+		client.Write([]byte(req))
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	<-done
+	// close_notify alerts are not needed, and nobody reads them
+	c.Close()
+	s.Close()
+
+	return segments, keyLog.Bytes()
+}
+
+func TestTLSDecryption(t *testing.T) {
+	cert := tlsTestCertificate(t)
+	requests := []string{
+		"GET /first HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"POST /second HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello",
+	}
+	// response spans several records and segments
+	body := bytes.Repeat([]byte("0123456789"), 2000)
+
+	cases := []struct {
+		name      string
+		version   uint16
+		suite     uint16
+		keysLater bool
+	}{
+		{"TLS12 AES-GCM", tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, false},
+		{"TLS12 ChaCha20", tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305, false},
+		{"TLS13", tls.VersionTLS13, 0, false},
+		{"TLS13 keys logged later", tls.VersionTLS13, 0, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := &tls.Config{Certificates: []tls.Certificate{cert}, MaxVersion: tc.version}
+			if tc.suite != 0 {
+				config.CipherSuites = []uint16{tc.suite}
+			}
+			segments, secrets := tlsSession(t, config, requests, body)
+
+			f, err := ioutil.TempFile("", "keylog")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+			if !tc.keysLater {
+				f.Write(secrets)
+			}
+			keyLog, err := NewKeyLog(f.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			parser := NewMessageParser(nil, Ports{{Min: 443, Max: 443}}, []net.IP{net.IPv4(127, 0, 0, 1)}, time.Second, false, WithTLSKeyLog(keyLog))
+			defer parser.Close()
+			parser.Start = func(pckt *Packet) (bool, bool) {
+				return proto.HasRequestTitle(pckt.Payload), proto.HasResponseTitle(pckt.Payload)
+			}
+			parser.End = func(m *Message) bool {
+				return proto.HasFullPayload(m, m.PacketData()...)
+			}
+
+			for _, p := range testPackets(segments, 443) {
+				parser.PacketHandler(p)
+			}
+			if tc.keysLater {
+				time.Sleep(200 * time.Millisecond)
+				f.Write(secrets)
+			}
+			f.Close()
+
+			reqs := make(map[string]string)
+			resps := make(map[string]string)
+			for i := 0; i < 2*len(requests); i++ {
+				select {
+				case m := <-parser.messages:
+					if m.Direction == DirIncoming {
+						reqs[string(m.UUID())] = string(m.Data())
+					} else {
+						resps[string(m.UUID())] = string(m.Data())
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatalf("expected %d messages, got %d", 2*len(requests), i)
+				}
+			}
+
+			for id, req := range reqs {
+				found := false
+				for _, r := range requests {
+					found = found || r == req
+				}
+				if !found {
+					t.Errorf("wrong request: %q", req)
+				}
+				resp, ok := resps[id]
+				if !ok {
+					t.Errorf("no response for request %q", req)
+					continue
+				}
+				if !strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n") || !strings.HasSuffix(resp, string(body)) {
+					t.Errorf("wrong response: %q", resp[:40])
+				}
+			}
+			if len(reqs) != len(requests) {
+				t.Errorf("expected %d different requests, got %d", len(requests), len(reqs))
+			}
+		})
+	}
+}
+
+func TestTLSPlainConnection(t *testing.T) {
+	decoder := newTLSDecoder(&KeyLog{secrets: make(map[string][]byte)})
+	pckt, err := ParsePacket(testPacket(true, 443, 1, 1, []byte("GET / HTTP/1.1\r\n\r\n")).Data, int(layers.LinkTypeLoop), 4, &gopacket.CaptureInfo{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var emitted []*Packet
+	decoder.decrypt(pckt, func(p *Packet) {
+		emitted = append(emitted, p)
+	})
+	if len(emitted) != 1 || emitted[0] != pckt {
+		t.Error("packets of plain connections should be passed unchanged")
+	}
+}
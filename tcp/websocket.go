@@ -0,0 +1,164 @@
+package tcp
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+// frames bigger than this are not reassembled, and their connections are not decoded anymore
+const wsMaxFrame = 16 << 20
+
+var errWSFrame = errors.New("WebSocket frame is too big")
+
+// wsDecoder splits data of upgraded WebSocket connections into frames. Opening handshake is processed
+// as usual HTTP request and response, and every following frame is emitted as a separate message.
+// Frames get the UUID of the handshake request, which identifies the session.
+type wsDecoder struct {
+	mu     sync.Mutex
+	active int32 // number of connections, to skip lookups when there are none
+	conns  map[string]*wsConn
+}
+
+func newWSDecoder() *wsDecoder {
+	return &wsDecoder{conns: make(map[string]*wsConn)}
+}
+
+// wsConn holds state of both directions of upgraded connection.
+// Client direction starts right after the handshake request, since responses may be not captured.
+type wsConn struct {
+	mu       sync.Mutex
+	lastSeen time.Time
+	failed   bool
+	seq, ack uint32 // of the handshake request
+	client   *tcpStream
+	server   *tcpStream
+}
+
+// decode passes packets of HTTP messages to next, and frames of upgraded connections to frame
+func (d *wsDecoder) decode(pckt *Packet, next, frame func(*Packet)) {
+	upgrade := proto.HasRequestTitle(pckt.Payload) && proto.IsWebSocketUpgrade(pckt.Payload)
+	if !upgrade && atomic.LoadInt32(&d.active) == 0 {
+		next(pckt)
+		return
+	}
+
+	id, src := connID(pckt)
+	d.mu.Lock()
+	conn := d.conns[id]
+	if upgrade && (conn == nil || conn.seq != pckt.Seq) {
+		// headers of handshake request should be in one packet
+		if end := proto.MIMEHeadersEndPos(pckt.Payload); end > 0 {
+			conn = &wsConn{seq: pckt.Seq, ack: pckt.Ack, client: &tcpStream{src: src}, server: new(tcpStream)}
+			conn.client.start(pckt.Seq + uint32(end))
+			if _, ok := d.conns[id]; !ok {
+				atomic.AddInt32(&d.active, 1)
+			}
+			d.conns[id] = conn
+			stats.Add("websocket_connections", 1)
+		}
+	}
+	d.mu.Unlock()
+	if conn == nil {
+		next(pckt)
+		return
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.lastSeen = time.Now()
+	if conn.failed {
+		next(pckt)
+		return
+	}
+	if err := conn.push(src, pckt, next, frame); err != nil {
+		stats.Add("websocket_errors", 1)
+		conn.failed = true
+		conn.client.reset()
+		conn.server.reset()
+	}
+}
+
+// tick forgets expired connections
+func (d *wsDecoder) tick(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, conn := range d.conns {
+		conn.mu.Lock()
+		if now.Sub(conn.lastSeen) > connExpire {
+			delete(d.conns, id)
+			atomic.AddInt32(&d.active, -1)
+		}
+		conn.mu.Unlock()
+	}
+}
+
+func (c *wsConn) push(src string, pckt *Packet, next, frame func(*Packet)) error {
+	s := c.server
+	if src == c.client.src {
+		s = c.client
+	} else if !s.started && proto.HasResponseTitle(pckt.Payload) {
+		end := proto.MIMEHeadersEndPos(pckt.Payload)
+		if string(proto.Status(pckt.Payload)) != "101" || end < 0 {
+			// upgrade rejected, connection continues as HTTP
+			c.failed = true
+			c.client.reset()
+			next(pckt)
+			return nil
+		}
+		s.src = src
+		s.start(pckt.Seq + uint32(end))
+	}
+
+	// data before the start of the stream belongs to the handshake
+	if s.started && seqDiff(pckt.Seq, s.startSeq) < 0 {
+		head := *pckt
+		if seqDiff(pckt.Seq+uint32(len(pckt.Payload)), s.startSeq) > 0 {
+			n := s.startSeq - pckt.Seq
+			head.Payload = pckt.Payload[:n:n]
+		}
+		next(&head)
+		if len(head.Payload) == len(pckt.Payload) {
+			return nil
+		}
+	}
+
+	return s.push(pckt, func(p *Packet) error {
+		for {
+			f, ok := proto.ParseWebSocketFrame(s.buf)
+			if ok && f.Len() > wsMaxFrame {
+				return errWSFrame
+			}
+			if !ok || len(s.buf) < f.Len() {
+				return nil
+			}
+			c.emit(s == c.client, p, proto.UnmaskWebSocketFrame(s.buf), frame)
+			s.buf = s.buf[f.Len():]
+			if len(s.buf) == 0 {
+				s.buf = nil
+			}
+		}
+	})
+}
+
+// emit passes the unmasked frame as a packet, with Seq and Ack making its UUID equal to UUID of the handshake request
+func (c *wsConn) emit(fromClient bool, pckt *Packet, data []byte, frame func(*Packet)) {
+	stats.Add("websocket_frames", 1)
+
+	p := *pckt
+	p.messageID = 0
+	p.Lost = 0
+	p.buf = nil
+	p.Payload = data[:len(data):len(data)]
+	if fromClient {
+		p.Direction = DirIncoming
+		p.Ack = c.ack
+	} else {
+		p.Direction = DirOutcoming
+		p.Seq = c.ack
+	}
+	frame(&p)
+}
@@ -0,0 +1,80 @@
+package tcp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/buger/goreplay/proto"
+)
+
+func TestWebSocketFrames(t *testing.T) {
+	key := [4]byte{1, 2, 3, 4}
+	text := []byte{0x81, 2, 'h', 'i'}
+	binary := append([]byte{0x82, 126, 0x07, 0xd0}, bytes.Repeat([]byte{7}, 2000)...)
+	closing := []byte{0x88, 0}
+
+	segments := []testSegment{
+		{true, []byte("GET /chat HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")},
+		{false, []byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n\r\n\x81\x05hello")},
+		// second frame spans two packets, which are captured in reverse order
+		{true, append(proto.MaskWebSocketFrame(text, key), proto.MaskWebSocketFrame(binary, key)...)},
+		{true, proto.MaskWebSocketFrame(closing, key)},
+	}
+
+	parser := NewMessageParser(nil, Ports{{Min: 443, Max: 443}}, []net.IP{net.IPv4(127, 0, 0, 1)}, time.Second, false, WithWebSocket())
+	parser.Start = func(pckt *Packet) (bool, bool) {
+		return proto.HasRequestTitle(pckt.Payload), proto.HasResponseTitle(pckt.Payload)
+	}
+	parser.End = func(m *Message) bool {
+		return proto.HasFullPayload(m, m.PacketData()...)
+	}
+	for _, p := range testPackets(segments, 443) {
+		parser.PacketHandler(p)
+	}
+
+	var messages []*Message
+	for len(messages) < 6 {
+		select {
+		case m := <-parser.messages:
+			messages = append(messages, m)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected 6 messages, got %d", len(messages))
+		}
+	}
+	parser.Close()
+
+	var session []byte
+	var clientFrames, serverFrames [][]byte
+	for _, m := range messages {
+		switch {
+		case !m.WebSocket && m.Direction == DirIncoming:
+			session = m.UUID()
+			if !proto.IsWebSocketUpgrade(m.Data()) {
+				t.Errorf("Wrong handshake request: %q", m.Data())
+			}
+		case !m.WebSocket:
+			if string(proto.Status(m.Data())) != "101" || !bytes.HasSuffix(m.Data(), proto.EmptyLine) {
+				t.Errorf("Wrong handshake response: %q", m.Data())
+			}
+		case m.Direction == DirIncoming:
+			clientFrames = append(clientFrames, m.Data())
+		default:
+			serverFrames = append(serverFrames, m.Data())
+		}
+	}
+	for _, m := range messages {
+		if !bytes.Equal(m.UUID(), session) {
+			t.Errorf("All messages should have UUID of the session %s, got %s", session, m.UUID())
+		}
+	}
+
+	// frames of the same direction are emitted in order
+	if len(clientFrames) != 3 || !bytes.Equal(clientFrames[0], text) || !bytes.Equal(clientFrames[1], binary) || !bytes.Equal(clientFrames[2], closing) {
+		t.Errorf("Wrong client frames: %q", clientFrames)
+	}
+	if len(serverFrames) != 1 || string(proto.WebSocketPayload(serverFrames[0])) != "hello" {
+		t.Errorf("Wrong server frames: %q", serverFrames)
+	}
+}